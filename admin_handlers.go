@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+
+	"wilbertopachecob/mosaic/lib/api_keys"
+)
+
+// ingestStatusHandler reports the progress of the tiles ingestion
+func ingestStatusHandler(w http.ResponseWriter, r *http.Request) {
+	sendJSONResponse(w, http.StatusOK, ingestProgress.Snapshot())
+}
+
+// tileCacheStatsHandler reports tile cache hit/miss counters and memory usage
+func tileCacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	sendJSONResponse(w, http.StatusOK, tileCache.Stats())
+}
+
+// resultCacheStatsHandler reports render cache hit/miss counters, memory and disk usage
+func resultCacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	sendJSONResponse(w, http.StatusOK, resultCache.Stats())
+}
+
+// apiUsageHandler reports the usage of every API key today against its daily quotas
+func apiUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if apiKeys == nil {
+		sendJSONResponse(w, http.StatusOK, []api_keys.KeyUsage{})
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, apiKeys.Usage())
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"wilbertopachecob/mosaic/lib/tiles_db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestIngestStatusHandler tests the ingestion progress endpoint
+func TestIngestStatusHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	routes().ServeHTTP(rr, httptest.NewRequest("GET", "/api/admin/ingest", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var status tiles_db.IngestStatus
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	assert.GreaterOrEqual(t, status.Done, int64(0))
+}
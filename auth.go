@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"strings"
+	"time"
+
+	"wilbertopachecob/mosaic/lib/api_keys"
+	"wilbertopachecob/mosaic/models"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// publicRoutes can be called without an API key
+var publicRoutes = map[string]bool{
+	"GET /api/health": true,
+}
+
+// routeScopes are the scopes required by routes, keyed by "METHOD /path/template"
+// Routes under /api/admin/ require ScopeAdmin, other routes any valid key
+var routeScopes = map[string]api_keys.Scope{
+	"POST /api/file/upload":                api_keys.ScopeRender,
+	"POST /api/jobs":                       api_keys.ScopeRender,
+	"GET /api/jobs/{id}":                   api_keys.ScopeRender,
+	"DELETE /api/jobs/{id}":                api_keys.ScopeRender,
+	"GET /api/jobs/{id}/result":            api_keys.ScopeRender,
+	"GET /api/jobs/{id}/events":            api_keys.ScopeRender,
+	"POST /api/tiles":                      api_keys.ScopeTiles,
+	"POST /api/tiles/slice":                api_keys.ScopeTiles,
+	"POST /api/tiles/import":               api_keys.ScopeTiles,
+	"POST /api/tiles/synth":                api_keys.ScopeTiles,
+	"POST /api/tiles/errors/retry":         api_keys.ScopeTiles,
+	"POST /api/tiles/errors/{id:.+}/retry": api_keys.ScopeTiles,
+	"POST /api/tiles/{id:.+}/move":         api_keys.ScopeTiles,
+	"PUT /api/tiles/{id:.+}/metadata":      api_keys.ScopeTiles,
+	"DELETE /api/tiles/{id:.+}":            api_keys.ScopeTiles,
+	"POST /api/tiles/coverage":             api_keys.ScopeRender,
+	"POST /api/tiles/search":               api_keys.ScopeRender,
+}
+
+// pngRouteScopes are the scopes of routes that only draw an image with format=png,
+// keyed like routeScopes. Without it they need no scope
+var pngRouteScopes = map[string]api_keys.Scope{
+	"GET /api/tiles/sheet": api_keys.ScopeRender,
+}
+
+// apiKeyContextKey is the context key of the API key of a request
+type apiKeyContextKey struct{}
+
+// routeTemplate returns the path template of the route matched by r, or its path
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return r.URL.Path
+}
+
+// requiredScope returns the scope needed to call the route matched by r
+// It returns an empty scope for routes any valid key may call
+func requiredScope(r *http.Request) api_keys.Scope {
+	template := routeTemplate(r)
+	if strings.HasPrefix(template, "/api/admin/") {
+		return api_keys.ScopeAdmin
+	}
+	if scope, ok := pngRouteScopes[r.Method+" "+template]; ok && r.URL.Query().Get("format") == "png" {
+		return scope
+	}
+	return routeScopes[r.Method+" "+template]
+}
+
+// authMiddleware rejects API requests without a valid API key with 401, and
+// requests whose key lacks the scope of the route with 403
+// Every 401 takes a token of the client IP in limiters.auth, an IP without tokens
+// left gets 429 before its key is looked at so that keys cannot be guessed.
+// It lets every request through when no API keys are configured
+func authMiddleware(limiters *routeLimiters) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if apiKeys == nil || r.Method == "OPTIONS" || !strings.HasPrefix(r.URL.Path, "/api/") ||
+				publicRoutes[r.Method+" "+routeTemplate(r)] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ip := clientIP(r)
+			if ok, wait := limiters.auth.Peek(ip); !ok {
+				logrus.WithFields(logrus.Fields{"client": ip, "path": r.URL.Path}).Warn("Unauthenticated requests rate limited")
+				sendRateLimited(w, wait)
+				return
+			}
+
+			secret := r.Header.Get("X-API-Key")
+			if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && secret == "" {
+				secret = strings.TrimSpace(bearer)
+			}
+			if secret == "" {
+				limiters.auth.Allow(ip)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				sendErrorCode(w, http.StatusUnauthorized, models.ErrorCodeUnauthorized, "API key required",
+					"send an API key in the X-API-Key header or as a bearer token")
+				return
+			}
+			key, ok := apiKeys.Lookup(secret)
+			if !ok {
+				limiters.auth.Allow(ip)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				sendErrorCode(w, http.StatusUnauthorized, models.ErrorCodeUnauthorized, "Invalid API key", "the API key is not known")
+				return
+			}
+			if scope := requiredScope(r); scope != "" && !key.Allows(scope) {
+				sendErrorCode(w, http.StatusForbidden, models.ErrorCodeForbidden, "Missing scope",
+					fmt.Sprintf("key %q does not have the %s scope", key.Name, scope))
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+		})
+	}
+}
+
+// requestKey returns the API key authenticated for r, nil when the API is open
+func requestKey(r *http.Request) *api_keys.Key {
+	key, _ := r.Context().Value(apiKeyContextKey{}).(*api_keys.Key)
+	return key
+}
+
+// checkQuota checks that a render of megapixels fits in the quotas of the API key of r
+// without charging it. It sends a 429 response and returns false when a quota is used up
+func checkQuota(w http.ResponseWriter, r *http.Request, megapixels float64) bool {
+	key := requestKey(r)
+	if key == nil {
+		return true
+	}
+	return quotaResponse(w, key, apiKeys.Check(key.Name, megapixels))
+}
+
+// chargeRender counts a render of megapixels against the quotas of the API key of r
+// It sends a 429 response and returns false when a quota is used up. Otherwise it
+// returns a function giving the render back to the day it was charged on, for
+// renders that turn out not to run. The function holds on to the key store of
+// the request, which may be replaced in the meantime
+func chargeRender(w http.ResponseWriter, r *http.Request, megapixels float64) (func(), bool) {
+	store, key := apiKeys, requestKey(r)
+	if key == nil {
+		return func() {}, true
+	}
+	charge, err := store.Charge(key.Name, megapixels)
+	if !quotaResponse(w, key, err) {
+		return nil, false
+	}
+	return func() {
+		if err := store.Refund(charge); err != nil {
+			logrus.WithError(err).WithField("key", key.Name).Warn("Failed to record API usage")
+		}
+	}, true
+}
+
+// quotaResponse sends the 429 response of a quota error and returns false
+// Errors recording usage are logged without refusing the render
+func quotaResponse(w http.ResponseWriter, key *api_keys.Key, err error) bool {
+	if errors.Is(err, api_keys.ErrQuotaExceeded) {
+		setRetryAfter(w, time.Until(apiKeys.ResetAt()))
+		sendErrorCode(w, http.StatusTooManyRequests, models.ErrorCodeQuotaExceeded, "Daily quota exceeded", err.Error())
+		return false
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("key", key.Name).Warn("Failed to record API usage")
+	}
+	return true
+}
+
+// sourceMegapixels returns the size of the source image of a render in megapixels
+func sourceMegapixels(req *mosaicRequest) float64 {
+	return megapixels(req.original.Bounds())
+}
+
+// megapixels returns the size of bounds in megapixels
+func megapixels(bounds image.Rectangle) float64 {
+	return float64(bounds.Dx()) * float64(bounds.Dy()) / 1e6
+}
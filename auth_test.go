@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"wilbertopachecob/mosaic/config"
+	"wilbertopachecob/mosaic/lib/api_keys"
+	"wilbertopachecob/mosaic/lib/jobs"
+	"wilbertopachecob/mosaic/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupAPIKeys requires API keys for the duration of a test
+func setupAPIKeys(t *testing.T, keys ...api_keys.Key) {
+	store, err := api_keys.NewStore(keys)
+	require.NoError(t, err)
+	prev := apiKeys
+	apiKeys = store
+	t.Cleanup(func() { apiKeys = prev })
+}
+
+// TestAuthMiddleware tests API key checks and route scopes
+func TestAuthMiddleware(t *testing.T) {
+	setupTilesTest(t)
+	setupJobsTest(t)
+	setupAPIKeys(t,
+		api_keys.Key{Name: "renderer", Key: "render-key", Scopes: []api_keys.Scope{api_keys.ScopeRender}},
+		api_keys.Key{Name: "curator", Key: "tiles-key", Scopes: []api_keys.Scope{api_keys.ScopeTiles}},
+		api_keys.Key{Name: "root", Key: "admin-key", Scopes: []api_keys.Scope{api_keys.ScopeAdmin}},
+	)
+	router := routes()
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		header string
+		value  string
+		status int
+		code   string
+	}{
+		{"public route", "GET", "/api/health", "", "", http.StatusOK, ""},
+		{"missing key", "GET", "/api/tiles", "", "", http.StatusUnauthorized, models.ErrorCodeUnauthorized},
+		{"unknown key", "GET", "/api/tiles", "X-API-Key", "nope", http.StatusUnauthorized, models.ErrorCodeUnauthorized},
+		{"any key reads tiles", "GET", "/api/tiles", "X-API-Key", "render-key", http.StatusOK, ""},
+		{"bearer token", "GET", "/api/tiles", "Authorization", "Bearer tiles-key", http.StatusOK, ""},
+		{"render scope required", "DELETE", "/api/jobs/missing", "X-API-Key", "tiles-key", http.StatusForbidden, models.ErrorCodeForbidden},
+		{"render scope", "DELETE", "/api/jobs/missing", "X-API-Key", "render-key", http.StatusNotFound, ""},
+		{"tiles scope required", "DELETE", "/api/tiles/missing.jpg", "X-API-Key", "render-key", http.StatusForbidden, models.ErrorCodeForbidden},
+		{"tiles scope", "DELETE", "/api/tiles/missing.jpg", "X-API-Key", "tiles-key", http.StatusNotFound, ""},
+		{"admin scope required", "GET", "/api/admin/usage", "X-API-Key", "tiles-key", http.StatusForbidden, models.ErrorCodeForbidden},
+		{"admin has every scope", "DELETE", "/api/tiles/missing.jpg", "X-API-Key", "admin-key", http.StatusNotFound, ""},
+		{"coverage needs render scope", "POST", "/api/tiles/coverage", "X-API-Key", "tiles-key", http.StatusForbidden, models.ErrorCodeForbidden},
+		{"image search needs render scope", "POST", "/api/tiles/search", "X-API-Key", "tiles-key", http.StatusForbidden, models.ErrorCodeForbidden},
+		{"png sheet needs render scope", "GET", "/api/tiles/sheet?format=png", "X-API-Key", "tiles-key", http.StatusForbidden, models.ErrorCodeForbidden},
+		{"json sheet needs no scope", "GET", "/api/tiles/sheet", "X-API-Key", "tiles-key", http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.status, rr.Code)
+			if tt.code != "" {
+				var response models.ErrorResponse
+				require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+				assert.Equal(t, tt.code, response.ErrorCode)
+			}
+		})
+	}
+}
+
+// TestAuthRateLimit tests that clients sending unknown keys are throttled before their keys are checked
+func TestAuthRateLimit(t *testing.T) {
+	setupTilesTest(t)
+	setupAPIKeys(t, api_keys.Key{Name: "curator", Key: "tiles-key", Scopes: []api_keys.Scope{api_keys.ScopeTiles}})
+	appConfig.AuthRateLimit = config.RateLimit{Rate: 0.001, Burst: 2}
+	router := routes()
+
+	send := func(key, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/tiles", nil)
+		req.Header.Set("X-API-Key", key)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, send("guess-1", "192.0.2.1:1234").Code)
+	assert.Equal(t, http.StatusUnauthorized, send("guess-2", "192.0.2.1:1234").Code)
+	limited := send("tiles-key", "192.0.2.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, limited.Code)
+	assert.NotEmpty(t, limited.Header().Get("Retry-After"))
+	assert.Contains(t, limited.Body.String(), models.ErrorCodeRateLimited)
+
+	// Valid keys don't use up the budget and other addresses have their own
+	assert.Equal(t, http.StatusOK, send("tiles-key", "192.0.2.2:1234").Code)
+	assert.Equal(t, http.StatusOK, send("tiles-key", "192.0.2.2:1234").Code)
+	assert.Equal(t, http.StatusOK, send("tiles-key", "192.0.2.2:1234").Code)
+}
+
+// TestJobOwnership tests that jobs can only be seen and canceled with the key that created them
+func TestJobOwnership(t *testing.T) {
+	dir := setupTilesTest(t)
+	setupJobsTest(t)
+	writeTestFile(t, filepath.Join(dir, "red.jpg"), imageToBytes(t, createTestImage(10, 10)))
+	loadTilesDB(appConfig)
+	setupAPIKeys(t,
+		api_keys.Key{Name: "alice", Key: "alice-key", Scopes: []api_keys.Scope{api_keys.ScopeRender}},
+		api_keys.Key{Name: "bob", Key: "bob-key", Scopes: []api_keys.Scope{api_keys.ScopeRender}},
+	)
+	router := routes()
+
+	req := renderRequest(t, "/api/jobs", createTestImage(40, 30), map[string]string{"tileSize": "10"})
+	req.Header.Set("X-API-Key", "alice-key")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusAccepted, rr.Code)
+	var job jobs.Status
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &job))
+	assert.NotContains(t, rr.Body.String(), "alice")
+
+	send := func(method, url, key string) int {
+		req := httptest.NewRequest(method, url, nil)
+		req.Header.Set("X-API-Key", key)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Other keys are told the job does not exist
+	for _, route := range []struct{ method, url string }{
+		{"GET", "/api/jobs/" + job.ID},
+		{"GET", "/api/jobs/" + job.ID + "/result"},
+		{"GET", "/api/jobs/" + job.ID + "/events"},
+		{"DELETE", "/api/jobs/" + job.ID},
+	} {
+		assert.Equal(t, http.StatusNotFound, send(route.method, route.url, "bob-key"), route)
+	}
+	_, ok := renderJobs.Get(job.ID)
+	assert.True(t, ok, "another key must not discard the job")
+
+	assert.Equal(t, http.StatusOK, send("GET", "/api/jobs/"+job.ID, "alice-key"))
+	assert.Equal(t, http.StatusOK, send("DELETE", "/api/jobs/"+job.ID, "alice-key"))
+}
+
+// TestRenderQuotas tests daily render quotas and the admin usage report
+func TestRenderQuotas(t *testing.T) {
+	dir := setupTilesTest(t)
+	setupJobsTest(t)
+	writeTestFile(t, filepath.Join(dir, "red.jpg"), imageToBytes(t, createTestImage(10, 10)))
+	loadTilesDB(appConfig)
+	setupAPIKeys(t,
+		api_keys.Key{Name: "renderer", Key: "render-key", Scopes: []api_keys.Scope{api_keys.ScopeRender}, DailyRenders: 2},
+		api_keys.Key{Name: "root", Key: "admin-key", Scopes: []api_keys.Scope{api_keys.ScopeAdmin}},
+	)
+	router := routes()
+
+	send := func(url string, fields map[string]string) *httptest.ResponseRecorder {
+		req := renderRequest(t, url, createTestImage(40, 30), fields)
+		req.Header.Set("X-API-Key", "render-key")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	render := func() *httptest.ResponseRecorder {
+		return send("/api/file/upload", map[string]string{"tileSize": "10"})
+	}
+
+	// Renders that fail, synchronously or as jobs, give their charge back
+	require.Equal(t, http.StatusUnprocessableEntity, send("/api/file/upload", map[string]string{"tileSize": "10", "maxBytes": "10"}).Code)
+	rr := send("/api/jobs", map[string]string{"tileSize": "10", "maxBytes": "10"})
+	require.Equal(t, http.StatusAccepted, rr.Code)
+	var job jobs.Status
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &job))
+	require.Eventually(t, func() bool {
+		status, _ := renderJobs.Get(job.ID)
+		return status.State == jobs.StateFailed
+	}, 5*time.Second, 5*time.Millisecond)
+
+	// A render served from the result cache costs nothing
+	first := render()
+	require.Equal(t, http.StatusCreated, first.Code)
+	require.Equal(t, "MISS", first.Header().Get("X-Mosaic-Cache"))
+	cached := render()
+	require.Equal(t, http.StatusCreated, cached.Code)
+	require.Equal(t, "HIT", cached.Header().Get("X-Mosaic-Cache"))
+
+	require.Equal(t, http.StatusCreated, send("/api/file/upload", map[string]string{"tileSize": "5"}).Code)
+	limited := render()
+	require.Equal(t, http.StatusTooManyRequests, limited.Code)
+	assert.NotEmpty(t, limited.Header().Get("Retry-After"))
+	var response models.ErrorResponse
+	require.NoError(t, json.Unmarshal(limited.Body.Bytes(), &response))
+	assert.Equal(t, models.ErrorCodeQuotaExceeded, response.ErrorCode)
+
+	req := httptest.NewRequest("GET", "/api/admin/usage", nil)
+	req.Header.Set("X-API-Key", "admin-key")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var usage []api_keys.KeyUsage
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &usage))
+	require.Len(t, usage, 2)
+	assert.Equal(t, "renderer", usage[0].Name)
+	assert.Equal(t, 2, usage[0].Renders)
+	assert.InDelta(t, 0.0024, usage[0].Megapixels, 1e-9)
+	assert.Equal(t, 2, usage[0].DailyRenders)
+	assert.NotContains(t, rr.Body.String(), "render-key")
+}
+
+// TestTileRouteQuotas tests that coverage, image search and PNG contact sheets are charged like renders
+func TestTileRouteQuotas(t *testing.T) {
+	dir := setupTilesTest(t)
+	writeTestFile(t, filepath.Join(dir, "red.jpg"), imageToBytes(t, createTestImage(10, 10)))
+	loadTilesDB(appConfig)
+	setupAPIKeys(t,
+		api_keys.Key{Name: "renderer", Key: "render-key", Scopes: []api_keys.Scope{api_keys.ScopeRender}, DailyRenders: 3},
+	)
+	router := routes()
+
+	send := func(req *http.Request) *httptest.ResponseRecorder {
+		req.Header.Set("X-API-Key", "render-key")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// A k out of range is rejected before the example costs anything
+	require.Equal(t, http.StatusBadRequest, send(multipartRequest(t, "/api/tiles/search?k=0", "image", "example.jpg", imageToBytes(t, createTestImage(20, 20)), nil)).Code)
+
+	require.Equal(t, http.StatusOK, send(renderRequest(t, "/api/tiles/coverage", createTestImage(40, 30), map[string]string{"tileSize": "10"})).Code)
+	require.Equal(t, http.StatusOK, send(multipartRequest(t, "/api/tiles/search", "image", "example.jpg", imageToBytes(t, createTestImage(20, 20)), nil)).Code)
+	require.Equal(t, http.StatusOK, send(httptest.NewRequest("GET", "/api/tiles/sheet?format=png&cell=10&padding=0", nil)).Code)
+
+	limited := send(httptest.NewRequest("GET", "/api/tiles/sheet?format=png&cell=10&padding=0", nil))
+	require.Equal(t, http.StatusTooManyRequests, limited.Code)
+	var response models.ErrorResponse
+	require.NoError(t, json.Unmarshal(limited.Body.Bytes(), &response))
+	assert.Equal(t, models.ErrorCodeQuotaExceeded, response.ErrorCode)
+
+	usage := apiKeys.Usage()
+	require.Len(t, usage, 1)
+	assert.Equal(t, 3, usage[0].Renders)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"wilbertopachecob/mosaic/config"
+	"wilbertopachecob/mosaic/lib/contact_sheet"
+	"wilbertopachecob/mosaic/lib/slicer"
+	"wilbertopachecob/mosaic/lib/synth"
+	"wilbertopachecob/mosaic/lib/tile_store"
+	"wilbertopachecob/mosaic/lib/tiles_db"
+)
+
+// cliUsage is printed for unknown commands
+const cliUsage = `Usage: mosaic [command] [flags]
+
+Without a command the HTTP server is started.
+
+Commands:
+  slice       Cut source images into square crops and store them as a new tile collection
+  import      Import the images of a .zip or .tar.gz archive into a tile collection
+  synth       Generate a synthetic tile collection covering a color space
+  sheet       Render a contact sheet of a tile collection and print its statistics
+  quarantine  List the tiles that failed to ingest and retry them once fixed
+`
+
+// runCommand runs a command line subcommand and returns the process exit code
+func runCommand(args []string) int {
+	appConfig = config.Load()
+	tiles_db.SetMaxPixels(appConfig.MaxImagePixels)
+
+	switch args[0] {
+	case "slice":
+		return sliceCommand(args[1:])
+	case "import":
+		return importCommand(args[1:])
+	case "synth":
+		return synthCommand(args[1:])
+	case "sheet":
+		return sheetCommand(args[1:])
+	case "quarantine":
+		return quarantineCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", args[0], cliUsage)
+		return 2
+	}
+}
+
+// sliceCommand implements "mosaic slice [flags] source..."
+// Sources are image files or directories of images, such as extracted video frames
+func sliceCommand(args []string) int {
+	opts := slicer.DefaultOptions()
+	opts.MaxPixels = appConfig.MaxImagePixels
+	opts.MaxCrops = appConfig.SliceMaxCrops
+	fs := flag.NewFlagSet("slice", flag.ContinueOnError)
+	collection := fs.String("collection", "", "name of the new tile collection (required)")
+	fs.IntVar(&opts.Size, "size", opts.Size, "side of the square crops in pixels")
+	fs.IntVar(&opts.Overlap, "overlap", opts.Overlap, "pixels shared by neighbouring grid crops")
+	fs.StringVar(&opts.Mode, "mode", opts.Mode, "crop placement: grid or random")
+	fs.IntVar(&opts.Count, "count", opts.Count, "crops per source image in random mode")
+	fs.Int64Var(&opts.Seed, "seed", opts.Seed, "seed of the random crop positions")
+	fs.Float64Var(&opts.MinStdDev, "min-stddev", opts.MinStdDev, "discard crops whose luminance standard deviation is lower (0 disables)")
+	fs.Float64Var(&opts.MinSharpness, "min-sharpness", opts.MinSharpness, "discard crops whose Laplacian variance is lower (0 disables)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "slice: at least one source image or directory is required")
+		return 2
+	}
+	if err := opts.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "slice: %v\n", err)
+		return 2
+	}
+	dir, err := newCollectionDir(*collection)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "slice: %v\n", err)
+		return 2
+	}
+
+	sources, err := expandSources(fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "slice: %v\n", err)
+		return 1
+	}
+
+	result, err := slicer.SliceFiles(sources, dir, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "slice: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Sliced %d source images into %d tiles in %s\n", result.Sources, len(result.Written), dir)
+	fmt.Printf("Discarded %d near-uniform and %d blurry crops\n", result.Uniform, result.Blurry)
+	for _, e := range result.Errors {
+		fmt.Fprintf(os.Stderr, "  error: %s\n", e)
+	}
+	if len(result.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// importCommand implements "mosaic import -collection name archive"
+func importCommand(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	collection := fs.String("collection", "", "name of the tile collection to import into (required)")
+	verbose := fs.Bool("v", false, "print the outcome of every archive entry")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "import: exactly one archive is required")
+		return 2
+	}
+	if !tiles_db.IsValidCollection(*collection) {
+		fmt.Fprintf(os.Stderr, "import: collection %q is not a valid name\n", *collection)
+		return 2
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %v\n", err)
+		return 1
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %v\n", err)
+		return 1
+	}
+
+	dir := filepath.Join(appConfig.TilesDir, *collection)
+	report, err := tiles_db.ImportArchive(file, info.Size(), dir, archiveLimits())
+	if report != nil {
+		for _, entry := range report.Entries {
+			if *verbose || entry.Status == tiles_db.EntryFailed {
+				fmt.Printf("  %-7s %s %s\n", entry.Status, entry.Name, entry.Reason)
+			}
+		}
+		fmt.Printf("Imported into %s: %d added, %d skipped, %d failed\n", dir, report.Added, report.Skipped, report.Failed)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// synthCommand implements "mosaic synth -collection name [flags]"
+func synthCommand(args []string) int {
+	opts := synth.DefaultOptions()
+	fs := flag.NewFlagSet("synth", flag.ContinueOnError)
+	collection := fs.String("collection", "", "name of the new tile collection (required)")
+	fs.IntVar(&opts.Size, "size", opts.Size, "side of the square tiles in pixels")
+	fs.IntVar(&opts.Count, "count", opts.Count, "number of tiles (defaults to the palette size with -palette)")
+	fs.StringVar(&opts.Style, "style", opts.Style, "tile style: solid, gradient, noise or pattern")
+	fs.StringVar(&opts.Sampling, "sampling", opts.Sampling, "color sampling: rgb, lab or palette")
+	palette := fs.String("palette", "", "comma separated #rrggbb colors, implies -sampling palette")
+	fs.Int64Var(&opts.Seed, "seed", opts.Seed, "seed of the noise textures")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *palette != "" {
+		colors, err := synth.ParsePalette(*palette)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "synth: %v\n", err)
+			return 2
+		}
+		opts.Palette, opts.Sampling = colors, synth.SamplingPalette
+		if !flagSet(fs, "count") {
+			opts.Count = 0
+		}
+	}
+	if err := opts.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "synth: %v\n", err)
+		return 2
+	}
+	dir, err := newCollectionDir(*collection)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "synth: %v\n", err)
+		return 2
+	}
+
+	result, err := synth.Generate(dir, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "synth: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Generated %d %s tiles in %s\n", len(result.Written), opts.Style, dir)
+	return 0
+}
+
+// sheetCommand implements "mosaic sheet [-collection name] [-o sheet.png] [flags]"
+// The tiles directory is ingested the same way as by the server, so the sheet
+// shows what the tiles database actually loads
+func sheetCommand(args []string) int {
+	opts := contact_sheet.DefaultOptions()
+	fs := flag.NewFlagSet("sheet", flag.ContinueOnError)
+	collection := fs.String("collection", "", "collection to summarize (defaults to the whole library)")
+	sortBy := fs.String("sort", contact_sheet.SortHue, "tile order: hue, luminance or name")
+	output := fs.String("o", "", "PNG file to write the contact sheet to")
+	fs.IntVar(&opts.Columns, "columns", opts.Columns, "tiles per row")
+	fs.IntVar(&opts.CellSize, "cell", opts.CellSize, "side of each tile in pixels")
+	fs.IntVar(&opts.Padding, "padding", opts.Padding, "pixels between tiles")
+	offset := fs.Int("offset", 0, "sorted tiles to skip before the first one on the sheet")
+	limit := fs.Int("limit", 0, "maximum number of tiles on the sheet, 0 for all")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "sheet: no arguments expected")
+		return 2
+	}
+	if *collection != "" && !tiles_db.IsValidCollection(*collection) {
+		fmt.Fprintf(os.Stderr, "sheet: collection %q is not a valid name\n", *collection)
+		return 2
+	}
+	if err := opts.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "sheet: %v\n", err)
+		return 2
+	}
+	if *offset < 0 || *limit < 0 {
+		fmt.Fprintln(os.Stderr, "sheet: offset and limit must not be negative")
+		return 2
+	}
+
+	result := tiles_db.Ingest(appConfig.TilesDir, appConfig.TileWorkers, nil)
+	records := make(map[string]tile_store.Record, len(result.Descriptors))
+	for path, descriptor := range result.Descriptors {
+		records[path] = tile_store.NewRecord(path, descriptor, result.Metadata[path])
+	}
+	tiles := collectionTiles(records, *collection)
+	if err := contact_sheet.SortTiles(tiles, *sortBy); err != nil {
+		fmt.Fprintf(os.Stderr, "sheet: %v\n", err)
+		return 2
+	}
+
+	stats := contact_sheet.Summarize(tiles, appConfig.DuplicateDistance)
+	fmt.Printf("%d tiles, %d bytes (min %d, median %d, max %d), %d failed to load\n",
+		stats.Count, stats.Sizes.Total, stats.Sizes.Min, stats.Sizes.Median, stats.Sizes.Max, len(result.Errors))
+	fmt.Printf("Colors: mean %s, spread %.1f, luminance %.0f-%.0f, %.0f%% gray\n",
+		stats.Colors.Mean, stats.Colors.Spread, stats.Colors.MinLuminance, stats.Colors.MaxLuminance, stats.Colors.GrayFraction*100)
+	fmt.Printf("Duplicates: %d exact groups (%d files), %d near groups (%d files)\n",
+		stats.Duplicates.ExactGroups, stats.Duplicates.ExactFiles, stats.Duplicates.NearGroups, stats.Duplicates.NearFiles)
+
+	if *output == "" {
+		return 0
+	}
+	page := sheetPage(tiles, *offset, *limit)
+	if err := checkSheetSize(len(page), opts); err != nil {
+		fmt.Fprintf(os.Stderr, "sheet: %v\n", err)
+		return 2
+	}
+	sheet, errs := renderContactSheet(page, opts)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "sheet: %v\n", err)
+	}
+	file, err := os.Create(*output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sheet: %v\n", err)
+		return 1
+	}
+	defer file.Close()
+	if err := png.Encode(file, sheet); err != nil {
+		fmt.Fprintf(os.Stderr, "sheet: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Wrote %s\n", *output)
+	return 0
+}
+
+// quarantineCommand implements "mosaic quarantine [-scan] [-retry]"
+// Files retried successfully are picked up by the next server start; a running
+// server publishes them with POST /api/tiles/errors/{id}/retry instead
+func quarantineCommand(args []string) int {
+	fs := flag.NewFlagSet("quarantine", flag.ContinueOnError)
+	scan := fs.Bool("scan", false, "decode the whole tiles directory to refresh the quarantine first")
+	retry := fs.Bool("retry", false, "decode the quarantined files again")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "quarantine: no arguments expected")
+		return 2
+	}
+
+	var err error
+	if quarantine, err = tiles_db.OpenQuarantine(appConfig.QuarantinePath); err != nil {
+		fmt.Fprintf(os.Stderr, "quarantine: %v\n", err)
+		return 1
+	}
+
+	if *scan {
+		result := tiles_db.Ingest(appConfig.TilesDir, appConfig.TileWorkers, nil)
+		if err := syncQuarantine(result); err != nil {
+			fmt.Fprintf(os.Stderr, "quarantine: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Scanned %s: %d tiles, %d failed\n", appConfig.TilesDir, len(result.Descriptors)+len(result.Errors), len(result.Errors))
+	}
+
+	if *retry {
+		for _, entry := range quarantine.List() {
+			info, _ := tileInfo(entry.File, [3]float64{})
+			switch _, err := quarantine.Retry(entry.File); {
+			case errors.Is(err, os.ErrNotExist):
+				fmt.Printf("  gone      %s\n", info.ID)
+			case err == nil:
+				fmt.Printf("  recovered %s\n", info.ID)
+			}
+		}
+	}
+
+	entries := quarantine.List()
+	for _, entry := range entries {
+		info, _ := tileInfo(entry.File, [3]float64{})
+		fmt.Printf("  %s (%d attempts, last %s): %s\n", info.ID, entry.Attempts, entry.LastSeen.Format(time.RFC3339), entry.Error)
+	}
+	fmt.Printf("%d quarantined tiles\n", len(entries))
+	if *retry && len(entries) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// flagSet reports whether a flag was given on the command line
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// expandSources replaces directories with the image files they contain, in name order
+func expandSources(paths []string) ([]string, error) {
+	var sources []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			sources = append(sources, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, entry := range entries {
+			if !entry.IsDir() && tiles_db.IsImageFile(entry.Name()) {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+		sort.Strings(files)
+		sources = append(sources, files...)
+	}
+	return sources, nil
+}
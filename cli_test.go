@@ -0,0 +1,109 @@
+package main
+
+import (
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestFile writes data to path, creating parent directories
+func writeTestFile(t *testing.T, path string, data []byte) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, data, 0644))
+}
+
+// TestExpandSources tests that directories are replaced by their images in name order
+func TestExpandSources(t *testing.T) {
+	dir := t.TempDir()
+	frame := imageToBytes(t, createTestImage(8, 8))
+	writeTestFile(t, filepath.Join(dir, "frames", "002.jpg"), frame)
+	writeTestFile(t, filepath.Join(dir, "frames", "001.jpg"), frame)
+	writeTestFile(t, filepath.Join(dir, "frames", "notes.txt"), []byte("text"))
+	writeTestFile(t, filepath.Join(dir, "single.jpg"), frame)
+
+	sources, err := expandSources([]string{filepath.Join(dir, "single.jpg"), filepath.Join(dir, "frames")})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "single.jpg"),
+		filepath.Join(dir, "frames", "001.jpg"),
+		filepath.Join(dir, "frames", "002.jpg"),
+	}, sources)
+
+	_, err = expandSources([]string{filepath.Join(dir, "missing")})
+	assert.Error(t, err)
+}
+
+// TestSliceCommand tests the slice command end to end
+func TestSliceCommand(t *testing.T) {
+	tilesDir := setupTilesTest(t)
+	source := filepath.Join(t.TempDir(), "panorama.jpg")
+	writeTestFile(t, source, imageToBytes(t, createCheckerImage(64, 32, 8)))
+
+	assert.Equal(t, 0, sliceCommand([]string{"-collection", "pano", "-size", "32", source}))
+	entries, err := os.ReadDir(filepath.Join(tilesDir, "pano"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	// Existing collections and bad flags are usage errors
+	assert.Equal(t, 2, sliceCommand([]string{"-collection", "pano", source}))
+	assert.Equal(t, 2, sliceCommand([]string{"-collection", "other", "-mode", "spiral", source}))
+}
+
+// TestSynthCommand tests the synth command end to end
+func TestSynthCommand(t *testing.T) {
+	tilesDir := setupTilesTest(t)
+
+	assert.Equal(t, 0, synthCommand([]string{"-collection", "flat", "-count", "8", "-size", "8", "-style", "noise"}))
+	entries, err := os.ReadDir(filepath.Join(tilesDir, "flat"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 8)
+
+	assert.Equal(t, 0, synthCommand([]string{"-collection", "brand", "-palette", "#ff0000,#00ff00,#0000ff"}))
+	entries, err = os.ReadDir(filepath.Join(tilesDir, "brand"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	assert.Equal(t, 2, synthCommand([]string{"-collection", "flat"}))
+	assert.Equal(t, 2, synthCommand([]string{"-collection", "other", "-sampling", "hsv"}))
+}
+
+// TestQuarantineCommand tests the quarantine report with a scan and a retry
+func TestQuarantineCommand(t *testing.T) {
+	tilesDir := setupTilesTest(t)
+	writeTestFile(t, filepath.Join(tilesDir, "red.jpg"), imageToBytes(t, createTestImage(8, 8)))
+	writeTestFile(t, filepath.Join(tilesDir, "broken.jpg"), []byte("not a jpeg"))
+
+	assert.Equal(t, 0, quarantineCommand([]string{"-scan"}))
+	require.Len(t, quarantine.List(), 1)
+	assert.Equal(t, 1, quarantineCommand([]string{"-retry"}))
+
+	writeTestFile(t, filepath.Join(tilesDir, "broken.jpg"), imageToBytes(t, createTestImage(8, 8)))
+	assert.Equal(t, 0, quarantineCommand([]string{"-retry"}))
+	assert.Empty(t, quarantine.List())
+
+	assert.Equal(t, 2, quarantineCommand([]string{"extra"}))
+}
+
+// TestSheetCommand tests writing a contact sheet from the command line
+func TestSheetCommand(t *testing.T) {
+	tilesDir := setupTilesTest(t)
+	writeTestFile(t, filepath.Join(tilesDir, "reds", "a.jpg"), imageToBytes(t, createTestImage(8, 8)))
+	writeTestFile(t, filepath.Join(tilesDir, "reds", "b.jpg"), imageToBytes(t, createGradientImage(8, 8, false)))
+	output := filepath.Join(t.TempDir(), "sheet.png")
+
+	assert.Equal(t, 0, sheetCommand([]string{"-collection", "reds", "-sort", "luminance", "-cell", "8", "-padding", "0", "-o", output}))
+	file, err := os.Open(output)
+	require.NoError(t, err)
+	defer file.Close()
+	config, err := png.DecodeConfig(file)
+	require.NoError(t, err)
+	assert.Equal(t, 16, config.Width)
+	assert.Equal(t, 8, config.Height)
+
+	assert.Equal(t, 2, sheetCommand([]string{"-sort", "size"}))
+	assert.Equal(t, 2, sheetCommand([]string{"-columns", "0"}))
+}
@@ -3,7 +3,9 @@ package config
 import (
 	"log"
 	"os"
+	"runtime"
 	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
@@ -14,6 +16,124 @@ type Config struct {
 	MaxFileSize int64
 	TilesDir    string
 	LogLevel    string
+	TileWorkers int
+
+	// Total size of an upload of several images, such as tiles or slice sources
+	MaxUploadBytes int64
+
+	// Decompression bomb guards: pixels an uploaded image may declare and cells a mosaic may have
+	MaxImagePixels int64
+	MaxMosaicCells int
+
+	// Crops one slice request may cut from all of its sources together
+	SliceMaxCrops int
+
+	// Maximum perceptual hash distance (in bits) for two tiles to count as near-duplicates
+	DuplicateDistance int
+
+	// Archive import limits, protecting against archive bombs
+	ImportMaxArchiveBytes int64
+	ImportMaxEntries      int
+	ImportMaxEntryBytes   int64
+	ImportMaxTotalBytes   int64
+	ImportMaxRatio        float64
+
+	// Tile cache settings
+	TileCacheBytes     int64
+	TileCacheWarmSizes []int
+
+	// Tile index backend ("memory" or "file") and database file of the file backend
+	TileStore     string
+	TileStorePath string
+
+	// File listing the tiles that failed to ingest
+	QuarantinePath string
+
+	// Asynchronous render jobs: concurrent renders, jobs waiting for a worker
+	// and seconds a finished job and its result are kept
+	JobWorkers   int
+	JobQueueSize int
+	JobResultTTL int
+
+	// Rendered results cache: bytes kept in memory, directory and bytes of the
+	// least recently used results spilled to disk
+	ResultCacheBytes     int64
+	ResultCacheDir       string
+	ResultCacheDiskBytes int64
+
+	// Per-client request rate limit of every API route, RateLimits overrides it for
+	// routes keyed by "METHOD /path/template" or "/path/template"
+	RateLimit  RateLimit
+	RateLimits map[string]RateLimit
+
+	// Requests with a missing or unknown API key allowed per client IP address
+	AuthRateLimit RateLimit
+
+	// Mosaic renders running at the same time, across requests and jobs
+	MaxConcurrentRenders int
+
+	// JSON file of the API keys, the API is open when empty, and file of their daily usage
+	APIKeysPath  string
+	APIUsagePath string
+}
+
+// RateLimit is a token bucket allowing Rate requests per second with bursts of Burst
+// requests. A Rate of zero or less disables the limit
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// Default returns the configuration used when no environment overrides are set
+func Default() *Config {
+	return &Config{
+		ServerPort:  "8080",
+		MaxFileSize: 10 * 1024 * 1024, // 10MB default
+		TilesDir:    "tiles",
+		LogLevel:    "info",
+		TileWorkers: runtime.NumCPU(),
+
+		MaxUploadBytes: 100 * 1024 * 1024, // 100MB default
+
+		MaxImagePixels: 40 * 1000 * 1000, // 40MP default
+		MaxMosaicCells: 250000,
+
+		SliceMaxCrops: 10000,
+
+		DuplicateDistance: 6,
+
+		ImportMaxArchiveBytes: 1024 * 1024 * 1024, // 1GB default
+		ImportMaxEntries:      10000,
+		ImportMaxEntryBytes:   50 * 1024 * 1024,       // 50MB default
+		ImportMaxTotalBytes:   2 * 1024 * 1024 * 1024, // 2GB default
+		ImportMaxRatio:        100,
+
+		TileCacheBytes: 256 * 1024 * 1024, // 256MB default
+
+		TileStore:     "memory",
+		TileStorePath: "data/tiles.db",
+
+		QuarantinePath: "data/quarantine.json",
+
+		JobWorkers:   2,
+		JobQueueSize: 16,
+		JobResultTTL: 600,
+
+		ResultCacheBytes:     64 * 1024 * 1024, // 64MB default
+		ResultCacheDir:       "data/result-cache",
+		ResultCacheDiskBytes: 512 * 1024 * 1024, // 512MB default
+
+		RateLimit: RateLimit{Rate: 20, Burst: 40},
+		RateLimits: map[string]RateLimit{
+			"POST /api/file/upload": {Rate: 1, Burst: 10},
+			"POST /api/jobs":        {Rate: 1, Burst: 10},
+		},
+		AuthRateLimit: RateLimit{Rate: 0.1, Burst: 10},
+
+		MaxConcurrentRenders: runtime.NumCPU(),
+
+		APIUsagePath: "data/api-usage.json",
+	}
 }
 
 // Load loads configuration from environment variables
@@ -23,11 +143,59 @@ func Load() *Config {
 		log.Println("Warning: .env file not found, using system environment variables")
 	}
 
+	defaults := Default()
 	config := &Config{
-		ServerPort:  getEnvWithDefault("SERVER_PORT", "8080"),
-		MaxFileSize: getEnvAsInt64WithDefault("MAX_FILE_SIZE", 10*1024*1024), // 10MB default
-		TilesDir:    getEnvWithDefault("TILES_DIR", "tiles"),
-		LogLevel:    getEnvWithDefault("LOG_LEVEL", "info"),
+		ServerPort:  getEnvWithDefault("SERVER_PORT", defaults.ServerPort),
+		MaxFileSize: getEnvAsInt64WithDefault("MAX_FILE_SIZE", defaults.MaxFileSize),
+		TilesDir:    getEnvWithDefault("TILES_DIR", defaults.TilesDir),
+		LogLevel:    getEnvWithDefault("LOG_LEVEL", defaults.LogLevel),
+		TileWorkers: getEnvAsIntWithDefault("TILE_WORKERS", defaults.TileWorkers),
+
+		MaxUploadBytes: getEnvAsInt64WithDefault("MAX_UPLOAD_BYTES", defaults.MaxUploadBytes),
+
+		MaxImagePixels: getEnvAsInt64WithDefault("MAX_IMAGE_PIXELS", defaults.MaxImagePixels),
+		MaxMosaicCells: getEnvAsIntWithDefault("MAX_MOSAIC_CELLS", defaults.MaxMosaicCells),
+
+		SliceMaxCrops: getEnvAsIntWithDefault("SLICE_MAX_CROPS", defaults.SliceMaxCrops),
+
+		DuplicateDistance: getEnvAsIntWithDefault("DUPLICATE_DISTANCE", defaults.DuplicateDistance),
+
+		ImportMaxArchiveBytes: getEnvAsInt64WithDefault("IMPORT_MAX_ARCHIVE_BYTES", defaults.ImportMaxArchiveBytes),
+		ImportMaxEntries:      getEnvAsIntWithDefault("IMPORT_MAX_ENTRIES", defaults.ImportMaxEntries),
+		ImportMaxEntryBytes:   getEnvAsInt64WithDefault("IMPORT_MAX_ENTRY_BYTES", defaults.ImportMaxEntryBytes),
+		ImportMaxTotalBytes:   getEnvAsInt64WithDefault("IMPORT_MAX_TOTAL_BYTES", defaults.ImportMaxTotalBytes),
+		ImportMaxRatio:        getEnvAsFloat64WithDefault("IMPORT_MAX_RATIO", defaults.ImportMaxRatio),
+
+		TileCacheBytes:     getEnvAsInt64WithDefault("TILE_CACHE_BYTES", defaults.TileCacheBytes),
+		TileCacheWarmSizes: getEnvAsIntListWithDefault("TILE_CACHE_WARM_SIZES", defaults.TileCacheWarmSizes),
+
+		TileStore:     getEnvWithDefault("TILE_STORE", defaults.TileStore),
+		TileStorePath: getEnvWithDefault("TILE_STORE_PATH", defaults.TileStorePath),
+
+		QuarantinePath: getEnvWithDefault("QUARANTINE_PATH", defaults.QuarantinePath),
+
+		JobWorkers:   getEnvAsIntWithDefault("JOB_WORKERS", defaults.JobWorkers),
+		JobQueueSize: getEnvAsIntWithDefault("JOB_QUEUE_SIZE", defaults.JobQueueSize),
+		JobResultTTL: getEnvAsIntWithDefault("JOB_RESULT_TTL", defaults.JobResultTTL),
+
+		ResultCacheBytes:     getEnvAsInt64WithDefault("RESULT_CACHE_BYTES", defaults.ResultCacheBytes),
+		ResultCacheDir:       getEnvWithDefault("RESULT_CACHE_DIR", defaults.ResultCacheDir),
+		ResultCacheDiskBytes: getEnvAsInt64WithDefault("RESULT_CACHE_DISK_BYTES", defaults.ResultCacheDiskBytes),
+
+		RateLimit: RateLimit{
+			Rate:  getEnvAsFloat64WithDefault("RATE_LIMIT", defaults.RateLimit.Rate),
+			Burst: getEnvAsIntWithDefault("RATE_LIMIT_BURST", defaults.RateLimit.Burst),
+		},
+		RateLimits: getEnvAsRateLimitsWithDefault("RATE_LIMIT_ROUTES", defaults.RateLimits),
+		AuthRateLimit: RateLimit{
+			Rate:  getEnvAsFloat64WithDefault("AUTH_RATE_LIMIT", defaults.AuthRateLimit.Rate),
+			Burst: getEnvAsIntWithDefault("AUTH_RATE_LIMIT_BURST", defaults.AuthRateLimit.Burst),
+		},
+
+		MaxConcurrentRenders: getEnvAsIntWithDefault("MAX_CONCURRENT_RENDERS", defaults.MaxConcurrentRenders),
+
+		APIKeysPath:  getEnvWithDefault("API_KEYS_PATH", defaults.APIKeysPath),
+		APIUsagePath: getEnvWithDefault("API_USAGE_PATH", defaults.APIUsagePath),
 	}
 
 	return config
@@ -50,3 +218,72 @@ func getEnvAsInt64WithDefault(key string, defaultValue int64) int64 {
 	}
 	return defaultValue
 }
+
+// getEnvAsIntWithDefault gets an environment variable as int with a default value
+func getEnvAsIntWithDefault(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if intValue, err := strconv.Atoi(value); err == nil {
+			return intValue
+		}
+	}
+	return defaultValue
+}
+
+// getEnvAsFloat64WithDefault gets an environment variable as float64 with a default value
+func getEnvAsFloat64WithDefault(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
+// getEnvAsIntListWithDefault gets a comma separated environment variable as []int with a default value
+func getEnvAsIntListWithDefault(key string, defaultValue []int) []int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	var values []int
+	for _, part := range strings.Split(value, ",") {
+		intValue, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return defaultValue
+		}
+		values = append(values, intValue)
+	}
+	return values
+}
+
+// getEnvAsRateLimitsWithDefault gets a comma separated list of "route=rate:burst"
+// entries as per-route rate limits with a default value
+func getEnvAsRateLimitsWithDefault(key string, defaultValue map[string]RateLimit) map[string]RateLimit {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	limits := make(map[string]RateLimit)
+	for _, part := range strings.Split(value, ",") {
+		route, limit, ok := strings.Cut(part, "=")
+		if !ok {
+			return defaultValue
+		}
+		rate, burst, ok := strings.Cut(limit, ":")
+		if !ok {
+			return defaultValue
+		}
+		rateValue, err := strconv.ParseFloat(strings.TrimSpace(rate), 64)
+		if err != nil {
+			return defaultValue
+		}
+		burstValue, err := strconv.Atoi(strings.TrimSpace(burst))
+		if err != nil {
+			return defaultValue
+		}
+		limits[strings.TrimSpace(route)] = RateLimit{Rate: rateValue, Burst: burstValue}
+	}
+	return limits
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"wilbertopachecob/mosaic/lib/coverage"
+	"wilbertopachecob/mosaic/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCoverageBins      = 8
+	maxCoverageBins          = 32
+	defaultCoverageThin      = 2
+	defaultCoverageThreshold = 40.0
+	coverageHeatmapCell      = 16
+)
+
+// libraryCoverageHandler reports which regions of the color space the tile library lacks
+// Returns JSON by default, or a PNG heatmap when format=png
+func libraryCoverageHandler(w http.ResponseWriter, r *http.Request) {
+	bins := queryInt(r, "bins", defaultCoverageBins)
+	if bins < 1 || bins > maxCoverageBins {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid bins", fmt.Sprintf("bins must be between 1 and %d", maxCoverageBins))
+		return
+	}
+	thin := queryInt(r, "thin", defaultCoverageThin)
+
+	db, _ := snapshotTilesDB(tileStore, nil)
+	report := coverage.Analyze(db, bins, thin)
+
+	if r.URL.Query().Get("format") == "png" {
+		sendPNGResponse(w, report.Heatmap(coverageHeatmapCell))
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, report)
+}
+
+// sourceCoverageHandler reports the cells of an uploaded image that no tile matches well
+// Returns JSON by default, or a PNG heatmap when format=png. Matching every cell
+// costs about as much as a render, so it is charged like one
+func sourceCoverageHandler(w http.ResponseWriter, r *http.Request) {
+	limitUpload(w, r)
+	if err := r.ParseMultipartForm(appConfig.MaxFileSize); isUploadTooLarge(err) {
+		sendUploadTooLarge(w)
+		return
+	} else if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid form data", err.Error())
+		return
+	}
+
+	file, _, err := r.FormFile("imgUpload")
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, "Failed to get uploaded file", err.Error())
+		return
+	}
+	defer file.Close()
+
+	tileSize, err := strconv.Atoi(r.FormValue("tileSize"))
+	if err != nil || tileSize <= 0 {
+		tileSize = 20 // Same default as mosaicHandler
+	}
+	threshold, err := strconv.ParseFloat(r.FormValue("threshold"), 64)
+	if err != nil || threshold < 0 {
+		threshold = defaultCoverageThreshold
+	}
+
+	original, _, err := decodeUpload(file)
+	if err != nil {
+		sendDecodeError(w, err)
+		return
+	}
+	bounds := original.Bounds()
+	if cells := mosaicCells(bounds.Dx(), bounds.Dy(), tileSize); cells > appConfig.MaxMosaicCells {
+		sendErrorCode(w, http.StatusUnprocessableEntity, models.ErrorCodeTooManyCells, "Too many cells",
+			fmt.Sprintf("tileSize %d gives %d cells, at most %d allowed", tileSize, cells, appConfig.MaxMosaicCells))
+		return
+	}
+	if _, ok := chargeRender(w, r, megapixels(bounds)); !ok {
+		return
+	}
+
+	db, _ := snapshotTilesDB(tileStore, nil)
+	report := coverage.MatchErrors(original, db, tileSize, threshold)
+
+	logrus.WithFields(logrus.Fields{
+		"cells":     report.TotalCells,
+		"poorCells": len(report.PoorCells),
+		"meanError": report.MeanError,
+	}).Info("Analyzed source image coverage")
+
+	if r.URL.Query().Get("format") == "png" {
+		sendPNGResponse(w, report.Heatmap(coverageHeatmapCell))
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, report)
+}
+
+// sendPNGResponse encodes img as the PNG body of the response
+func sendPNGResponse(w http.ResponseWriter, img image.Image) {
+	w.Header().Set("Content-Type", "image/png")
+	w.WriteHeader(http.StatusOK)
+	if err := png.Encode(w, img); err != nil {
+		logrus.WithError(err).Warn("Failed to encode PNG response")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"wilbertopachecob/mosaic/lib/coverage"
+	"wilbertopachecob/mosaic/lib/tile_store"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLibraryCoverageHandler tests the coverage report in JSON and PNG form
+func TestLibraryCoverageHandler(t *testing.T) {
+	dir := setupTilesTest(t)
+	tileStore.Put(tile_store.Record{Path: filepath.Join(dir, "red.jpg"), Color: [3]float64{65535, 0, 0}})
+	router := routes()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles/coverage?bins=4", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var report coverage.Report
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	assert.Equal(t, 64, report.TotalBins)
+	assert.Equal(t, 1, report.CoveredBins)
+	assert.Len(t, report.Empty, 63)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles/coverage?format=png", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "image/png", rr.Header().Get("Content-Type"))
+	_, err := png.Decode(rr.Body)
+	assert.NoError(t, err)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles/coverage?bins=0", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+// TestSourceCoverageHandler tests reporting poorly matched cells of a source image
+func TestSourceCoverageHandler(t *testing.T) {
+	dir := setupTilesTest(t)
+	tileStore.Put(tile_store.Record{Path: filepath.Join(dir, "blue.jpg"), Color: [3]float64{0, 0, 65535}})
+
+	req := multipartRequest(t, "/api/tiles/coverage", "imgUpload", "test.jpg", imageToBytes(t, createTestImage(40, 20)), map[string]string{"tileSize": "20"})
+	rr := httptest.NewRecorder()
+	routes().ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var report coverage.MatchReport
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	assert.Equal(t, 2, report.TotalCells)
+	assert.Len(t, report.PoorCells, 2)
+}
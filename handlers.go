@@ -2,129 +2,496 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"image/draw"
-	"image/jpeg"
+	"io"
 	"math"
+	"mime"
 	"net/http"
-	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	"wilbertopachecob/mosaic/lib/encoder"
 	imgpkg "wilbertopachecob/mosaic/lib/img"
+	"wilbertopachecob/mosaic/lib/tile_cache"
+	"wilbertopachecob/mosaic/lib/tile_store"
 	"wilbertopachecob/mosaic/lib/tiles_db"
+	"wilbertopachecob/mosaic/models"
 
 	"github.com/sirupsen/logrus"
 )
 
+// mosaicRequest holds the source image and the options of a render request
+// sourceSum is the SHA-256 of the uploaded bytes
+type mosaicRequest struct {
+	original  image.Image
+	format    string
+	sourceSum string
+	options   models.RenderOptions
+}
+
+// encoderOptions returns the encoder options of the request for the negotiated contentType,
+// the requested output format or JPEG when the response is JSON
+func (req *mosaicRequest) encoderOptions(contentType string) encoder.Options {
+	format := req.options.OutputFormat
+	if strings.HasPrefix(contentType, "image/") {
+		format = strings.TrimPrefix(contentType, "image/")
+	}
+	if format == "" {
+		format = encoder.FormatJPEG
+	}
+	return req.options.EncoderOptions(format)
+}
+
 // mosaicHandler handles the mosaic generation request
+// It answers with JSON, or with the mosaic itself when the Accept header prefers an
+// image type, in which case the metadata moves to X-Mosaic-* headers
 func mosaicHandler(w http.ResponseWriter, r *http.Request) {
 	t0 := time.Now()
 
-	// Parse multipart form
-	if err := r.ParseMultipartForm(10 << 20); err != nil { // 10MB max
-		sendErrorResponse(w, "Failed to parse form", err, http.StatusBadRequest)
+	req, ok := parseMosaicRequest(w, r)
+	if !ok {
 		return
 	}
 
-	// Get uploaded file
-	file, header, err := r.FormFile("imgUpload")
+	// An explicit output format is the only image type offered
+	offers := mosaicContentTypes
+	if req.options.OutputFormat != "" {
+		offers = []string{"application/json", encoder.ContentType(req.options.OutputFormat)}
+	}
+	contentType := negotiateContentType(r.Header.Get("Accept"), offers)
+	w.Header().Add("Vary", "Accept")
+	if contentType == "" {
+		sendErrorResponse(w, http.StatusNotAcceptable, "Not acceptable", "Accept must allow one of "+strings.Join(offers, ", "))
+		return
+	}
+
+	// Compression depends on the format, which may only be known now
+	output := req.encoderOptions(contentType)
+	if err := output.Validate(); err != nil {
+		sendValidationError(w, []models.FieldError{{Field: "compression", Code: models.FieldInvalidChoice, Message: err.Error()}})
+		return
+	}
+
+	// Identical uploads with identical options against the same tiles give the same mosaic
+	version := tileStore.Version()
+	key := renderCacheKey(req, output, version)
+	etag := renderETag(key, contentType)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Quotas are checked before rendering, but only renders that ran are charged
+	megapixels := sourceMegapixels(req)
+	if !checkQuota(w, r, megapixels) {
+		return
+	}
+
+	// Generate mosaic, stopping when the client goes away or the deadline passes
+	ctx, cancel := syncRenderContext(r.Context(), req.options, t0)
+	defer cancel()
+	render, cached, err := renderOrLoad(ctx, req, output, version, key, renderSlots, false, nil)
+	if errors.Is(err, errTooManyRenders) {
+		sendTooManyRenders(w)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		message := err.Error()
+		if cause := context.Cause(ctx); errors.Is(cause, errSyncRenderTooLong) {
+			message += ": " + cause.Error()
+		}
+		sendErrorCode(w, http.StatusGatewayTimeout, models.ErrorCodeRenderTimeout, "Render timed out", message)
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		// Nobody is left to read a response
+		logrus.WithError(err).Info("Render canceled by the client")
+		return
+	}
+	if errors.Is(err, encoder.ErrTooLarge) {
+		sendErrorResponse(w, http.StatusUnprocessableEntity, "Mosaic exceeds the maximum size", err.Error())
+		return
+	}
 	if err != nil {
-		sendErrorResponse(w, "Failed to get uploaded file", err, http.StatusBadRequest)
+		sendErrorResponse(w, http.StatusInternalServerError, "Failed to generate mosaic", err.Error())
 		return
 	}
-	defer file.Close()
+	if !cached {
+		if _, ok := chargeRender(w, r, megapixels); !ok {
+			return
+		}
+	}
+	w.Header().Set("ETag", etag)
+	if cached {
+		w.Header().Set("X-Mosaic-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Mosaic-Cache", "MISS")
+	}
 
-	// Get tile size parameter
-	tileSizeStr := r.FormValue("tileSize")
-	tileSize, err := strconv.Atoi(tileSizeStr)
-	if err != nil || tileSize <= 0 {
-		tileSize = 20 // Default tile size
+	// Calculate duration
+	duration := math.Round(time.Since(t0).Seconds()*100) / 100
+
+	if contentType != "application/json" {
+		header := w.Header()
+		header.Set("Content-Type", contentType)
+		header.Set("Content-Length", strconv.Itoa(len(render.Data)))
+		header.Set("X-Mosaic-Duration", strconv.FormatFloat(duration, 'f', -1, 64))
+		header.Set("X-Mosaic-Source-Format", render.SourceFormat)
+		header.Set("X-Mosaic-Grid", fmt.Sprintf("%dx%d", render.Columns, render.Rows))
+		header.Set("X-Mosaic-Tile-Size", strconv.Itoa(req.options.TileSize))
+		header.Set("X-Mosaic-Tiles", strconv.Itoa(render.Tiles))
+		if render.Output.Quality > 0 {
+			header.Set("X-Mosaic-Quality", strconv.Itoa(render.Output.Quality))
+		}
+		if render.Output.Colors > 0 {
+			header.Set("X-Mosaic-Colors", strconv.Itoa(render.Output.Colors))
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write(render.Data)
+		return
+	}
+
+	// Send response
+	sendJSONResponse(w, http.StatusCreated, render.response(duration, cached))
+}
+
+// mosaicContentTypes are the representations of a mosaic, JSON first for clients that accept anything
+var mosaicContentTypes = []string{"application/json", "image/jpeg", "image/png", "image/gif", "image/tiff"}
+
+// negotiateContentType returns the offer that the Accept header value prefers,
+// or an empty string if it accepts none. An empty header accepts anything.
+// Ties go to the earlier offer
+func negotiateContentType(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		// The most specific media range matching the offer sets its quality
+		q, specificity := 0.0, -1
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			rangeQ := 1.0
+			if value, ok := params["q"]; ok {
+				if rangeQ, err = strconv.ParseFloat(value, 64); err != nil {
+					continue
+				}
+			}
+			var rangeSpecificity int
+			switch {
+			case mediaType == offer:
+				rangeSpecificity = 2
+			case mediaType == "*/*":
+				rangeSpecificity = 0
+			case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediaType, "*")):
+				rangeSpecificity = 1
+			default:
+				continue
+			}
+			if rangeSpecificity > specificity {
+				q, specificity = rangeQ, rangeSpecificity
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
 	}
+	return best
+}
+
+// parseMosaicRequest reads the render options and the source image of a render request,
+// from a multipart form with the image in imgUpload or from a JSON body with the image
+// base64-encoded in image. It writes a 400 response, a 413 response for an upload
+// over MaxFileSize or a 422 response for an image or mosaic over the pixel and
+// cell limits, and returns false if the request is invalid
+func parseMosaicRequest(w http.ResponseWriter, r *http.Request) (*mosaicRequest, bool) {
+	var (
+		options   models.RenderOptions
+		source    io.ReadSeeker
+		fileName  string
+		fieldErrs []models.FieldError
+	)
+	limitUpload(w, r)
+	if isJSONRequest(r) {
+		var body models.MosaicRequest
+		body.RenderOptions = models.DefaultRenderOptions()
+		var err error
+		if fieldErrs, err = decodeRenderBody(r.Body, &body); isUploadTooLarge(err) {
+			sendUploadTooLarge(w)
+			return nil, false
+		} else if err != nil {
+			sendErrorResponse(w, http.StatusBadRequest, "Invalid request body", err.Error())
+			return nil, false
+		}
+		if fieldErrs == nil && body.Image == "" {
+			fieldErrs = []models.FieldError{{Field: "image", Code: models.FieldRequired, Message: "image must be a base64-encoded image"}}
+		}
+		if fieldErrs == nil {
+			data, err := decodeImageData(body.Image)
+			if err != nil {
+				fieldErrs = []models.FieldError{{Field: "image", Code: models.FieldInvalidType, Message: err.Error()}}
+			}
+			if int64(len(data)) > appConfig.MaxFileSize {
+				sendUploadTooLarge(w)
+				return nil, false
+			}
+			source, fileName = bytes.NewReader(data), "image"
+		}
+		options = body.RenderOptions
+	} else {
+		// Parse multipart form
+		if err := r.ParseMultipartForm(appConfig.MaxFileSize); isUploadTooLarge(err) {
+			sendUploadTooLarge(w)
+			return nil, false
+		} else if err != nil {
+			sendErrorResponse(w, http.StatusBadRequest, "Invalid form data", err.Error())
+			return nil, false
+		}
+
+		// Get uploaded file
+		file, header, err := r.FormFile("imgUpload")
+		if err != nil {
+			sendErrorResponse(w, http.StatusBadRequest, "Failed to get uploaded file", err.Error())
+			return nil, false
+		}
+		defer file.Close()
+		if header.Size > appConfig.MaxFileSize {
+			sendUploadTooLarge(w)
+			return nil, false
+		}
+		source, fileName = file, header.Filename
+
+		options, fieldErrs = parseRenderForm(r)
+	}
+	if fieldErrs == nil {
+		fieldErrs = options.Validate()
+	}
+	if len(fieldErrs) > 0 {
+		sendValidationError(w, fieldErrs)
+		return nil, false
+	}
+
+	// Optionally restrict the tiles to the ones carrying any of the given tags
+	options.Tags = tiles_db.NormalizeTags(options.Tags)
 
 	// Log request details
 	logrus.WithFields(logrus.Fields{
-		"fileName": header.Filename,
-		"fileSize": header.Size,
-		"tileSize": tileSize,
+		"fileName": fileName,
+		"tileSize": options.TileSize,
+		"tags":     options.Tags,
+		"output":   options.OutputFormat,
 	}).Info("Processing mosaic request")
 
+	sum := sha256.New()
+	if _, err := io.Copy(sum, source); err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, "Failed to read uploaded file", err.Error())
+		return nil, false
+	}
+	if _, err := source.Seek(0, io.SeekStart); err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, "Failed to read uploaded file", err.Error())
+		return nil, false
+	}
+
+	// Check the declared size before decoding, a small file can expand to gigabytes
+	config, _, err := decodeUploadConfig(source)
+	if err != nil {
+		sendDecodeError(w, err)
+		return nil, false
+	}
+	if cells := mosaicCells(config.Width, config.Height, options.TileSize); cells > appConfig.MaxMosaicCells {
+		sendErrorCode(w, http.StatusUnprocessableEntity, models.ErrorCodeTooManyCells, "Too many cells",
+			fmt.Sprintf("a %dx%d image with tileSize %d has %d cells, at most %d allowed", config.Width, config.Height, options.TileSize, cells, appConfig.MaxMosaicCells))
+		return nil, false
+	}
+
 	// Decode original image
-	original, format, err := image.Decode(file)
+	original, format, err := image.Decode(source)
 	if err != nil {
-		sendErrorResponse(w, "Failed to decode image", err, http.StatusBadRequest)
-		return
+		sendDecodeError(w, err)
+		return nil, false
 	}
 
-	// Generate mosaic
-	mosaicImg, err := generateMosaic(original, tileSize)
+	return &mosaicRequest{original: original, format: format, sourceSum: hex.EncodeToString(sum.Sum(nil)), options: options}, true
+}
+
+// generateMosaic creates a mosaic from the original image using tiles from store
+// When tags is not empty only tiles carrying one of the tags are used.
+// Returns the encoded mosaic and how many cells each tile was used for
+func generateMosaic(store tile_store.TileStore, original image.Image, tileSize int, tags []string) (string, map[string]int, error) {
+	newImage, usage, err := renderMosaic(context.Background(), store, original, tileSize, tags, nil)
 	if err != nil {
-		sendErrorResponse(w, "Failed to generate mosaic", err, http.StatusInternalServerError)
-		return
+		return "", nil, err
 	}
 
-	// Calculate duration
-	duration := math.Round(time.Since(t0).Seconds()*100) / 100
+	// Encode the mosaic image to base64
+	mosaicImg, err := encodeImageToBase64(newImage)
+	return mosaicImg, usage, err
+}
 
-	// Send response
-	response := struct {
-		MosaicImg string  `json:"mosaicImg"`
-		Duration  float64 `json:"duration"`
-		Format    string  `json:"format"`
-	}{
-		MosaicImg: mosaicImg,
-		Duration:  duration,
-		Format:    format,
+// partialRenderError reports a render that stopped before its last row
+// It wraps the reason, the error of the render context
+type partialRenderError struct {
+	rows, totalRows int
+	err             error
+}
+
+func (e *partialRenderError) Error() string {
+	return fmt.Sprintf("render stopped after %d of %d rows: %v", e.rows, e.totalRows, e.err)
+}
+
+func (e *partialRenderError) Unwrap() error {
+	return e.err
+}
+
+// renderContext returns the context of a render, bounded by its timeoutMs if any
+func renderContext(parent context.Context, options models.RenderOptions) (context.Context, context.CancelFunc) {
+	if options.TimeoutMs == 0 {
+		return context.WithCancel(parent)
 	}
+	return context.WithTimeout(parent, options.Timeout())
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(response)
+// errSyncRenderTooLong is the cause of a synchronous render stopped by the write timeout
+var errSyncRenderTooLong = errors.New("renders outlasting the server write timeout must be submitted to /api/jobs")
+
+// syncRenderContext returns the context of a render answered by the request started at start
+// Nothing can be written once the server write timeout passes, so besides its
+// timeoutMs the render stops in time to leave a tenth of the write timeout for the response
+func syncRenderContext(parent context.Context, options models.RenderOptions, start time.Time) (context.Context, context.CancelFunc) {
+	ctx, cancel := renderContext(parent, options)
+	ctx, cancelWrite := context.WithDeadlineCause(ctx, start.Add(writeTimeout*9/10), errSyncRenderTooLong)
+	return ctx, func() {
+		cancelWrite()
+		cancel()
+	}
 }
 
-// generateMosaic creates a mosaic from the original image using tiles from the database
-func generateMosaic(original image.Image, tileSize int) (string, error) {
+// renderMosaic draws the mosaic of original row by row
+// It stops with a *partialRenderError wrapping ctx.Err() when ctx is done before
+// the last row. report, which may be nil, is called after each row with the number
+// of rows done and the mosaic drawn so far, which it must not keep
+func renderMosaic(ctx context.Context, store tile_store.TileStore, original image.Image, tileSize int, tags []string, report func(done, total int, mosaic *image.NRGBA)) (*image.NRGBA, map[string]int, error) {
 	bounds := original.Bounds()
 
 	// Create new image for the mosaic
 	newImage := image.NewNRGBA(image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Max.Y))
 
 	// Clone tiles database to avoid concurrent access issues
-	db := tiles_db.CloneTilesDB(tilesDB)
+	db, groups := snapshotTilesDB(store, tags)
+	spread := tileSpread(store)
+	usage := make(map[string]int)
 
 	// Source point for drawing
 	sourcePoint := image.Point{0, 0}
 
 	// Process image tile by tile - using original algorithm with single pixel sampling
-	for y := bounds.Min.Y; y < bounds.Max.Y; y += tileSize {
+	rows := (bounds.Dy() + tileSize - 1) / tileSize
+	for row, y := 0, bounds.Min.Y; y < bounds.Max.Y; row, y = row+1, y+tileSize {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, &partialRenderError{rows: row, totalRows: rows, err: err}
+		}
 		for x := bounds.Min.X; x < bounds.Max.X; x += tileSize {
 			// Get color from original image at this position (single pixel sampling)
 			r, g, b, _ := original.At(x, y).RGBA()
 			color := [3]float64{float64(r), float64(g), float64(b)}
 
-			// Find nearest tile by color
-			nearestFileByColor := imgpkg.Nearest(color, &db)
+			// Find nearest tile by color, flat regions prefer flat tiles
+			nearest := imgpkg.Nearest
+			if cellStdDev(original, image.Rect(x, y, x+tileSize, y+tileSize)) <= flatCellStdDev {
+				nearest = func(target [3]float64, db *map[string][3]float64) string {
+					return imgpkg.NearestWithPenalty(target, db, spread)
+				}
+			}
+			nearestFileByColor := nearest(color, &db)
 
 			// If no tile found (database empty), refill it
 			if nearestFileByColor == "" {
-				db = tiles_db.CloneTilesDB(tilesDB)
+				db, groups = snapshotTilesDB(store, tags)
 				if len(db) > 0 {
-					nearestFileByColor = imgpkg.Nearest(color, &db)
+					nearestFileByColor = nearest(color, &db)
 				}
 			}
 
+			// Near-duplicates count as the same tile, so they are used up together
+			for _, duplicate := range groups[nearestFileByColor] {
+				delete(db, duplicate)
+			}
+
 			// Process the tile
 			if err := processTile(nearestFileByColor, newImage, x, y, tileSize, sourcePoint); err != nil {
 				logrus.WithError(err).WithField("tile", nearestFileByColor).Warn("Failed to process tile")
+			} else if nearestFileByColor != "" {
+				usage[nearestFileByColor]++
 			}
 		}
+		if report != nil {
+			report(row+1, rows, newImage)
+		}
 	}
 
-	// Encode the mosaic image to base64
-	return encodeImageToBase64(newImage)
+	return newImage, usage, nil
+}
+
+const (
+	// flatCellStdDev is the 8-bit color standard deviation below which a source cell is flat
+	flatCellStdDev = 8.0
+	// flatCellSamples is the number of pixels sampled along each side of a cell to measure its flatness
+	flatCellSamples = 8
+)
+
+// tileSpread returns the color standard deviation of every tile in store, scaled to
+// 16-bit color distances so that it can penalize busy tiles when matching flat cells
+func tileSpread(store tile_store.TileStore) map[string]float64 {
+	spread := make(map[string]float64)
+	store.Iterate(func(record tile_store.Record) bool {
+		spread[record.Path] = record.Stats.StdDev() * 257
+		return true
+	})
+	return spread
+}
+
+// cellStdDev returns the 8-bit color standard deviation of the part of the cell inside img
+func cellStdDev(img image.Image, cell image.Rectangle) float64 {
+	cell = cell.Intersect(img.Bounds())
+	if cell.Empty() {
+		return 0
+	}
+	stepX, stepY := max(cell.Dx()/flatCellSamples, 1), max(cell.Dy()/flatCellSamples, 1)
+
+	var sum, sumSq [3]float64
+	n := 0.0
+	for y := cell.Min.Y; y < cell.Max.Y; y += stepY {
+		for x := cell.Min.X; x < cell.Max.X; x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+			for c, v := range [3]float64{float64(r >> 8), float64(g >> 8), float64(b >> 8)} {
+				sum[c] += v
+				sumSq[c] += v * v
+			}
+			n++
+		}
+	}
+
+	variance := 0.0
+	for c := range sum {
+		mean := sum[c] / n
+		variance += sumSq[c]/n - mean*mean
+	}
+	return math.Sqrt(math.Max(variance, 0))
 }
 
 // processTile processes a single tile and draws it onto the mosaic
@@ -139,21 +506,12 @@ func processTile(tilePath string, newImage *image.NRGBA, x, y, tileSize int, sou
 		return nil
 	}
 
-	file, err := os.Open(tilePath)
-	if err != nil {
-		return fmt.Errorf("failed to open tile file: %w", err)
-	}
-	defer file.Close()
-
-	tileImg, _, err := image.Decode(file)
+	// Decoded and resized tiles are shared through the cache
+	tile, err := tileCache.Get(tile_cache.Key{Path: tilePath, Size: tileSize})
 	if err != nil {
-		return fmt.Errorf("failed to decode tile image: %w", err)
+		return err
 	}
 
-	// Resize tile to match tile size
-	resizedTile := imgpkg.Resize(tileImg, tileSize)
-	tile := resizedTile.SubImage(resizedTile.Bounds())
-
 	// Define tile bounds
 	tileBounds := image.Rect(x, y, x+tileSize, y+tileSize)
 
@@ -165,24 +523,86 @@ func processTile(tilePath string, newImage *image.NRGBA, x, y, tileSize int, sou
 
 // encodeImageToBase64 encodes an image to base64 string
 func encodeImageToBase64(img image.Image) (string, error) {
-	buf := new(bytes.Buffer)
-	if err := jpeg.Encode(buf, img, nil); err != nil {
-		return "", fmt.Errorf("failed to encode image: %w", err)
+	data, _, err := encoder.Encode(img, encoder.DefaultOptions())
+	if err != nil {
+		return "", err
 	}
-	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+	return base64.StdEncoding.EncodeToString(data), nil
 }
 
-// sendErrorResponse sends a JSON error response
-func sendErrorResponse(w http.ResponseWriter, message string, err error, statusCode int) {
-	logrus.WithError(err).Error(message)
+// snapshotTilesDB returns a private copy of the tile colors in store
+// along with the current near-duplicate groups, which must not be modified.
+// Files with identical content count as one tile, represented by their first path.
+// When tags is not empty only tiles carrying one of the tags are copied
+func snapshotTilesDB(store tile_store.TileStore, tags []string) (map[string][3]float64, map[string][]string) {
+	db := make(map[string][3]float64)
+	canonical := make(map[string]string) // Content hash to the path representing it
+	store.Iterate(func(record tile_store.Record) bool {
+		if len(tags) > 0 && !record.Metadata.HasAnyTag(tags) {
+			return true
+		}
+		if record.SHA256 != "" {
+			if path, seen := canonical[record.SHA256]; seen {
+				if path < record.Path {
+					return true
+				}
+				delete(db, path)
+			}
+			canonical[record.SHA256] = record.Path
+		}
+		db[record.Path] = record.Color
+		return true
+	})
+
+	tilesMu.RLock()
+	defer tilesMu.RUnlock()
+	return db, tileGroups
+}
 
-	response := struct {
-		Error string `json:"error"`
-	}{
-		Error: message,
+// buildCredits lists every tile used in a mosaic with its attribution from store, sorted by ID
+func buildCredits(store tile_store.TileStore, usage map[string]int) []models.Credit {
+	credits := make([]models.Credit, 0, len(usage))
+	for path, count := range usage {
+		info, _ := tileInfo(path, [3]float64{})
+		record, _ := store.Get(path)
+		metadata := record.Metadata
+		credits = append(credits, models.Credit{
+			ID:        info.ID,
+			SHA256:    record.SHA256,
+			Count:     count,
+			Author:    metadata.Author,
+			SourceURL: metadata.SourceURL,
+			License:   metadata.License,
+			Caption:   metadata.Caption,
+		})
 	}
+	sort.Slice(credits, func(i, j int) bool { return credits[i].ID < credits[j].ID })
+	return credits
+}
+
+// sendErrorResponse sends a JSON error response in the models.ErrorResponse shape
+func sendErrorResponse(w http.ResponseWriter, statusCode int, errorMsg string, message string) {
+	sendErrorCode(w, statusCode, "", errorMsg, message)
+}
+
+// sendErrorCode sends a JSON error response with a machine-readable errorCode
+func sendErrorCode(w http.ResponseWriter, statusCode int, errorCode, errorMsg, message string) {
+	logrus.WithFields(logrus.Fields{
+		"code":    statusCode,
+		"details": message,
+	}).Error(errorMsg)
+
+	sendJSONResponse(w, statusCode, models.ErrorResponse{
+		Error:     errorMsg,
+		Message:   message,
+		Code:      statusCode,
+		ErrorCode: errorCode,
+	})
+}
 
+// sendJSONResponse encodes v as the JSON body of the response
+func sendJSONResponse(w http.ResponseWriter, statusCode int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(v)
 }
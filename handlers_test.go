@@ -2,15 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"image"
 	"image/color"
 	"image/jpeg"
+	"image/png"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"wilbertopachecob/mosaic/models"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -60,7 +67,7 @@ func TestMosaicHandlerWithInvalidRequest(t *testing.T) {
 			contentType:    "application/json",
 			body:           "",
 			expectedStatus: http.StatusBadRequest,
-			expectedError:  "Invalid form data",
+			expectedError:  "Invalid request body",
 		},
 	}
 
@@ -130,7 +137,7 @@ func TestMosaicHandlerWithInvalidTileSize(t *testing.T) {
 // TestMosaicHandlerWithValidRequest tests mosaic handler with a valid request
 func TestMosaicHandlerWithValidRequest(t *testing.T) {
 	// Skip if no tiles database is available
-	if len(tilesDB) == 0 {
+	if len(tileStore.List()) == 0 {
 		t.Skip("No tiles database available for testing")
 	}
 
@@ -173,14 +180,181 @@ func TestMosaicHandlerWithValidRequest(t *testing.T) {
 	}
 }
 
+// TestMosaicContentNegotiation tests that the upload endpoint answers in the format the Accept header prefers
+func TestMosaicContentNegotiation(t *testing.T) {
+	dir := setupTilesTest(t)
+	writeTestFile(t, filepath.Join(dir, "red.jpg"), imageToBytes(t, createTestImage(10, 10)))
+	loadTilesDB(appConfig)
+	router := routes()
+
+	for accept, want := range map[string]string{
+		"":                                  "application/json",
+		"*/*":                               "application/json",
+		"image/*":                           "image/jpeg",
+		"image/png":                         "image/png",
+		"image/png;q=0.5, image/jpeg":       "image/jpeg",
+		"application/json, image/png;q=0.9": "application/json",
+	} {
+		req := renderRequest(t, "/api/file/upload", createTestImage(40, 30), map[string]string{"tileSize": "10"})
+		req.Header.Set("Accept", accept)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusCreated, rr.Code, accept)
+		assert.Equal(t, want, rr.Header().Get("Content-Type"), accept)
+		assert.Contains(t, rr.Header().Values("Vary"), "Accept", accept)
+		if want == "application/json" {
+			var response models.MosaicResponse
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+			assert.NotEmpty(t, response.MosaicImg)
+			continue
+		}
+
+		mosaic, format, err := image.Decode(rr.Body)
+		require.NoError(t, err, accept)
+		assert.Equal(t, strings.TrimPrefix(want, "image/"), format)
+		assert.Equal(t, image.Rect(0, 0, 40, 30), mosaic.Bounds())
+		assert.Equal(t, "jpeg", rr.Header().Get("X-Mosaic-Source-Format"))
+		assert.Equal(t, "4x3", rr.Header().Get("X-Mosaic-Grid"))
+		assert.Equal(t, "10", rr.Header().Get("X-Mosaic-Tile-Size"))
+		assert.Equal(t, "1", rr.Header().Get("X-Mosaic-Tiles"))
+		assert.NotEmpty(t, rr.Header().Get("X-Mosaic-Duration"))
+	}
+
+	req := renderRequest(t, "/api/file/upload", createTestImage(40, 30), nil)
+	req.Header.Set("Accept", "image/webp, text/html")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotAcceptable, rr.Code)
+}
+
+// TestMosaicOutputOptions tests choosing the output format and its encoder options
+func TestMosaicOutputOptions(t *testing.T) {
+	dir := setupTilesTest(t)
+	writeTestFile(t, filepath.Join(dir, "red.jpg"), imageToBytes(t, createTestImage(10, 10)))
+	loadTilesDB(appConfig)
+	router := routes()
+
+	render := func(accept string, fields map[string]string) *httptest.ResponseRecorder {
+		fields["tileSize"] = "10"
+		req := renderRequest(t, "/api/file/upload", createTestImage(40, 30), fields)
+		req.Header.Set("Accept", accept)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := render("", map[string]string{"outputFormat": "gif", "colors": "16", "dither": "true"})
+	require.Equal(t, http.StatusCreated, rr.Code)
+	var response models.MosaicResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, "jpeg", response.Format)
+	assert.Equal(t, "gif", response.Output.Format)
+	assert.Equal(t, 16, response.Output.Colors)
+	data, err := base64.StdEncoding.DecodeString(response.MosaicImg)
+	require.NoError(t, err)
+	assert.Equal(t, len(data), response.Output.Bytes)
+	_, format, err := image.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, "gif", format)
+
+	rr = render("image/*", map[string]string{"outputFormat": "png", "compression": "best"})
+	require.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, "image/png", rr.Header().Get("Content-Type"))
+
+	rr = render("image/jpeg", map[string]string{"quality": "40"})
+	require.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, "40", rr.Header().Get("X-Mosaic-Quality"))
+
+	rr = render("image/jpeg", map[string]string{"outputFormat": "png"})
+	assert.Equal(t, http.StatusNotAcceptable, rr.Code)
+
+	rr = render("", map[string]string{"maxBytes": "10"})
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+
+	for _, fields := range []map[string]string{
+		{"outputFormat": "webp"},
+		{"quality": "high"},
+		{"quality": "0"},
+		{"outputFormat": "png", "compression": "deflate"},
+		{"dither": "maybe"},
+	} {
+		rr = render("", fields)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, fields)
+	}
+}
+
+// TestRenderMosaicCancellation tests that a render stops between rows once its context is done
+func TestRenderMosaicCancellation(t *testing.T) {
+	dir := setupTilesTest(t)
+	writeTestFile(t, filepath.Join(dir, "red.jpg"), imageToBytes(t, createTestImage(10, 10)))
+	loadTilesDB(appConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rows := 0
+	_, _, err := renderMosaic(ctx, tileStore, createTestImage(40, 30), 10, nil, func(done, total int, mosaic *image.NRGBA) {
+		rows = done
+		cancel()
+	})
+	var partial *partialRenderError
+	require.ErrorAs(t, err, &partial)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, rows)
+	assert.Equal(t, 1, partial.rows)
+	assert.Equal(t, 3, partial.totalRows)
+	assert.Contains(t, err.Error(), "after 1 of 3 rows")
+
+	ctx, cancel = renderContext(context.Background(), models.RenderOptions{TimeoutMs: 50})
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(50*time.Millisecond), deadline, 40*time.Millisecond)
+
+	// A deadline that has passed answers 504, a client that went away gets nothing
+	router := routes()
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, renderRequest(t, "/api/file/upload", createTestImage(40, 30), map[string]string{"tileSize": "10"}).WithContext(expired))
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	var response models.ErrorResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, models.ErrorCodeRenderTimeout, response.ErrorCode)
+	assert.Contains(t, response.Message, "after 0 of 3 rows")
+
+	// Renders outlasting the write timeout stop in time to answer 504 and point to jobs
+	prevTimeout := writeTimeout
+	writeTimeout = time.Nanosecond
+	t.Cleanup(func() { writeTimeout = prevTimeout })
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, renderRequest(t, "/api/file/upload", createTestImage(40, 30), map[string]string{"tileSize": "10", "timeoutMs": "600000"}))
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	response = models.ErrorResponse{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, models.ErrorCodeRenderTimeout, response.ErrorCode)
+	assert.Contains(t, response.Message, "/api/jobs")
+	writeTimeout = prevTimeout
+
+	gone, cancelGone := context.WithCancel(context.Background())
+	cancelGone()
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, renderRequest(t, "/api/file/upload", createTestImage(40, 30), map[string]string{"tileSize": "10"}).WithContext(gone))
+	assert.Empty(t, rr.Body.String())
+}
+
 // Helper functions
 
 // createTestImage creates a simple test image
 func createTestImage(width, height int) image.Image {
+	return createColorImage(width, height, color.RGBA{255, 0, 0, 255})
+}
+
+// createColorImage creates a width x height image of a single color
+func createColorImage(width, height int, c color.Color) image.Image {
 	img := image.NewRGBA(image.Rect(0, 0, width, height))
 	for y := 0; y < height; y++ {
 		for x := 0; x < width; x++ {
-			img.Set(x, y, color.RGBA{255, 0, 0, 255})
+			img.Set(x, y, c)
 		}
 	}
 	return img
@@ -194,6 +368,40 @@ func imageToBytes(t *testing.T, img image.Image) []byte {
 	return buf.Bytes()
 }
 
+// imageToPNG converts an image to PNG bytes, for tests that need exact colors
+func imageToPNG(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+// multipartRequest builds a multipart POST to url with data as the file filename
+// of field and the given form fields
+func multipartRequest(t *testing.T, url, field, filename string, data []byte, fields map[string]string) *http.Request {
+	return multipartFilesRequest(t, url, field, map[string][]byte{filename: data}, fields)
+}
+
+// multipartFilesRequest builds a multipart POST to url with every file of files,
+// by name, in field and the given form fields
+func multipartFilesRequest(t *testing.T, url, field string, files map[string][]byte, fields map[string]string) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for name, data := range files {
+		part, err := writer.CreateFormFile(field, name)
+		require.NoError(t, err)
+		_, err = part.Write(data)
+		require.NoError(t, err)
+	}
+	for key, value := range fields {
+		require.NoError(t, writer.WriteField(key, value))
+	}
+	require.NoError(t, writer.Close())
+
+	req := httptest.NewRequest("POST", url, body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
 // TestSendErrorResponse tests the sendErrorResponse function
 func TestSendErrorResponse(t *testing.T) {
 	rr := httptest.NewRecorder()
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+
+	"wilbertopachecob/mosaic/lib/tile_store"
+	"wilbertopachecob/mosaic/lib/tiles_db"
+	"wilbertopachecob/mosaic/models"
+)
+
+// ImportResponse reports the outcome of importing a tile archive
+type ImportResponse struct {
+	*tiles_db.ImportReport
+	Tiles []TileInfo `json:"tiles"`
+}
+
+// importTilesHandler imports the images of an uploaded .zip or .tar.gz archive into a collection
+func importTilesHandler(w http.ResponseWriter, r *http.Request) {
+	// Large archives are spooled to disk by the multipart reader, up to the archive limit
+	r.Body = http.MaxBytesReader(w, r.Body, appConfig.ImportMaxArchiveBytes+uploadOverhead)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		if isUploadTooLarge(err) {
+			sendErrorCode(w, http.StatusRequestEntityTooLarge, models.ErrorCodeUploadTooLarge, "Archive too large",
+				fmt.Sprintf("archives must be at most %d bytes", appConfig.ImportMaxArchiveBytes))
+			return
+		}
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid form data", err.Error())
+		return
+	}
+
+	collection := r.FormValue("collection")
+	if !tiles_db.IsValidCollection(collection) {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid collection", fmt.Sprintf("collection %q is not a valid name", collection))
+		return
+	}
+
+	file, header, err := r.FormFile("archive")
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, "Failed to get uploaded archive", err.Error())
+		return
+	}
+	defer file.Close()
+
+	dir := filepath.Join(appConfig.TilesDir, collection)
+	report, err := tiles_db.ImportArchive(file, header.Size, dir, archiveLimits())
+	if report == nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, tiles_db.ErrInvalidArchive) {
+			status = http.StatusBadRequest
+		}
+		sendErrorResponse(w, status, "Failed to import archive", err.Error())
+		return
+	}
+	// Archive entries whose content is already in the library are reported as skipped
+	for path, existing := range publishTiles(report.Descriptors, nil) {
+		report.MarkDuplicate(path, existing)
+	}
+
+	response := ImportResponse{ImportReport: report, Tiles: []TileInfo{}}
+	for path, descriptor := range report.Descriptors {
+		info, _ := recordInfo(tile_store.NewRecord(path, descriptor, tiles_db.Metadata{}))
+		response.Tiles = append(response.Tiles, info)
+	}
+
+	// Tiles imported before a failure are kept, the report tells what happened
+	status := http.StatusCreated
+	switch {
+	case errors.Is(err, tiles_db.ErrArchiveTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, tiles_db.ErrInvalidArchive):
+		status = http.StatusBadRequest
+	case err != nil:
+		status = http.StatusInternalServerError
+	}
+	sendJSONResponse(w, status, response)
+}
+
+// archiveLimits returns the configured archive import limits
+func archiveLimits() tiles_db.ArchiveLimits {
+	return tiles_db.ArchiveLimits{
+		MaxEntries:    appConfig.ImportMaxEntries,
+		MaxEntryBytes: appConfig.ImportMaxEntryBytes,
+		MaxTotalBytes: appConfig.ImportMaxTotalBytes,
+		MaxRatio:      appConfig.ImportMaxRatio,
+		MaxPixels:     appConfig.MaxImagePixels,
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"wilbertopachecob/mosaic/lib/tiles_db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestImportTilesHandler tests importing a zip archive into a collection
+func TestImportTilesHandler(t *testing.T) {
+	setupTilesTest(t)
+	router := routes()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range map[string][]byte{
+		"red.jpg":      imageToBytes(t, createTestImage(10, 10)),
+		"../evil.jpg":  imageToBytes(t, createTestImage(10, 10)),
+		"notes/a.txt":  []byte("text"),
+		"gradient.jpg": imageToBytes(t, createGradientImage(10, 10, false)),
+	} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		w.Write(data)
+	}
+	zw.Close()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, multipartRequest(t, "/api/tiles/import", "archive", "tiles.zip", buf.Bytes(), map[string]string{"collection": "imported"}))
+	require.Equal(t, http.StatusCreated, rr.Code)
+
+	var response ImportResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, 2, response.Added)
+	assert.Equal(t, 1, response.Skipped)
+	assert.Equal(t, 1, response.Failed)
+	assert.Len(t, response.Tiles, 2)
+	assert.Len(t, tileStore.List(), 2)
+
+	statuses := make(map[string]string)
+	for _, entry := range response.Entries {
+		statuses[entry.Name] = entry.Status
+	}
+	assert.Equal(t, tiles_db.EntryFailed, statuses["../evil.jpg"])
+
+	// Invalid collection names and non-archives are rejected
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, multipartRequest(t, "/api/tiles/import", "archive", "tiles.zip", buf.Bytes(), map[string]string{"collection": "../up"}))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, multipartRequest(t, "/api/tiles/import", "archive", "tiles.zip", []byte("not an archive"), map[string]string{"collection": "imported"}))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+// TestImportTilesHandlerLimits tests the archive byte limit and the pixel limit of entries
+func TestImportTilesHandlerLimits(t *testing.T) {
+	setupTilesTest(t)
+	appConfig.MaxImagePixels = 100 * 100
+	router := routes()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range map[string][]byte{
+		"red.jpg":  imageToBytes(t, createTestImage(10, 10)),
+		"bomb.png": pngHeader(50000, 50000),
+	} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		w.Write(data)
+	}
+	zw.Close()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, multipartRequest(t, "/api/tiles/import", "archive", "tiles.zip", buf.Bytes(), map[string]string{"collection": "limited"}))
+	require.Equal(t, http.StatusCreated, rr.Code)
+	var response ImportResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, 1, response.Added)
+	assert.Equal(t, 1, response.Failed)
+	for _, entry := range response.Entries {
+		if entry.Name == "bomb.png" {
+			assert.Contains(t, entry.Reason, "too large")
+		}
+	}
+
+	appConfig.ImportMaxArchiveBytes = 16
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, multipartRequest(t, "/api/tiles/import", "archive", "tiles.zip", bytes.Repeat(buf.Bytes(), uploadOverhead/len(buf.Bytes())+2), map[string]string{"collection": "oversized"}))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+}
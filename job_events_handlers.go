@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+	"net/http"
+	"time"
+
+	"wilbertopachecob/mosaic/lib/jobs"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// previewInterval is the minimum time between two preview frames
+	previewInterval = 250 * time.Millisecond
+	// eventsKeepAlive is how often an idle event stream sends a comment
+	eventsKeepAlive = 15 * time.Second
+)
+
+// ProgressEvent is the data of a "progress" event, sent after every row of the mosaic
+// Elapsed and ETA are in seconds, ETA is extrapolated from the rows done so far
+type ProgressEvent struct {
+	Done       int     `json:"done"`
+	Total      int     `json:"total"`
+	Cells      int     `json:"cells"`
+	TotalCells int     `json:"totalCells"`
+	Progress   float64 `json:"progress"`
+	Elapsed    float64 `json:"elapsed"`
+	ETA        float64 `json:"eta"`
+}
+
+// PreviewEvent is the data of a "preview" event, a low-resolution JPEG of the mosaic so far
+type PreviewEvent struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Image  string `json:"image"` // data:image/jpeg;base64 URL
+}
+
+// JobErrorEvent is the data of the final "error" event of a job that failed or was canceled
+type JobErrorEvent struct {
+	State jobs.State `json:"state"`
+	Error string     `json:"error"`
+}
+
+// renderUpdate is the payload a render job attaches to its progress reports
+type renderUpdate struct {
+	cells, totalCells int
+	preview           *PreviewEvent
+}
+
+// renderReporter adapts the row callback of renderMosaic to the progress reports of a job
+// When the preview width is positive it attaches a preview frame at most every
+// previewInterval and after the last row
+func renderReporter(req *mosaicRequest, report func(done, total int, data interface{})) func(done, total int, mosaic *image.NRGBA) {
+	bounds := req.original.Bounds()
+	columns := (bounds.Dx() + req.options.TileSize - 1) / req.options.TileSize
+	previewWidth := req.options.PreviewWidth
+	var lastPreview time.Time
+
+	return func(done, total int, mosaic *image.NRGBA) {
+		update := renderUpdate{cells: done * columns, totalCells: total * columns}
+		if previewWidth > 0 && (done == total || time.Since(lastPreview) >= previewInterval) {
+			preview, err := previewFrame(mosaic, previewWidth)
+			if err != nil {
+				logrus.WithError(err).Warn("Failed to encode preview frame")
+			} else {
+				update.preview, lastPreview = preview, time.Now()
+			}
+		}
+		report(done, total, update)
+	}
+}
+
+// previewFrame scales the mosaic down to width pixels and encodes it as a JPEG data URL
+// Scaling samples the nearest pixel, which is enough for a progress preview
+func previewFrame(mosaic *image.NRGBA, width int) (*PreviewEvent, error) {
+	bounds := mosaic.Bounds()
+	width = min(width, bounds.Dx())
+	height := max(bounds.Dy()*width/max(bounds.Dx(), 1), 1)
+
+	frame := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		sy := bounds.Min.Y + y*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			frame.SetNRGBA(x, y, mosaic.NRGBAAt(bounds.Min.X+x*bounds.Dx()/width, sy))
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, frame, &jpeg.Options{Quality: 60}); err != nil {
+		return nil, err
+	}
+	return &PreviewEvent{
+		Width:  width,
+		Height: height,
+		Image:  "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+	}, nil
+}
+
+// jobEventsHandler streams the progress of a render job as Server-Sent Events
+// The stream sends "progress" and optional "preview" events while the job runs and
+// closes with a "result" event carrying the mosaic or an "error" event
+func jobEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := lookupJob(w, r); !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	events, unsubscribe, ok := renderJobs.Subscribe(id)
+	if !ok {
+		sendErrorResponse(w, http.StatusNotFound, "Job not found", id)
+		return
+	}
+	defer unsubscribe()
+
+	// Streams last as long as the render, beyond the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && err != http.ErrNotSupported {
+		logrus.WithError(err).Warn("Failed to clear the write deadline of an event stream")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			rc.Flush()
+		case event, open := <-events:
+			if !open {
+				writeFinalEvent(w, id)
+				rc.Flush()
+				return
+			}
+			if !event.Status.State.Finished() {
+				writeProgressEvents(w, event)
+				rc.Flush()
+			}
+		}
+	}
+}
+
+// writeProgressEvents writes the progress event of a status update and its preview frame, if any
+func writeProgressEvents(w http.ResponseWriter, event jobs.Event) {
+	status := event.Status
+	update, _ := event.Data.(renderUpdate)
+	progress := ProgressEvent{
+		Done:       status.Done,
+		Total:      status.Total,
+		Cells:      update.cells,
+		TotalCells: update.totalCells,
+		Progress:   math.Round(status.Progress*1000) / 1000,
+		Elapsed:    math.Round(status.RanFor*100) / 100,
+	}
+	if status.Progress > 0 {
+		progress.ETA = math.Round(status.RanFor*(1-status.Progress)/status.Progress*100) / 100
+	}
+	writeEvent(w, "progress", progress)
+	if update.preview != nil {
+		writeEvent(w, "preview", update.preview)
+	}
+}
+
+// writeFinalEvent writes the result of a finished job, or why it has none
+func writeFinalEvent(w http.ResponseWriter, id string) {
+	result, status, ok := renderJobs.Result(id)
+	switch {
+	case !ok:
+		writeEvent(w, "error", JobErrorEvent{State: jobs.StateCanceled, Error: "job was discarded"})
+	case status.State == jobs.StateSucceeded:
+		writeEvent(w, "result", result)
+	default:
+		writeEvent(w, "error", JobErrorEvent{State: status.State, Error: status.Error})
+	}
+}
+
+// writeEvent writes one Server-Sent Event with a JSON data line
+func writeEvent(w http.ResponseWriter, name string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		logrus.WithError(err).WithField("event", name).Warn("Failed to encode event")
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, payload)
+}
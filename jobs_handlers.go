@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"time"
+
+	"wilbertopachecob/mosaic/lib/jobs"
+	"wilbertopachecob/mosaic/models"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// createJobHandler queues a mosaic render and returns its job status
+// It takes the same form as the synchronous upload endpoint
+func createJobHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := parseMosaicRequest(w, r)
+	if !ok {
+		return
+	}
+	output := req.encoderOptions("")
+	if err := output.Validate(); err != nil {
+		sendValidationError(w, []models.FieldError{{Field: "compression", Code: models.FieldInvalidChoice, Message: err.Error()}})
+		return
+	}
+
+	// Jobs that fail or are canceled, even before they start, give their render
+	// back, and so do jobs served from the result cache
+	refund, ok := chargeRender(w, r, sourceMegapixels(req))
+	if !ok {
+		return
+	}
+	onFinish := func(status jobs.Status) {
+		if status.State != jobs.StateSucceeded {
+			refund()
+		}
+	}
+	status, err := renderJobs.SubmitNotify(jobOwner(r), func(ctx context.Context, report func(done, total int, data interface{})) (interface{}, error) {
+		t0 := time.Now()
+		ctx, cancel := renderContext(ctx, req.options)
+		defer cancel()
+		version := tileStore.Version()
+		render, cached, err := renderOrLoad(ctx, req, output, version, renderCacheKey(req, output, version), renderSlots, true, renderReporter(req, report))
+		if err != nil {
+			return nil, err
+		}
+		if cached {
+			refund()
+		}
+		return render.response(math.Round(time.Since(t0).Seconds()*100)/100, cached), nil
+	}, onFinish)
+	if err != nil {
+		refund()
+	}
+	if errors.Is(err, jobs.ErrQueueFull) || errors.Is(err, jobs.ErrClosed) {
+		w.Header().Set("Retry-After", "5")
+		sendErrorResponse(w, http.StatusServiceUnavailable, "Render queue is full", err.Error())
+		return
+	}
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, "Failed to queue render", err.Error())
+		return
+	}
+
+	logrus.WithField("job", status.ID).Info("Render job queued")
+	w.Header().Set("Location", "/api/jobs/"+status.ID)
+	sendJSONResponse(w, http.StatusAccepted, status)
+}
+
+// jobOwner returns the owner of the jobs submitted by r, the name of its API key
+func jobOwner(r *http.Request) string {
+	if key := requestKey(r); key != nil {
+		return key.Name
+	}
+	return ""
+}
+
+// lookupJob returns the status of the {id} job if it was submitted with the API key of r
+// Jobs of other keys are answered like missing ones, a 404, and false is returned
+func lookupJob(w http.ResponseWriter, r *http.Request) (jobs.Status, bool) {
+	id := mux.Vars(r)["id"]
+	status, ok := renderJobs.Get(id)
+	if !ok || status.Owner != jobOwner(r) {
+		sendErrorResponse(w, http.StatusNotFound, "Job not found", id)
+		return jobs.Status{}, false
+	}
+	return status, true
+}
+
+// getJobHandler returns the state, progress, timings and error of a job
+func getJobHandler(w http.ResponseWriter, r *http.Request) {
+	status, ok := lookupJob(w, r)
+	if !ok {
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, status)
+}
+
+// jobResultHandler returns the mosaic of a job that succeeded
+// Jobs that are still running answer 409, jobs that failed or were canceled 410
+func jobResultHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := lookupJob(w, r); !ok {
+		return
+	}
+	result, status, ok := renderJobs.Result(mux.Vars(r)["id"])
+	switch {
+	case !ok:
+		sendErrorResponse(w, http.StatusNotFound, "Job not found", mux.Vars(r)["id"])
+	case !status.State.Finished():
+		sendErrorResponse(w, http.StatusConflict, "Job not finished", string(status.State))
+	case status.State != jobs.StateSucceeded:
+		sendErrorResponse(w, http.StatusGone, "Job "+string(status.State), status.Error)
+	default:
+		sendJSONResponse(w, http.StatusOK, result)
+	}
+}
+
+// cancelJobHandler cancels a queued or running job, or discards the result of a finished one
+func cancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := lookupJob(w, r); !ok {
+		return
+	}
+	status, ok := renderJobs.Cancel(mux.Vars(r)["id"])
+	if !ok {
+		sendErrorResponse(w, http.StatusNotFound, "Job not found", mux.Vars(r)["id"])
+		return
+	}
+	logrus.WithFields(logrus.Fields{"job": status.ID, "state": status.State}).Info("Render job canceled")
+	sendJSONResponse(w, http.StatusOK, status)
+}
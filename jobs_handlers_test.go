@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"wilbertopachecob/mosaic/config"
+	"wilbertopachecob/mosaic/lib/jobs"
+	"wilbertopachecob/mosaic/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// renderRequest builds a multipart render request for url
+func renderRequest(t *testing.T, url string, img image.Image, fields map[string]string) *http.Request {
+	return multipartRequest(t, url, "imgUpload", "source.jpg", imageToBytes(t, img), fields)
+}
+
+// setupJobsTest creates the render job pool for the duration of a test
+func setupJobsTest(t *testing.T) {
+	prev := renderJobs
+	renderJobs = newRenderJobs(config.Default())
+	t.Cleanup(func() {
+		renderJobs.Close()
+		renderJobs = prev
+	})
+}
+
+// waitForJob polls a job through the API until it is finished
+func waitForJob(t *testing.T, router http.Handler, id string) jobs.Status {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/jobs/"+id, nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+		var status jobs.Status
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+		if status.State.Finished() {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Job %s did not finish", id)
+	return jobs.Status{}
+}
+
+// TestRenderJobAPI tests queuing a render, polling it and fetching its result
+func TestRenderJobAPI(t *testing.T) {
+	dir := setupTilesTest(t)
+	setupJobsTest(t)
+	writeTestFile(t, filepath.Join(dir, "red.jpg"), imageToBytes(t, createTestImage(10, 10)))
+	loadTilesDB(appConfig)
+	router := routes()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, renderRequest(t, "/api/jobs", createTestImage(40, 30), map[string]string{"tileSize": "10"}))
+	require.Equal(t, http.StatusAccepted, rr.Code)
+	var created jobs.Status
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+	assert.Equal(t, "/api/jobs/"+created.ID, rr.Header().Get("Location"))
+
+	status := waitForJob(t, router, created.ID)
+	assert.Equal(t, jobs.StateSucceeded, status.State)
+	assert.Equal(t, 3, status.Total)
+	assert.Equal(t, 1.0, status.Progress)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/jobs/"+created.ID+"/result", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var result models.MosaicResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.NotEmpty(t, result.MosaicImg)
+	require.Len(t, result.Credits, 1)
+	assert.Equal(t, 12, result.Credits[0].Count)
+
+	// Deleting a finished job discards its result
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("DELETE", "/api/jobs/"+created.ID, nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/jobs/"+created.ID+"/result", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/api/jobs", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+// TestRenderJobCancel tests that a canceled render stops and has no result
+func TestRenderJobCancel(t *testing.T) {
+	setupTilesTest(t)
+	setupJobsTest(t)
+	router := routes()
+
+	// Block the only worker so that the render stays queued
+	cfg := config.Default()
+	cfg.JobWorkers, cfg.JobQueueSize = 1, 1
+	renderJobs.Close()
+	renderJobs = newRenderJobs(cfg)
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	_, err := renderJobs.Submit(func(ctx context.Context, report func(done, total int, data interface{})) (interface{}, error) {
+		close(started)
+		<-release
+		return nil, nil
+	})
+	require.NoError(t, err)
+	<-started
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, renderRequest(t, "/api/jobs", createTestImage(20, 20), nil))
+	require.Equal(t, http.StatusAccepted, rr.Code)
+	var created jobs.Status
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, renderRequest(t, "/api/jobs", createTestImage(20, 20), nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("DELETE", "/api/jobs/"+created.ID, nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/jobs/"+created.ID+"/result", nil))
+	assert.Equal(t, http.StatusGone, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/jobs/missing", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+// readEvents reads Server-Sent Events from a stream until it ends or until an event named last
+func readEvents(t *testing.T, scanner *bufio.Scanner, last string) []jobEvent {
+	t.Helper()
+	var events []jobEvent
+	var event jobEvent
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event.Name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.Data = []byte(strings.TrimPrefix(line, "data: "))
+		case line == "" && event.Name != "":
+			events = append(events, event)
+			if event.Name == last {
+				return events
+			}
+			event = jobEvent{}
+		}
+	}
+	return events
+}
+
+// jobEvent is one Server-Sent Event read by readEvents
+type jobEvent struct {
+	Name string
+	Data []byte
+}
+
+// TestJobEvents tests streaming the progress, previews and result of a render job
+func TestJobEvents(t *testing.T) {
+	dir := setupTilesTest(t)
+	setupJobsTest(t)
+	writeTestFile(t, filepath.Join(dir, "red.jpg"), imageToBytes(t, createTestImage(10, 10)))
+	loadTilesDB(appConfig)
+	server := httptest.NewServer(routes())
+	defer server.Close()
+
+	// Block the only worker so that the stream is open before the render starts
+	cfg := config.Default()
+	cfg.JobWorkers = 1
+	renderJobs.Close()
+	renderJobs = newRenderJobs(cfg)
+	started, release := make(chan struct{}), make(chan struct{})
+	_, err := renderJobs.Submit(func(ctx context.Context, report func(done, total int, data interface{})) (interface{}, error) {
+		close(started)
+		<-release
+		return nil, nil
+	})
+	require.NoError(t, err)
+	<-started
+
+	rr := httptest.NewRecorder()
+	routes().ServeHTTP(rr, renderRequest(t, "/api/jobs", createTestImage(40, 30), map[string]string{"tileSize": "10", "previewWidth": "20"}))
+	require.Equal(t, http.StatusAccepted, rr.Code)
+	var created jobs.Status
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+
+	resp, err := http.Get(server.URL + "/api/jobs/" + created.ID + "/events")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	events := readEvents(t, scanner, "progress")
+	require.Len(t, events, 1)
+	close(release)
+
+	events = append(events, readEvents(t, scanner, "result")...)
+	names := make(map[string]int)
+	for _, event := range events {
+		names[event.Name]++
+	}
+	assert.Equal(t, 4, names["progress"])
+	assert.Equal(t, 1, names["result"])
+	assert.GreaterOrEqual(t, names["preview"], 1)
+
+	// The last row always comes with a preview frame
+	var progress ProgressEvent
+	var preview PreviewEvent
+	for _, event := range events {
+		switch event.Name {
+		case "progress":
+			require.NoError(t, json.Unmarshal(event.Data, &progress))
+		case "preview":
+			require.NoError(t, json.Unmarshal(event.Data, &preview))
+		}
+	}
+	assert.Equal(t, 3, progress.Done)
+	assert.Equal(t, 12, progress.Cells)
+	assert.Equal(t, 12, progress.TotalCells)
+	assert.Equal(t, 1.0, progress.Progress)
+	assert.Zero(t, progress.ETA)
+
+	assert.Equal(t, 20, preview.Width)
+	assert.Equal(t, 15, preview.Height)
+	assert.True(t, strings.HasPrefix(preview.Image, "data:image/jpeg;base64,"))
+
+	var result models.MosaicResponse
+	require.NoError(t, json.Unmarshal(events[len(events)-1].Data, &result))
+	assert.NotEmpty(t, result.MosaicImg)
+
+	// A finished job only sends its result
+	resp, err = http.Get(server.URL + "/api/jobs/" + created.ID + "/events")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	events = readEvents(t, bufio.NewScanner(resp.Body), "")
+	require.Len(t, events, 1)
+	assert.Equal(t, "result", events[0].Name)
+
+	resp, err = http.Get(server.URL + "/api/jobs/missing/events")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	rr = httptest.NewRecorder()
+	routes().ServeHTTP(rr, renderRequest(t, "/api/jobs", createTestImage(40, 30), map[string]string{"previewWidth": "9999"}))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
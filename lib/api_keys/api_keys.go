@@ -0,0 +1,291 @@
+package api_keys
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Scope is a group of API routes a key may call
+type Scope string
+
+const (
+	ScopeRender Scope = "render" // Render mosaics and manage render jobs
+	ScopeTiles  Scope = "tiles"  // Add, change and remove tiles
+	ScopeAdmin  Scope = "admin"  // Admin routes, implies every other scope
+)
+
+// Key is an API key with its scopes and daily quotas
+// A quota of zero means no limit
+type Key struct {
+	Name            string  `json:"name"`
+	Key             string  `json:"key"`
+	Scopes          []Scope `json:"scopes"`
+	DailyRenders    int     `json:"dailyRenders"`
+	DailyMegapixels float64 `json:"dailyMegapixels"`
+}
+
+// Allows reports whether the key has scope
+func (k *Key) Allows(scope Scope) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Usage is what a key used on a day (UTC, formatted as 2006-01-02)
+type Usage struct {
+	Name       string  `json:"name"`
+	Date       string  `json:"date"`
+	Renders    int     `json:"renders"`
+	Megapixels float64 `json:"megapixels"`
+}
+
+// KeyUsage is the usage of a key today next to its scopes and quotas
+type KeyUsage struct {
+	Usage
+	Scopes          []Scope `json:"scopes"`
+	DailyRenders    int     `json:"dailyRenders"`
+	DailyMegapixels float64 `json:"dailyMegapixels"`
+}
+
+// Charge is a render counted against the quotas of a key on a day, handed out by
+// Store.Charge so that Store.Refund gives it back to that day
+type Charge struct {
+	Name       string
+	Date       string
+	Megapixels float64
+}
+
+// ErrQuotaExceeded is returned by Charge and Check when a render would exceed a daily quota
+var ErrQuotaExceeded = errors.New("daily quota exceeded")
+
+// Store holds the API keys and their daily usage, persisted as JSON so that
+// quotas survive restarts. It is safe for concurrent use
+type Store struct {
+	keys      map[[sha256.Size]byte]*Key
+	names     []string
+	byName    map[string]*Key
+	usagePath string // Empty for usage kept in memory only
+
+	mu    sync.Mutex
+	usage map[string]Usage
+	now   func() time.Time
+}
+
+// NewStore returns a store of keys whose usage is not persisted
+// Keys must have a unique name and secret and only known scopes
+func NewStore(keys []Key) (*Store, error) {
+	s := &Store{
+		keys:   make(map[[sha256.Size]byte]*Key),
+		byName: make(map[string]*Key),
+		usage:  make(map[string]Usage),
+		now:    time.Now,
+	}
+	for i := range keys {
+		key := keys[i]
+		if key.Name == "" || key.Key == "" {
+			return nil, fmt.Errorf("key %d has no name or secret", i)
+		}
+		if _, ok := s.byName[key.Name]; ok {
+			return nil, fmt.Errorf("key %q is defined twice", key.Name)
+		}
+		sum := sha256.Sum256([]byte(key.Key))
+		if _, ok := s.keys[sum]; ok {
+			return nil, fmt.Errorf("key %q reuses the secret of another key", key.Name)
+		}
+		for _, scope := range key.Scopes {
+			if scope != ScopeRender && scope != ScopeTiles && scope != ScopeAdmin {
+				return nil, fmt.Errorf("key %q has unknown scope %q", key.Name, scope)
+			}
+		}
+		s.keys[sum] = &key
+		s.byName[key.Name] = &key
+		s.names = append(s.names, key.Name)
+	}
+	sort.Strings(s.names)
+	return s, nil
+}
+
+// Load reads the keys defined in the JSON file at keysPath and the usage
+// persisted at usagePath, a missing usage file is no usage
+func Load(keysPath, usagePath string) (*Store, error) {
+	data, err := os.ReadFile(keysPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API keys: %w", err)
+	}
+	var keys []Key
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse API keys: %w", err)
+	}
+	s, err := NewStore(keys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid API keys: %w", err)
+	}
+	s.usagePath = usagePath
+
+	data, err = os.ReadFile(usagePath)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API usage: %w", err)
+	}
+	var usage []Usage
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return nil, fmt.Errorf("failed to parse API usage: %w", err)
+	}
+	for _, u := range usage {
+		if _, ok := s.byName[u.Name]; ok {
+			s.usage[u.Name] = u
+		}
+	}
+	return s, nil
+}
+
+// Lookup returns the key whose secret is secret
+func (s *Store) Lookup(secret string) (*Key, bool) {
+	key, ok := s.keys[sha256.Sum256([]byte(secret))]
+	return key, ok
+}
+
+// Charge counts a render of megapixels against the daily quotas of the key named name
+// and returns what it counted. It returns an error wrapping ErrQuotaExceeded, and
+// counts nothing, when the render does not fit in what is left of a quota. Other
+// errors come from persisting the usage, the render is counted anyway
+func (s *Store) Charge(name string, megapixels float64) (Charge, error) {
+	key, ok := s.byName[name]
+	if !ok {
+		return Charge{}, fmt.Errorf("unknown key %q", name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := s.today(name)
+	if err := fits(key, usage, megapixels); err != nil {
+		return Charge{}, err
+	}
+	usage.Renders++
+	usage.Megapixels += megapixels
+	s.usage[name] = usage
+	return Charge{Name: name, Date: usage.Date, Megapixels: megapixels}, s.save()
+}
+
+// Check reports whether a render of megapixels fits in what is left of the daily
+// quotas of the key named name, without counting it
+func (s *Store) Check(name string, megapixels float64) error {
+	key, ok := s.byName[name]
+	if !ok {
+		return fmt.Errorf("unknown key %q", name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fits(key, s.today(name), megapixels)
+}
+
+// fits returns an error wrapping ErrQuotaExceeded when a render of megapixels
+// does not fit in the quotas of key on top of usage
+func fits(key *Key, usage Usage, megapixels float64) error {
+	if key.DailyRenders > 0 && usage.Renders+1 > key.DailyRenders {
+		return fmt.Errorf("%w: %d of %d renders used", ErrQuotaExceeded, usage.Renders, key.DailyRenders)
+	}
+	if key.DailyMegapixels > 0 && usage.Megapixels+megapixels > key.DailyMegapixels {
+		return fmt.Errorf("%w: %.2f of %g megapixels used, the render needs %.2f",
+			ErrQuotaExceeded, usage.Megapixels, key.DailyMegapixels, megapixels)
+	}
+	return nil
+}
+
+// Refund gives back a render charged with Charge that did not run
+// The render is given back to the day it was charged on, a charge of a day whose
+// quotas have started over since has nothing left to give back
+func (s *Store) Refund(charge Charge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage, ok := s.usage[charge.Name]
+	if !ok || usage.Date != charge.Date || usage.Renders == 0 {
+		return nil
+	}
+	usage.Renders--
+	usage.Megapixels -= charge.Megapixels
+	if usage.Megapixels < 0 {
+		usage.Megapixels = 0
+	}
+	s.usage[charge.Name] = usage
+	return s.save()
+}
+
+// Usage returns the usage of every key today, sorted by name
+func (s *Store) Usage() []KeyUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := make([]KeyUsage, 0, len(s.names))
+	for _, name := range s.names {
+		key := s.byName[name]
+		usage = append(usage, KeyUsage{
+			Usage:           s.today(name),
+			Scopes:          key.Scopes,
+			DailyRenders:    key.DailyRenders,
+			DailyMegapixels: key.DailyMegapixels,
+		})
+	}
+	return usage
+}
+
+// ResetAt returns when the daily quotas start over, at the next UTC midnight
+func (s *Store) ResetAt() time.Time {
+	return s.now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+// today returns the usage of name on the current day, the caller must hold s.mu
+func (s *Store) today(name string) Usage {
+	date := s.now().UTC().Format("2006-01-02")
+	usage := s.usage[name]
+	if usage.Date != date {
+		usage = Usage{Name: name, Date: date}
+	}
+	return usage
+}
+
+// save writes the usage to the usage file through a temporary file
+// The caller must hold s.mu
+func (s *Store) save() error {
+	if s.usagePath == "" {
+		return nil
+	}
+
+	usage := make([]Usage, 0, len(s.usage))
+	for _, name := range s.names {
+		if u, ok := s.usage[name]; ok {
+			usage = append(usage, u)
+		}
+	}
+	data, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode API usage: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.usagePath), 0755); err != nil {
+		return fmt.Errorf("failed to create API usage directory: %w", err)
+	}
+	tmp := s.usagePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write API usage: %w", err)
+	}
+	if err := os.Rename(tmp, s.usagePath); err != nil {
+		return fmt.Errorf("failed to write API usage: %w", err)
+	}
+	return nil
+}
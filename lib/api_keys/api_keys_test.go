@@ -0,0 +1,140 @@
+package api_keys
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestStoreLookupAndScopes tests secret lookup and scope checks
+func TestStoreLookupAndScopes(t *testing.T) {
+	store, err := NewStore([]Key{
+		{Name: "renderer", Key: "secret-1", Scopes: []Scope{ScopeRender}},
+		{Name: "root", Key: "secret-2", Scopes: []Scope{ScopeAdmin}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	key, ok := store.Lookup("secret-1")
+	if !ok || key.Name != "renderer" {
+		t.Fatalf("Expected the renderer key, got %v %v", key, ok)
+	}
+	if !key.Allows(ScopeRender) || key.Allows(ScopeTiles) || key.Allows(ScopeAdmin) {
+		t.Errorf("Unexpected scopes for %v", key.Scopes)
+	}
+	if key, _ := store.Lookup("secret-2"); !key.Allows(ScopeTiles) {
+		t.Error("Admin key should have every scope")
+	}
+	if _, ok := store.Lookup("secret-3"); ok {
+		t.Error("Unknown secret was accepted")
+	}
+
+	invalid := [][]Key{
+		{{Name: "", Key: "a"}},
+		{{Name: "a", Key: "a"}, {Name: "a", Key: "b"}},
+		{{Name: "a", Key: "a"}, {Name: "b", Key: "a"}},
+		{{Name: "a", Key: "a", Scopes: []Scope{"superuser"}}},
+	}
+	for _, keys := range invalid {
+		if _, err := NewStore(keys); err == nil {
+			t.Errorf("Expected %v to be rejected", keys)
+		}
+	}
+}
+
+// TestStoreQuotas tests daily render and megapixel quotas and their reset
+func TestStoreQuotas(t *testing.T) {
+	store, err := NewStore([]Key{{Name: "a", Key: "secret", DailyRenders: 2, DailyMegapixels: 10}})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	now := time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+
+	if _, err := store.Charge("a", 8); err != nil {
+		t.Fatalf("First render was refused: %v", err)
+	}
+	if _, err := store.Charge("a", 4); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected the megapixel quota to be exceeded, got %v", err)
+	}
+	if err := store.Check("a", 4); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected Check to see the megapixel quota exceeded, got %v", err)
+	}
+	if err := store.Check("a", 2); err != nil {
+		t.Errorf("Expected Check to allow a render within the quotas, got %v", err)
+	}
+	charge, err := store.Charge("a", 2)
+	if err != nil {
+		t.Fatalf("Render within the quotas was refused: %v", err)
+	}
+	if _, err := store.Charge("a", 0); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected the render quota to be exceeded, got %v", err)
+	}
+
+	usage := store.Usage()
+	if len(usage) != 1 || usage[0].Renders != 2 || usage[0].Megapixels != 10 || usage[0].Date != "2024-05-01" {
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+
+	if charge != (Charge{Name: "a", Date: "2024-05-01", Megapixels: 2}) {
+		t.Errorf("Unexpected charge %+v", charge)
+	}
+	if err := store.Refund(charge); err != nil {
+		t.Fatalf("Failed to refund: %v", err)
+	}
+	late, err := store.Charge("a", 1)
+	if err != nil {
+		t.Errorf("Refunded render was not available: %v", err)
+	}
+
+	if reset := store.ResetAt(); !reset.Equal(time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected reset time %v", reset)
+	}
+	now = now.Add(2 * time.Hour)
+	if _, err := store.Charge("a", 8); err != nil {
+		t.Errorf("Quotas did not reset the next day: %v", err)
+	}
+
+	// A render charged yesterday and refunded today gives nothing back to today
+	if err := store.Refund(late); err != nil {
+		t.Fatalf("Failed to refund: %v", err)
+	}
+	if usage := store.Usage(); usage[0].Renders != 1 || usage[0].Megapixels != 8 || usage[0].Date != "2024-05-02" {
+		t.Errorf("Expected a refund of yesterday to leave today's usage alone, got %+v", usage)
+	}
+}
+
+// TestStorePersistence tests that usage is reloaded with the keys
+func TestStorePersistence(t *testing.T) {
+	dir := t.TempDir()
+	keysPath := filepath.Join(dir, "keys.json")
+	usagePath := filepath.Join(dir, "data", "usage.json")
+	keys := `[{"name": "a", "key": "secret", "scopes": ["render"], "dailyRenders": 5}]`
+	if err := os.WriteFile(keysPath, []byte(keys), 0644); err != nil {
+		t.Fatalf("Failed to write keys: %v", err)
+	}
+
+	store, err := Load(keysPath, usagePath)
+	if err != nil {
+		t.Fatalf("Failed to load keys: %v", err)
+	}
+	if _, err := store.Charge("a", 1.5); err != nil {
+		t.Fatalf("Failed to charge: %v", err)
+	}
+
+	reloaded, err := Load(keysPath, usagePath)
+	if err != nil {
+		t.Fatalf("Failed to reload keys: %v", err)
+	}
+	usage := reloaded.Usage()
+	if len(usage) != 1 || usage[0].Renders != 1 || usage[0].Megapixels != 1.5 {
+		t.Errorf("Usage was not persisted: %+v", usage)
+	}
+
+	if _, err := Load(filepath.Join(dir, "missing.json"), usagePath); err == nil {
+		t.Error("Expected a missing keys file to fail")
+	}
+}
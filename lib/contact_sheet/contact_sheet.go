@@ -0,0 +1,306 @@
+package contact_sheet
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+
+	"wilbertopachecob/mosaic/lib/tiles_db"
+)
+
+// Sort orders
+const (
+	SortHue       = "hue"
+	SortLuminance = "luminance"
+	SortName      = "name"
+)
+
+// grayChroma is the 8-bit chroma below which a tile has no meaningful hue
+// Sorted by hue, such tiles come last, from dark to light
+const grayChroma = 16
+
+// sizeBuckets are the upper bounds, in bytes, of the file size distribution buckets
+var sizeBuckets = []int64{4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+
+// Tile is a tile of a collection as known to the tile index
+// Color is 16-bit per channel like in the tiles database
+type Tile struct {
+	ID     string
+	Path   string
+	Color  [3]float64
+	Size   int64
+	SHA256 string
+	Hash   uint64
+}
+
+// Options controls the layout of a contact sheet
+type Options struct {
+	Columns  int
+	CellSize int
+	Padding  int
+}
+
+// DefaultOptions returns the default contact sheet layout
+func DefaultOptions() Options {
+	return Options{Columns: 16, CellSize: 48, Padding: 2}
+}
+
+// Validate checks that the layout can be rendered
+func (o Options) Validate() error {
+	switch {
+	case o.Columns < 1 || o.Columns > 256:
+		return fmt.Errorf("columns must be between 1 and 256, got %d", o.Columns)
+	case o.CellSize < 4 || o.CellSize > 512:
+		return fmt.Errorf("cell size must be between 4 and 512, got %d", o.CellSize)
+	case o.Padding < 0 || o.Padding > 64:
+		return fmt.Errorf("padding must be between 0 and 64, got %d", o.Padding)
+	}
+	return nil
+}
+
+// Bounds returns the bounds of the sheet of count tiles
+func (o Options) Bounds(count int) image.Rectangle {
+	columns := min(o.Columns, max(count, 1))
+	rows := max((count+columns-1)/columns, 1)
+	step := o.CellSize + o.Padding
+	return image.Rect(0, 0, columns*step+o.Padding, rows*step+o.Padding)
+}
+
+// SizeBucket counts the tiles whose file size is at most MaxBytes
+// The last bucket has no upper bound and a MaxBytes of zero
+type SizeBucket struct {
+	MaxBytes int64 `json:"maxBytes"`
+	Count    int   `json:"count"`
+}
+
+// SizeStats is the file size distribution of a collection
+type SizeStats struct {
+	Total   int64        `json:"total"`
+	Min     int64        `json:"min"`
+	Max     int64        `json:"max"`
+	Mean    float64      `json:"mean"`
+	Median  int64        `json:"median"`
+	Buckets []SizeBucket `json:"buckets"`
+}
+
+// ColorStats describes how the average colors of a collection are spread, in 8-bit RGB
+// Spread is the root of the summed channel variances, 0 for a single color
+type ColorStats struct {
+	Mean         string     `json:"mean"`
+	StdDev       [3]float64 `json:"stdDev"`
+	Spread       float64    `json:"spread"`
+	MinLuminance float64    `json:"minLuminance"`
+	MaxLuminance float64    `json:"maxLuminance"`
+	GrayFraction float64    `json:"grayFraction"`
+	HueHistogram []int      `json:"hueHistogram"` // 12 bins of 30 degrees, grays excluded
+}
+
+// DuplicateStats counts the tiles sharing their content or their perceptual hash with another tile
+type DuplicateStats struct {
+	ExactGroups int `json:"exactGroups"`
+	ExactFiles  int `json:"exactFiles"`
+	NearGroups  int `json:"nearGroups"`
+	NearFiles   int `json:"nearFiles"`
+}
+
+// Stats summarizes a collection
+type Stats struct {
+	Count      int            `json:"count"`
+	Sizes      SizeStats      `json:"sizes"`
+	Colors     ColorStats     `json:"colors"`
+	Duplicates DuplicateStats `json:"duplicates"`
+}
+
+// SortTiles orders tiles by hue, luminance or name, ties are broken by ID
+func SortTiles(tiles []Tile, by string) error {
+	var less func(a, b Tile) bool
+	switch by {
+	case SortName, "":
+		less = func(a, b Tile) bool { return false }
+	case SortLuminance:
+		less = func(a, b Tile) bool { return luminance(a.Color) < luminance(b.Color) }
+	case SortHue:
+		less = func(a, b Tile) bool {
+			hueA, grayA := hue(a.Color)
+			hueB, grayB := hue(b.Color)
+			if grayA || grayB {
+				if grayA != grayB {
+					return grayB
+				}
+				return luminance(a.Color) < luminance(b.Color)
+			}
+			return hueA < hueB
+		}
+	default:
+		return fmt.Errorf("unknown sort %q, expected %q, %q or %q", by, SortHue, SortLuminance, SortName)
+	}
+
+	sort.Slice(tiles, func(i, j int) bool {
+		if less(tiles[i], tiles[j]) {
+			return true
+		}
+		if less(tiles[j], tiles[i]) {
+			return false
+		}
+		return tiles[i].ID < tiles[j].ID
+	})
+	return nil
+}
+
+// Summarize computes the statistics of a collection
+// Tiles whose perceptual hashes are within nearDistance bits are near-duplicates
+func Summarize(tiles []Tile, nearDistance int) Stats {
+	stats := Stats{Count: len(tiles)}
+	stats.Colors.HueHistogram = make([]int, 12)
+	stats.Sizes.Buckets = make([]SizeBucket, len(sizeBuckets)+1)
+	for i, limit := range sizeBuckets {
+		stats.Sizes.Buckets[i].MaxBytes = limit
+	}
+	if len(tiles) == 0 {
+		return stats
+	}
+	n := float64(len(tiles))
+
+	sizes := make([]int64, 0, len(tiles))
+	var mean [3]float64
+	stats.Colors.MinLuminance = math.Inf(1)
+	for _, tile := range tiles {
+		sizes = append(sizes, tile.Size)
+		stats.Sizes.Total += tile.Size
+		bucket := sort.Search(len(sizeBuckets), func(i int) bool { return tile.Size <= sizeBuckets[i] })
+		stats.Sizes.Buckets[bucket].Count++
+
+		c := to8Bit(tile.Color)
+		for i := range mean {
+			mean[i] += c[i] / n
+		}
+		lum := luminance(tile.Color)
+		stats.Colors.MinLuminance = math.Min(stats.Colors.MinLuminance, lum)
+		stats.Colors.MaxLuminance = math.Max(stats.Colors.MaxLuminance, lum)
+		if h, gray := hue(tile.Color); gray {
+			stats.Colors.GrayFraction += 1 / n
+		} else {
+			stats.Colors.HueHistogram[int(h/30)%12]++
+		}
+	}
+
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	stats.Sizes.Min, stats.Sizes.Max = sizes[0], sizes[len(sizes)-1]
+	stats.Sizes.Mean = round(float64(stats.Sizes.Total) / n)
+	stats.Sizes.Median = sizes[len(sizes)/2]
+
+	var variance float64
+	for _, tile := range tiles {
+		c := to8Bit(tile.Color)
+		for i := range c {
+			d := (c[i] - mean[i]) * (c[i] - mean[i]) / n
+			stats.Colors.StdDev[i] += d
+			variance += d
+		}
+	}
+	for i := range stats.Colors.StdDev {
+		stats.Colors.StdDev[i] = round(math.Sqrt(stats.Colors.StdDev[i]))
+	}
+	stats.Colors.Mean = fmt.Sprintf("#%02x%02x%02x", uint8(mean[0]), uint8(mean[1]), uint8(mean[2]))
+	stats.Colors.Spread = round(math.Sqrt(variance))
+	stats.Colors.MinLuminance = round(stats.Colors.MinLuminance)
+	stats.Colors.MaxLuminance = round(stats.Colors.MaxLuminance)
+	stats.Colors.GrayFraction = round(stats.Colors.GrayFraction)
+
+	stats.Duplicates = duplicates(tiles, nearDistance)
+	return stats
+}
+
+// duplicates counts exact duplicates by content hash and near-duplicates by perceptual hash
+func duplicates(tiles []Tile, nearDistance int) DuplicateStats {
+	var stats DuplicateStats
+	bySum := make(map[string]int)
+	fingerprints := make(map[string]tiles_db.Fingerprint, len(tiles))
+	for _, tile := range tiles {
+		if tile.SHA256 != "" {
+			bySum[tile.SHA256]++
+		}
+		fingerprints[tile.Path] = tiles_db.Fingerprint{Hash: tile.Hash, Color: tile.Color}
+	}
+	for _, count := range bySum {
+		if count > 1 {
+			stats.ExactGroups++
+			stats.ExactFiles += count
+		}
+	}
+	for _, group := range tiles_db.GroupDuplicates(fingerprints, nearDistance) {
+		stats.NearGroups++
+		stats.NearFiles += len(group)
+	}
+	return stats
+}
+
+// Render draws the tiles, in order, on a grid of opts.Columns columns
+// load returns the image of a tile at opts.CellSize pixels. Tiles that fail to
+// load are drawn as a magenta cell so that they stand out
+func Render(tiles []Tile, opts Options, load func(Tile) (image.Image, error)) (*image.NRGBA, []error) {
+	columns := min(opts.Columns, max(len(tiles), 1))
+	step := opts.CellSize + opts.Padding
+	sheet := image.NewNRGBA(opts.Bounds(len(tiles)))
+	draw.Draw(sheet, sheet.Bounds(), &image.Uniform{color.NRGBA{32, 32, 32, 255}}, image.Point{}, draw.Src)
+
+	var errs []error
+	for i, tile := range tiles {
+		x, y := opts.Padding+(i%columns)*step, opts.Padding+(i/columns)*step
+		cell := image.Rect(x, y, x+opts.CellSize, y+opts.CellSize)
+
+		img, err := load(tile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", tile.ID, err))
+			draw.Draw(sheet, cell, &image.Uniform{color.NRGBA{255, 0, 255, 255}}, image.Point{}, draw.Src)
+			continue
+		}
+		draw.Draw(sheet, cell, img, img.Bounds().Min, draw.Src)
+	}
+	return sheet, errs
+}
+
+// hue returns the HSV hue in degrees of a 16-bit color and whether it is too gray to have one
+func hue(c [3]float64) (float64, bool) {
+	rgb := to8Bit(c)
+	r, g, b := rgb[0], rgb[1], rgb[2]
+	maxC, minC := math.Max(r, math.Max(g, b)), math.Min(r, math.Min(g, b))
+	chroma := maxC - minC
+	if chroma < grayChroma {
+		return 0, true
+	}
+
+	var h float64
+	switch maxC {
+	case r:
+		h = math.Mod((g-b)/chroma, 6)
+	case g:
+		h = (b-r)/chroma + 2
+	default:
+		h = (r-g)/chroma + 4
+	}
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+	return h, false
+}
+
+// luminance returns the 8-bit Rec. 601 luma of a 16-bit color
+func luminance(c [3]float64) float64 {
+	rgb := to8Bit(c)
+	return 0.299*rgb[0] + 0.587*rgb[1] + 0.114*rgb[2]
+}
+
+// to8Bit converts a 16-bit per channel color to 8 bits per channel
+func to8Bit(c [3]float64) [3]float64 {
+	return [3]float64{c[0] / 257, c[1] / 257, c[2] / 257}
+}
+
+// round rounds v to two decimals
+func round(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -0,0 +1,137 @@
+package contact_sheet
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// tile16 builds a tile with an 8-bit color scaled to the 16-bit tiles database range
+func tile16(id string, r, g, b float64) Tile {
+	return Tile{ID: id, Path: "/tiles/" + id, Color: [3]float64{r * 257, g * 257, b * 257}}
+}
+
+// ids returns the IDs of tiles in order
+func ids(tiles []Tile) []string {
+	var result []string
+	for _, tile := range tiles {
+		result = append(result, tile.ID)
+	}
+	return result
+}
+
+// TestSortTiles tests the hue, luminance and name orders
+func TestSortTiles(t *testing.T) {
+	tiles := []Tile{
+		tile16("white", 255, 255, 255),
+		tile16("blue", 0, 0, 255),
+		tile16("black", 0, 0, 0),
+		tile16("red", 255, 0, 0),
+		tile16("green", 0, 255, 0),
+	}
+
+	tests := []struct {
+		by       string
+		expected []string
+	}{
+		{SortHue, []string{"red", "green", "blue", "black", "white"}},
+		{SortLuminance, []string{"black", "blue", "red", "green", "white"}},
+		{SortName, []string{"black", "blue", "green", "red", "white"}},
+	}
+	for _, tt := range tests {
+		if err := SortTiles(tiles, tt.by); err != nil {
+			t.Fatalf("Failed to sort by %s: %v", tt.by, err)
+		}
+		got := ids(tiles)
+		for i := range tt.expected {
+			if got[i] != tt.expected[i] {
+				t.Errorf("Sort by %s: expected %v, got %v", tt.by, tt.expected, got)
+				break
+			}
+		}
+	}
+
+	if err := SortTiles(tiles, "size"); err == nil {
+		t.Error("Expected an unknown sort to fail")
+	}
+}
+
+// TestSummarize tests the size, color and duplicate statistics
+func TestSummarize(t *testing.T) {
+	tiles := []Tile{
+		tile16("a", 255, 0, 0),
+		tile16("b", 0, 0, 255),
+		tile16("c", 128, 128, 128),
+		tile16("d", 128, 128, 128),
+	}
+	sizes := []int64{1000, 3000, 20000, 20000}
+	for i := range tiles {
+		tiles[i].Size = sizes[i]
+		tiles[i].Hash = uint64(i)
+	}
+	tiles[2].SHA256, tiles[3].SHA256 = "same", "same"
+	tiles[3].Hash = tiles[2].Hash
+
+	stats := Summarize(tiles, 0)
+	if stats.Count != 4 || stats.Sizes.Total != 44000 || stats.Sizes.Min != 1000 || stats.Sizes.Max != 20000 || stats.Sizes.Median != 20000 {
+		t.Errorf("Unexpected size stats: %+v", stats.Sizes)
+	}
+	if stats.Sizes.Buckets[0].Count != 2 || stats.Sizes.Buckets[2].Count != 2 {
+		t.Errorf("Expected 2 tiles up to 4KB and 2 up to 64KB, got %+v", stats.Sizes.Buckets)
+	}
+	if stats.Colors.GrayFraction != 0.5 || stats.Colors.HueHistogram[0] != 1 || stats.Colors.HueHistogram[8] != 1 {
+		t.Errorf("Unexpected color stats: %+v", stats.Colors)
+	}
+	if stats.Colors.Spread <= 0 {
+		t.Errorf("Expected a positive color spread, got %v", stats.Colors.Spread)
+	}
+	expected := DuplicateStats{ExactGroups: 1, ExactFiles: 2, NearGroups: 1, NearFiles: 2}
+	if stats.Duplicates != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats.Duplicates)
+	}
+
+	if empty := Summarize(nil, 6); empty.Count != 0 || len(empty.Sizes.Buckets) != len(sizeBuckets)+1 {
+		t.Errorf("Unexpected stats of an empty collection: %+v", empty)
+	}
+}
+
+// TestRender tests the sheet layout and the marking of tiles that fail to load
+func TestRender(t *testing.T) {
+	tiles := []Tile{tile16("a", 255, 0, 0), tile16("b", 0, 255, 0), tile16("broken", 0, 0, 255)}
+	opts := Options{Columns: 2, CellSize: 8, Padding: 1}
+	load := func(tile Tile) (image.Image, error) {
+		if tile.ID == "broken" {
+			return nil, errors.New("failed to decode image")
+		}
+		img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+		c := tile.Color
+		draw.Draw(img, img.Bounds(), &image.Uniform{color.NRGBA{uint8(c[0] / 257), uint8(c[1] / 257), uint8(c[2] / 257), 255}}, image.Point{}, draw.Src)
+		return img, nil
+	}
+
+	sheet, errs := Render(tiles, opts, load)
+	if len(errs) != 1 {
+		t.Errorf("Expected 1 error, got %v", errs)
+	}
+	if sheet.Bounds().Dx() != 19 || sheet.Bounds().Dy() != 19 {
+		t.Fatalf("Expected a 19x19 sheet, got %v", sheet.Bounds())
+	}
+	if c := sheet.NRGBAAt(1, 1); c.R != 255 || c.G != 0 {
+		t.Errorf("Expected the first tile to be red, got %v", c)
+	}
+	if c := sheet.NRGBAAt(10, 1); c.G != 255 || c.R != 0 {
+		t.Errorf("Expected the second tile to be green, got %v", c)
+	}
+	if c := sheet.NRGBAAt(1, 10); c != (color.NRGBA{255, 0, 255, 255}) {
+		t.Errorf("Expected the broken tile to be magenta, got %v", c)
+	}
+
+	if bounds := opts.Bounds(5); bounds.Dx() != 19 || bounds.Dy() != 28 {
+		t.Errorf("Expected a 19x28 sheet of 5 tiles, got %v", bounds)
+	}
+	if err := (Options{Columns: 0, CellSize: 8}).Validate(); err == nil {
+		t.Error("Expected zero columns to be invalid")
+	}
+}
@@ -0,0 +1,252 @@
+package coverage
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	imgpkg "wilbertopachecob/mosaic/lib/img"
+)
+
+// maxDistance is the largest possible distance between two 8-bit RGB colors
+var maxDistance = math.Sqrt(3 * 255 * 255)
+
+// Bin is a cube of the binned RGB color space
+type Bin struct {
+	Index [3]int `json:"index"`
+	Hex   string `json:"hex"`
+	Count int    `json:"count"`
+}
+
+// Report describes how the tile library covers the RGB color space
+// Colors are split into BinsPerChannel^3 cubes, bins holding no more than
+// ThinThreshold tiles are reported as thin, bins with no tiles as empty
+type Report struct {
+	BinsPerChannel int     `json:"binsPerChannel"`
+	ThinThreshold  int     `json:"thinThreshold"`
+	TileCount      int     `json:"tileCount"`
+	CoveredBins    int     `json:"coveredBins"`
+	TotalBins      int     `json:"totalBins"`
+	Coverage       float64 `json:"coverage"`
+	Empty          []Bin   `json:"empty"`
+	Thin           []Bin   `json:"thin"`
+
+	counts []int
+}
+
+// Cell is a region of a source image and how well the library matches it
+type Cell struct {
+	X           int     `json:"x"`
+	Y           int     `json:"y"`
+	Hex         string  `json:"hex"`
+	Error       float64 `json:"error"`
+	NearestTile string  `json:"nearestTile"`
+}
+
+// MatchReport lists the cells of a source image whose best tile match is poor
+// Errors are Euclidean distances in 8-bit RGB, from 0 to about 441
+type MatchReport struct {
+	TileSize   int     `json:"tileSize"`
+	Threshold  float64 `json:"threshold"`
+	TotalCells int     `json:"totalCells"`
+	PoorCells  []Cell  `json:"poorCells"`
+	MeanError  float64 `json:"meanError"`
+
+	cols, rows int
+	errors     []float64
+	colors     []color.NRGBA
+}
+
+// Analyze bins the tile colors (16-bit per channel, as stored in tiles_db)
+func Analyze(colors map[string][3]float64, binsPerChannel, thinThreshold int) *Report {
+	if binsPerChannel < 1 {
+		binsPerChannel = 1
+	}
+
+	report := &Report{
+		BinsPerChannel: binsPerChannel,
+		ThinThreshold:  thinThreshold,
+		TileCount:      len(colors),
+		TotalBins:      binsPerChannel * binsPerChannel * binsPerChannel,
+		Empty:          []Bin{},
+		Thin:           []Bin{},
+	}
+	report.counts = make([]int, report.TotalBins)
+
+	for _, c := range colors {
+		report.counts[report.binIndex(to8Bit(c))]++
+	}
+
+	for i, count := range report.counts {
+		bin := report.bin(i)
+		switch {
+		case count == 0:
+			report.Empty = append(report.Empty, bin)
+		case count <= thinThreshold:
+			report.Thin = append(report.Thin, bin)
+		}
+		if count > 0 {
+			report.CoveredBins++
+		}
+	}
+	report.Coverage = float64(report.CoveredBins) / float64(report.TotalBins)
+
+	return report
+}
+
+// Heatmap renders the bins as one square per bin, with one block of bins per blue level
+// Empty bins are crossed out and thin bins are outlined in black
+func (report *Report) Heatmap(cellSize int) *image.NRGBA {
+	n := report.BinsPerChannel
+	gap := cellSize / 2
+	out := image.NewNRGBA(image.Rect(0, 0, n*(n*cellSize+gap)-gap, n*cellSize))
+	draw.Draw(out, out.Bounds(), image.White, image.Point{}, draw.Src)
+
+	for i, count := range report.counts {
+		bin := report.bin(i)
+		r, g, b := bin.Index[0], bin.Index[1], bin.Index[2]
+		cell := image.Rect(0, 0, cellSize, cellSize).Add(image.Pt(b*(n*cellSize+gap)+r*cellSize, g*cellSize))
+
+		draw.Draw(out, cell, &image.Uniform{report.binColor(bin.Index)}, image.Point{}, draw.Src)
+		switch {
+		case count == 0:
+			for d := 0; d < cellSize; d++ {
+				out.Set(cell.Min.X+d, cell.Min.Y+d, color.Black)
+				out.Set(cell.Max.X-1-d, cell.Min.Y+d, color.Black)
+			}
+		case count <= report.ThinThreshold:
+			for d := 0; d < cellSize; d++ {
+				out.Set(cell.Min.X+d, cell.Min.Y, color.Black)
+				out.Set(cell.Min.X+d, cell.Max.Y-1, color.Black)
+				out.Set(cell.Min.X, cell.Min.Y+d, color.Black)
+				out.Set(cell.Max.X-1, cell.Min.Y+d, color.Black)
+			}
+		}
+	}
+	return out
+}
+
+// MatchErrors finds the best tile for every tileSize cell of img and reports
+// the cells whose match error is above threshold
+func MatchErrors(img image.Image, colors map[string][3]float64, tileSize int, threshold float64) *MatchReport {
+	bounds := img.Bounds()
+	report := &MatchReport{
+		TileSize:  tileSize,
+		Threshold: threshold,
+		PoorCells: []Cell{},
+		cols:      (bounds.Dx() + tileSize - 1) / tileSize,
+		rows:      (bounds.Dy() + tileSize - 1) / tileSize,
+	}
+
+	totalError := 0.0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += tileSize {
+		for x := bounds.Min.X; x < bounds.Max.X; x += tileSize {
+			cellRect := image.Rect(x, y, x+tileSize, y+tileSize).Intersect(bounds)
+			cellColor := to8Bit(imgpkg.AverageColor(subImage(img, cellRect)))
+
+			nearest, best := "", maxDistance
+			for path, c := range colors {
+				if d := imgpkg.Distance(cellColor, to8Bit(c)); d < best {
+					nearest, best = path, d
+				}
+			}
+
+			report.TotalCells++
+			report.errors = append(report.errors, best)
+			report.colors = append(report.colors, nrgba(cellColor))
+			totalError += best
+
+			if best > threshold {
+				report.PoorCells = append(report.PoorCells, Cell{
+					X:           x,
+					Y:           y,
+					Hex:         hex(cellColor),
+					Error:       math.Round(best*100) / 100,
+					NearestTile: nearest,
+				})
+			}
+		}
+	}
+	if report.TotalCells > 0 {
+		report.MeanError = math.Round(totalError/float64(report.TotalCells)*100) / 100
+	}
+	return report
+}
+
+// Heatmap renders one square per source cell: well matched cells show their
+// color dimmed, poorly matched cells are red with intensity growing with the error
+func (report *MatchReport) Heatmap(cellSize int) *image.NRGBA {
+	out := image.NewNRGBA(image.Rect(0, 0, report.cols*cellSize, report.rows*cellSize))
+
+	for i, e := range report.errors {
+		c := report.colors[i]
+		if e > report.Threshold {
+			c = color.NRGBA{uint8(128 + 127*e/maxDistance), 0, 0, 255}
+		} else {
+			c = color.NRGBA{c.R / 2, c.G / 2, c.B / 2, 255}
+		}
+		cell := image.Rect(0, 0, cellSize, cellSize).Add(image.Pt((i%report.cols)*cellSize, (i/report.cols)*cellSize))
+		draw.Draw(out, cell, &image.Uniform{c}, image.Point{}, draw.Src)
+	}
+	return out
+}
+
+// binIndex returns the flat index of the bin holding an 8-bit color
+func (report *Report) binIndex(c [3]float64) int {
+	n := report.BinsPerChannel
+	idx := [3]int{}
+	for i := range idx {
+		idx[i] = int(c[i]) * n / 256
+		if idx[i] >= n {
+			idx[i] = n - 1
+		}
+	}
+	return (idx[2]*n+idx[1])*n + idx[0]
+}
+
+// bin describes the bin at a flat index
+func (report *Report) bin(i int) Bin {
+	n := report.BinsPerChannel
+	index := [3]int{i % n, (i / n) % n, i / (n * n)}
+	return Bin{Index: index, Hex: hex(report.center(index)), Count: report.counts[i]}
+}
+
+// center returns the 8-bit color at the center of a bin
+func (report *Report) center(index [3]int) [3]float64 {
+	width := 256.0 / float64(report.BinsPerChannel)
+	return [3]float64{
+		(float64(index[0]) + 0.5) * width,
+		(float64(index[1]) + 0.5) * width,
+		(float64(index[2]) + 0.5) * width,
+	}
+}
+
+// binColor returns the center color of a bin
+func (report *Report) binColor(index [3]int) color.NRGBA {
+	return nrgba(report.center(index))
+}
+
+// subImage returns the part of img inside r, normalised to start at the origin
+// so that imgpkg.AverageColor divides by the right pixel count
+func subImage(img image.Image, r image.Rectangle) image.Image {
+	out := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(out, out.Bounds(), img, r.Min, draw.Src)
+	return out
+}
+
+// to8Bit converts a 16-bit per channel color to 8-bit per channel
+func to8Bit(c [3]float64) [3]float64 {
+	return [3]float64{c[0] / 257, c[1] / 257, c[2] / 257}
+}
+
+// nrgba converts an 8-bit per channel color to color.NRGBA
+func nrgba(c [3]float64) color.NRGBA {
+	return color.NRGBA{uint8(c[0]), uint8(c[1]), uint8(c[2]), 255}
+}
+
+// hex formats an 8-bit per channel color as #rrggbb
+func hex(c [3]float64) string {
+	return fmt.Sprintf("#%02x%02x%02x", uint8(c[0]), uint8(c[1]), uint8(c[2]))
+}
@@ -0,0 +1,73 @@
+package coverage
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// color16 converts an 8-bit color to the 16-bit scale used by tiles_db
+func color16(r, g, b float64) [3]float64 {
+	return [3]float64{r * 257, g * 257, b * 257}
+}
+
+// TestAnalyze tests binning of tile colors into empty, thin and covered bins
+func TestAnalyze(t *testing.T) {
+	colors := map[string][3]float64{
+		"black1.jpg": color16(0, 0, 0),
+		"black2.jpg": color16(10, 10, 10),
+		"black3.jpg": color16(20, 5, 5),
+		"white.jpg":  color16(255, 255, 255),
+	}
+
+	report := Analyze(colors, 2, 1)
+
+	if report.TotalBins != 8 || report.CoveredBins != 2 {
+		t.Errorf("Expected 2 of 8 bins covered, got %d of %d", report.CoveredBins, report.TotalBins)
+	}
+	if len(report.Empty) != 6 {
+		t.Errorf("Expected 6 empty bins, got %d", len(report.Empty))
+	}
+	if len(report.Thin) != 1 || report.Thin[0].Index != [3]int{1, 1, 1} || report.Thin[0].Hex != "#c0c0c0" {
+		t.Errorf("Expected the white bin to be thin, got %+v", report.Thin)
+	}
+	if report.Coverage != 0.25 {
+		t.Errorf("Expected coverage 0.25, got %f", report.Coverage)
+	}
+
+	heatmap := report.Heatmap(4)
+	if heatmap.Bounds().Dx() != 2*(2*4+2)-2 || heatmap.Bounds().Dy() != 8 {
+		t.Errorf("Unexpected heatmap size %v", heatmap.Bounds())
+	}
+}
+
+// TestMatchErrors tests that cells without a close tile are reported
+func TestMatchErrors(t *testing.T) {
+	// Left half black, right half pure red
+	img := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	draw.Draw(img, image.Rect(10, 0, 20, 10), &image.Uniform{color.RGBA{255, 0, 0, 255}}, image.Point{}, draw.Src)
+
+	colors := map[string][3]float64{"black.jpg": color16(0, 0, 0)}
+	report := MatchErrors(img, colors, 10, 40)
+
+	if report.TotalCells != 2 {
+		t.Fatalf("Expected 2 cells, got %d", report.TotalCells)
+	}
+	if len(report.PoorCells) != 1 {
+		t.Fatalf("Expected 1 poor cell, got %d", len(report.PoorCells))
+	}
+
+	cell := report.PoorCells[0]
+	if cell.X != 10 || cell.Y != 0 || cell.Hex != "#ff0000" || cell.Error != 255 || cell.NearestTile != "black.jpg" {
+		t.Errorf("Unexpected poor cell %+v", cell)
+	}
+
+	heatmap := report.Heatmap(3)
+	if heatmap.Bounds().Dx() != 6 || heatmap.Bounds().Dy() != 3 {
+		t.Errorf("Unexpected heatmap size %v", heatmap.Bounds())
+	}
+	if heatmap.NRGBAAt(4, 1).R < 128 {
+		t.Errorf("Expected the poor cell to be red, got %v", heatmap.NRGBAAt(4, 1))
+	}
+}
@@ -0,0 +1,310 @@
+package encoder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"sort"
+
+	"golang.org/x/image/tiff"
+)
+
+// Output formats
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatGIF  = "gif"
+	FormatTIFF = "tiff"
+)
+
+// Chroma modes of JPEG output
+// The standard library encoder always subsamples chroma 4:2:0, gray drops it
+const (
+	Chroma420  = "420"
+	ChromaGray = "gray"
+)
+
+// Compression settings, default is the encoder's own choice
+const (
+	CompressionDefault = "default"
+	CompressionNone    = "none"
+	CompressionSpeed   = "speed"   // PNG only
+	CompressionBest    = "best"    // PNG only
+	CompressionDeflate = "deflate" // TIFF only
+)
+
+// GIF palettes, adaptive picks the most frequent colors of the image
+const (
+	PaletteAdaptive = "adaptive"
+	PalettePlan9    = "plan9"
+	PaletteWebSafe  = "websafe"
+)
+
+const (
+	// qualityStep is how much the JPEG quality drops per attempt to fit MaxBytes
+	qualityStep = 10
+	// minQuality is the lowest JPEG quality tried to fit MaxBytes
+	minQuality = 10
+)
+
+// ErrTooLarge is returned when the output cannot be made to fit MaxBytes
+var ErrTooLarge = errors.New("output exceeds the maximum size")
+
+// Options selects the output format and its encoder settings
+// Settings of other formats than Format are ignored
+type Options struct {
+	Format      string
+	Quality     int    // JPEG, 1 to 100
+	Chroma      string // JPEG
+	Compression string // PNG and TIFF
+	Colors      int    // GIF, 2 to 256
+	Palette     string // GIF
+	Dither      bool   // GIF, Floyd-Steinberg error diffusion
+	MaxBytes    int    // Zero for no limit
+}
+
+// DefaultOptions returns the options of the historical output, a JPEG at the default quality
+func DefaultOptions() Options {
+	return Options{
+		Format:      FormatJPEG,
+		Quality:     jpeg.DefaultQuality,
+		Chroma:      Chroma420,
+		Compression: CompressionDefault,
+		Colors:      256,
+		Palette:     PaletteAdaptive,
+	}
+}
+
+// Validate checks that the options can be encoded
+func (o Options) Validate() error {
+	switch o.Format {
+	case FormatJPEG, FormatPNG, FormatGIF, FormatTIFF:
+	default:
+		return fmt.Errorf("format must be jpeg, png, gif or tiff, got %q", o.Format)
+	}
+	if o.Quality < 1 || o.Quality > 100 {
+		return fmt.Errorf("quality must be between 1 and 100, got %d", o.Quality)
+	}
+	if o.Chroma != Chroma420 && o.Chroma != ChromaGray {
+		return fmt.Errorf("chroma must be 420 or gray, got %q", o.Chroma)
+	}
+	if o.Colors < 2 || o.Colors > 256 {
+		return fmt.Errorf("colors must be between 2 and 256, got %d", o.Colors)
+	}
+	switch o.Palette {
+	case PaletteAdaptive, PalettePlan9, PaletteWebSafe:
+	default:
+		return fmt.Errorf("palette must be adaptive, plan9 or websafe, got %q", o.Palette)
+	}
+	if o.MaxBytes < 0 {
+		return fmt.Errorf("max bytes must not be negative, got %d", o.MaxBytes)
+	}
+
+	compressions := map[string][]string{
+		FormatPNG:  {CompressionDefault, CompressionNone, CompressionSpeed, CompressionBest},
+		FormatTIFF: {CompressionDefault, CompressionNone, CompressionDeflate},
+	}[o.Format]
+	if compressions == nil {
+		return nil
+	}
+	for _, compression := range compressions {
+		if o.Compression == compression {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s compression must be one of %v, got %q", o.Format, compressions, o.Compression)
+}
+
+// ContentType returns the media type of format, or an empty string if it is unknown
+func ContentType(format string) string {
+	switch format {
+	case FormatJPEG, FormatPNG, FormatGIF, FormatTIFF:
+		return "image/" + format
+	}
+	return ""
+}
+
+// Result describes an encoded image
+// Quality and Colors are the settings used in the end, which may be lower than
+// the requested ones to fit MaxBytes
+type Result struct {
+	Format      string `json:"format"`
+	ContentType string `json:"contentType"`
+	Quality     int    `json:"quality,omitempty"`
+	Colors      int    `json:"colors,omitempty"`
+	Bytes       int    `json:"bytes"`
+}
+
+// Encode encodes img with opts
+// When the output exceeds MaxBytes it steps the JPEG quality or the GIF colors
+// down, or switches PNG and TIFF to their strongest compression, and returns
+// ErrTooLarge if that is not enough
+func Encode(img image.Image, opts Options) ([]byte, Result, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, Result{}, err
+	}
+	if opts.Format == FormatJPEG && opts.Chroma == ChromaGray {
+		gray := image.NewGray(img.Bounds())
+		draw.Draw(gray, gray.Bounds(), img, img.Bounds().Min, draw.Src)
+		img = gray
+	}
+
+	for {
+		data, err := encode(img, opts)
+		if err != nil {
+			return nil, Result{}, fmt.Errorf("failed to encode image: %w", err)
+		}
+		if opts.MaxBytes == 0 || len(data) <= opts.MaxBytes {
+			result := Result{Format: opts.Format, ContentType: ContentType(opts.Format), Bytes: len(data)}
+			switch opts.Format {
+			case FormatJPEG:
+				result.Quality = opts.Quality
+			case FormatGIF:
+				result.Colors = opts.Colors
+			}
+			return data, result, nil
+		}
+
+		smaller, ok := stepDown(opts)
+		if !ok {
+			return nil, Result{}, fmt.Errorf("%w: %d bytes as %s, at most %d allowed", ErrTooLarge, len(data), opts.Format, opts.MaxBytes)
+		}
+		opts = smaller
+	}
+}
+
+// stepDown returns the next options to try to make the output smaller
+func stepDown(opts Options) (Options, bool) {
+	switch opts.Format {
+	case FormatJPEG:
+		if opts.Quality <= minQuality {
+			return opts, false
+		}
+		opts.Quality = max(opts.Quality-qualityStep, minQuality)
+	case FormatGIF:
+		if opts.Colors <= 2 {
+			return opts, false
+		}
+		opts.Colors = max(opts.Colors/2, 2)
+	case FormatPNG:
+		if opts.Compression == CompressionBest {
+			return opts, false
+		}
+		opts.Compression = CompressionBest
+	case FormatTIFF:
+		if opts.Compression == CompressionDeflate {
+			return opts, false
+		}
+		opts.Compression = CompressionDeflate
+	}
+	return opts, true
+}
+
+// encode encodes img once with opts
+func encode(img image.Image, opts Options) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	var err error
+	switch opts.Format {
+	case FormatJPEG:
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: opts.Quality})
+	case FormatPNG:
+		level := map[string]png.CompressionLevel{
+			CompressionDefault: png.DefaultCompression,
+			CompressionNone:    png.NoCompression,
+			CompressionSpeed:   png.BestSpeed,
+			CompressionBest:    png.BestCompression,
+		}[opts.Compression]
+		err = (&png.Encoder{CompressionLevel: level}).Encode(buf, img)
+	case FormatGIF:
+		var drawer draw.Drawer = draw.Src
+		if opts.Dither {
+			drawer = draw.FloydSteinberg
+		}
+		err = gif.Encode(buf, img, &gif.Options{
+			NumColors: opts.Colors,
+			Quantizer: paletteQuantizer(opts.Palette),
+			Drawer:    drawer,
+		})
+	case FormatTIFF:
+		compression := tiff.Uncompressed
+		if opts.Compression == CompressionDeflate {
+			compression = tiff.Deflate
+		}
+		err = tiff.Encode(buf, img, &tiff.Options{Compression: compression, Predictor: compression != tiff.Uncompressed})
+	}
+	return buf.Bytes(), err
+}
+
+// paletteQuantizer returns the quantizer building the named GIF palette
+func paletteQuantizer(name string) draw.Quantizer {
+	switch name {
+	case PalettePlan9:
+		return fixedPalette(palette.Plan9)
+	case PaletteWebSafe:
+		return fixedPalette(palette.WebSafe)
+	}
+	return popularityQuantizer{}
+}
+
+// fixedPalette is a quantizer that always returns the same palette, cut to the requested size
+type fixedPalette color.Palette
+
+// Quantize implements draw.Quantizer
+func (f fixedPalette) Quantize(p color.Palette, m image.Image) color.Palette {
+	return append(p, f[:min(len(f), cap(p)-len(p))]...)
+}
+
+// popularityQuantizer builds a palette of the most frequent colors of an image,
+// counting colors with 5 bits per channel and averaging the colors of each bucket
+type popularityQuantizer struct{}
+
+// Quantize implements draw.Quantizer
+func (popularityQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	type bucket struct {
+		key     int
+		sum     [3]int
+		samples int
+	}
+	buckets := make(map[int]*bucket)
+	bounds := m.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := m.At(x, y).RGBA()
+			r, g, b = r>>8, g>>8, b>>8
+			key := int(r>>3)<<10 | int(g>>3)<<5 | int(b>>3)
+			entry := buckets[key]
+			if entry == nil {
+				entry = &bucket{key: key}
+				buckets[key] = entry
+			}
+			entry.sum[0] += int(r)
+			entry.sum[1] += int(g)
+			entry.sum[2] += int(b)
+			entry.samples++
+		}
+	}
+
+	sorted := make([]*bucket, 0, len(buckets))
+	for _, entry := range buckets {
+		sorted = append(sorted, entry)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].samples != sorted[j].samples {
+			return sorted[i].samples > sorted[j].samples
+		}
+		return sorted[i].key < sorted[j].key
+	})
+
+	for _, entry := range sorted[:min(len(sorted), cap(p)-len(p))] {
+		n := entry.samples
+		p = append(p, color.RGBA{uint8(entry.sum[0] / n), uint8(entry.sum[1] / n), uint8(entry.sum[2] / n), 255})
+	}
+	return p
+}
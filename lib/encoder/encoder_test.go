@@ -0,0 +1,159 @@
+package encoder
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+// noise builds an image that compresses badly
+func noise(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	seed := uint32(1)
+	for i := range img.Pix {
+		seed = seed*1664525 + 1013904223
+		img.Pix[i] = uint8(seed >> 24)
+		if i%4 == 3 {
+			img.Pix[i] = 255
+		}
+	}
+	return img
+}
+
+// TestEncodeFormats tests that every format decodes back to an image of the same size
+func TestEncodeFormats(t *testing.T) {
+	img := noise(32, 24)
+	for _, format := range []string{FormatJPEG, FormatPNG, FormatGIF, FormatTIFF} {
+		opts := DefaultOptions()
+		opts.Format = format
+		data, result, err := Encode(img, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if result.ContentType != "image/"+format || result.Bytes != len(data) {
+			t.Errorf("%s: unexpected result %+v", format, result)
+		}
+
+		var decoded image.Image
+		if format == FormatTIFF {
+			decoded, err = tiff.Decode(bytes.NewReader(data))
+		} else {
+			var name string
+			decoded, name, err = image.Decode(bytes.NewReader(data))
+			if err == nil && name != format {
+				t.Errorf("%s: decoded as %s", format, name)
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s: decode: %v", format, err)
+		}
+		if decoded.Bounds() != img.Bounds() {
+			t.Errorf("%s: bounds %v, expected %v", format, decoded.Bounds(), img.Bounds())
+		}
+	}
+}
+
+// TestEncodeGray tests that gray chroma produces a single-channel JPEG
+func TestEncodeGray(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Chroma = ChromaGray
+	data, _, err := Encode(noise(16, 16), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decoded.(*image.Gray); !ok {
+		t.Errorf("expected a gray image, got %T", decoded)
+	}
+}
+
+// TestEncodeGIFPalette tests that the adaptive palette keeps the colors of the image
+func TestEncodeGIFPalette(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			img.Set(x, y, color.NRGBA{uint8(x * 32), 100, uint8(y * 32), 255})
+		}
+	}
+	opts := DefaultOptions()
+	opts.Format = FormatGIF
+	opts.Colors = 64
+	data, _, err := Encode(img, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, g, b, _ := decoded.At(3, 5).RGBA()
+	if r>>8 != 96 || g>>8 != 100 || b>>8 != 160 {
+		t.Errorf("expected (96, 100, 160), got (%d, %d, %d)", r>>8, g>>8, b>>8)
+	}
+}
+
+// TestEncodeMaxBytes tests stepping the quality down to fit the maximum size
+func TestEncodeMaxBytes(t *testing.T) {
+	img := noise(64, 64)
+	opts := DefaultOptions()
+	opts.Quality = 95
+	full, _, err := Encode(img, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts.MaxBytes = len(full) * 2 / 3
+	data, result, err := Encode(img, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > opts.MaxBytes || result.Quality >= 95 || result.Quality < minQuality {
+		t.Errorf("expected at most %d bytes at a lower quality, got %d bytes at %d", opts.MaxBytes, len(data), result.Quality)
+	}
+
+	opts.MaxBytes = 100
+	if _, _, err := Encode(img, opts); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected ErrTooLarge, got %v", err)
+	}
+
+	opts.Format, opts.Colors = FormatGIF, 256
+	opts.MaxBytes = 2000
+	data, result, err = Encode(img, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > opts.MaxBytes || result.Colors >= 256 {
+		t.Errorf("expected at most %d bytes with fewer colors, got %d bytes with %d", opts.MaxBytes, len(data), result.Colors)
+	}
+}
+
+// TestValidate tests rejecting invalid options
+func TestValidate(t *testing.T) {
+	tests := []func(*Options){
+		func(o *Options) { o.Format = "webp" },
+		func(o *Options) { o.Quality = 0 },
+		func(o *Options) { o.Chroma = "444" },
+		func(o *Options) { o.Colors = 300 },
+		func(o *Options) { o.Palette = "grays" },
+		func(o *Options) { o.MaxBytes = -1 },
+		func(o *Options) { o.Format, o.Compression = FormatPNG, CompressionDeflate },
+		func(o *Options) { o.Format, o.Compression = FormatTIFF, CompressionBest },
+	}
+	for i, modify := range tests {
+		opts := DefaultOptions()
+		modify(&opts)
+		if err := opts.Validate(); err == nil {
+			t.Errorf("case %d: expected an error for %+v", i, opts)
+		}
+	}
+	if err := DefaultOptions().Validate(); err != nil {
+		t.Errorf("default options: %v", err)
+	}
+}
@@ -56,18 +56,72 @@ func Resize(in image.Image, newWidth int) image.NRGBA {
 	return *out
 }
 
+// Match is a database entry and its distance to a target color
+type Match struct {
+	Key      string
+	Distance float64
+}
+
 // Nearest finds the nearest color match in the database and removes it
 func Nearest(target [3]float64, db *map[string][3]float64) string {
-	var filename string
-	smallest := 1000000.0
-	for k, v := range *db {
-		dist := Distance(target, v)
-		if dist < smallest {
-			filename, smallest = k, dist
+	return NearestWithPenalty(target, db, nil)
+}
+
+// NearestWithPenalty finds the entry of the database minimizing the distance to target
+// plus the entry's penalty and removes it. Entries missing from penalty have none
+func NearestWithPenalty(target [3]float64, db *map[string][3]float64, penalty map[string]float64) string {
+	matches := nearest(target, *db, 1, penalty)
+	if len(matches) == 0 {
+		return ""
+	}
+	delete(*db, matches[0].Key)
+	return matches[0].Key
+}
+
+// KNearest returns the k entries of the database nearest to target, nearest first
+// It ranks entries exactly like Nearest, without modifying the database
+func KNearest(target [3]float64, db map[string][3]float64, k int) []Match {
+	return nearest(target, db, k, nil)
+}
+
+// nearest returns the k entries with the smallest distance plus penalty, smallest first
+// Ties are broken by key so that the result doesn't depend on map order.
+// Match.Distance is the plain distance, without the penalty
+func nearest(target [3]float64, db map[string][3]float64, k int, penalty map[string]float64) []Match {
+	if k <= 0 {
+		return nil
+	}
+	type scored struct {
+		Match
+		score float64
+	}
+	before := func(a, b scored) bool {
+		return a.score < b.score || (a.score == b.score && a.Key < b.Key)
+	}
+
+	// Keep the best k entries in an insertion-sorted slice, k is small
+	best := make([]scored, 0, min(k, len(db)))
+	for key, color := range db {
+		distance := Distance(target, color)
+		candidate := scored{Match{key, distance}, distance + penalty[key]}
+		switch {
+		case len(best) < k:
+			best = append(best, candidate)
+		case before(candidate, best[k-1]):
+			best[k-1] = candidate
+		default:
+			continue
+		}
+		for i := len(best) - 1; i > 0 && before(best[i], best[i-1]); i-- {
+			best[i], best[i-1] = best[i-1], best[i]
 		}
 	}
-	delete(*db, filename)
-	return filename
+
+	matches := make([]Match, len(best))
+	for i := range best {
+		matches[i] = best[i].Match
+	}
+	return matches
 }
 
 // Distance calculates the Euclidean distance between two color points
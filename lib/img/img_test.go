@@ -3,6 +3,7 @@ package img
 import (
 	"image"
 	"image/color"
+	"math"
 	"testing"
 )
 
@@ -120,6 +121,62 @@ func TestNearest(t *testing.T) {
 	}
 }
 
+// TestNearestWithPenalty tests that penalties outweigh small color differences
+func TestNearestWithPenalty(t *testing.T) {
+	db := map[string][3]float64{
+		"busy.jpg": [3]float64{128, 128, 128},
+		"flat.jpg": [3]float64{140, 140, 140},
+	}
+	penalty := map[string]float64{"busy.jpg": 100}
+
+	nearest := NearestWithPenalty([3]float64{128, 128, 128}, &db, penalty)
+	if nearest != "flat.jpg" {
+		t.Errorf("Expected 'flat.jpg', got '%s'", nearest)
+	}
+	if _, exists := db["flat.jpg"]; exists {
+		t.Error("Expected 'flat.jpg' to be removed from database")
+	}
+
+	// Without a competitor the penalized entry is still used
+	if nearest := NearestWithPenalty([3]float64{128, 128, 128}, &db, penalty); nearest != "busy.jpg" {
+		t.Errorf("Expected 'busy.jpg', got '%s'", nearest)
+	}
+}
+
+// TestKNearest tests ranking without modifying the database
+func TestKNearest(t *testing.T) {
+	db := map[string][3]float64{
+		"red.jpg":     [3]float64{255, 0, 0},
+		"darkred.jpg": [3]float64{200, 0, 0},
+		"blue.jpg":    [3]float64{0, 0, 255},
+		"twin.jpg":    [3]float64{200, 0, 0},
+	}
+
+	matches := KNearest([3]float64{250, 0, 0}, db, 3)
+	expected := []string{"red.jpg", "darkred.jpg", "twin.jpg"}
+	if len(matches) != len(expected) {
+		t.Fatalf("Expected %d matches, got %d", len(expected), len(matches))
+	}
+	for i, key := range expected {
+		if matches[i].Key != key {
+			t.Errorf("Expected match %d to be '%s', got '%s'", i, key, matches[i].Key)
+		}
+	}
+	if matches[0].Distance != 5 {
+		t.Errorf("Expected distance 5, got %v", matches[0].Distance)
+	}
+	if len(db) != 4 {
+		t.Error("Expected the database to be left unchanged")
+	}
+
+	if matches := KNearest([3]float64{}, db, 10); len(matches) != 4 {
+		t.Errorf("Expected every entry when k exceeds the database, got %d", len(matches))
+	}
+	if nearest := Nearest([3]float64{250, 0, 0}, &db); nearest != matches[0].Key {
+		t.Errorf("Expected Nearest to agree with KNearest, got '%s'", nearest)
+	}
+}
+
 // TestResize tests the Resize function
 func TestResize(t *testing.T) {
 	// Create a test image (4x4)
@@ -174,4 +231,21 @@ func BenchmarkDistance(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		Distance(p1, p2)
 	}
-} 
\ No newline at end of file
+} 
+// TestLabRoundTrip tests converting sRGB colors to Lab and back
+func TestLabRoundTrip(t *testing.T) {
+	for _, c := range [][3]float64{{0, 0, 0}, {255, 255, 255}, {255, 0, 0}, {12, 200, 99}, {128, 128, 128}} {
+		back, inGamut := LabToRGB(RGBToLab(c))
+		if !inGamut || Distance(c, back) > 1 {
+			t.Errorf("Round trip of %v gave %v (in gamut: %v)", c, back, inGamut)
+		}
+	}
+
+	white := RGBToLab([3]float64{255, 255, 255})
+	if math.Abs(white[0]-100) > 0.01 || math.Abs(white[1]) > 0.01 || math.Abs(white[2]) > 0.01 {
+		t.Errorf("Expected white to be L=100 a=0 b=0, got %v", white)
+	}
+	if _, inGamut := LabToRGB([3]float64{50, 127, -127}); inGamut {
+		t.Error("Expected an extreme Lab color to be out of the sRGB gamut")
+	}
+}
@@ -0,0 +1,81 @@
+package img
+
+import "math"
+
+// D65 reference white in CIE XYZ
+const (
+	whiteX = 0.95047
+	whiteY = 1.0
+	whiteZ = 1.08883
+)
+
+// RGBToLab converts an 8-bit per channel sRGB color to CIE L*a*b* (D65)
+// L is between 0 and 100, a and b roughly between -128 and 127
+func RGBToLab(c [3]float64) [3]float64 {
+	r, g, b := toLinear(c[0]/255), toLinear(c[1]/255), toLinear(c[2]/255)
+
+	x := (0.4124564*r + 0.3575761*g + 0.1804375*b) / whiteX
+	y := (0.2126729*r + 0.7151522*g + 0.0721750*b) / whiteY
+	z := (0.0193339*r + 0.1191920*g + 0.9503041*b) / whiteZ
+
+	fx, fy, fz := labF(x), labF(y), labF(z)
+	return [3]float64{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
+
+// LabToRGB converts a CIE L*a*b* (D65) color to 8-bit per channel sRGB
+// The result is clamped to the sRGB gamut; inGamut reports whether clamping was needed
+func LabToRGB(lab [3]float64) (c [3]float64, inGamut bool) {
+	fy := (lab[0] + 16) / 116
+	fx := fy + lab[1]/500
+	fz := fy - lab[2]/200
+
+	x, y, z := labFInv(fx)*whiteX, labFInv(fy)*whiteY, labFInv(fz)*whiteZ
+
+	linear := [3]float64{
+		3.2404542*x - 1.5371385*y - 0.4985314*z,
+		-0.9692660*x + 1.8760108*y + 0.0415560*z,
+		0.0556434*x - 0.2040259*y + 1.0572252*z,
+	}
+
+	inGamut = true
+	for i, v := range linear {
+		// Allow for rounding errors at the gamut boundary
+		if v < -1e-4 || v > 1+1e-4 {
+			inGamut = false
+		}
+		c[i] = math.Round(fromLinear(math.Min(1, math.Max(0, v))) * 255)
+	}
+	return c, inGamut
+}
+
+// toLinear removes the sRGB transfer curve from a channel in [0, 1]
+func toLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// fromLinear applies the sRGB transfer curve to a linear channel in [0, 1]
+func fromLinear(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// labF is the nonlinearity of the XYZ to Lab conversion
+func labF(t float64) float64 {
+	if t > 216.0/24389.0 {
+		return math.Cbrt(t)
+	}
+	return (24389.0/27.0*t + 16) / 116
+}
+
+// labFInv is the inverse of labF
+func labFInv(t float64) float64 {
+	if t3 := t * t * t; t3 > 216.0/24389.0 {
+		return t3
+	}
+	return (116*t - 16) * 27.0 / 24389.0
+}
@@ -0,0 +1,28 @@
+package img
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+)
+
+// ErrTooManyPixels is returned by CheckPixels for an image declaring more pixels than allowed
+var ErrTooManyPixels = errors.New("image is too large")
+
+// CheckPixels reads the dimensions r declares in its header, without decoding the
+// pixels, and rewinds r for decoding. It returns an error wrapping ErrTooManyPixels
+// when the image has more than maxPixels pixels, zero or less means no limit
+func CheckPixels(r io.ReadSeeker, maxPixels int64) (image.Config, string, error) {
+	config, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return config, format, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return config, format, err
+	}
+	if pixels := int64(config.Width) * int64(config.Height); maxPixels > 0 && pixels > maxPixels {
+		return config, format, fmt.Errorf("%w: %dx%d is %d pixels, at most %d allowed", ErrTooManyPixels, config.Width, config.Height, pixels, maxPixels)
+	}
+	return config, format, nil
+}
@@ -0,0 +1,64 @@
+package img
+
+import (
+	"image"
+	"math/bits"
+)
+
+// DHashVersion identifies the DHash algorithm, hashes of other versions are not comparable
+const DHashVersion = 2
+
+// dhashMargin is how much brighter, in 8-bit luminance levels, a cell must be than its
+// right neighbour to set a bit. It keeps compression noise in flat areas out of the hash
+const dhashMargin = 2
+
+// DHash computes a 64-bit difference hash of an image
+// The image is reduced to a 9x8 grid of mean 8-bit luminances and each bit records
+// whether a cell is clearly brighter than its right neighbour, so re-encoded or slightly
+// edited copies of the same photo produce hashes a few bits apart. Flat images hash to
+// zero whatever their color: the hash describes structure, not color
+func DHash(img image.Image) uint64 {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= 0 || h <= 0 {
+		return 0
+	}
+
+	var sums [8][9]int
+	var counts [8][9]int
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		cy := (y - bounds.Min.Y) * 8 / h
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			cx := (x - bounds.Min.X) * 9 / w
+			r, g, b, _ := img.At(x, y).RGBA()
+			sums[cy][cx] += int(299*(r>>8)+587*(g>>8)+114*(b>>8)) / 1000
+			counts[cy][cx]++
+		}
+	}
+
+	var hash uint64
+	for cy := 0; cy < 8; cy++ {
+		for cx := 0; cx < 8; cx++ {
+			left := cellMean(sums[cy][cx], counts[cy][cx])
+			right := cellMean(sums[cy][cx+1], counts[cy][cx+1])
+			hash <<= 1
+			if left > right+dhashMargin {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// HammingDistance returns the number of differing bits between two hashes
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// cellMean returns the rounded mean of a grid cell, empty cells of tiny images count as black
+func cellMean(sum, count int) int {
+	if count == 0 {
+		return 0
+	}
+	return (sum + count/2) / count
+}
@@ -0,0 +1,72 @@
+package img
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// gradientImage creates a horizontal gradient, reversed when descending is set
+func gradientImage(width, height int, descending bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8(x * 255 / width)
+			if descending {
+				v = 255 - v
+			}
+			img.Set(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	return img
+}
+
+// TestDHash tests that similar images hash close together and different ones don't
+func TestDHash(t *testing.T) {
+	descending := DHash(gradientImage(90, 80, true))
+	ascending := DHash(gradientImage(90, 80, false))
+	scaled := DHash(gradientImage(180, 160, true))
+
+	if descending != ^uint64(0) {
+		t.Errorf("Expected all bits set for a descending gradient, got %064b", descending)
+	}
+	if d := HammingDistance(descending, scaled); d > 4 {
+		t.Errorf("Expected a scaled copy to be within 4 bits, got %d", d)
+	}
+	if d := HammingDistance(descending, ascending); d < 32 {
+		t.Errorf("Expected opposite gradients to differ by at least 32 bits, got %d", d)
+	}
+}
+
+// TestDHashFlatImages tests that compression noise in flat images does not set bits
+func TestDHashFlatImages(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 90, 80))
+	for y := 0; y < 80; y++ {
+		for x := 0; x < 90; x++ {
+			v := uint8(120 + (x*7+y*3)%3) // Noise of up to 2 levels
+			img.Set(x, y, color.RGBA{v, 40, 200, 255})
+		}
+	}
+	if hash := DHash(img); hash != 0 {
+		t.Errorf("Expected a noisy flat image to hash to 0, got %016x", hash)
+	}
+}
+
+// TestHammingDistance tests bit counting between hashes
+func TestHammingDistance(t *testing.T) {
+	tests := []struct {
+		a, b     uint64
+		expected int
+	}{
+		{0, 0, 0},
+		{0, 1, 1},
+		{0xFF, 0x0F, 4},
+		{0, ^uint64(0), 64},
+	}
+
+	for _, tt := range tests {
+		if result := HammingDistance(tt.a, tt.b); result != tt.expected {
+			t.Errorf("HammingDistance(%x, %x) = %d, want %d", tt.a, tt.b, result, tt.expected)
+		}
+	}
+}
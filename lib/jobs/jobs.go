@@ -0,0 +1,368 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// State is the lifecycle state of a job
+type State string
+
+const (
+	StateQueued    State = "queued"
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+	StateCanceled  State = "canceled"
+)
+
+// Finished reports whether a job in this state will not change anymore
+func (s State) Finished() bool {
+	return s == StateSucceeded || s == StateFailed || s == StateCanceled
+}
+
+// ErrQueueFull is returned by Submit when no more jobs can be queued
+var ErrQueueFull = errors.New("job queue is full")
+
+// ErrClosed is returned by Submit once the manager is closed
+var ErrClosed = errors.New("job manager is closed")
+
+// Func is the work of a job
+// It should return ctx.Err() soon after ctx is done and may report its
+// progress as done out of total units of work. data is an optional payload,
+// such as a preview, that is forwarded to subscribers along with the status
+type Func func(ctx context.Context, report func(done, total int, data interface{})) (interface{}, error)
+
+// Event is a progress update sent to the subscribers of a job
+type Event struct {
+	Status Status
+	Data   interface{}
+}
+
+// subscriberBuffer is the number of events a slow subscriber may lag behind
+// before further progress events are dropped for it
+const subscriberBuffer = 32
+
+// Status is a point-in-time view of a job
+type Status struct {
+	ID         string     `json:"id"`
+	State      State      `json:"state"`
+	Done       int        `json:"done"`
+	Total      int        `json:"total"`
+	Progress   float64    `json:"progress"` // Fraction of the work done, from 0 to 1
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	QueuedFor  float64    `json:"queuedFor"` // Seconds between creation and start, or until now
+	RanFor     float64    `json:"ranFor"`    // Seconds between start and finish, or until now
+	Owner      string     `json:"-"`         // Who submitted the job, empty when anonymous
+}
+
+// job is the state of a submitted job, guarded by the manager's mutex
+type job struct {
+	status      Status
+	fn          Func
+	ctx         context.Context
+	cancel      context.CancelFunc
+	result      interface{}
+	subscribers map[chan Event]struct{}
+	onFinish    func(Status)
+}
+
+// Manager runs jobs on a bounded pool of workers
+// Finished jobs and their results are kept for ttl and then forgotten.
+// A Manager is safe for concurrent use
+type Manager struct {
+	ttl   time.Duration
+	queue chan *job
+
+	mu     sync.Mutex
+	jobs   map[string]*job
+	closed bool
+
+	wg   sync.WaitGroup
+	stop chan struct{}
+}
+
+// NewManager starts workers goroutines serving a queue of up to queueSize waiting jobs
+func NewManager(workers, queueSize int, ttl time.Duration) *Manager {
+	m := &Manager{
+		ttl:   ttl,
+		queue: make(chan *job, max(queueSize, 0)),
+		jobs:  make(map[string]*job),
+		stop:  make(chan struct{}),
+	}
+	for i := 0; i < max(workers, 1); i++ {
+		m.wg.Add(1)
+		go m.work()
+	}
+	go m.expire()
+	return m
+}
+
+// Submit queues fn and returns the status of the new job
+func (m *Manager) Submit(fn Func) (Status, error) {
+	return m.SubmitNotify("", fn, nil)
+}
+
+// SubmitNotify queues fn like Submit for owner, recorded in the job's status, and
+// calls onFinish with the final status of the job, whether it ran or was canceled
+// while queued. onFinish is not called when SubmitNotify fails. It runs with the
+// manager locked and must not use it
+func (m *Manager) SubmitNotify(owner string, fn Func, onFinish func(Status)) (Status, error) {
+	id, err := newID()
+	if err != nil {
+		return Status{}, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		status:      Status{ID: id, State: StateQueued, CreatedAt: time.Now().UTC(), Owner: owner},
+		fn:          fn,
+		ctx:         ctx,
+		cancel:      cancel,
+		subscribers: make(map[chan Event]struct{}),
+		onFinish:    onFinish,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		cancel()
+		return Status{}, ErrClosed
+	}
+	select {
+	case m.queue <- j:
+	default:
+		cancel()
+		return Status{}, ErrQueueFull
+	}
+	m.jobs[id] = j
+	return j.snapshot(), nil
+}
+
+// Get returns the status of a job
+func (m *Manager) Get(id string) (Status, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return Status{}, false
+	}
+	return j.snapshot(), true
+}
+
+// Result returns the status of a job and its result, which is nil unless the job succeeded
+func (m *Manager) Result(id string) (interface{}, Status, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return nil, Status{}, false
+	}
+	return j.result, j.snapshot(), true
+}
+
+// Subscribe returns a channel receiving the current status of a job and then every
+// progress update. The channel is closed once the job is finished, the final state
+// and result are then available from Result. Updates are dropped for subscribers
+// that fall behind. unsubscribe must be called when the caller stops receiving
+func (m *Manager) Subscribe(id string) (events <-chan Event, unsubscribe func(), ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return nil, nil, false
+	}
+
+	ch := make(chan Event, subscriberBuffer)
+	ch <- Event{Status: j.snapshot()}
+	if j.status.State.Finished() {
+		close(ch)
+		return ch, func() {}, true
+	}
+
+	j.subscribers[ch] = struct{}{}
+	unsubscribe = func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if _, ok := j.subscribers[ch]; ok {
+			delete(j.subscribers, ch)
+			close(ch)
+		}
+	}
+	return ch, unsubscribe, true
+}
+
+// Cancel stops a queued or running job, its status becomes canceled once it has stopped
+// Canceling a finished job discards it and its result
+func (m *Manager) Cancel(id string) (Status, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return Status{}, false
+	}
+
+	switch {
+	case j.status.State.Finished():
+		delete(m.jobs, id)
+	case j.status.State == StateQueued:
+		// The worker that dequeues it skips it
+		j.finish(StateCanceled, context.Canceled, m.ttl)
+	}
+	j.cancel()
+	return j.snapshot(), true
+}
+
+// Close cancels all jobs and waits for the workers to stop
+func (m *Manager) Close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	for _, j := range m.jobs {
+		j.cancel()
+	}
+	close(m.queue)
+	close(m.stop)
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// work runs queued jobs until the queue is closed
+func (m *Manager) work() {
+	defer m.wg.Done()
+	for j := range m.queue {
+		m.mu.Lock()
+		if j.status.State != StateQueued || j.ctx.Err() != nil {
+			if !j.status.State.Finished() {
+				j.finish(StateCanceled, j.ctx.Err(), m.ttl)
+			}
+			m.mu.Unlock()
+			continue
+		}
+		started := time.Now().UTC()
+		j.status.State, j.status.StartedAt = StateRunning, &started
+		m.mu.Unlock()
+
+		report := func(done, total int, data interface{}) {
+			m.mu.Lock()
+			j.status.Done, j.status.Total = done, total
+			j.publish(Event{Status: j.snapshot(), Data: data})
+			m.mu.Unlock()
+		}
+		result, err := j.fn(j.ctx, report)
+
+		m.mu.Lock()
+		switch {
+		case j.ctx.Err() != nil:
+			// Keep the job's own error, which may say how far it got
+			if err == nil {
+				err = j.ctx.Err()
+			}
+			j.finish(StateCanceled, err, m.ttl)
+		case err != nil:
+			j.finish(StateFailed, err, m.ttl)
+		default:
+			j.result = result
+			j.finish(StateSucceeded, nil, m.ttl)
+		}
+		j.cancel()
+		m.mu.Unlock()
+	}
+}
+
+// expire periodically forgets finished jobs whose results have expired
+func (m *Manager) expire() {
+	ticker := time.NewTicker(max(m.ttl/4, 100*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case now := <-ticker.C:
+			m.mu.Lock()
+			for id, j := range m.jobs {
+				if j.status.ExpiresAt != nil && now.After(*j.status.ExpiresAt) {
+					delete(m.jobs, id)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+// finish moves the job to a final state, the caller must hold the manager's mutex
+func (j *job) finish(state State, err error, ttl time.Duration) {
+	finished := time.Now().UTC()
+	expires := finished.Add(ttl)
+	j.status.State, j.status.FinishedAt, j.status.ExpiresAt = state, &finished, &expires
+	if err != nil {
+		j.status.Error = err.Error()
+	}
+
+	j.publish(Event{Status: j.snapshot()})
+	for ch := range j.subscribers {
+		close(ch)
+	}
+	j.subscribers = nil
+	if j.onFinish != nil {
+		j.onFinish(j.snapshot())
+	}
+}
+
+// publish sends an event to every subscriber that has room for it
+// The caller must hold the manager's mutex
+func (j *job) publish(event Event) {
+	for ch := range j.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// snapshot returns a copy of the job status with derived fields filled in
+// The caller must hold the manager's mutex
+func (j *job) snapshot() Status {
+	status := j.status
+	now := time.Now().UTC()
+	switch {
+	case status.State == StateSucceeded:
+		status.Progress = 1
+	case status.Total > 0:
+		status.Progress = float64(status.Done) / float64(status.Total)
+	}
+
+	started, finished := now, now
+	if status.StartedAt != nil {
+		started = *status.StartedAt
+	} else if status.FinishedAt != nil {
+		started = *status.FinishedAt
+	}
+	if status.FinishedAt != nil {
+		finished = *status.FinishedAt
+	}
+	status.QueuedFor = started.Sub(status.CreatedAt).Seconds()
+	if status.StartedAt != nil {
+		status.RanFor = finished.Sub(started).Seconds()
+	}
+	return status
+}
+
+// newID returns a random job ID
+func newID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
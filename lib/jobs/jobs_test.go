@@ -0,0 +1,231 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// noop is a job that does nothing
+func noop(ctx context.Context, report func(done, total int, data interface{})) (interface{}, error) {
+	return nil, nil
+}
+
+// waitFor polls the status of a job until it is finished
+func waitFor(t *testing.T, m *Manager, id string) Status {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		status, ok := m.Get(id)
+		if !ok {
+			t.Fatalf("Job %s disappeared", id)
+		}
+		if status.State.Finished() {
+			return status
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Job %s did not finish", id)
+	return Status{}
+}
+
+// TestManagerRunsJobs tests results, errors, progress and timings
+func TestManagerRunsJobs(t *testing.T) {
+	m := NewManager(2, 4, time.Minute)
+	defer m.Close()
+
+	ok, err := m.Submit(func(ctx context.Context, report func(done, total int, data interface{})) (interface{}, error) {
+		report(1, 2, nil)
+		report(2, 2, nil)
+		return "mosaic", nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to submit job: %v", err)
+	}
+	failing, _ := m.Submit(func(ctx context.Context, report func(done, total int, data interface{})) (interface{}, error) {
+		return nil, errors.New("no tiles")
+	})
+
+	status := waitFor(t, m, ok.ID)
+	result, _, _ := m.Result(ok.ID)
+	if status.State != StateSucceeded || result != "mosaic" || status.Progress != 1 || status.Done != 2 {
+		t.Errorf("Expected a succeeded job with its result, got %+v and %v", status, result)
+	}
+	if status.StartedAt == nil || status.FinishedAt == nil || status.ExpiresAt == nil || status.RanFor < 0 {
+		t.Errorf("Expected timings to be set, got %+v", status)
+	}
+
+	status = waitFor(t, m, failing.ID)
+	if status.State != StateFailed || status.Error != "no tiles" {
+		t.Errorf("Expected a failed job, got %+v", status)
+	}
+	if _, ok := m.Get("missing"); ok {
+		t.Error("Expected an unknown job not to be found")
+	}
+}
+
+// TestManagerCancel tests canceling running, queued and finished jobs
+func TestManagerCancel(t *testing.T) {
+	m := NewManager(1, 1, time.Minute)
+	defer m.Close()
+
+	started := make(chan struct{})
+	running, _ := m.Submit(func(ctx context.Context, report func(done, total int, data interface{})) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, fmt.Errorf("stopped halfway: %w", ctx.Err())
+	})
+	<-started
+	queued, _ := m.Submit(func(ctx context.Context, report func(done, total int, data interface{})) (interface{}, error) {
+		t.Error("Expected the canceled job not to run")
+		return nil, nil
+	})
+	if _, err := m.Submit(noop); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected the queue to be full, got %v", err)
+	}
+
+	if status, _ := m.Cancel(queued.ID); status.State != StateCanceled {
+		t.Errorf("Expected the queued job to be canceled at once, got %s", status.State)
+	}
+	m.Cancel(running.ID)
+	if status := waitFor(t, m, running.ID); status.State != StateCanceled || status.Error != "stopped halfway: context canceled" {
+		t.Errorf("Expected the running job to be canceled with its own error, got %s %q", status.State, status.Error)
+	}
+
+	// Canceling a finished job discards it
+	m.Cancel(running.ID)
+	if _, ok := m.Get(running.ID); ok {
+		t.Error("Expected the finished job to be discarded")
+	}
+}
+
+// TestManagerSubmitNotify tests that the final status of every job is reported once
+func TestManagerSubmitNotify(t *testing.T) {
+	m := NewManager(1, 1, time.Minute)
+	defer m.Close()
+
+	finished := make(chan Status, 3)
+	notify := func(status Status) { finished <- status }
+
+	started := make(chan struct{})
+	running, _ := m.SubmitNotify("", func(ctx context.Context, report func(done, total int, data interface{})) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, notify)
+	<-started
+	queued, _ := m.SubmitNotify("", noop, notify)
+	if _, err := m.SubmitNotify("", noop, notify); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Expected the queue to be full, got %v", err)
+	}
+
+	m.Cancel(queued.ID)
+	if status := <-finished; status.ID != queued.ID || status.State != StateCanceled {
+		t.Errorf("Expected the queued job to be reported canceled, got %+v", status)
+	}
+	m.Cancel(running.ID)
+	if status := <-finished; status.ID != running.ID || status.State != StateCanceled {
+		t.Errorf("Expected the running job to be reported canceled, got %+v", status)
+	}
+
+	succeeded, _ := m.SubmitNotify("alice", noop, notify)
+	if succeeded.Owner != "alice" {
+		t.Errorf("Expected the job to be owned by alice, got %q", succeeded.Owner)
+	}
+	if status := <-finished; status.ID != succeeded.ID || status.State != StateSucceeded || status.Owner != "alice" {
+		t.Errorf("Expected alice's job to be reported succeeded, got %+v", status)
+	}
+	select {
+	case status := <-finished:
+		t.Errorf("Expected one report per job, got another %+v", status)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestManagerExpiry tests that finished jobs are forgotten after their ttl
+func TestManagerExpiry(t *testing.T) {
+	m := NewManager(1, 1, 50*time.Millisecond)
+	defer m.Close()
+
+	status, _ := m.Submit(func(ctx context.Context, report func(done, total int, data interface{})) (interface{}, error) {
+		return "mosaic", nil
+	})
+	waitFor(t, m, status.ID)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := m.Get(status.ID); !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected the finished job to expire")
+}
+
+// TestManagerClose tests that closing cancels jobs and rejects new ones
+func TestManagerClose(t *testing.T) {
+	m := NewManager(1, 1, time.Minute)
+	started := make(chan struct{})
+	status, _ := m.Submit(func(ctx context.Context, report func(done, total int, data interface{})) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	<-started
+	m.Close()
+
+	if status, _ := m.Get(status.ID); status.State != StateCanceled {
+		t.Errorf("Expected the running job to be canceled, got %s", status.State)
+	}
+	if _, err := m.Submit(noop); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+// TestManagerSubscribe tests that subscribers receive progress updates until the job finishes
+func TestManagerSubscribe(t *testing.T) {
+	m := NewManager(1, 1, time.Minute)
+	defer m.Close()
+
+	proceed := make(chan struct{})
+	status, _ := m.Submit(func(ctx context.Context, report func(done, total int, data interface{})) (interface{}, error) {
+		<-proceed
+		report(1, 2, "first row")
+		report(2, 2, "second row")
+		return "mosaic", nil
+	})
+	events, unsubscribe, ok := m.Subscribe(status.ID)
+	if !ok {
+		t.Fatal("Expected to subscribe to the job")
+	}
+	defer unsubscribe()
+	close(proceed)
+
+	var received []Event
+	for event := range events {
+		received = append(received, event)
+	}
+	if len(received) != 4 {
+		t.Fatalf("Expected the current status, 2 updates and the final status, got %+v", received)
+	}
+	if received[1].Data != "first row" || received[2].Status.Done != 2 {
+		t.Errorf("Unexpected updates: %+v", received[1:3])
+	}
+	if received[3].Status.State != StateSucceeded {
+		t.Errorf("Expected the last event to be the final status, got %+v", received[3])
+	}
+
+	// Subscribing to a finished job yields its final status only
+	events, _, _ = m.Subscribe(status.ID)
+	if event := <-events; event.Status.State != StateSucceeded {
+		t.Errorf("Expected the final status, got %+v", event)
+	}
+	if _, open := <-events; open {
+		t.Error("Expected the channel of a finished job to be closed")
+	}
+	if _, _, ok := m.Subscribe("missing"); ok {
+		t.Error("Expected an unknown job not to be found")
+	}
+}
@@ -0,0 +1,162 @@
+package rate_limit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// bucket is the token bucket of one client
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter applies a token bucket rate limit to each client key
+// Every client starts with burst tokens, each request takes one and tokens
+// refill at rate per second. A Limiter is safe for concurrent use
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	pruneAt int
+	now     func() time.Time
+}
+
+// minPruneAt is the number of buckets above which idle clients are forgotten
+const minPruneAt = 1024
+
+// New creates a limiter allowing rate requests per second with bursts of burst requests
+// A rate of zero or less disables the limit, every request is then allowed
+func New(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		pruneAt: minPruneAt,
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of key
+// When the bucket is empty it returns false and how long until a token is available
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		l.prune(now)
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Peek reports whether Allow would let a request of key through, without taking a token,
+// and otherwise how long until a token is available
+func (l *Limiter) Peek(key string) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		return true, 0
+	}
+	tokens := math.Min(l.burst, b.tokens+l.now().Sub(b.last).Seconds()*l.rate)
+	if tokens < 1 {
+		return false, time.Duration((1 - tokens) / l.rate * float64(time.Second))
+	}
+	return true, 0
+}
+
+// prune forgets the clients whose bucket has refilled, they are
+// indistinguishable from new clients. The caller must hold the lock
+func (l *Limiter) prune(now time.Time) {
+	if len(l.buckets) < l.pruneAt {
+		return
+	}
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.pruneAt = len(l.buckets) * 2
+	if l.pruneAt < minPruneAt {
+		l.pruneAt = minPruneAt
+	}
+}
+
+// Semaphore caps the number of operations running at the same time
+type Semaphore struct {
+	slots chan struct{}
+}
+
+// NewSemaphore creates a semaphore allowing n concurrent holders
+// A limit of zero or less never blocks
+func NewSemaphore(n int) *Semaphore {
+	if n <= 0 {
+		return &Semaphore{}
+	}
+	return &Semaphore{slots: make(chan struct{}, n)}
+}
+
+// TryAcquire takes a slot if one is free and reports whether it did
+func (s *Semaphore) TryAcquire() bool {
+	if s.slots == nil {
+		return true
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Acquire waits for a free slot until ctx is done
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	if s.slots == nil {
+		return nil
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot taken by TryAcquire or Acquire
+func (s *Semaphore) Release() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// InUse returns the number of slots currently taken
+func (s *Semaphore) InUse() int {
+	return len(s.slots)
+}
@@ -0,0 +1,121 @@
+package rate_limit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestLimiterBurstAndRefill tests that a client gets its burst and then one request per refill
+func TestLimiterBurstAndRefill(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := New(2, 3)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("Request %d of the burst was rejected", i)
+		}
+	}
+	ok, wait := limiter.Allow("a")
+	if ok {
+		t.Fatal("Request past the burst was allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("Expected a 500ms wait, got %v", wait)
+	}
+
+	// Other clients have their own bucket
+	if ok, _ := limiter.Allow("b"); !ok {
+		t.Error("Another client was rejected")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := limiter.Allow("a"); !ok {
+		t.Error("Request after the refill was rejected")
+	}
+	if ok, _ := limiter.Allow("a"); ok {
+		t.Error("Refill gave more than one token")
+	}
+}
+
+// TestLimiterPeek tests that peeking reports the state of a bucket without taking tokens
+func TestLimiterPeek(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := New(2, 1)
+	limiter.now = func() time.Time { return now }
+
+	if ok, _ := limiter.Peek("a"); !ok {
+		t.Fatal("Expected an unknown client to be allowed")
+	}
+	if ok, _ := limiter.Allow("a"); !ok {
+		t.Fatal("Expected the peek not to take the only token")
+	}
+	ok, wait := limiter.Peek("a")
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("Expected an empty bucket refilling in 500ms, got %t and %v", ok, wait)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := limiter.Peek("a"); !ok {
+		t.Error("Expected the refilled bucket to allow a request")
+	}
+}
+
+// TestLimiterDisabled tests that a zero rate allows everything
+func TestLimiterDisabled(t *testing.T) {
+	limiter := New(0, 1)
+	for i := 0; i < 100; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatal("Disabled limiter rejected a request")
+		}
+	}
+}
+
+// TestLimiterPrune tests that idle clients are forgotten once there are many
+func TestLimiterPrune(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := New(1, 1)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < minPruneAt; i++ {
+		limiter.Allow(time.Duration(i).String())
+	}
+	now = now.Add(time.Second)
+	limiter.Allow("new")
+	if len(limiter.buckets) != 1 {
+		t.Errorf("Expected idle buckets to be pruned, %d left", len(limiter.buckets))
+	}
+}
+
+// TestSemaphore tests slot accounting and waiting for a slot
+func TestSemaphore(t *testing.T) {
+	sem := NewSemaphore(1)
+	if !sem.TryAcquire() {
+		t.Fatal("Free slot was not acquired")
+	}
+	if sem.TryAcquire() {
+		t.Fatal("Acquired more slots than the limit")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := sem.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected the wait to time out, got %v", err)
+	}
+
+	sem.Release()
+	if err := sem.Acquire(context.Background()); err != nil {
+		t.Errorf("Released slot was not acquired: %v", err)
+	}
+	if sem.InUse() != 1 {
+		t.Errorf("Expected 1 slot in use, got %d", sem.InUse())
+	}
+
+	unlimited := NewSemaphore(0)
+	for i := 0; i < 10; i++ {
+		if !unlimited.TryAcquire() {
+			t.Fatal("Unlimited semaphore rejected a holder")
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package result_cache
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// spillExt is the extension of the files results are spilled to
+const spillExt = ".result"
+
+// Stats reports cache usage counters
+type Stats struct {
+	Hits         int64  `json:"hits"`
+	Misses       int64  `json:"misses"`
+	Spills       int64  `json:"spills"`
+	Evictions    int64  `json:"evictions"`
+	Entries      int    `json:"entries"`
+	Bytes        int64  `json:"bytes"`
+	MaxBytes     int64  `json:"maxBytes"`
+	DiskEntries  int    `json:"diskEntries"`
+	DiskBytes    int64  `json:"diskBytes"`
+	MaxDiskBytes int64  `json:"maxDiskBytes"`
+	Version      uint64 `json:"version"`
+}
+
+// entry is a result in memory or on disk, in one of the two LRU lists
+type entry struct {
+	key   string
+	value []byte // Nil once spilled to disk
+	bytes int64
+}
+
+// Cache keeps rendered results in memory within a byte budget and spills the
+// least recently used ones to files in a directory within a second budget
+// Results belong to a version of their inputs, such as the tile set they were
+// rendered from: a Get or Put with another version drops every result first.
+// Keys must be safe to use as file names. A Cache is safe for concurrent use
+type Cache struct {
+	mu           sync.Mutex
+	maxBytes     int64
+	maxDiskBytes int64
+	dir          string
+	version      uint64
+
+	memory    *list.List
+	disk      *list.List
+	entries   map[string]*list.Element // Key to its element in memory or disk
+	bytes     int64
+	diskBytes int64
+
+	hits      int64
+	misses    int64
+	spills    int64
+	evictions int64
+}
+
+// New creates a cache holding at most maxBytes of results in memory and
+// maxDiskBytes in files under dir, which is emptied of earlier spills
+// A memory budget of zero or less disables caching, an empty dir or a disk
+// budget of zero or less disables spilling
+func New(maxBytes int64, dir string, maxDiskBytes int64) *Cache {
+	c := &Cache{
+		maxBytes:     maxBytes,
+		maxDiskBytes: maxDiskBytes,
+		dir:          dir,
+		memory:       list.New(),
+		disk:         list.New(),
+		entries:      make(map[string]*list.Element),
+	}
+	if dir == "" || maxDiskBytes <= 0 {
+		c.maxDiskBytes = 0
+		return c
+	}
+
+	// Spilled results are only valid for the version they were rendered at,
+	// which does not survive a restart
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logrus.WithError(err).WithField("dir", dir).Warn("Failed to create result cache directory, spilling disabled")
+		c.maxDiskBytes = 0
+		return c
+	}
+	c.removeSpills()
+	return c
+}
+
+// Get returns the result stored for key at version
+// A result found on disk moves back to memory
+func (c *Cache) Get(version uint64, key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setVersion(version)
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	e := elem.Value.(*entry)
+	if e.value != nil {
+		c.memory.MoveToFront(elem)
+		c.hits++
+		return e.value, true
+	}
+
+	value, err := os.ReadFile(c.spillPath(key))
+	c.removeDisk(elem)
+	if err != nil {
+		logrus.WithError(err).WithField("key", key).Warn("Failed to read spilled result")
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.add(key, value)
+	return value, true
+}
+
+// Put stores the result for key at version
+// The value is kept as is and must not be modified afterwards
+func (c *Cache) Put(version uint64, key string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setVersion(version)
+
+	if elem, ok := c.entries[key]; ok {
+		if elem.Value.(*entry).value != nil {
+			c.removeMemory(elem)
+		} else {
+			c.removeDisk(elem)
+		}
+	}
+	c.add(key, value)
+}
+
+// Invalidate drops every result if version is not the version of the cached results
+func (c *Cache) Invalidate(version uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setVersion(version)
+}
+
+// Stats returns the current cache counters
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Stats{
+		Hits:         c.hits,
+		Misses:       c.misses,
+		Spills:       c.spills,
+		Evictions:    c.evictions,
+		Entries:      c.memory.Len(),
+		Bytes:        c.bytes,
+		MaxBytes:     c.maxBytes,
+		DiskEntries:  c.disk.Len(),
+		DiskBytes:    c.diskBytes,
+		MaxDiskBytes: c.maxDiskBytes,
+		Version:      c.version,
+	}
+}
+
+// setVersion drops every result when version changes, the caller must hold the lock
+func (c *Cache) setVersion(version uint64) {
+	if version == c.version {
+		return
+	}
+	for c.memory.Len() > 0 {
+		c.removeMemory(c.memory.Back())
+	}
+	for c.disk.Len() > 0 {
+		c.removeDisk(c.disk.Back())
+	}
+	c.version = version
+}
+
+// add stores a value in memory and moves the least recently used values over
+// budget to disk, the caller must hold the lock
+func (c *Cache) add(key string, value []byte) {
+	size := int64(len(value))
+	if size > c.maxBytes {
+		return
+	}
+	c.entries[key] = c.memory.PushFront(&entry{key: key, value: value, bytes: size})
+	c.bytes += size
+
+	for c.bytes > c.maxBytes {
+		c.spill(c.memory.Back())
+	}
+}
+
+// spill moves a value from memory to disk, or drops it if it doesn't fit,
+// the caller must hold the lock
+func (c *Cache) spill(elem *list.Element) {
+	e := elem.Value.(*entry)
+	value := e.value
+	c.removeMemory(elem)
+	if e.bytes > c.maxDiskBytes {
+		c.evictions++
+		return
+	}
+	if err := os.WriteFile(c.spillPath(e.key), value, 0644); err != nil {
+		logrus.WithError(err).WithField("key", e.key).Warn("Failed to spill result")
+		c.evictions++
+		return
+	}
+
+	c.entries[e.key] = c.disk.PushFront(&entry{key: e.key, bytes: e.bytes})
+	c.diskBytes += e.bytes
+	c.spills++
+	for c.diskBytes > c.maxDiskBytes {
+		c.removeDisk(c.disk.Back())
+		c.evictions++
+	}
+}
+
+// removeMemory deletes a value held in memory, the caller must hold the lock
+func (c *Cache) removeMemory(elem *list.Element) {
+	e := c.memory.Remove(elem).(*entry)
+	delete(c.entries, e.key)
+	c.bytes -= e.bytes
+}
+
+// removeDisk deletes a value spilled to disk, the caller must hold the lock
+func (c *Cache) removeDisk(elem *list.Element) {
+	e := c.disk.Remove(elem).(*entry)
+	delete(c.entries, e.key)
+	c.diskBytes -= e.bytes
+	if err := os.Remove(c.spillPath(e.key)); err != nil && !os.IsNotExist(err) {
+		logrus.WithError(err).WithField("key", e.key).Warn("Failed to remove spilled result")
+	}
+}
+
+// removeSpills deletes the spill files left in the directory
+func (c *Cache) removeSpills() {
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		logrus.WithError(err).WithField("dir", c.dir).Warn("Failed to list result cache directory")
+		return
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), spillExt) {
+			os.Remove(filepath.Join(c.dir, file.Name()))
+		}
+	}
+}
+
+// spillPath returns the file a result is spilled to
+func (c *Cache) spillPath(key string) string {
+	return filepath.Join(c.dir, key+spillExt)
+}
@@ -0,0 +1,95 @@
+package result_cache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCacheGetPut tests storing and finding results in memory
+func TestCacheGetPut(t *testing.T) {
+	c := New(100, "", 0)
+	if _, ok := c.Get(1, "a"); ok {
+		t.Fatal("Expected a miss on an empty cache")
+	}
+	c.Put(1, "a", []byte("alpha"))
+	value, ok := c.Get(1, "a")
+	if !ok || string(value) != "alpha" {
+		t.Fatalf("Expected alpha, got %q %v", value, ok)
+	}
+
+	// Without a disk, results over budget are evicted
+	c.Put(1, "b", bytes.Repeat([]byte("b"), 60))
+	c.Put(1, "c", bytes.Repeat([]byte("c"), 60))
+	if _, ok := c.Get(1, "b"); ok {
+		t.Error("Expected the least recently used result to be evicted")
+	}
+	stats := c.Stats()
+	if stats.Hits != 1 || stats.Misses != 2 || stats.Evictions != 2 || stats.Entries != 1 || stats.Bytes != 60 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// Too large to ever fit
+	c.Put(1, "d", make([]byte, 101))
+	if _, ok := c.Get(1, "d"); ok {
+		t.Error("Expected a result over the budget not to be cached")
+	}
+}
+
+// TestCacheSpill tests moving results over the memory budget to disk and back
+func TestCacheSpill(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "stale"+spillExt)
+	if err := os.WriteFile(stale, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(100, dir, 150)
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("Expected spills of an earlier run to be removed")
+	}
+
+	c.Put(1, "a", bytes.Repeat([]byte("a"), 60))
+	c.Put(1, "b", bytes.Repeat([]byte("b"), 60))
+	if _, err := os.Stat(filepath.Join(dir, "a"+spillExt)); err != nil {
+		t.Fatalf("Expected a to be spilled: %v", err)
+	}
+	c.Put(1, "c", bytes.Repeat([]byte("c"), 60))
+	c.Put(1, "d", bytes.Repeat([]byte("d"), 60))
+	stats := c.Stats()
+	if stats.Spills != 3 || stats.DiskEntries != 2 || stats.DiskBytes != 120 || stats.Evictions != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if _, ok := c.Get(1, "a"); ok {
+		t.Error("Expected the oldest spill to be evicted over the disk budget")
+	}
+
+	value, ok := c.Get(1, "b")
+	if !ok || !bytes.Equal(value, bytes.Repeat([]byte("b"), 60)) {
+		t.Fatalf("Expected b back from disk, got %d bytes %v", len(value), ok)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b"+spillExt)); !os.IsNotExist(err) {
+		t.Error("Expected b to move back to memory")
+	}
+}
+
+// TestCacheVersion tests that a new version drops every result
+func TestCacheVersion(t *testing.T) {
+	dir := t.TempDir()
+	c := New(100, dir, 1000)
+	c.Put(1, "a", bytes.Repeat([]byte("a"), 60))
+	c.Put(1, "b", bytes.Repeat([]byte("b"), 60))
+
+	c.Invalidate(1)
+	if _, ok := c.Get(1, "b"); !ok {
+		t.Fatal("Expected the same version to keep results")
+	}
+	if _, ok := c.Get(2, "b"); ok {
+		t.Error("Expected a new version to drop results")
+	}
+	files, _ := os.ReadDir(dir)
+	if stats := c.Stats(); stats.Entries != 0 || stats.DiskEntries != 0 || len(files) != 0 || stats.Version != 2 {
+		t.Errorf("Expected an empty cache at version 2, got %+v and %d files", stats, len(files))
+	}
+}
@@ -0,0 +1,309 @@
+package slicer
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	imgpkg "wilbertopachecob/mosaic/lib/img"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Crop placement modes
+const (
+	ModeGrid   = "grid"
+	ModeRandom = "random"
+)
+
+// maxCount bounds the number of random crops cut from one source
+const maxCount = 4096
+
+// ErrTooManyCrops is returned when the sources of a run would yield more than MaxCrops crops
+var ErrTooManyCrops = errors.New("too many crops")
+
+// Options configures how source images are cut into tiles
+type Options struct {
+	Size    int    // Side of the square crops in pixels
+	Overlap int    // Pixels shared by neighbouring grid crops
+	Mode    string // ModeGrid or ModeRandom
+	Count   int    // Crops per source image in random mode
+	Seed    int64  // Seed of the random crop positions
+
+	// Crops whose luminance standard deviation is below MinStdDev are near-uniform,
+	// crops whose Laplacian variance is below MinSharpness are blurry. Zero disables a check
+	MinStdDev    float64
+	MinSharpness float64
+
+	// MaxPixels is the most pixels a source may declare before it is decoded, zero for no limit
+	MaxPixels int64
+
+	// MaxCrops is the most crops a run may cut from all its sources together, zero for no limit
+	MaxCrops int
+}
+
+// DefaultOptions returns the options used when none are given
+func DefaultOptions() Options {
+	return Options{
+		Size:         64,
+		Mode:         ModeGrid,
+		Count:        50,
+		Seed:         1,
+		MinStdDev:    4,
+		MinSharpness: 10,
+		MaxPixels:    40 * 1000 * 1000,
+		MaxCrops:     10000,
+	}
+}
+
+// Validate checks that the options are usable
+func (o Options) Validate() error {
+	switch {
+	case o.Size < 4:
+		return fmt.Errorf("size must be at least 4 pixels")
+	case o.Overlap < 0 || o.Overlap > o.Size-o.Size/2:
+		// Grid crops advance by at least half their size
+		return fmt.Errorf("overlap must be between 0 and %d", o.Size-o.Size/2)
+	case o.Mode != ModeGrid && o.Mode != ModeRandom:
+		return fmt.Errorf("mode must be %q or %q", ModeGrid, ModeRandom)
+	case o.Mode == ModeRandom && (o.Count < 1 || o.Count > maxCount):
+		return fmt.Errorf("count must be between 1 and %d in random mode", maxCount)
+	}
+	return nil
+}
+
+// Crop is a square region cut from a source image
+type Crop struct {
+	Rect  image.Rectangle
+	Image *image.NRGBA
+}
+
+// Result summarises a slicing run
+type Result struct {
+	Sources   int      `json:"sources"`
+	Written   []string `json:"written"`
+	Uniform   int      `json:"discardedUniform"`
+	Blurry    int      `json:"discardedBlurry"`
+	Errors    []string `json:"errors"`
+	OutputDir string   `json:"outputDir"`
+}
+
+// Slice cuts img into crops according to opts, discarding uniform and blurry ones
+// It returns the kept crops and the number of uniform and blurry crops dropped
+func Slice(img image.Image, opts Options, rng *rand.Rand) (kept []Crop, uniform, blurry int) {
+	for _, rect := range cropRects(img.Bounds(), opts, rng) {
+		crop := image.NewNRGBA(image.Rect(0, 0, opts.Size, opts.Size))
+		draw.Draw(crop, crop.Bounds(), img, rect.Min, draw.Src)
+
+		lum := luminance(crop)
+		switch {
+		case opts.MinStdDev > 0 && stdDev(lum) < opts.MinStdDev:
+			uniform++
+		case opts.MinSharpness > 0 && laplacianVariance(lum, opts.Size) < opts.MinSharpness:
+			blurry++
+		default:
+			kept = append(kept, Crop{Rect: rect, Image: crop})
+		}
+	}
+	return kept, uniform, blurry
+}
+
+// SliceFiles cuts every source image into outDir as JPEG tiles
+// Sources that fail to decode are reported in the result and skipped. When the
+// sources would yield more than opts.MaxCrops crops nothing is written and an
+// error wrapping ErrTooManyCrops is returned
+func SliceFiles(sources []string, outDir string, opts Options) (*Result, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if total := CountCrops(sources, opts); opts.MaxCrops > 0 && total > opts.MaxCrops {
+		return nil, fmt.Errorf("%w: sources yield %d crops, at most %d allowed", ErrTooManyCrops, total, opts.MaxCrops)
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	result := &Result{Written: []string{}, Errors: []string{}, OutputDir: outDir}
+	rng := rand.New(rand.NewSource(opts.Seed))
+
+	for _, source := range sources {
+		img, err := decodeFile(source, opts.MaxPixels)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", source, err))
+			continue
+		}
+		result.Sources++
+
+		crops, uniform, blurry := Slice(img, opts, rng)
+		result.Uniform += uniform
+		result.Blurry += blurry
+
+		prefix := strings.TrimSuffix(filepath.Base(source), filepath.Ext(source))
+		for _, crop := range crops {
+			name := fmt.Sprintf("%s_x%d_y%d.jpg", prefix, crop.Rect.Min.X, crop.Rect.Min.Y)
+			path := filepath.Join(outDir, name)
+			if err := writeJPEG(path, crop.Image); err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", name, err))
+				continue
+			}
+			result.Written = append(result.Written, path)
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"sources": result.Sources,
+		"written": len(result.Written),
+		"uniform": result.Uniform,
+		"blurry":  result.Blurry,
+		"output":  outDir,
+	}).Info("Sliced source images into tiles")
+
+	return result, nil
+}
+
+// CountCrops returns the number of crops the sources yield before any are discarded
+// Only the dimensions declared by each source are read; sources that can't be
+// read or exceed opts.MaxPixels count as none
+func CountCrops(sources []string, opts Options) int {
+	total := 0
+	for _, source := range sources {
+		file, err := os.Open(source)
+		if err != nil {
+			continue
+		}
+		config, _, err := imgpkg.CheckPixels(file, opts.MaxPixels)
+		file.Close()
+		if err == nil {
+			total += cropCount(config.Width, config.Height, opts)
+		}
+	}
+	return total
+}
+
+// cropCount returns the number of crops cropRects places on a width by height source
+func cropCount(width, height int, opts Options) int {
+	if width < opts.Size || height < opts.Size {
+		return 0
+	}
+	if opts.Mode == ModeRandom {
+		return opts.Count
+	}
+	step := opts.Size - opts.Overlap
+	return ((width-opts.Size)/step + 1) * ((height-opts.Size)/step + 1)
+}
+
+// cropRects returns the crop rectangles for a source image of the given bounds
+func cropRects(bounds image.Rectangle, opts Options, rng *rand.Rand) []image.Rectangle {
+	if bounds.Dx() < opts.Size || bounds.Dy() < opts.Size {
+		return nil
+	}
+
+	var rects []image.Rectangle
+	if opts.Mode == ModeRandom {
+		for i := 0; i < opts.Count; i++ {
+			x := bounds.Min.X + rng.Intn(bounds.Dx()-opts.Size+1)
+			y := bounds.Min.Y + rng.Intn(bounds.Dy()-opts.Size+1)
+			rects = append(rects, image.Rect(x, y, x+opts.Size, y+opts.Size))
+		}
+		return rects
+	}
+
+	step := opts.Size - opts.Overlap
+	for y := bounds.Min.Y; y+opts.Size <= bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x+opts.Size <= bounds.Max.X; x += step {
+			rects = append(rects, image.Rect(x, y, x+opts.Size, y+opts.Size))
+		}
+	}
+	return rects
+}
+
+// luminance returns the 8-bit luminance of every pixel of a crop, row by row
+func luminance(img *image.NRGBA) []float64 {
+	bounds := img.Bounds()
+	lum := make([]float64, 0, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.NRGBAAt(x, y)
+			lum = append(lum, 0.299*float64(c.R)+0.587*float64(c.G)+0.114*float64(c.B))
+		}
+	}
+	return lum
+}
+
+// stdDev returns the standard deviation of values
+func stdDev(values []float64) float64 {
+	return math.Sqrt(variance(values))
+}
+
+// variance returns the population variance of values
+func variance(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	mean := 0.0
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+
+	sum := 0.0
+	for _, v := range values {
+		sum += (v - mean) * (v - mean)
+	}
+	return sum / float64(len(values))
+}
+
+// laplacianVariance measures sharpness as the variance of the 4-neighbour Laplacian
+func laplacianVariance(lum []float64, size int) float64 {
+	if size < 3 {
+		return 0
+	}
+	responses := make([]float64, 0, (size-2)*(size-2))
+	for y := 1; y < size-1; y++ {
+		for x := 1; x < size-1; x++ {
+			i := y*size + x
+			responses = append(responses, lum[i-size]+lum[i+size]+lum[i-1]+lum[i+1]-4*lum[i])
+		}
+	}
+	return variance(responses)
+}
+
+// decodeFile opens and decodes an image file of at most maxPixels pixels
+func decodeFile(path string, maxPixels int64) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	if _, _, err := imgpkg.CheckPixels(file, maxPixels); err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return img, nil
+}
+
+// writeJPEG encodes img to a new file at path
+func writeJPEG(path string, img image.Image) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create tile file: %w", err)
+	}
+	if err := jpeg.Encode(file, img, &jpeg.Options{Quality: 90}); err != nil {
+		file.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to encode tile: %w", err)
+	}
+	return file.Close()
+}
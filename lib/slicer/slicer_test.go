@@ -0,0 +1,173 @@
+package slicer
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// checkerImage creates a sharp, high-contrast image
+func checkerImage(width, height, square int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if (x/square+y/square)%2 == 0 {
+				img.Set(x, y, color.White)
+			} else {
+				img.Set(x, y, color.NRGBA{200, 30, 30, 255})
+			}
+		}
+	}
+	return img
+}
+
+// TestCropRects tests grid and random crop placement
+func TestCropRects(t *testing.T) {
+	bounds := image.Rect(0, 0, 100, 60)
+	rng := rand.New(rand.NewSource(1))
+
+	grid := cropRects(bounds, Options{Size: 20, Mode: ModeGrid}, rng)
+	if len(grid) != 5*3 {
+		t.Errorf("Expected 15 grid crops, got %d", len(grid))
+	}
+
+	overlapping := cropRects(bounds, Options{Size: 20, Overlap: 10, Mode: ModeGrid}, rng)
+	if len(overlapping) != 9*5 {
+		t.Errorf("Expected 45 overlapping crops, got %d", len(overlapping))
+	}
+
+	random := cropRects(bounds, Options{Size: 20, Mode: ModeRandom, Count: 7}, rng)
+	if len(random) != 7 {
+		t.Errorf("Expected 7 random crops, got %d", len(random))
+	}
+	for _, r := range random {
+		if !r.In(bounds) {
+			t.Errorf("Random crop %v is outside %v", r, bounds)
+		}
+	}
+
+	if rects := cropRects(image.Rect(0, 0, 10, 10), Options{Size: 20, Mode: ModeGrid}, rng); len(rects) != 0 {
+		t.Errorf("Expected no crops from a source smaller than the crop size, got %d", len(rects))
+	}
+}
+
+// TestSliceDiscardsUniformAndBlurryCrops tests the quality filters
+func TestSliceDiscardsUniformAndBlurryCrops(t *testing.T) {
+	// Left crop is a sharp checkerboard, middle is flat gray, right is a smooth gradient
+	img := image.NewNRGBA(image.Rect(0, 0, 96, 32))
+	draw.Draw(img, image.Rect(0, 0, 32, 32), checkerImage(32, 32, 4), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(32, 0, 64, 32), &image.Uniform{color.Gray{128}}, image.Point{}, draw.Src)
+	for y := 0; y < 32; y++ {
+		for x := 64; x < 96; x++ {
+			img.Set(x, y, color.Gray{uint8((x - 64) * 4)})
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.Size = 32
+	kept, uniform, blurry := Slice(img, opts, rand.New(rand.NewSource(1)))
+
+	if len(kept) != 1 || kept[0].Rect.Min.X != 0 {
+		t.Errorf("Expected only the checkerboard crop to be kept, got %d crops", len(kept))
+	}
+	if uniform != 1 || blurry != 1 {
+		t.Errorf("Expected 1 uniform and 1 blurry crop, got %d and %d", uniform, blurry)
+	}
+}
+
+// TestSliceFiles tests writing crops of source files into a directory
+func TestSliceFiles(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "panorama.png")
+	file, err := os.Create(source)
+	if err != nil {
+		t.Fatalf("Failed to create source: %v", err)
+	}
+	png.Encode(file, checkerImage(64, 32, 4))
+	file.Close()
+
+	opts := DefaultOptions()
+	opts.Size = 32
+	outDir := filepath.Join(dir, "out")
+	result, err := SliceFiles([]string{source, filepath.Join(dir, "missing.png")}, outDir, opts)
+	if err != nil {
+		t.Fatalf("SliceFiles failed: %v", err)
+	}
+
+	if result.Sources != 1 || len(result.Written) != 2 || len(result.Errors) != 1 {
+		t.Errorf("Unexpected result %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "panorama_x32_y0.jpg")); err != nil {
+		t.Errorf("Expected crop file to exist: %v", err)
+	}
+
+	// Sources declaring more pixels than allowed fail before they are decoded
+	opts.MaxPixels = 64*32 - 1
+	result, err = SliceFiles([]string{source}, filepath.Join(dir, "limited"), opts)
+	if err != nil {
+		t.Fatalf("SliceFiles failed: %v", err)
+	}
+	if result.Sources != 0 || len(result.Errors) != 1 || !strings.Contains(result.Errors[0], "too large") {
+		t.Errorf("Expected the source to exceed the pixel limit, got %+v", result)
+	}
+
+	if _, err := SliceFiles(nil, outDir, Options{Size: 32, Overlap: 32, Mode: ModeGrid}); err == nil {
+		t.Error("Expected invalid options to be rejected")
+	}
+
+	// Runs yielding more crops than allowed are rejected before anything is written
+	opts = DefaultOptions()
+	opts.Size = 8
+	opts.MaxCrops = 31
+	limited := filepath.Join(dir, "too-many")
+	if _, err := SliceFiles([]string{source}, limited, opts); !errors.Is(err, ErrTooManyCrops) {
+		t.Errorf("Expected ErrTooManyCrops for 32 crops, got %v", err)
+	}
+	if _, err := os.Stat(limited); !os.IsNotExist(err) {
+		t.Error("Expected no output directory for a rejected run")
+	}
+}
+
+// TestOptionsValidate tests the bounds on overlap and random crop counts
+func TestOptionsValidate(t *testing.T) {
+	cases := []struct {
+		opts  Options
+		valid bool
+	}{
+		{Options{Size: 32, Overlap: 16, Mode: ModeGrid}, true},
+		{Options{Size: 32, Overlap: 17, Mode: ModeGrid}, false},
+		{Options{Size: 33, Overlap: 17, Mode: ModeGrid}, true},
+		{Options{Size: 32, Overlap: 31, Mode: ModeGrid}, false},
+		{Options{Size: 32, Mode: ModeRandom, Count: maxCount}, true},
+		{Options{Size: 32, Mode: ModeRandom, Count: maxCount + 1}, false},
+		{Options{Size: 32, Mode: ModeRandom}, false},
+	}
+	for _, c := range cases {
+		if err := c.opts.Validate(); (err == nil) != c.valid {
+			t.Errorf("Expected %+v valid=%v, got %v", c.opts, c.valid, err)
+		}
+	}
+}
+
+// TestCountCrops tests that counted crops match the placed ones
+func TestCountCrops(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, opts := range []Options{
+		{Size: 20, Mode: ModeGrid},
+		{Size: 20, Overlap: 10, Mode: ModeGrid},
+		{Size: 7, Overlap: 3, Mode: ModeGrid},
+		{Size: 20, Mode: ModeRandom, Count: 7},
+		{Size: 200, Mode: ModeGrid},
+	} {
+		if got, want := cropCount(100, 60, opts), len(cropRects(image.Rect(0, 0, 100, 60), opts, rng)); got != want {
+			t.Errorf("Expected %d crops for %+v, counted %d", want, opts, got)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package synth
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	imgpkg "wilbertopachecob/mosaic/lib/img"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Tile styles
+const (
+	StyleSolid    = "solid"
+	StyleGradient = "gradient"
+	StyleNoise    = "noise"
+	StylePattern  = "pattern"
+)
+
+// Color sampling modes
+const (
+	SamplingRGB     = "rgb"
+	SamplingLab     = "lab"
+	SamplingPalette = "palette"
+)
+
+// maxCount bounds the number of tiles generated in one run
+const maxCount = 4096
+
+// Options configures a synthetic tile set
+type Options struct {
+	Size     int           // Side of the square tiles in pixels
+	Count    int           // Number of tiles, defaults to the palette size in palette mode
+	Style    string        // StyleSolid, StyleGradient, StyleNoise or StylePattern
+	Sampling string        // SamplingRGB, SamplingLab or SamplingPalette
+	Palette  []color.NRGBA // Colors used in palette mode
+	Seed     int64         // Seed of the noise textures
+}
+
+// DefaultOptions returns the options used when none are given
+func DefaultOptions() Options {
+	return Options{
+		Size:     32,
+		Count:    64,
+		Style:    StyleSolid,
+		Sampling: SamplingRGB,
+		Seed:     1,
+	}
+}
+
+// Validate checks that the options are usable
+func (o Options) Validate() error {
+	switch {
+	case o.Size < 2 || o.Size > 512:
+		return fmt.Errorf("size must be between 2 and 512 pixels")
+	case o.Count < 0 || o.Count > maxCount:
+		return fmt.Errorf("count must be between 1 and %d", maxCount)
+	case o.Count == 0 && o.Sampling != SamplingPalette:
+		return fmt.Errorf("count must be between 1 and %d", maxCount)
+	case o.Style != StyleSolid && o.Style != StyleGradient && o.Style != StyleNoise && o.Style != StylePattern:
+		return fmt.Errorf("style must be %q, %q, %q or %q", StyleSolid, StyleGradient, StyleNoise, StylePattern)
+	case o.Sampling != SamplingRGB && o.Sampling != SamplingLab && o.Sampling != SamplingPalette:
+		return fmt.Errorf("sampling must be %q, %q or %q", SamplingRGB, SamplingLab, SamplingPalette)
+	case o.Sampling == SamplingPalette && len(o.Palette) == 0:
+		return fmt.Errorf("palette sampling requires at least one palette color")
+	}
+	return nil
+}
+
+// Result summarises a generation run
+type Result struct {
+	Written   []string `json:"written"`
+	OutputDir string   `json:"outputDir"`
+}
+
+// Generate writes a synthetic tile set into outDir as PNG files
+// The output only depends on opts, so the same options always produce the same files
+func Generate(outDir string, opts Options) (*Result, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	rng := rand.New(rand.NewSource(opts.Seed))
+	result := &Result{Written: []string{}, OutputDir: outDir}
+	for i, c := range SampleColors(opts) {
+		tile := Render(c, i, opts, rng)
+		name := fmt.Sprintf("synth_%04d_%02x%02x%02x.png", i, c.R, c.G, c.B)
+		path := filepath.Join(outDir, name)
+		if err := writePNG(path, tile); err != nil {
+			return result, err
+		}
+		result.Written = append(result.Written, path)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"written":  len(result.Written),
+		"style":    opts.Style,
+		"sampling": opts.Sampling,
+		"output":   outDir,
+	}).Info("Generated synthetic tiles")
+
+	return result, nil
+}
+
+// SampleColors returns the base colors of the tiles, spread evenly over the sampled color space
+func SampleColors(opts Options) []color.NRGBA {
+	switch opts.Sampling {
+	case SamplingLab:
+		return sampleLab(opts.Count)
+	case SamplingPalette:
+		count := opts.Count
+		if count == 0 {
+			count = len(opts.Palette)
+		}
+		colors := make([]color.NRGBA, count)
+		for i := range colors {
+			colors[i] = opts.Palette[i%len(opts.Palette)]
+		}
+		return colors
+	default:
+		return sampleRGB(opts.Count)
+	}
+}
+
+// sampleRGB picks count colors from the smallest uniform RGB grid holding at least count points
+func sampleRGB(count int) []color.NRGBA {
+	levels := 1
+	for levels*levels*levels < count {
+		levels++
+	}
+
+	grid := make([]color.NRGBA, 0, levels*levels*levels)
+	for r := 0; r < levels; r++ {
+		for g := 0; g < levels; g++ {
+			for b := 0; b < levels; b++ {
+				grid = append(grid, color.NRGBA{gridLevel(r, levels), gridLevel(g, levels), gridLevel(b, levels), 255})
+			}
+		}
+	}
+	return spread(grid, count)
+}
+
+// sampleLab picks count colors from a grid that is uniform in Lab, keeping only sRGB colors
+// Lab is perceptually uniform, so the tiles are spread evenly as the eye sees them.
+// Odd level counts keep the neutral axis (a = b = 0) on the grid, from black to white
+func sampleLab(count int) []color.NRGBA {
+	for levels := 3; ; levels += 2 {
+		var grid []color.NRGBA
+		seen := make(map[color.NRGBA]bool)
+		for l := 0; l < levels; l++ {
+			for a := 0; a < levels; a++ {
+				for b := 0; b < levels; b++ {
+					lab := [3]float64{
+						100 * float64(l) / float64(levels-1),
+						-127 + 254*float64(a)/float64(levels-1),
+						-127 + 254*float64(b)/float64(levels-1),
+					}
+					rgb, inGamut := imgpkg.LabToRGB(lab)
+					c := color.NRGBA{uint8(rgb[0]), uint8(rgb[1]), uint8(rgb[2]), 255}
+					if inGamut && !seen[c] {
+						seen[c] = true
+						grid = append(grid, c)
+					}
+				}
+			}
+		}
+		if len(grid) >= count {
+			return spread(grid, count)
+		}
+	}
+}
+
+// gridLevel returns the 8-bit value of level i out of levels evenly spaced levels
+func gridLevel(i, levels int) uint8 {
+	if levels == 1 {
+		return 128
+	}
+	return uint8(math.Round(255 * float64(i) / float64(levels-1)))
+}
+
+// spread picks count evenly spaced elements of grid
+func spread(grid []color.NRGBA, count int) []color.NRGBA {
+	colors := make([]color.NRGBA, count)
+	for i := range colors {
+		colors[i] = grid[i*len(grid)/count]
+	}
+	return colors
+}
+
+// Render draws one tile of the configured style around base color c
+// Every style keeps the average color of the tile close to c. The index selects
+// the pattern variant and rng provides the noise
+func Render(c color.NRGBA, index int, opts Options, rng *rand.Rand) *image.NRGBA {
+	size := opts.Size
+	tile := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			var delta float64
+			switch opts.Style {
+			case StyleGradient:
+				// Diagonal ramp from darker to lighter than the base color
+				delta = 48 * (float64(x+y)/float64(2*size-2) - 0.5)
+			case StyleNoise:
+				delta = float64(rng.Intn(49) - 24)
+			case StylePattern:
+				if patternOn(index%3, x, y, size) {
+					delta = 24
+				} else {
+					delta = -24
+				}
+			}
+			tile.SetNRGBA(x, y, shade(c, delta))
+		}
+	}
+	return tile
+}
+
+// patternOn reports whether a pixel is lit in pattern variant 0 (stripes), 1 (checker) or 2 (diagonals)
+func patternOn(variant, x, y, size int) bool {
+	cell := size / 4
+	if cell < 1 {
+		cell = 1
+	}
+	switch variant {
+	case 0:
+		return (y/cell)%2 == 0
+	case 1:
+		return (x/cell+y/cell)%2 == 0
+	default:
+		return ((x+y)/cell)%2 == 0
+	}
+}
+
+// shade adds delta to every channel of c, clamping to the 8-bit range
+func shade(c color.NRGBA, delta float64) color.NRGBA {
+	channel := func(v uint8) uint8 {
+		return uint8(math.Max(0, math.Min(255, math.Round(float64(v)+delta))))
+	}
+	return color.NRGBA{channel(c.R), channel(c.G), channel(c.B), 255}
+}
+
+// ParsePalette parses a comma separated list of #rrggbb colors
+func ParsePalette(s string) ([]color.NRGBA, error) {
+	var palette []color.NRGBA
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		hex := strings.TrimPrefix(part, "#")
+		v, err := strconv.ParseUint(hex, 16, 32)
+		if len(hex) != 6 || err != nil {
+			return nil, fmt.Errorf("invalid palette color %q, expected #rrggbb", part)
+		}
+		palette = append(palette, color.NRGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255})
+	}
+	return palette, nil
+}
+
+// writePNG encodes img to a new file at path
+func writePNG(path string, img image.Image) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create tile file: %w", err)
+	}
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to encode tile: %w", err)
+	}
+	return file.Close()
+}
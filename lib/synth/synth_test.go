@@ -0,0 +1,119 @@
+package synth
+
+import (
+	"bytes"
+	"image/color"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	imgpkg "wilbertopachecob/mosaic/lib/img"
+)
+
+// TestValidate tests option validation
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  func(o *Options)
+		valid bool
+	}{
+		{"defaults", func(o *Options) {}, true},
+		{"tiny", func(o *Options) { o.Size = 1 }, false},
+		{"no count", func(o *Options) { o.Count = 0 }, false},
+		{"too many", func(o *Options) { o.Count = maxCount + 1 }, false},
+		{"bad style", func(o *Options) { o.Style = "plaid" }, false},
+		{"bad sampling", func(o *Options) { o.Sampling = "hsv" }, false},
+		{"empty palette", func(o *Options) { o.Sampling = SamplingPalette }, false},
+		{"palette count", func(o *Options) {
+			o.Sampling, o.Count, o.Palette = SamplingPalette, 0, []color.NRGBA{{255, 0, 0, 255}}
+		}, true},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		tt.opts(&opts)
+		if err := opts.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid=%v, got %v", tt.name, tt.valid, err)
+		}
+	}
+}
+
+// TestSampleColors tests that every sampling returns distinct colors spread over the space
+func TestSampleColors(t *testing.T) {
+	for _, sampling := range []string{SamplingRGB, SamplingLab} {
+		opts := DefaultOptions()
+		opts.Sampling, opts.Count = sampling, 50
+
+		colors := SampleColors(opts)
+		if len(colors) != 50 {
+			t.Fatalf("%s: expected 50 colors, got %d", sampling, len(colors))
+		}
+		seen := make(map[color.NRGBA]bool)
+		var minL, maxL float64 = 100, 0
+		for _, c := range colors {
+			seen[c] = true
+			l := imgpkg.RGBToLab([3]float64{float64(c.R), float64(c.G), float64(c.B)})[0]
+			minL, maxL = min(minL, l), max(maxL, l)
+		}
+		if len(seen) != 50 {
+			t.Errorf("%s: expected distinct colors, got %d", sampling, len(seen))
+		}
+		if minL > 10 || maxL < 80 {
+			t.Errorf("%s: expected colors from dark to light, lightness spans %.0f to %.0f", sampling, minL, maxL)
+		}
+	}
+
+	palette, err := ParsePalette("#ff0000, #00ff00")
+	if err != nil {
+		t.Fatalf("ParsePalette failed: %v", err)
+	}
+	opts := Options{Sampling: SamplingPalette, Palette: palette, Count: 3}
+	if colors := SampleColors(opts); len(colors) != 3 || colors[2] != palette[0] {
+		t.Errorf("Expected the palette to be cycled, got %v", colors)
+	}
+	if _, err := ParsePalette("#ff00"); err == nil {
+		t.Error("Expected short color to be rejected")
+	}
+}
+
+// TestRenderKeepsAverageColor tests that every style averages to its base color
+func TestRenderKeepsAverageColor(t *testing.T) {
+	base := color.NRGBA{100, 150, 200, 255}
+	for _, style := range []string{StyleSolid, StyleGradient, StyleNoise, StylePattern} {
+		opts := DefaultOptions()
+		opts.Style = style
+		tile := Render(base, 1, opts, rand.New(rand.NewSource(1)))
+
+		avg := imgpkg.AverageColor(tile)
+		got := [3]float64{avg[0] / 257, avg[1] / 257, avg[2] / 257}
+		if d := imgpkg.Distance(got, [3]float64{100, 150, 200}); d > 6 {
+			t.Errorf("%s: average %v is too far from the base color", style, got)
+		}
+	}
+}
+
+// TestGenerateIsDeterministic tests that the same options produce identical files
+func TestGenerateIsDeterministic(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Count, opts.Size, opts.Style = 8, 8, StyleNoise
+
+	first, err := Generate(filepath.Join(t.TempDir(), "a"), opts)
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	second, err := Generate(filepath.Join(t.TempDir(), "b"), opts)
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+
+	if len(first.Written) != 8 || len(second.Written) != 8 {
+		t.Fatalf("Expected 8 tiles, got %d and %d", len(first.Written), len(second.Written))
+	}
+	for i := range first.Written {
+		a, _ := os.ReadFile(first.Written[i])
+		b, _ := os.ReadFile(second.Written[i])
+		if filepath.Base(first.Written[i]) != filepath.Base(second.Written[i]) || !bytes.Equal(a, b) {
+			t.Errorf("Tile %d differs between runs", i)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package tile_cache
+
+import (
+	"container/list"
+	"fmt"
+	"image"
+	"os"
+	"sync"
+
+	imgpkg "wilbertopachecob/mosaic/lib/img"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Transform is a geometric transformation applied to a tile after resizing
+type Transform string
+
+const (
+	TransformNone      Transform = ""
+	TransformFlipH     Transform = "flipH"
+	TransformFlipV     Transform = "flipV"
+	TransformRotate180 Transform = "rotate180"
+)
+
+// Key identifies a decoded and pre-scaled tile in the cache
+type Key struct {
+	Path      string
+	Size      int
+	Transform Transform
+}
+
+// Stats reports cache usage counters
+type Stats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"maxBytes"`
+}
+
+// entry is a cached tile stored in the LRU list
+type entry struct {
+	key   Key
+	img   *image.NRGBA
+	bytes int64
+}
+
+// Cache keeps decoded, resized tiles in memory within a byte budget
+// The least recently used tiles are evicted first. A Cache is safe for concurrent use
+type Cache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	lru      *list.List
+	entries  map[Key]*list.Element
+
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+// New creates a cache holding at most maxBytes of pixel data
+// A budget of zero or less disables caching, every Get then loads from disk
+func New(maxBytes int64) *Cache {
+	return &Cache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[Key]*list.Element),
+	}
+}
+
+// Get returns the tile for key, loading and resizing it from disk on a miss
+// The returned image is shared and must not be modified
+func (c *Cache) Get(key Key) (*image.NRGBA, error) {
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		c.hits++
+		img := elem.Value.(*entry).img
+		c.mu.Unlock()
+		return img, nil
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	// Load outside the lock so a slow decode doesn't block other renders
+	img, err := load(key)
+	if err != nil {
+		return nil, err
+	}
+
+	c.add(key, img)
+	return img, nil
+}
+
+// Warm loads every tile at every size so the first renders hit the cache
+func (c *Cache) Warm(paths []string, sizes []int) {
+	for _, size := range sizes {
+		for _, path := range paths {
+			if _, err := c.Get(Key{Path: path, Size: size}); err != nil {
+				logrus.WithError(err).WithField("tile", path).Warn("Failed to warm tile cache")
+			}
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"tiles": len(paths),
+		"sizes": sizes,
+	}).Info("Tile cache warmed")
+}
+
+// Invalidate drops every cached version of the tile at path
+func (c *Cache) Invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.entries {
+		if key.Path == path {
+			c.remove(elem)
+		}
+	}
+}
+
+// Stats returns the current cache counters
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Stats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   len(c.entries),
+		Bytes:     c.bytes,
+		MaxBytes:  c.maxBytes,
+	}
+}
+
+// add stores a loaded tile and evicts the least recently used tiles over budget
+func (c *Cache) add(key Key, img *image.NRGBA) {
+	size := int64(len(img.Pix))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Another render may have loaded the same tile in the meantime
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&entry{key: key, img: img, bytes: size})
+	c.bytes += size
+
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+// remove deletes an element from the cache, the caller must hold the lock
+func (c *Cache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*entry)
+	delete(c.entries, e.key)
+	c.bytes -= e.bytes
+}
+
+// load opens, decodes, resizes and transforms a tile
+func load(key Key) (*image.NRGBA, error) {
+	file, err := os.Open(key.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tile file: %w", err)
+	}
+	defer file.Close()
+
+	tileImg, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode tile image: %w", err)
+	}
+
+	resized := imgpkg.Resize(tileImg, key.Size)
+	return applyTransform(&resized, key.Transform)
+}
+
+// applyTransform returns img transformed in place
+func applyTransform(img *image.NRGBA, transform Transform) (*image.NRGBA, error) {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	swap := func(x1, y1, x2, y2 int) {
+		i, j := img.PixOffset(x1, y1), img.PixOffset(x2, y2)
+		for k := 0; k < 4; k++ {
+			img.Pix[i+k], img.Pix[j+k] = img.Pix[j+k], img.Pix[i+k]
+		}
+	}
+
+	switch transform {
+	case TransformNone:
+	case TransformFlipH:
+		for y := 0; y < h; y++ {
+			for x := 0; x < w/2; x++ {
+				swap(x, y, w-1-x, y)
+			}
+		}
+	case TransformFlipV:
+		for y := 0; y < h/2; y++ {
+			for x := 0; x < w; x++ {
+				swap(x, y, x, h-1-y)
+			}
+		}
+	case TransformRotate180:
+		for i := 0; i < w*h/2; i++ {
+			swap(i%w, i/w, w-1-i%w, h-1-i/w)
+		}
+	default:
+		return nil, fmt.Errorf("unknown tile transform %q", transform)
+	}
+	return img, nil
+}
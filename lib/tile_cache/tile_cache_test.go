@@ -0,0 +1,129 @@
+package tile_cache
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTile writes a width x width PNG whose left half is red and right half is blue
+func writeTile(t *testing.T, dir, name string, width int) string {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, width))
+	for y := 0; y < width; y++ {
+		for x := 0; x < width; x++ {
+			if x < width/2 {
+				img.Set(x, y, color.NRGBA{255, 0, 0, 255})
+			} else {
+				img.Set(x, y, color.NRGBA{0, 0, 255, 255})
+			}
+		}
+	}
+
+	path := filepath.Join(dir, name)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create tile: %v", err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, img); err != nil {
+		t.Fatalf("Failed to encode tile: %v", err)
+	}
+	return path
+}
+
+// TestCacheHitsAndMisses tests that repeated lookups are served from memory
+func TestCacheHitsAndMisses(t *testing.T) {
+	path := writeTile(t, t.TempDir(), "tile.png", 40)
+	cache := New(1 << 20)
+
+	first, err := cache.Get(Key{Path: path, Size: 10})
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if first.Bounds().Dx() != 10 {
+		t.Errorf("Expected width 10, got %d", first.Bounds().Dx())
+	}
+
+	second, err := cache.Get(Key{Path: path, Size: 10})
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if first != second {
+		t.Error("Expected the second lookup to return the cached image")
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+// TestCacheEvictsLeastRecentlyUsed tests LRU eviction under the memory budget
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	a := writeTile(t, dir, "a.png", 20)
+	b := writeTile(t, dir, "b.png", 20)
+	c := writeTile(t, dir, "c.png", 20)
+
+	// Room for exactly two 10x10 NRGBA tiles
+	cache := New(2 * 10 * 10 * 4)
+	for _, path := range []string{a, b, a, c} {
+		if _, err := cache.Get(Key{Path: path, Size: 10}); err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+	}
+
+	stats := cache.Stats()
+	if stats.Entries != 2 || stats.Evictions != 1 || stats.Bytes > stats.MaxBytes {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	// b was the least recently used tile, so it is the one reloaded
+	cache.Get(Key{Path: a, Size: 10})
+	cache.Get(Key{Path: b, Size: 10})
+	if stats := cache.Stats(); stats.Hits != 2 || stats.Misses != 4 {
+		t.Errorf("Expected a to hit and b to miss, got %+v", stats)
+	}
+}
+
+// TestCacheInvalidate tests that every size of a tile is dropped
+func TestCacheInvalidate(t *testing.T) {
+	path := writeTile(t, t.TempDir(), "tile.png", 20)
+	cache := New(1 << 20)
+	cache.Warm([]string{path}, []int{5, 10})
+
+	if entries := cache.Stats().Entries; entries != 2 {
+		t.Fatalf("Expected 2 warmed entries, got %d", entries)
+	}
+
+	cache.Invalidate(path)
+	if entries := cache.Stats().Entries; entries != 0 {
+		t.Errorf("Expected no entries after invalidation, got %d", entries)
+	}
+}
+
+// TestCacheTransform tests that transformed tiles are cached separately
+func TestCacheTransform(t *testing.T) {
+	path := writeTile(t, t.TempDir(), "tile.png", 20)
+	cache := New(1 << 20)
+
+	plain, err := cache.Get(Key{Path: path, Size: 10})
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	flipped, err := cache.Get(Key{Path: path, Size: 10, Transform: TransformFlipH})
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+
+	if plain.NRGBAAt(0, 0).R != 255 || flipped.NRGBAAt(0, 0).B != 255 {
+		t.Errorf("Expected flipped tile to mirror the original, got %v and %v", plain.NRGBAAt(0, 0), flipped.NRGBAAt(0, 0))
+	}
+	if _, err := cache.Get(Key{Path: path, Size: 10, Transform: "skew"}); err == nil {
+		t.Error("Expected an error for an unknown transform")
+	}
+}
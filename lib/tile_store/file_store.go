@@ -0,0 +1,302 @@
+package tile_store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Log operations
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// compactMinGarbage is the number of superseded log entries below which the log is never compacted
+const compactMinGarbage = 1024
+
+// logEntry is one line of the append-only log
+type logEntry struct {
+	Op     string  `json:"op"`
+	Path   string  `json:"path,omitempty"`
+	Record *Record `json:"record,omitempty"`
+}
+
+// FileStore persists records in a single append-only file of JSON lines
+// Every Put and Delete appends one line and the file is replayed into memory
+// when it is opened, so records survive restarts. Once superseded lines
+// outnumber the live records the file is rewritten with only the live ones
+type FileStore struct {
+	mu      sync.Mutex // Serializes writes to the log
+	memory  *MemoryStore
+	path    string
+	file    *os.File
+	writer  *bufio.Writer
+	garbage int // Log lines superseded by later ones
+}
+
+// OpenFileStore opens or creates the store at path
+// A truncated last line, left by a crash in the middle of a write, is dropped
+func OpenFileStore(path string) (*FileStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create tile store directory: %w", err)
+	}
+
+	s := &FileStore{memory: NewMemoryStore(), path: path}
+	corrupt, err := s.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	// A corrupt tail is cut off by rewriting the log from the replayed records
+	if corrupt || s.needsCompaction() {
+		if err := s.compact(); err != nil {
+			return nil, err
+		}
+	} else if err := s.openLog(); err != nil {
+		return nil, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"path":    path,
+		"records": len(s.memory.records),
+	}).Info("Opened tile store")
+	return s, nil
+}
+
+// replay loads the log into memory and reports whether it ended with a corrupt line
+func (s *FileStore) replay() (bool, error) {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open tile store: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var entry logEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || !s.apply(entry) {
+			logrus.WithField("path", s.path).Warnf("Dropping tile store log from corrupt line %d", line)
+			return true, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("failed to read tile store: %w", err)
+	}
+	return false, nil
+}
+
+// apply replays one log entry into memory and reports whether it was valid
+func (s *FileStore) apply(entry logEntry) bool {
+	records := s.memory.records
+	switch {
+	case entry.Op == opPut && entry.Record != nil:
+		if _, ok := records[entry.Record.Path]; ok {
+			s.garbage++
+		}
+		s.memory.set(*entry.Record)
+	case entry.Op == opDelete:
+		if _, ok := records[entry.Path]; ok {
+			s.memory.remove(entry.Path)
+			s.garbage++
+		}
+		s.garbage++ // The delete line itself
+	default:
+		return false
+	}
+	return true
+}
+
+// openLog opens the log file for appending
+func (s *FileStore) openLog() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open tile store: %w", err)
+	}
+	s.file = file
+	s.writer = bufio.NewWriter(file)
+	return nil
+}
+
+// Get returns the record stored for path
+func (s *FileStore) Get(path string) (Record, bool) {
+	return s.memory.Get(path)
+}
+
+// Put adds or replaces the record for record.Path
+// Putting a record identical to the stored one doesn't grow the log
+func (s *FileStore) Put(record Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, exists := s.memory.Get(record.Path)
+	if exists && reflect.DeepEqual(previous, record) {
+		return nil
+	}
+	if err := s.append(logEntry{Op: opPut, Record: &record}); err != nil {
+		return err
+	}
+	if exists {
+		s.garbage++
+	}
+	s.memory.Put(record)
+	return s.maybeCompact()
+}
+
+// Delete removes the record for path
+func (s *FileStore) Delete(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.memory.Get(path); !exists {
+		return nil
+	}
+	if err := s.append(logEntry{Op: opDelete, Path: path}); err != nil {
+		return err
+	}
+	s.garbage += 2
+	s.memory.Delete(path)
+	return s.maybeCompact()
+}
+
+// FindByHash returns the records whose content has the given SHA-256, sorted by path
+func (s *FileStore) FindByHash(sum string) []Record {
+	return s.memory.FindByHash(sum)
+}
+
+// List returns the paths of all records in sorted order
+func (s *FileStore) List() []string {
+	return s.memory.List()
+}
+
+// Iterate calls fn for every record until fn returns false
+func (s *FileStore) Iterate(fn func(Record) bool) {
+	s.memory.Iterate(fn)
+}
+
+// Snapshot returns a copy of all records keyed by path
+func (s *FileStore) Snapshot() map[string]Record {
+	return s.memory.Snapshot()
+}
+
+// Version returns a number that changes whenever a record is put or deleted
+func (s *FileStore) Version() uint64 {
+	return s.memory.Version()
+}
+
+// Close flushes and closes the log
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.writer.Flush()
+	if syncErr := s.file.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file = nil
+	return err
+}
+
+// append writes one entry to the log
+// The caller must hold s.mu
+func (s *FileStore) append(entry logEntry) error {
+	if s.file == nil {
+		return fmt.Errorf("tile store is closed")
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode tile record: %w", err)
+	}
+	data = append(data, '\n')
+	if _, err := s.writer.Write(data); err != nil {
+		return fmt.Errorf("failed to write tile store: %w", err)
+	}
+	if err := s.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write tile store: %w", err)
+	}
+	return nil
+}
+
+// needsCompaction reports whether superseded lines outnumber the live records
+func (s *FileStore) needsCompaction() bool {
+	return s.garbage >= compactMinGarbage && s.garbage > len(s.memory.records)
+}
+
+// maybeCompact compacts the log when it has grown too much
+// The caller must hold s.mu
+func (s *FileStore) maybeCompact() error {
+	if !s.needsCompaction() {
+		return nil
+	}
+	return s.compact()
+}
+
+// compact rewrites the log with one line per live record and reopens it
+// The new log is written next to the old one and renamed over it, so a
+// crash during compaction leaves the previous log intact
+func (s *FileStore) compact() error {
+	if s.file != nil {
+		s.writer.Flush()
+		s.file.Close()
+		s.file = nil
+	}
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to compact tile store: %w", err)
+	}
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, path := range s.memory.List() {
+		record := s.memory.records[path]
+		if err = encoder.Encode(logEntry{Op: opPut, Record: &record}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		if reopenErr := s.openLog(); reopenErr != nil {
+			logrus.WithError(reopenErr).Error("Failed to reopen tile store after failed compaction")
+		}
+		return fmt.Errorf("failed to compact tile store: %w", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"path":    s.path,
+		"records": len(s.memory.records),
+		"dropped": s.garbage,
+	}).Debug("Compacted tile store")
+	s.garbage = 0
+	return s.openLog()
+}
@@ -0,0 +1,255 @@
+package tile_store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"wilbertopachecob/mosaic/lib/tiles_db"
+)
+
+// Store backends
+const (
+	BackendMemory = "memory"
+	BackendFile   = "file"
+)
+
+// Record is everything the index knows about one tile, keyed by its file path
+// Files with the same SHA256 hold the same content: they are aliases of one tile
+type Record struct {
+	Path        string            `json:"path"`
+	Color       [3]float64        `json:"color"`
+	Hash        uint64            `json:"hash"`
+	HashVersion int               `json:"hashVersion,omitempty"`
+	SHA256      string            `json:"sha256"`
+	Size        int64             `json:"size"`
+	ModTime     time.Time         `json:"modTime"`
+	Stats       tiles_db.Stats    `json:"stats"`
+	Metadata    tiles_db.Metadata `json:"metadata"`
+}
+
+// NewRecord builds the record of an ingested tile
+func NewRecord(path string, descriptor tiles_db.Descriptor, metadata tiles_db.Metadata) Record {
+	return Record{
+		Path:        path,
+		Color:       descriptor.Color,
+		Hash:        descriptor.Hash,
+		HashVersion: descriptor.HashVersion,
+		SHA256:      descriptor.SHA256,
+		Size:        descriptor.Size,
+		ModTime:     descriptor.ModTime.UTC(), // UTC survives the JSON round trip unchanged
+		Stats:       descriptor.Stats,
+		Metadata:    metadata,
+	}
+}
+
+// Descriptor returns the ingestion descriptor stored in the record
+func (r Record) Descriptor() tiles_db.Descriptor {
+	return tiles_db.Descriptor{
+		Color:       r.Color,
+		Hash:        r.Hash,
+		HashVersion: r.HashVersion,
+		SHA256:      r.SHA256,
+		Size:        r.Size,
+		ModTime:     r.ModTime,
+		Stats:       r.Stats,
+	}
+}
+
+// TileStore indexes tile records by path
+// The SHA-256 is a secondary index only: aliases of one content are separate
+// records, each with its own metadata
+// Implementations are safe for concurrent use. Records are values: the
+// Metadata.Tags slice of a returned record must not be modified
+type TileStore interface {
+	// Get returns the record stored for path
+	Get(path string) (Record, bool)
+	// FindByHash returns the records whose content has the given SHA-256, sorted by path
+	FindByHash(sum string) []Record
+	// Put adds or replaces the record for record.Path
+	Put(record Record) error
+	// Delete removes the record for path, deleting a missing record is not an error
+	Delete(path string) error
+	// List returns the paths of all records in sorted order
+	List() []string
+	// Iterate calls fn for every record in no particular order until fn returns false
+	// fn must not modify the store
+	Iterate(fn func(Record) bool)
+	// Snapshot returns a copy of all records keyed by path
+	Snapshot() map[string]Record
+	// Version returns a number that changes whenever a record is put or deleted
+	// Versions of different stores are unlikely to be equal
+	Version() uint64
+	// Close releases the resources held by the store
+	Close() error
+}
+
+// Open opens a store of the given backend
+// path is the database file of the file backend and is ignored by the memory backend
+func Open(backend, path string) (TileStore, error) {
+	switch backend {
+	case BackendMemory, "":
+		return NewMemoryStore(), nil
+	case BackendFile:
+		return OpenFileStore(path)
+	default:
+		return nil, fmt.Errorf("unknown tile store backend %q, expected %q or %q", backend, BackendMemory, BackendFile)
+	}
+}
+
+// Colors returns the average color of every tile in store
+func Colors(store TileStore) map[string][3]float64 {
+	colors := make(map[string][3]float64)
+	store.Iterate(func(record Record) bool {
+		colors[record.Path] = record.Color
+		return true
+	})
+	return colors
+}
+
+// Fingerprints returns the near-duplicate fingerprint of every tile in store
+func Fingerprints(store TileStore) map[string]tiles_db.Fingerprint {
+	fingerprints := make(map[string]tiles_db.Fingerprint)
+	store.Iterate(func(record Record) bool {
+		fingerprints[record.Path] = record.Descriptor().Fingerprint()
+		return true
+	})
+	return fingerprints
+}
+
+// MemoryStore keeps records in memory only
+// It is rebuilt from the tiles directory by the ingestion on every start
+type MemoryStore struct {
+	mu      sync.RWMutex
+	records map[string]Record
+	byHash  map[string]map[string]bool // SHA-256 to the set of paths with that content
+	version atomic.Uint64
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{
+		records: make(map[string]Record),
+		byHash:  make(map[string]map[string]bool),
+	}
+	// Versions start at an arbitrary point so that stores don't share them
+	s.version.Store(uint64(time.Now().UnixNano()))
+	return s
+}
+
+// Get returns the record stored for path
+func (s *MemoryStore) Get(path string) (Record, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, ok := s.records[path]
+	return record, ok
+}
+
+// FindByHash returns the records whose content has the given SHA-256, sorted by path
+func (s *MemoryStore) FindByHash(sum string) []Record {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if sum == "" {
+		return nil
+	}
+	records := make([]Record, 0, len(s.byHash[sum]))
+	for path := range s.byHash[sum] {
+		records = append(records, s.records[path])
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Path < records[j].Path })
+	return records
+}
+
+// Put adds or replaces the record for record.Path
+func (s *MemoryStore) Put(record Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(record)
+	return nil
+}
+
+// Delete removes the record for path
+func (s *MemoryStore) Delete(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(path)
+	return nil
+}
+
+// set stores a record and indexes its content hash
+// The caller must hold the write lock
+func (s *MemoryStore) set(record Record) {
+	s.remove(record.Path)
+	s.version.Add(1)
+	s.records[record.Path] = record
+	if record.SHA256 != "" {
+		if s.byHash[record.SHA256] == nil {
+			s.byHash[record.SHA256] = make(map[string]bool)
+		}
+		s.byHash[record.SHA256][record.Path] = true
+	}
+}
+
+// remove deletes a record and its hash index entry
+// The caller must hold the write lock
+func (s *MemoryStore) remove(path string) {
+	record, ok := s.records[path]
+	if !ok {
+		return
+	}
+	delete(s.records, path)
+	s.version.Add(1)
+	if paths := s.byHash[record.SHA256]; paths != nil {
+		delete(paths, path)
+		if len(paths) == 0 {
+			delete(s.byHash, record.SHA256)
+		}
+	}
+}
+
+// List returns the paths of all records in sorted order
+func (s *MemoryStore) List() []string {
+	s.mu.RLock()
+	paths := make([]string, 0, len(s.records))
+	for path := range s.records {
+		paths = append(paths, path)
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(paths)
+	return paths
+}
+
+// Iterate calls fn for every record until fn returns false
+func (s *MemoryStore) Iterate(fn func(Record) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, record := range s.records {
+		if !fn(record) {
+			return
+		}
+	}
+}
+
+// Snapshot returns a copy of all records keyed by path
+func (s *MemoryStore) Snapshot() map[string]Record {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	records := make(map[string]Record, len(s.records))
+	for path, record := range s.records {
+		records[path] = record
+	}
+	return records
+}
+
+// Version returns a number that changes whenever a record is put or deleted
+func (s *MemoryStore) Version() uint64 {
+	return s.version.Load()
+}
+
+// Close does nothing, a memory store holds no resources
+func (s *MemoryStore) Close() error {
+	return nil
+}
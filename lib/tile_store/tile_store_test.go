@@ -0,0 +1,209 @@
+package tile_store
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"wilbertopachecob/mosaic/lib/tiles_db"
+)
+
+// testRecord builds a record with a distinctive color
+func testRecord(path string, red float64) Record {
+	return Record{
+		Path:     path,
+		Color:    [3]float64{red, 0, 0},
+		Hash:     uint64(red),
+		Size:     100,
+		ModTime:  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Metadata: tiles_db.Metadata{Tags: []string{"red"}},
+	}
+}
+
+// testStoreContract runs the behavior every TileStore must have
+func testStoreContract(t *testing.T, store TileStore) {
+	if err := store.Put(testRecord("b.jpg", 2)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	store.Put(testRecord("a.jpg", 1))
+	store.Put(testRecord("c.jpg", 3))
+	store.Put(testRecord("b.jpg", 20))
+
+	if record, ok := store.Get("b.jpg"); !ok || record.Color[0] != 20 {
+		t.Errorf("Expected replaced record, got %+v, %v", record, ok)
+	}
+	if _, ok := store.Get("missing.jpg"); ok {
+		t.Error("Expected missing record")
+	}
+
+	if err := store.Delete("c.jpg"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := store.Delete("missing.jpg"); err != nil {
+		t.Errorf("Deleting a missing record should not fail: %v", err)
+	}
+
+	if paths := store.List(); !reflect.DeepEqual(paths, []string{"a.jpg", "b.jpg"}) {
+		t.Errorf("Unexpected paths: %v", paths)
+	}
+
+	visited := 0
+	store.Iterate(func(Record) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Errorf("Expected iteration to stop after 1 record, visited %d", visited)
+	}
+
+	snapshot := store.Snapshot()
+	delete(snapshot, "a.jpg")
+	if _, ok := store.Get("a.jpg"); !ok || len(snapshot) != 1 {
+		t.Error("Expected snapshot to be a copy")
+	}
+	if colors := Colors(store); colors["a.jpg"] != [3]float64{1, 0, 0} {
+		t.Errorf("Unexpected colors: %v", colors)
+	}
+
+	// Aliases of the same content are found by hash, replaced and deleted records are not
+	alias := testRecord("z.jpg", 1)
+	alias.SHA256 = "abc"
+	store.Put(alias)
+	alias.Path = "d.jpg"
+	store.Put(alias)
+	moved := testRecord("b.jpg", 20)
+	moved.SHA256 = "def"
+	store.Put(moved)
+	store.Delete("z.jpg")
+
+	if records := store.FindByHash("abc"); len(records) != 1 || records[0].Path != "d.jpg" {
+		t.Errorf("Unexpected records for hash: %+v", records)
+	}
+	if records := store.FindByHash(""); len(records) != 0 {
+		t.Errorf("Records without a hash should not be indexed, got %+v", records)
+	}
+
+	// Changes move the version, reads and deleting a missing record don't
+	version := store.Version()
+	store.Get("a.jpg")
+	store.Delete("missing.jpg")
+	if store.Version() != version {
+		t.Error("Expected reads not to change the version")
+	}
+	store.Put(testRecord("e.jpg", 5))
+	if store.Version() == version {
+		t.Error("Expected a put to change the version")
+	}
+	version = store.Version()
+	store.Delete("e.jpg")
+	if store.Version() == version {
+		t.Error("Expected a delete to change the version")
+	}
+}
+
+// TestMemoryStore tests the in-memory backend
+func TestMemoryStore(t *testing.T) {
+	testStoreContract(t, NewMemoryStore())
+}
+
+// TestFileStore tests the file backend and that its records survive reopening
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "tiles.db")
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	testStoreContract(t, store)
+	if err := store.Close(); err != nil {
+		t.Fatalf("Failed to close store: %v", err)
+	}
+
+	reopened, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer reopened.Close()
+
+	if paths := reopened.List(); !reflect.DeepEqual(paths, []string{"a.jpg", "b.jpg", "d.jpg"}) {
+		t.Errorf("Unexpected paths after reopening: %v", paths)
+	}
+	if record, _ := reopened.Get("a.jpg"); !reflect.DeepEqual(record, testRecord("a.jpg", 1)) {
+		t.Errorf("Record changed across restarts: %+v", record)
+	}
+	if records := reopened.FindByHash("def"); len(records) != 1 || records[0].Path != "b.jpg" {
+		t.Errorf("Hash index not rebuilt after reopening: %+v", records)
+	}
+}
+
+// TestFileStoreDropsTruncatedTail tests recovery from a crash in the middle of a write
+func TestFileStoreDropsTruncatedTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tiles.db")
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	store.Put(testRecord("a.jpg", 1))
+	store.Close()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	file.WriteString(`{"op":"put","record":{"path":"b.j`)
+	file.Close()
+
+	store, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+
+	if paths := store.List(); !reflect.DeepEqual(paths, []string{"a.jpg"}) {
+		t.Errorf("Expected the truncated record to be dropped, got %v", paths)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "b.j") {
+		t.Error("Expected the corrupt tail to be removed from the log")
+	}
+}
+
+// TestFileStoreCompaction tests that rewriting records doesn't grow the log without bound
+func TestFileStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tiles.db")
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	for i := 0; i < 3*compactMinGarbage; i++ {
+		if err := store.Put(testRecord("a.jpg", float64(i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	data, _ := os.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines > compactMinGarbage+1 {
+		t.Errorf("Expected the log to be compacted, it has %d lines", lines)
+	}
+	if record, _ := store.Get("a.jpg"); record.Color[0] != 3*compactMinGarbage-1 {
+		t.Errorf("Unexpected record after compaction: %+v", record)
+	}
+}
+
+// TestOpen tests backend selection
+func TestOpen(t *testing.T) {
+	if _, err := Open("redis", ""); err == nil {
+		t.Error("Expected unknown backend to fail")
+	}
+	store, err := Open(BackendMemory, "")
+	if err != nil {
+		t.Fatalf("Failed to open memory store: %v", err)
+	}
+	if _, ok := store.(*MemoryStore); !ok {
+		t.Errorf("Expected a memory store, got %T", store)
+	}
+}
@@ -0,0 +1,400 @@
+package tiles_db
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	imgpkg "wilbertopachecob/mosaic/lib/img"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Import entry statuses
+const (
+	EntryAdded   = "added"
+	EntrySkipped = "skipped"
+	EntryFailed  = "failed"
+)
+
+// ErrArchiveTooLarge is returned when an archive exceeds its total size or entry limits
+var ErrArchiveTooLarge = errors.New("archive exceeds import limits")
+
+// ErrInvalidArchive is returned for data that is not a readable .zip, .tar or .tar.gz archive
+var ErrInvalidArchive = errors.New("invalid archive")
+
+// ArchiveLimits protects imports against archive bombs
+type ArchiveLimits struct {
+	MaxEntries    int     // Maximum number of entries, including skipped ones
+	MaxEntryBytes int64   // Maximum uncompressed size of a single entry
+	MaxTotalBytes int64   // Maximum uncompressed size of all entries together, or of the whole tar stream
+	MaxRatio      float64 // Maximum compression ratio of a zip entry or of a whole .tar.gz stream
+	MaxPixels     int64   // Maximum pixels an image entry may declare, zero for no limit
+}
+
+// DefaultArchiveLimits returns the limits used when none are configured
+func DefaultArchiveLimits() ArchiveLimits {
+	return ArchiveLimits{
+		MaxEntries:    10000,
+		MaxEntryBytes: 50 << 20,
+		MaxTotalBytes: 2 << 30,
+		MaxRatio:      100,
+		MaxPixels:     DefaultMaxPixels,
+	}
+}
+
+// ImportEntry reports what happened to one archive entry
+type ImportEntry struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+	File   string `json:"file,omitempty"`
+}
+
+// ImportReport lists the outcome of every file entry of an imported archive
+type ImportReport struct {
+	Added   int           `json:"added"`
+	Skipped int           `json:"skipped"`
+	Failed  int           `json:"failed"`
+	Entries []ImportEntry `json:"entries"`
+
+	// Descriptors of the added tiles keyed by path, ready to publish
+	Descriptors map[string]Descriptor `json:"-"`
+}
+
+// record appends an entry and updates the counters
+func (report *ImportReport) record(entry ImportEntry) {
+	switch entry.Status {
+	case EntryAdded:
+		report.Added++
+	case EntrySkipped:
+		report.Skipped++
+	case EntryFailed:
+		report.Failed++
+	}
+	report.Entries = append(report.Entries, entry)
+}
+
+// MarkDuplicate turns the added entry of filePath into a skipped duplicate of existing
+// The caller is responsible for removing the extracted file
+func (report *ImportReport) MarkDuplicate(filePath, existing string) {
+	if _, ok := report.Descriptors[filePath]; !ok {
+		return
+	}
+	delete(report.Descriptors, filePath)
+
+	base := filepath.Base(filePath)
+	for i, entry := range report.Entries {
+		if entry.Status == EntryAdded && entry.File == base {
+			report.Entries[i].Status = EntrySkipped
+			report.Entries[i].Reason = "duplicate of " + existing
+			report.Added--
+			report.Skipped++
+			return
+		}
+	}
+}
+
+// archiveImporter holds the state of a running import
+type archiveImporter struct {
+	destDir string
+	limits  ArchiveLimits
+	report  *ImportReport
+	entries int
+	total   int64
+}
+
+// ImportArchive extracts the images of a .zip, .tar or .tar.gz archive into destDir
+// Each image is decoded through processImageFile; entries are flattened to their
+// base name and never overwrite existing files. The archive format is detected
+// from its content. When a limit is exceeded the partial report is returned
+// together with ErrArchiveTooLarge
+func ImportArchive(r io.ReaderAt, size int64, destDir string, limits ArchiveLimits) (*ImportReport, error) {
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create collection directory: %w", err)
+	}
+
+	importer := &archiveImporter{
+		destDir: destDir,
+		limits:  limits,
+		report:  &ImportReport{Entries: []ImportEntry{}, Descriptors: make(map[string]Descriptor)},
+	}
+
+	header := make([]byte, 512)
+	n, _ := r.ReadAt(header, 0)
+	header = header[:n]
+
+	var err error
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")) || bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		err = importer.importZip(r, size)
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(io.NewSectionReader(r, 0, size))
+		if err == nil {
+			stream := importer.limitStream(gz)
+			if ratioLimit := int64(limits.MaxRatio * float64(size)); ratioLimit < stream.remaining {
+				stream.remaining = ratioLimit
+				stream.err = fmt.Errorf("%w: compression ratio exceeds limit", ErrArchiveTooLarge)
+			}
+			err = importer.importTar(tar.NewReader(stream))
+		} else {
+			err = fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+		}
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		err = importer.importTar(tar.NewReader(importer.limitStream(io.NewSectionReader(r, 0, size))))
+	default:
+		return nil, fmt.Errorf("%w: unsupported format, expected .zip, .tar or .tar.gz", ErrInvalidArchive)
+	}
+
+	report := importer.report
+	logrus.WithFields(logrus.Fields{
+		"destination": destDir,
+		"added":       report.Added,
+		"skipped":     report.Skipped,
+		"failed":      report.Failed,
+	}).Info("Imported tile archive")
+
+	return report, err
+}
+
+// importZip walks the entries of a zip archive
+func (importer *archiveImporter) importZip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("%w: failed to read zip archive: %v", ErrInvalidArchive, err)
+	}
+
+	for _, file := range zr.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		if err := importer.countEntry(); err != nil {
+			return err
+		}
+		if !file.Mode().IsRegular() {
+			importer.report.record(ImportEntry{Name: file.Name, Status: EntrySkipped, Reason: "not a regular file"})
+			continue
+		}
+
+		// Reject suspicious compression ratios before inflating anything
+		if file.CompressedSize64 > 0 && float64(file.UncompressedSize64)/float64(file.CompressedSize64) > importer.limits.MaxRatio {
+			importer.report.record(ImportEntry{Name: file.Name, Status: EntryFailed, Reason: "compression ratio exceeds limit"})
+			continue
+		}
+
+		if err := importer.importEntry(file.Name, file.Open); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importTar walks the entries of a tar stream
+// Next decompresses every entry it skips, so each entry's declared size counts
+// toward the total whether it is extracted or not
+func (importer *archiveImporter) importTar(tr *tar.Reader) error {
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, ErrArchiveTooLarge) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("%w: failed to read tar archive: %v", ErrInvalidArchive, err)
+		}
+
+		total := importer.total + header.Size
+		if total > importer.limits.MaxTotalBytes {
+			importer.report.record(ImportEntry{Name: header.Name, Status: EntryFailed, Reason: "archive exceeds total size limit"})
+			return fmt.Errorf("%w: more than %d bytes in total", ErrArchiveTooLarge, importer.limits.MaxTotalBytes)
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			importer.total = total
+			continue
+		}
+		if err := importer.countEntry(); err != nil {
+			return err
+		}
+
+		switch {
+		case header.Size > importer.limits.MaxEntryBytes:
+			importer.report.record(ImportEntry{Name: header.Name, Status: EntryFailed, Reason: fmt.Sprintf("entry larger than %d bytes", importer.limits.MaxEntryBytes)})
+		case header.Typeflag != tar.TypeReg:
+			importer.report.record(ImportEntry{Name: header.Name, Status: EntrySkipped, Reason: "not a regular file"})
+		default:
+			open := func() (io.ReadCloser, error) { return io.NopCloser(tr), nil }
+			if err := importer.importEntry(header.Name, open); err != nil {
+				return err
+			}
+		}
+		importer.total = total
+	}
+}
+
+// limitStream caps the whole tar stream, headers and skipped entries included, at the total size limit
+func (importer *archiveImporter) limitStream(r io.Reader) *limitedStream {
+	return &limitedStream{
+		r:         r,
+		remaining: importer.limits.MaxTotalBytes,
+		err:       fmt.Errorf("%w: more than %d bytes in total", ErrArchiveTooLarge, importer.limits.MaxTotalBytes),
+	}
+}
+
+// limitedStream fails with err once more than its remaining bytes are read
+type limitedStream struct {
+	r         io.Reader
+	remaining int64
+	err       error
+}
+
+func (s *limitedStream) Read(p []byte) (int, error) {
+	if s.remaining <= 0 {
+		return 0, s.err
+	}
+	if int64(len(p)) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n, err := s.r.Read(p)
+	s.remaining -= int64(n)
+	return n, err
+}
+
+// countEntry enforces the entry count limit
+func (importer *archiveImporter) countEntry() error {
+	importer.entries++
+	if importer.entries > importer.limits.MaxEntries {
+		return fmt.Errorf("%w: more than %d entries", ErrArchiveTooLarge, importer.limits.MaxEntries)
+	}
+	return nil
+}
+
+// importEntry extracts and describes a single file entry
+// Only limit violations that abort the whole import are returned as errors
+func (importer *archiveImporter) importEntry(name string, open func() (io.ReadCloser, error)) error {
+	report := importer.report
+
+	if !isSafeEntryName(name) {
+		report.record(ImportEntry{Name: name, Status: EntryFailed, Reason: "unsafe path"})
+		return nil
+	}
+	base := path.Base(name)
+	if strings.HasPrefix(base, ".") || !isImageFile(base) {
+		report.record(ImportEntry{Name: name, Status: EntrySkipped, Reason: "not an image file"})
+		return nil
+	}
+
+	filePath := filepath.Join(importer.destDir, base)
+	dst, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			report.record(ImportEntry{Name: name, Status: EntrySkipped, Reason: "tile already exists", File: base})
+		} else {
+			report.record(ImportEntry{Name: name, Status: EntryFailed, Reason: err.Error()})
+		}
+		return nil
+	}
+
+	written, copyErr := importer.copyLimited(dst, open)
+	importer.total += written
+	if closeErr := dst.Close(); copyErr == nil {
+		copyErr = closeErr
+	}
+	if copyErr != nil {
+		os.Remove(filePath)
+		report.record(ImportEntry{Name: name, Status: EntryFailed, Reason: copyErr.Error()})
+
+		// Running out of total budget aborts the import, an oversized entry only fails itself
+		if errors.Is(copyErr, ErrArchiveTooLarge) && importer.total > importer.limits.MaxTotalBytes {
+			return copyErr
+		}
+		return nil
+	}
+
+	// A small entry can declare gigapixels, check before decoding
+	if err := checkFilePixels(filePath, importer.limits.MaxPixels); err != nil {
+		os.Remove(filePath)
+		report.record(ImportEntry{Name: name, Status: EntryFailed, Reason: err.Error()})
+		return nil
+	}
+
+	descriptor, err := processImageFile(filePath)
+	if err != nil {
+		os.Remove(filePath)
+		report.record(ImportEntry{Name: name, Status: EntryFailed, Reason: err.Error()})
+		return nil
+	}
+
+	report.Descriptors[filePath] = descriptor
+	report.record(ImportEntry{Name: name, Status: EntryAdded, File: base})
+	return nil
+}
+
+// copyLimited copies an entry into dst, stopping at the per-entry and total limits
+func (importer *archiveImporter) copyLimited(dst io.Writer, open func() (io.ReadCloser, error)) (int64, error) {
+	src, err := open()
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	limit := importer.limits.MaxEntryBytes
+	if remaining := importer.limits.MaxTotalBytes - importer.total; remaining < limit {
+		limit = remaining
+	}
+
+	written, err := io.Copy(dst, io.LimitReader(src, limit+1))
+	if err != nil {
+		return written, err
+	}
+	if written > limit {
+		if written > importer.limits.MaxEntryBytes {
+			return written, fmt.Errorf("%w: entry larger than %d bytes", ErrArchiveTooLarge, importer.limits.MaxEntryBytes)
+		}
+		return written, fmt.Errorf("%w: more than %d bytes in total", ErrArchiveTooLarge, importer.limits.MaxTotalBytes)
+	}
+	return written, nil
+}
+
+// checkFilePixels checks the dimensions declared by the image file at filePath
+func checkFilePixels(filePath string, maxPixels int64) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, _, err := imgpkg.CheckPixels(file, maxPixels); err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+	return nil
+}
+
+// isSafeEntryName rejects absolute paths and paths escaping the archive root
+func isSafeEntryName(name string) bool {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if name == "" || strings.HasPrefix(name, "/") || hasDriveLetter(name) {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// hasDriveLetter reports whether name starts with a Windows drive such as "C:"
+func hasDriveLetter(name string) bool {
+	return len(name) >= 2 && name[1] == ':' && (name[0] >= 'a' && name[0] <= 'z' || name[0] >= 'A' && name[0] <= 'Z')
+}
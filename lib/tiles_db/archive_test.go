@@ -0,0 +1,248 @@
+package tiles_db
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pngBytes encodes a small solid image
+func pngBytes(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < 16; i++ {
+		img.Set(i%4, i/4, color.NRGBA{uint8(i * 16), 0, 0, 255})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Failed to encode image: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// zipArchive builds a zip archive from name/content pairs
+func zipArchive(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("Failed to create zip entry: %v", err)
+		}
+		w.Write(data)
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+// entryStatuses maps entry names to their import status
+func entryStatuses(report *ImportReport) map[string]string {
+	statuses := make(map[string]string)
+	for _, entry := range report.Entries {
+		statuses[entry.Name] = entry.Status
+	}
+	return statuses
+}
+
+// TestImportZipArchive tests importing, skipping and rejecting zip entries
+func TestImportZipArchive(t *testing.T) {
+	dir := t.TempDir()
+	archive := zipArchive(t, map[string][]byte{
+		"photos/a.png":     pngBytes(t),
+		"b.png":            pngBytes(t),
+		"readme.txt":       []byte("hello"),
+		"../escape.png":    pngBytes(t),
+		"broken.png":       []byte("not a png"),
+		"other/a.png":      pngBytes(t),
+		"bomb.png":         make([]byte, 1<<20),
+		"/etc/passwd.png":  pngBytes(t),
+		"C:\\windows.png":  pngBytes(t),
+		"photos/.hide.png": pngBytes(t),
+	})
+
+	report, err := ImportArchive(bytes.NewReader(archive), int64(len(archive)), dir, DefaultArchiveLimits())
+	if err != nil {
+		t.Fatalf("ImportArchive failed: %v", err)
+	}
+
+	statuses := entryStatuses(report)
+	expected := map[string]string{
+		"b.png":           EntryAdded,
+		"readme.txt":      EntrySkipped,
+		"../escape.png":   EntryFailed,
+		"broken.png":      EntryFailed,
+		"bomb.png":        EntryFailed,
+		"/etc/passwd.png": EntryFailed,
+		"C:\\windows.png": EntryFailed,
+	}
+	for name, status := range expected {
+		if statuses[name] != status {
+			t.Errorf("Expected entry '%s' to be %s, got %s", name, status, statuses[name])
+		}
+	}
+
+	// Entries are flattened, so only one of the two a.png files is added
+	if report.Added != 2 || len(report.Descriptors) != 2 {
+		t.Errorf("Expected 2 added tiles, got %d (%d descriptors)", report.Added, len(report.Descriptors))
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escape.png")); !os.IsNotExist(err) {
+		t.Error("Expected traversal entry not to be written")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "broken.png")); !os.IsNotExist(err) {
+		t.Error("Expected undecodable entry to be removed")
+	}
+}
+
+// TestImportTarGzArchive tests streaming a gzip compressed tar archive
+func TestImportTarGzArchive(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range []string{"x.png", "nested/y.png"} {
+		data := pngBytes(t)
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		tw.Write(data)
+	}
+	tw.WriteHeader(&tar.Header{Name: "link.png", Linkname: "/etc/passwd", Typeflag: tar.TypeSymlink})
+	tw.Close()
+	gz.Close()
+
+	dir := t.TempDir()
+	report, err := ImportArchive(bytes.NewReader(buf.Bytes()), int64(buf.Len()), dir, DefaultArchiveLimits())
+	if err != nil {
+		t.Fatalf("ImportArchive failed: %v", err)
+	}
+	if report.Added != 2 || report.Skipped != 1 {
+		t.Errorf("Expected 2 added and 1 skipped entries, got %+v", report)
+	}
+}
+
+// tarGzArchive builds a gzip compressed tar archive from name/content pairs in order
+func tarGzArchive(t *testing.T, names []string, contents [][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for i, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents[i])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		tw.Write(contents[i])
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// TestImportTarGzSkippedEntryLimits tests that skipped tar entries count toward the limits
+func TestImportTarGzSkippedEntryLimits(t *testing.T) {
+	archive := tarGzArchive(t, []string{"a.png", "padding.txt", "b.png"}, [][]byte{pngBytes(t), make([]byte, 4<<20), pngBytes(t)})
+
+	// A skipped entry inflating far beyond its compressed size trips the ratio limit
+	report, err := ImportArchive(bytes.NewReader(archive), int64(len(archive)), t.TempDir(), DefaultArchiveLimits())
+	if !errors.Is(err, ErrArchiveTooLarge) {
+		t.Errorf("Expected ErrArchiveTooLarge for a highly compressed skipped entry, got %v", err)
+	}
+	if report == nil || report.Added != 1 {
+		t.Errorf("Expected the import to stop after the first entry, got %+v", report)
+	}
+
+	// Its declared size counts toward the total even though it is never extracted
+	limits := DefaultArchiveLimits()
+	limits.MaxRatio = 1e6
+	limits.MaxTotalBytes = 1 << 20
+	report, err = ImportArchive(bytes.NewReader(archive), int64(len(archive)), t.TempDir(), limits)
+	if !errors.Is(err, ErrArchiveTooLarge) {
+		t.Errorf("Expected ErrArchiveTooLarge for a skipped entry over the total limit, got %v", err)
+	}
+	if report == nil || report.Added != 1 || report.Failed != 1 {
+		t.Errorf("Expected the oversized skipped entry to fail the import, got %+v", report)
+	}
+
+	// An entry over the per-entry limit fails on its header alone
+	limits = DefaultArchiveLimits()
+	limits.MaxRatio = 1e6
+	limits.MaxEntryBytes = 1 << 20
+	report, err = ImportArchive(bytes.NewReader(archive), int64(len(archive)), t.TempDir(), limits)
+	if err != nil {
+		t.Fatalf("ImportArchive failed: %v", err)
+	}
+	if statuses := entryStatuses(report); statuses["padding.txt"] != EntryFailed || report.Added != 2 {
+		t.Errorf("Expected only the oversized entry to fail, got %+v", report.Entries)
+	}
+
+	// The whole decompressed stream, tar headers included, stays under the total
+	limits = DefaultArchiveLimits()
+	limits.MaxTotalBytes = int64(len(pngBytes(t)))
+	archive = tarGzArchive(t, []string{"a.png"}, [][]byte{pngBytes(t)})
+	if _, err := ImportArchive(bytes.NewReader(archive), int64(len(archive)), t.TempDir(), limits); !errors.Is(err, ErrArchiveTooLarge) {
+		t.Errorf("Expected ErrArchiveTooLarge once headers push the stream over the total, got %v", err)
+	}
+}
+
+// TestImportArchiveLimits tests that the total size and entry count limits abort the import
+func TestImportArchiveLimits(t *testing.T) {
+	files := map[string][]byte{"a.png": pngBytes(t), "b.png": pngBytes(t), "c.png": pngBytes(t)}
+	archive := zipArchive(t, files)
+
+	limits := DefaultArchiveLimits()
+	limits.MaxTotalBytes = int64(len(files["a.png"])) + 10
+	report, err := ImportArchive(bytes.NewReader(archive), int64(len(archive)), t.TempDir(), limits)
+	if !errors.Is(err, ErrArchiveTooLarge) {
+		t.Errorf("Expected ErrArchiveTooLarge, got %v", err)
+	}
+	if report == nil || report.Added != 1 || report.Failed != 1 {
+		t.Errorf("Expected the import to stop after the first entry, got %+v", report)
+	}
+
+	limits = DefaultArchiveLimits()
+	limits.MaxEntries = 2
+	if _, err := ImportArchive(bytes.NewReader(archive), int64(len(archive)), t.TempDir(), limits); !errors.Is(err, ErrArchiveTooLarge) {
+		t.Errorf("Expected ErrArchiveTooLarge for too many entries, got %v", err)
+	}
+
+	if _, err := ImportArchive(bytes.NewReader([]byte("plain text")), 10, t.TempDir(), limits); !errors.Is(err, ErrInvalidArchive) {
+		t.Errorf("Expected ErrInvalidArchive for an unsupported archive format, got %v", err)
+	}
+
+	// Entries declaring more pixels than allowed fail before they are decoded
+	limits = DefaultArchiveLimits()
+	limits.MaxPixels = 15
+	report, err = ImportArchive(bytes.NewReader(archive), int64(len(archive)), t.TempDir(), limits)
+	if err != nil || report.Failed != 3 {
+		t.Errorf("Expected every 4x4 entry to fail a 15 pixel limit, got %+v, %v", report, err)
+	}
+}
+
+// TestImportReportMarkDuplicate tests turning an added entry into a skipped duplicate
+func TestImportReportMarkDuplicate(t *testing.T) {
+	dir := t.TempDir()
+	archive := zipArchive(t, map[string][]byte{"a.png": pngBytes(t), "b.png": pngBytes(t)})
+	report, err := ImportArchive(bytes.NewReader(archive), int64(len(archive)), dir, DefaultArchiveLimits())
+	if err != nil {
+		t.Fatalf("ImportArchive failed: %v", err)
+	}
+	if report.Descriptors[filepath.Join(dir, "a.png")].SHA256 != report.Descriptors[filepath.Join(dir, "b.png")].SHA256 {
+		t.Fatal("Expected identical entries to have the same content hash")
+	}
+
+	report.MarkDuplicate(filepath.Join(dir, "b.png"), "a.png")
+
+	if report.Added != 1 || report.Skipped != 1 || len(report.Descriptors) != 1 {
+		t.Errorf("Unexpected counters: %d added, %d skipped, %d descriptors", report.Added, report.Skipped, len(report.Descriptors))
+	}
+	for _, entry := range report.Entries {
+		if entry.Name == "b.png" && (entry.Status != EntrySkipped || entry.Reason != "duplicate of a.png") {
+			t.Errorf("Unexpected duplicate entry: %+v", entry)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package tiles_db
+
+import (
+	"math"
+	"sort"
+
+	imgpkg "wilbertopachecob/mosaic/lib/img"
+)
+
+// MaxDuplicateColorDistance is the largest distance between the mean colors of two
+// near-duplicates, in the 16-bit units of Descriptor.Color (16 levels out of 255)
+// The perceptual hash only describes structure, flat tiles of any color share a hash
+const MaxDuplicateColorDistance = 16 * 257
+
+// Fingerprint is what near-duplicate detection compares of a tile
+type Fingerprint struct {
+	Hash  uint64
+	Color [3]float64
+}
+
+// GroupDuplicates clusters tiles whose perceptual hashes are within maxDistance bits
+// and whose mean colors are within MaxDuplicateColorDistance
+// Clustering is transitive: if a~b and b~c then a, b and c share a group.
+// Only groups of two or more tiles are returned, each sorted by path
+func GroupDuplicates(tiles map[string]Fingerprint, maxDistance int) [][]string {
+	if maxDistance < 0 || len(tiles) < 2 {
+		return nil
+	}
+
+	paths := make([]string, 0, len(tiles))
+	for path := range tiles {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	parent := make([]int, len(paths))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	// Split hashes into maxDistance+1 chunks. By the pigeonhole principle two
+	// hashes within maxDistance bits agree on at least one whole chunk, so only
+	// tiles sharing a chunk value need to be compared. From 64 bits on any two
+	// hashes are within the distance and every pair is compared
+	chunks := maxDistance + 1
+	if chunks > 64 {
+		chunks = 1
+	}
+	for c := 0; c < chunks; c++ {
+		lo, hi := c*64/chunks, (c+1)*64/chunks
+		mask := (uint64(1)<<(hi-lo) - 1) << lo
+		if hi-lo == 64 {
+			mask = ^uint64(0)
+		}
+		if maxDistance >= 64 {
+			mask = 0
+		}
+
+		buckets := make(map[uint64][]int)
+		for i, path := range paths {
+			key := tiles[path].Hash & mask
+			buckets[key] = append(buckets[key], i)
+		}
+
+		for _, bucket := range buckets {
+			for x := 0; x < len(bucket); x++ {
+				for y := x + 1; y < len(bucket); y++ {
+					i, j := bucket[x], bucket[y]
+					if find(i) == find(j) {
+						continue
+					}
+					a, b := tiles[paths[i]], tiles[paths[j]]
+					if imgpkg.HammingDistance(a.Hash, b.Hash) <= maxDistance && colorDistance(a.Color, b.Color) <= MaxDuplicateColorDistance {
+						parent[find(i)] = find(j)
+					}
+				}
+			}
+		}
+	}
+
+	members := make(map[int][]string)
+	for i, path := range paths {
+		root := find(i)
+		members[root] = append(members[root], path)
+	}
+
+	var groups [][]string
+	for _, group := range members {
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+	return groups
+}
+
+// colorDistance returns the Euclidean distance between two RGB colors
+func colorDistance(a, b [3]float64) float64 {
+	dr, dg, db := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return math.Sqrt(dr*dr + dg*dg + db*db)
+}
@@ -0,0 +1,104 @@
+package tiles_db
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestGroupDuplicates tests clustering of tiles by hash distance
+func TestGroupDuplicates(t *testing.T) {
+	gray := [3]float64{30000, 30000, 30000}
+	hashes := map[string]Fingerprint{
+		"a.jpg": {0x0000000000000000, gray},
+		"b.jpg": {0x0000000000000003, gray}, // 2 bits from a
+		"c.jpg": {0x000000000000000F, gray}, // 2 bits from b, 4 from a
+		"d.jpg": {0xFFFFFFFF00000000, gray},
+		"e.jpg": {0xFFFFFFFF00000001, gray}, // 1 bit from d
+		"f.jpg": {0x00FF00FF00FF00FF, gray},
+		"g.jpg": {0x0000000000000000, [3]float64{65535, 0, 0}}, // Same hash as a, another color
+	}
+
+	groups := GroupDuplicates(hashes, 2)
+	expected := [][]string{
+		{"a.jpg", "b.jpg", "c.jpg"},
+		{"d.jpg", "e.jpg"},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("GroupDuplicates() = %v, want %v", groups, expected)
+	}
+
+	if groups := GroupDuplicates(hashes, 0); len(groups) != 0 {
+		t.Errorf("Expected no exact duplicates, got %v", groups)
+	}
+
+	// At 64 bits every hash is in range, only colors keep tiles apart
+	groups = GroupDuplicates(hashes, 64)
+	expected = [][]string{{"a.jpg", "b.jpg", "c.jpg", "d.jpg", "e.jpg", "f.jpg"}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("GroupDuplicates(64) = %v, want %v", groups, expected)
+	}
+}
+
+// TestGroupDuplicatesDistinctTiles tests that flat and gradient tiles of different colors are not grouped
+func TestGroupDuplicatesDistinctTiles(t *testing.T) {
+	dir := t.TempDir()
+	fingerprints := make(map[string]Fingerprint)
+	write := func(name string, img image.Image) {
+		path := filepath.Join(dir, name)
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatalf("Failed to create tile: %v", err)
+		}
+		if err := jpeg.Encode(file, img, &jpeg.Options{Quality: 75}); err != nil {
+			t.Fatalf("Failed to encode tile: %v", err)
+		}
+		file.Close()
+		descriptor, err := DescribeTile(path)
+		if err != nil {
+			t.Fatalf("Failed to describe tile: %v", err)
+		}
+		fingerprints[name] = descriptor.Fingerprint()
+	}
+
+	for i := 0; i < 64; i++ {
+		base := color.RGBA{uint8(i % 4 * 85), uint8(i / 4 % 4 * 85), uint8(i / 16 * 85), 255}
+		solid := image.NewRGBA(image.Rect(0, 0, 32, 32))
+		gradient := image.NewRGBA(image.Rect(0, 0, 32, 32))
+		for y := 0; y < 32; y++ {
+			for x := 0; x < 32; x++ {
+				solid.Set(x, y, base)
+				shade := uint8(x * 2)
+				gradient.Set(x, y, color.RGBA{base.R/2 + shade, base.G/2 + shade, base.B/2 + shade, 255})
+			}
+		}
+		write(fmt.Sprintf("solid%d.jpg", i), solid)
+		write(fmt.Sprintf("gradient%d.jpg", i), gradient)
+	}
+
+	if groups := GroupDuplicates(fingerprints, 6); len(groups) != 0 {
+		t.Errorf("Expected distinct tiles not to be grouped, got %d groups: %v", len(groups), groups)
+	}
+}
+
+// BenchmarkGroupDuplicates benchmarks clustering a large tile library
+func BenchmarkGroupDuplicates(b *testing.B) {
+	hashes := make(map[string]Fingerprint, 10000)
+	seed := uint64(88172645463325252)
+	for i := 0; i < 10000; i++ {
+		seed ^= seed << 13
+		seed ^= seed >> 7
+		seed ^= seed << 17
+		hashes[fmt.Sprintf("tile%d.jpg", i)] = Fingerprint{Hash: seed}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		GroupDuplicates(hashes, 6)
+	}
+}
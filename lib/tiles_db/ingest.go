@@ -0,0 +1,191 @@
+package tiles_db
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// IngestError records a file that could not be added to the tiles database
+type IngestError struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
+
+// IngestStatus is a point-in-time view of an ingestion run
+type IngestStatus struct {
+	Total    int64         `json:"total"`
+	Done     int64         `json:"done"`
+	Failed   int64         `json:"failed"`
+	Finished bool          `json:"finished"`
+	Elapsed  float64       `json:"elapsed"`
+	Errors   []IngestError `json:"errors"`
+}
+
+// IngestProgress tracks a running ingestion and is safe for concurrent use
+// Done counts every processed file, including the ones that failed
+type IngestProgress struct {
+	total    atomic.Int64
+	done     atomic.Int64
+	failed   atomic.Int64
+	finished atomic.Bool
+	started  time.Time
+
+	mu     sync.Mutex
+	errors []IngestError
+}
+
+// NewIngestProgress creates a progress tracker whose clock starts now
+func NewIngestProgress() *IngestProgress {
+	return &IngestProgress{started: time.Now()}
+}
+
+// Snapshot returns the current progress counters and collected errors
+func (p *IngestProgress) Snapshot() IngestStatus {
+	p.mu.Lock()
+	errors := make([]IngestError, len(p.errors))
+	copy(errors, p.errors)
+	p.mu.Unlock()
+
+	return IngestStatus{
+		Total:    p.total.Load(),
+		Done:     p.done.Load(),
+		Failed:   p.failed.Load(),
+		Finished: p.finished.Load(),
+		Elapsed:  time.Since(p.started).Seconds(),
+		Errors:   errors,
+	}
+}
+
+// fail records a failed file
+func (p *IngestProgress) fail(file string, err error) {
+	p.failed.Add(1)
+	p.mu.Lock()
+	p.errors = append(p.errors, IngestError{File: file, Error: err.Error()})
+	p.mu.Unlock()
+}
+
+// IngestResult holds the tiles database built by Ingest
+type IngestResult struct {
+	Descriptors map[string]Descriptor
+	Metadata    map[string]Metadata // Only tiles with a sidecar file
+	Errors      []IngestError
+	Reused      int // Unchanged tiles whose known descriptor was kept
+}
+
+// newIngestResult returns an empty result
+func newIngestResult() *IngestResult {
+	return &IngestResult{
+		Descriptors: make(map[string]Descriptor),
+		Metadata:    make(map[string]Metadata),
+	}
+}
+
+// Ingest populates a tiles database from tilesDir using a pool of workers
+// Progress is reported through progress, which may be nil
+// The result lists the files that failed to decode
+func Ingest(tilesDir string, workers int, progress *IngestProgress) *IngestResult {
+	return IngestIncremental(tilesDir, workers, progress, nil)
+}
+
+// IngestIncremental works like Ingest but doesn't decode files again when their
+// size and modification time still match their descriptor in known
+// Metadata sidecars are always reloaded
+func IngestIncremental(tilesDir string, workers int, progress *IngestProgress, known map[string]Descriptor) *IngestResult {
+	if progress == nil {
+		progress = NewIngestProgress()
+	}
+	defer progress.finished.Store(true)
+
+	result := newIngestResult()
+
+	logrus.Info("Starting tiles database population")
+
+	// Check if tiles directory exists
+	if _, err := os.Stat(tilesDir); os.IsNotExist(err) {
+		logrus.Warnf("Tiles directory '%s' does not exist", tilesDir)
+		return result
+	}
+
+	paths, err := listTileFiles(tilesDir)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to read tiles directory")
+		return result
+	}
+	progress.total.Store(int64(len(paths)))
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	// Each worker fills its own result, they are merged once all files are processed
+	jobs := make(chan string)
+	results := make([]*IngestResult, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		results[i] = newIngestResult()
+		wg.Add(1)
+		go func(partial *IngestResult) {
+			defer wg.Done()
+			for filePath := range jobs {
+				ingestFile(filePath, known, partial, progress)
+				progress.done.Add(1)
+			}
+		}(results[i])
+	}
+
+	for _, filePath := range paths {
+		jobs <- filePath
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, partial := range results {
+		for path, descriptor := range partial.Descriptors {
+			result.Descriptors[path] = descriptor
+		}
+		for path, metadata := range partial.Metadata {
+			result.Metadata[path] = metadata
+		}
+		result.Reused += partial.Reused
+	}
+
+	status := progress.Snapshot()
+	logrus.WithFields(logrus.Fields{
+		"tileCount": len(result.Descriptors),
+		"reused":    result.Reused,
+		"failed":    status.Failed,
+		"workers":   workers,
+		"elapsed":   status.Elapsed,
+	}).Info("Tiles database population completed")
+
+	result.Errors = status.Errors
+	return result
+}
+
+// ingestFile describes one tile and loads its metadata sidecar into a worker's result
+// A broken sidecar is logged but doesn't prevent the tile from being used
+func ingestFile(filePath string, known map[string]Descriptor, partial *IngestResult, progress *IngestProgress) {
+	descriptor, ok := known[filePath]
+	if info, err := os.Stat(filePath); ok && err == nil && descriptor.Matches(info) {
+		partial.Reused++
+	} else {
+		descriptor, err = processImageFile(filePath)
+		if err != nil {
+			logrus.WithError(err).WithField("file", filePath).Error("Failed to process image file")
+			progress.fail(filePath, err)
+			return
+		}
+	}
+	partial.Descriptors[filePath] = descriptor
+
+	metadata, err := LoadMetadata(filePath)
+	if err != nil {
+		logrus.WithError(err).WithField("file", filePath).Warn("Ignoring tile metadata")
+	} else if !metadata.IsEmpty() {
+		partial.Metadata[filePath] = metadata
+	}
+}
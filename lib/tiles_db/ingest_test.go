@@ -0,0 +1,77 @@
+package tiles_db
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestIngest tests parallel ingestion with progress and error collection
+func TestIngest(t *testing.T) {
+	tilesDir := t.TempDir()
+	for _, name := range []string{"a.png", "b.png", "c.png", "nature/d.png", "nature/e.png"} {
+		writeTestImage(t, filepath.Join(tilesDir, name))
+	}
+	broken := filepath.Join(tilesDir, "broken.jpg")
+	if err := os.WriteFile(broken, []byte("not a jpeg"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	progress := NewIngestProgress()
+	result := Ingest(tilesDir, 3, progress)
+	errors := result.Errors
+
+	if len(result.Descriptors) != 5 {
+		t.Errorf("Expected 5 tiles, got %d", len(result.Descriptors))
+	}
+	if len(errors) != 1 || errors[0].File != broken {
+		t.Errorf("Expected one error for '%s', got %v", broken, errors)
+	}
+
+	status := progress.Snapshot()
+	if status.Total != 6 || status.Done != 6 || status.Failed != 1 || !status.Finished {
+		t.Errorf("Unexpected final progress: %+v", status)
+	}
+}
+
+// TestIngestMissingDirectory tests that a missing directory yields an empty database
+func TestIngestMissingDirectory(t *testing.T) {
+	progress := NewIngestProgress()
+	result := Ingest(filepath.Join(t.TempDir(), "missing"), 2, progress)
+
+	if len(result.Descriptors) != 0 || len(result.Errors) != 0 {
+		t.Errorf("Expected empty results, got %d tiles and %d errors", len(result.Descriptors), len(result.Errors))
+	}
+	if !progress.Snapshot().Finished {
+		t.Error("Expected progress to be finished")
+	}
+}
+
+// TestIngestIncremental tests that unchanged tiles are not decoded again
+func TestIngestIncremental(t *testing.T) {
+	tilesDir := t.TempDir()
+	for _, name := range []string{"a.png", "b.png"} {
+		writeTestImage(t, filepath.Join(tilesDir, name))
+	}
+	first := Ingest(tilesDir, 2, nil)
+
+	// A stale descriptor is recomputed, a matching one is kept as is
+	known := make(map[string]Descriptor)
+	for path, descriptor := range first.Descriptors {
+		known[path] = descriptor
+	}
+	stale := known[filepath.Join(tilesDir, "b.png")]
+	stale.Size++
+	stale.Hash = 42
+	known[filepath.Join(tilesDir, "b.png")] = stale
+
+	result := IngestIncremental(tilesDir, 2, nil, known)
+
+	if result.Reused != 1 || len(result.Descriptors) != 2 {
+		t.Fatalf("Expected 2 tiles with 1 reused, got %d with %d reused", len(result.Descriptors), result.Reused)
+	}
+	if !reflect.DeepEqual(result.Descriptors[filepath.Join(tilesDir, "b.png")], first.Descriptors[filepath.Join(tilesDir, "b.png")]) {
+		t.Error("Expected the stale descriptor to be recomputed")
+	}
+}
@@ -0,0 +1,102 @@
+package tiles_db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Metadata holds descriptive and attribution information about a tile
+type Metadata struct {
+	Tags      []string `json:"tags,omitempty"`
+	Author    string   `json:"author,omitempty"`
+	SourceURL string   `json:"sourceUrl,omitempty"`
+	License   string   `json:"license,omitempty"`
+	Caption   string   `json:"caption,omitempty"`
+}
+
+// IsEmpty reports whether no metadata field is set
+func (m Metadata) IsEmpty() bool {
+	return len(m.Tags) == 0 && m.Author == "" && m.SourceURL == "" && m.License == "" && m.Caption == ""
+}
+
+// HasAnyTag reports whether the tile carries at least one of tags
+func (m Metadata) HasAnyTag(tags []string) bool {
+	for _, want := range tags {
+		for _, tag := range m.Tags {
+			if tag == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Normalize lowercases, trims, deduplicates and sorts the tags
+func (m Metadata) Normalize() Metadata {
+	m.Tags = NormalizeTags(m.Tags)
+	m.Author = strings.TrimSpace(m.Author)
+	m.SourceURL = strings.TrimSpace(m.SourceURL)
+	m.License = strings.TrimSpace(m.License)
+	m.Caption = strings.TrimSpace(m.Caption)
+	return m
+}
+
+// NormalizeTags lowercases, trims, deduplicates and sorts tags, dropping empty ones
+func NormalizeTags(tags []string) []string {
+	seen := make(map[string]bool, len(tags))
+	var normalized []string
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// SidecarPath returns the path of the metadata sidecar of a tile ("leaf.jpg" -> "leaf.jpg.json")
+func SidecarPath(tilePath string) string {
+	return tilePath + ".json"
+}
+
+// LoadMetadata reads the sidecar of a tile
+// A missing sidecar is not an error and yields empty metadata
+func LoadMetadata(tilePath string) (Metadata, error) {
+	data, err := os.ReadFile(SidecarPath(tilePath))
+	if os.IsNotExist(err) {
+		return Metadata{}, nil
+	}
+	if err != nil {
+		return Metadata{}, fmt.Errorf("failed to read metadata sidecar: %w", err)
+	}
+
+	var metadata Metadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return Metadata{}, fmt.Errorf("failed to parse metadata sidecar: %w", err)
+	}
+	return metadata.Normalize(), nil
+}
+
+// SaveMetadata writes the sidecar of a tile, removing it when metadata is empty
+func SaveMetadata(tilePath string, metadata Metadata) error {
+	if metadata.IsEmpty() {
+		if err := os.Remove(SidecarPath(tilePath)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove metadata sidecar: %w", err)
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	if err := os.WriteFile(SidecarPath(tilePath), data, 0644); err != nil {
+		return fmt.Errorf("failed to write metadata sidecar: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package tiles_db
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestMetadataRoundTrip tests saving, loading and removing a metadata sidecar
+func TestMetadataRoundTrip(t *testing.T) {
+	tilePath := filepath.Join(t.TempDir(), "leaf.png")
+	writeTestImage(t, tilePath)
+
+	metadata, err := LoadMetadata(tilePath)
+	if err != nil || !metadata.IsEmpty() {
+		t.Fatalf("Expected empty metadata without sidecar, got %+v, %v", metadata, err)
+	}
+
+	saved := Metadata{Tags: []string{" Nature", "green", "nature"}, Author: " Ana "}.Normalize()
+	if err := SaveMetadata(tilePath, saved); err != nil {
+		t.Fatalf("Failed to save metadata: %v", err)
+	}
+	loaded, err := LoadMetadata(tilePath)
+	if err != nil {
+		t.Fatalf("Failed to load metadata: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, Metadata{Tags: []string{"green", "nature"}, Author: "Ana"}) {
+		t.Errorf("Unexpected metadata: %+v", loaded)
+	}
+	if !loaded.HasAnyTag([]string{"sky", "green"}) || loaded.HasAnyTag([]string{"sky"}) {
+		t.Errorf("Unexpected tag matching for %v", loaded.Tags)
+	}
+
+	// Saving empty metadata removes the sidecar
+	if err := SaveMetadata(tilePath, Metadata{}); err != nil {
+		t.Fatalf("Failed to clear metadata: %v", err)
+	}
+	if _, err := os.Stat(SidecarPath(tilePath)); !os.IsNotExist(err) {
+		t.Errorf("Expected sidecar to be removed, got %v", err)
+	}
+}
+
+// TestIngestLoadsSidecars tests that ingestion picks up metadata sidecars without treating them as tiles
+func TestIngestLoadsSidecars(t *testing.T) {
+	tilesDir := t.TempDir()
+	tilePath := filepath.Join(tilesDir, "leaf.png")
+	writeTestImage(t, tilePath)
+	writeTestImage(t, filepath.Join(tilesDir, "stone.png"))
+	if err := os.WriteFile(SidecarPath(tilePath), []byte(`{"tags": ["Green"], "license": "CC0"}`), 0644); err != nil {
+		t.Fatalf("Failed to write sidecar: %v", err)
+	}
+
+	result := Ingest(tilesDir, 2, nil)
+
+	if len(result.Descriptors) != 2 || len(result.Errors) != 0 {
+		t.Fatalf("Expected 2 tiles and no errors, got %d tiles and %v", len(result.Descriptors), result.Errors)
+	}
+	if len(result.Metadata) != 1 || result.Metadata[tilePath].License != "CC0" {
+		t.Errorf("Unexpected metadata: %+v", result.Metadata)
+	}
+	if tags := result.Metadata[tilePath].Tags; len(tags) != 1 || tags[0] != "green" {
+		t.Errorf("Expected normalized tags, got %v", tags)
+	}
+}
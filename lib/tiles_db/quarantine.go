@@ -0,0 +1,190 @@
+package tiles_db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QuarantineEntry records a tile file that failed to ingest
+// The file stays where it is; it is skipped by renders until a retry succeeds
+type QuarantineEntry struct {
+	File      string    `json:"file"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// Quarantine is the list of tile files that failed to ingest, persisted as JSON
+// so that it can be inspected from the command line. It is safe for concurrent use
+type Quarantine struct {
+	path string // Empty for a quarantine kept in memory only
+
+	mu      sync.Mutex
+	entries map[string]QuarantineEntry
+}
+
+// NewQuarantine returns an empty quarantine that is not persisted
+func NewQuarantine() *Quarantine {
+	return &Quarantine{entries: make(map[string]QuarantineEntry)}
+}
+
+// OpenQuarantine loads the quarantine persisted at path, a missing file is an empty quarantine
+func OpenQuarantine(path string) (*Quarantine, error) {
+	q := NewQuarantine()
+	q.path = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quarantine: %w", err)
+	}
+
+	var entries []QuarantineEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse quarantine: %w", err)
+	}
+	for _, entry := range entries {
+		q.entries[entry.File] = entry
+	}
+	return q, nil
+}
+
+// Add quarantines file, or records another failure of a quarantined file
+func (q *Quarantine) Add(file, reason string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.record(file, reason, time.Now().UTC())
+	return q.save()
+}
+
+// Sync records a failure of every file in failures and releases all other
+// files, writing the quarantine once. failures maps files to their errors
+func (q *Quarantine) Sync(failures map[string]string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now().UTC()
+	for file := range q.entries {
+		if _, ok := failures[file]; !ok {
+			delete(q.entries, file)
+		}
+	}
+	for file, reason := range failures {
+		q.record(file, reason, now)
+	}
+	return q.save()
+}
+
+// record adds a failure of file at now, the caller must hold q.mu
+func (q *Quarantine) record(file, reason string, now time.Time) {
+	entry, ok := q.entries[file]
+	if !ok {
+		entry = QuarantineEntry{File: file, FirstSeen: now}
+	}
+	entry.Error = reason
+	entry.Attempts++
+	entry.LastSeen = now
+	q.entries[file] = entry
+}
+
+// Remove releases file from the quarantine, removing a file that is not quarantined is not an error
+func (q *Quarantine) Remove(files ...string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	removed := false
+	for _, file := range files {
+		if _, ok := q.entries[file]; ok {
+			delete(q.entries, file)
+			removed = true
+		}
+	}
+	if !removed {
+		return nil
+	}
+	return q.save()
+}
+
+// Get returns the quarantine entry of file
+func (q *Quarantine) Get(file string) (QuarantineEntry, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entry, ok := q.entries[file]
+	return entry, ok
+}
+
+// List returns all entries sorted by file
+func (q *Quarantine) List() []QuarantineEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.sorted()
+}
+
+// sorted returns the entries sorted by file, the caller must hold q.mu
+func (q *Quarantine) sorted() []QuarantineEntry {
+	entries := make([]QuarantineEntry, 0, len(q.entries))
+	for _, entry := range q.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].File < entries[j].File })
+	return entries
+}
+
+// Retry describes a quarantined file again
+// On success the file leaves the quarantine, otherwise the failure is recorded.
+// A file that no longer exists leaves the quarantine and an error wrapping
+// os.ErrNotExist is returned
+func (q *Quarantine) Retry(file string) (Descriptor, error) {
+	if _, ok := q.Get(file); !ok {
+		return Descriptor{}, fmt.Errorf("%s is not quarantined", file)
+	}
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		if err := q.Remove(file); err != nil {
+			return Descriptor{}, err
+		}
+		return Descriptor{}, fmt.Errorf("quarantined file is gone: %w", err)
+	}
+
+	descriptor, err := processImageFile(file)
+	if err != nil {
+		if saveErr := q.Add(file, err.Error()); saveErr != nil {
+			return Descriptor{}, saveErr
+		}
+		return Descriptor{}, err
+	}
+	return descriptor, q.Remove(file)
+}
+
+// save writes the entries to the quarantine file through a temporary file
+// The caller must hold q.mu
+func (q *Quarantine) save() error {
+	if q.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(q.sorted(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode quarantine: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(q.path), 0755); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write quarantine: %w", err)
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return fmt.Errorf("failed to write quarantine: %w", err)
+	}
+	return nil
+}
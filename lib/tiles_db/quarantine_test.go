@@ -0,0 +1,115 @@
+package tiles_db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestQuarantinePersistence tests that entries and attempts survive reopening the quarantine
+func TestQuarantinePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "quarantine.json")
+	q, err := OpenQuarantine(path)
+	if err != nil {
+		t.Fatalf("Failed to open quarantine: %v", err)
+	}
+	if err := q.Add("b.jpg", "failed to decode image"); err != nil {
+		t.Fatalf("Failed to add entry: %v", err)
+	}
+	if err := q.Add("a.jpg", "failed to decode image"); err != nil {
+		t.Fatalf("Failed to add entry: %v", err)
+	}
+	if err := q.Add("b.jpg", "unexpected EOF"); err != nil {
+		t.Fatalf("Failed to add entry: %v", err)
+	}
+
+	q, err = OpenQuarantine(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen quarantine: %v", err)
+	}
+	entries := q.List()
+	if len(entries) != 2 || entries[0].File != "a.jpg" || entries[1].File != "b.jpg" {
+		t.Fatalf("Expected a.jpg and b.jpg, got %+v", entries)
+	}
+	if entries[1].Attempts != 2 || entries[1].Error != "unexpected EOF" {
+		t.Errorf("Expected 2 attempts ending with the latest error, got %+v", entries[1])
+	}
+
+	if err := q.Remove("a.jpg", "missing.jpg"); err != nil {
+		t.Fatalf("Failed to remove entry: %v", err)
+	}
+	if _, ok := q.Get("a.jpg"); ok {
+		t.Error("Expected a.jpg to leave the quarantine")
+	}
+}
+
+// TestQuarantineSync tests that a sync records failures and releases the other files
+func TestQuarantineSync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quarantine.json")
+	q, err := OpenQuarantine(path)
+	if err != nil {
+		t.Fatalf("Failed to open quarantine: %v", err)
+	}
+	if err := q.Add("fixed.jpg", "failed to decode image"); err != nil {
+		t.Fatalf("Failed to add entry: %v", err)
+	}
+	if err := q.Add("broken.jpg", "failed to decode image"); err != nil {
+		t.Fatalf("Failed to add entry: %v", err)
+	}
+
+	if err := q.Sync(map[string]string{"broken.jpg": "unexpected EOF", "new.jpg": "bad header"}); err != nil {
+		t.Fatalf("Failed to sync quarantine: %v", err)
+	}
+
+	q, err = OpenQuarantine(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen quarantine: %v", err)
+	}
+	entries := q.List()
+	if len(entries) != 2 || entries[0].File != "broken.jpg" || entries[1].File != "new.jpg" {
+		t.Fatalf("Expected broken.jpg and new.jpg, got %+v", entries)
+	}
+	if entries[0].Attempts != 2 || entries[0].Error != "unexpected EOF" {
+		t.Errorf("Expected 2 attempts ending with the latest error, got %+v", entries[0])
+	}
+	if entries[1].Attempts != 1 {
+		t.Errorf("Expected 1 attempt for a new failure, got %+v", entries[1])
+	}
+}
+
+// TestQuarantineRetry tests retrying a broken, a fixed and a deleted file
+func TestQuarantineRetry(t *testing.T) {
+	dir := t.TempDir()
+	broken, fixed, gone := filepath.Join(dir, "broken.png"), filepath.Join(dir, "fixed.png"), filepath.Join(dir, "gone.png")
+	for _, path := range []string{broken, fixed} {
+		if err := os.WriteFile(path, []byte("not a png"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	q := NewQuarantine()
+	for _, path := range []string{broken, fixed, gone} {
+		if err := q.Add(path, "failed to decode image"); err != nil {
+			t.Fatalf("Failed to add entry: %v", err)
+		}
+	}
+	writeTestImage(t, fixed)
+
+	if _, err := q.Retry(broken); err == nil {
+		t.Error("Expected the broken file to fail again")
+	}
+	if entry, _ := q.Get(broken); entry.Attempts != 2 {
+		t.Errorf("Expected 2 attempts, got %d", entry.Attempts)
+	}
+
+	descriptor, err := q.Retry(fixed)
+	if err != nil || descriptor.SHA256 == "" {
+		t.Errorf("Expected the fixed file to ingest, got %v", err)
+	}
+	if _, err := q.Retry(gone); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected a missing file error, got %v", err)
+	}
+	if entries := q.List(); len(entries) != 1 || entries[0].File != broken {
+		t.Errorf("Expected only the broken file to stay quarantined, got %+v", entries)
+	}
+}
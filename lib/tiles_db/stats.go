@@ -0,0 +1,200 @@
+package tiles_db
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+)
+
+const (
+	// statsSampleSize is the side of the grid of pixels the statistics are computed from
+	statsSampleSize = 32
+	// histogramBins is the number of bins of the luminance histogram
+	histogramBins = 16
+	// dominantColors is the number of k-means clusters
+	dominantColors = 3
+	// edgeThreshold is the Sobel gradient magnitude, in 8-bit luminance, above which a pixel is an edge
+	edgeThreshold = 64
+)
+
+// DominantColor is a k-means cluster center and the fraction of pixels it holds
+type DominantColor struct {
+	Color  [3]float64 `json:"color"` // 8-bit per channel
+	Hex    string     `json:"hex"`
+	Weight float64    `json:"weight"`
+}
+
+// Stats describes the content of a tile beyond its average color
+// Colors and luminance are 8-bit per channel
+type Stats struct {
+	Variance    float64         `json:"variance"`    // Mean squared RGB distance to the average color
+	Brightness  float64         `json:"brightness"`  // Mean luminance, 0 to 255
+	EdgeDensity float64         `json:"edgeDensity"` // Fraction of pixels on an edge
+	Dominant    []DominantColor `json:"dominant"`    // Up to 3 clusters, largest first
+	Histogram   []float64       `json:"histogram"`   // Fraction of pixels in each of 16 luminance bins
+}
+
+// StdDev returns the color standard deviation of the tile
+func (s Stats) StdDev() float64 {
+	return math.Sqrt(s.Variance)
+}
+
+// ComputeStats computes the statistics of an image from a grid of sampled pixels
+func ComputeStats(img image.Image) Stats {
+	pixels, width := samplePixels(img)
+	stats := Stats{Histogram: make([]float64, histogramBins)}
+	if len(pixels) == 0 {
+		return stats
+	}
+	n := float64(len(pixels))
+
+	var mean [3]float64
+	lum := make([]float64, len(pixels))
+	for i, p := range pixels {
+		for c := range mean {
+			mean[c] += p[c] / n
+		}
+		lum[i] = 0.299*p[0] + 0.587*p[1] + 0.114*p[2]
+		stats.Brightness += lum[i] / n
+
+		bin := int(lum[i]) * histogramBins / 256
+		if bin >= histogramBins {
+			bin = histogramBins - 1
+		}
+		stats.Histogram[bin] += 1 / n
+	}
+	for _, p := range pixels {
+		stats.Variance += squaredDistance(p, mean) / n
+	}
+
+	stats.EdgeDensity = edgeDensity(lum, width, len(pixels)/width)
+	stats.Dominant = kMeans(pixels, lum)
+	return stats
+}
+
+// samplePixels returns up to statsSampleSize x statsSampleSize evenly spaced 8-bit pixels, row by row
+func samplePixels(img image.Image) ([][3]float64, int) {
+	bounds := img.Bounds()
+	width, height := min(bounds.Dx(), statsSampleSize), min(bounds.Dy(), statsSampleSize)
+	if width <= 0 || height <= 0 {
+		return nil, 0
+	}
+
+	pixels := make([][3]float64, 0, width*height)
+	for j := 0; j < height; j++ {
+		y := bounds.Min.Y + j*bounds.Dy()/height
+		for i := 0; i < width; i++ {
+			x := bounds.Min.X + i*bounds.Dx()/width
+			r, g, b, _ := img.At(x, y).RGBA()
+			pixels = append(pixels, [3]float64{float64(r >> 8), float64(g >> 8), float64(b >> 8)})
+		}
+	}
+	return pixels, width
+}
+
+// edgeDensity returns the fraction of interior pixels whose Sobel gradient exceeds edgeThreshold
+func edgeDensity(lum []float64, width, height int) float64 {
+	if width < 3 || height < 3 {
+		return 0
+	}
+	at := func(x, y int) float64 { return lum[y*width+x] }
+
+	edges := 0
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+			gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+			if math.Hypot(gx, gy) > edgeThreshold {
+				edges++
+			}
+		}
+	}
+	return float64(edges) / float64((width-2)*(height-2))
+}
+
+// kMeans clusters the pixels into up to dominantColors colors
+// Centers start at the luminance quantiles so the result is deterministic;
+// clusters that end up empty or on top of each other are merged
+func kMeans(pixels [][3]float64, lum []float64) []DominantColor {
+	order := make([]int, len(pixels))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return lum[order[a]] < lum[order[b]] })
+
+	centers := make([][3]float64, dominantColors)
+	for k := range centers {
+		centers[k] = pixels[order[(2*k+1)*len(order)/(2*dominantColors)]]
+	}
+
+	assignment := make([]int, len(pixels))
+	counts := make([]int, dominantColors)
+	for iteration := 0; iteration < 10; iteration++ {
+		changed := false
+		for i, p := range pixels {
+			best := 0
+			for k := 1; k < dominantColors; k++ {
+				if squaredDistance(p, centers[k]) < squaredDistance(p, centers[best]) {
+					best = k
+				}
+			}
+			if iteration == 0 || best != assignment[i] {
+				assignment[i] = best
+				changed = true
+			}
+		}
+
+		sums := make([][3]float64, dominantColors)
+		counts = make([]int, dominantColors)
+		for i, p := range pixels {
+			k := assignment[i]
+			counts[k]++
+			for c := range p {
+				sums[k][c] += p[c]
+			}
+		}
+		for k := range centers {
+			if counts[k] > 0 {
+				for c := range centers[k] {
+					centers[k][c] = sums[k][c] / float64(counts[k])
+				}
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+
+	var dominant []DominantColor
+	for k, center := range centers {
+		if counts[k] == 0 {
+			continue
+		}
+		weight := float64(counts[k]) / float64(len(pixels))
+		merged := false
+		for i := range dominant {
+			if squaredDistance(dominant[i].Color, center) < 1 {
+				dominant[i].Weight += weight
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			dominant = append(dominant, DominantColor{Color: center, Weight: weight})
+		}
+	}
+	sort.SliceStable(dominant, func(i, j int) bool { return dominant[i].Weight > dominant[j].Weight })
+	for i := range dominant {
+		c := dominant[i].Color
+		dominant[i].Color = [3]float64{math.Round(c[0]), math.Round(c[1]), math.Round(c[2])}
+		dominant[i].Hex = fmt.Sprintf("#%02x%02x%02x", uint8(dominant[i].Color[0]), uint8(dominant[i].Color[1]), uint8(dominant[i].Color[2]))
+		dominant[i].Weight = math.Round(dominant[i].Weight*1000) / 1000
+	}
+	return dominant
+}
+
+// squaredDistance returns the squared Euclidean distance between two colors
+func squaredDistance(a, b [3]float64) float64 {
+	return (a[0]-b[0])*(a[0]-b[0]) + (a[1]-b[1])*(a[1]-b[1]) + (a[2]-b[2])*(a[2]-b[2])
+}
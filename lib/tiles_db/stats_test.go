@@ -0,0 +1,75 @@
+package tiles_db
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestComputeStats tests the statistics of a flat and a two-color tile
+func TestComputeStats(t *testing.T) {
+	flat := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	draw.Draw(flat, flat.Bounds(), &image.Uniform{color.RGBA{200, 40, 40, 255}}, image.Point{}, draw.Src)
+
+	stats := ComputeStats(flat)
+	if stats.Variance != 0 || stats.EdgeDensity != 0 {
+		t.Errorf("Expected a flat tile to have no variance and no edges, got %v and %v", stats.Variance, stats.EdgeDensity)
+	}
+	if len(stats.Dominant) != 1 || stats.Dominant[0].Hex != "#c82828" || stats.Dominant[0].Weight != 1 {
+		t.Errorf("Expected a single dominant color #c82828, got %+v", stats.Dominant)
+	}
+	if len(stats.Histogram) != histogramBins {
+		t.Fatalf("Expected %d histogram bins, got %d", histogramBins, len(stats.Histogram))
+	}
+	bin := int(stats.Brightness) * histogramBins / 256
+	if stats.Histogram[bin] != 1 {
+		t.Errorf("Expected every pixel in bin %d, got %v", bin, stats.Histogram)
+	}
+
+	// Left half black, right half white
+	split := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	draw.Draw(split, split.Bounds(), &image.Uniform{color.Black}, image.Point{}, draw.Src)
+	draw.Draw(split, image.Rect(8, 0, 16, 16), &image.Uniform{color.White}, image.Point{}, draw.Src)
+
+	stats = ComputeStats(split)
+	if math.Abs(stats.Brightness-127.5) > 0.5 {
+		t.Errorf("Expected brightness 127.5, got %v", stats.Brightness)
+	}
+	if stats.StdDev() < 200 {
+		t.Errorf("Expected a large standard deviation, got %v", stats.StdDev())
+	}
+	if stats.EdgeDensity <= 0 || stats.EdgeDensity >= 0.5 {
+		t.Errorf("Expected edges only along the split, got %v", stats.EdgeDensity)
+	}
+	if len(stats.Dominant) != 2 || stats.Dominant[0].Weight != 0.5 || stats.Dominant[1].Weight != 0.5 {
+		t.Errorf("Expected black and white as equal dominant colors, got %+v", stats.Dominant)
+	}
+	if stats.Histogram[0] != 0.5 || stats.Histogram[histogramBins-1] != 0.5 {
+		t.Errorf("Expected half of the pixels in each end bin, got %v", stats.Histogram)
+	}
+}
+
+// TestIngestRecomputesMissingStats tests that descriptors stored before statistics existed are recomputed
+func TestIngestRecomputesMissingStats(t *testing.T) {
+	tilesDir := t.TempDir()
+	path := filepath.Join(tilesDir, "a.png")
+	writeTestImage(t, path)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat tile: %v", err)
+	}
+
+	old := Descriptor{SHA256: "abc", Size: info.Size(), ModTime: info.ModTime()}
+	result := IngestIncremental(tilesDir, 1, nil, map[string]Descriptor{path: old})
+
+	if result.Reused != 0 {
+		t.Errorf("Expected the descriptor without stats to be recomputed, got %d reused", result.Reused)
+	}
+	if len(result.Descriptors[path].Stats.Histogram) != histogramBins {
+		t.Errorf("Expected the recomputed descriptor to have stats, got %+v", result.Descriptors[path].Stats)
+	}
+}
@@ -1,61 +1,137 @@
 package tiles_db
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"image"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	imgpkg "wilbertopachecob/mosaic/lib/img"
 )
 
+// DefaultMaxPixels is the most pixels a tile may declare before it is decoded
+const DefaultMaxPixels = 40 * 1000 * 1000
+
+// maxPixels is the pixel limit of processImageFile, see SetMaxPixels
+var maxPixels atomic.Int64
+
+func init() {
+	maxPixels.Store(DefaultMaxPixels)
+}
+
+// SetMaxPixels sets the most pixels a tile may declare before it is decoded,
+// zero or less for no limit. Larger tiles fail to ingest without being decoded
+func SetMaxPixels(pixels int64) {
+	maxPixels.Store(pixels)
+}
+
 // TilesDB initializes and populates the tiles database
 // Scans the tiles directory for image files and calculates their average colors
 // Returns a map of filename to average color [R, G, B]
 func TilesDB() map[string][3]float64 {
-	logrus.Info("Starting tiles database population")
-	
-	db := make(map[string][3]float64)
-	tilesDir := "tiles"
-	
-	// Check if tiles directory exists
-	if _, err := os.Stat(tilesDir); os.IsNotExist(err) {
-		logrus.Warnf("Tiles directory '%s' does not exist", tilesDir)
-		return db
+	return TilesDBFromDir("tiles")
+}
+
+// TilesDBFromDir populates the tiles database from the given directory
+// Images directly inside tilesDir belong to the default collection, images in
+// its immediate subdirectories belong to the collection named after the subdirectory
+func TilesDBFromDir(tilesDir string) map[string][3]float64 {
+	result := Ingest(tilesDir, runtime.NumCPU(), nil)
+	colors := make(map[string][3]float64, len(result.Descriptors))
+	for path, descriptor := range result.Descriptors {
+		colors[path] = descriptor.Color
 	}
+	return colors
+}
+
+// listTileFiles returns the paths of all image files in tilesDir and its collections
+func listTileFiles(tilesDir string) ([]string, error) {
+	var paths []string
 	
-	// Read tiles directory
 	files, err := os.ReadDir(tilesDir)
 	if err != nil {
-		logrus.WithError(err).Error("Failed to read tiles directory")
-		return db
+		return nil, err
 	}
 	
-	// Process each file in the tiles directory
 	for _, file := range files {
 		if file.IsDir() {
-			continue // Skip subdirectories
-		}
-		
-		filename := file.Name()
-		filePath := filepath.Join(tilesDir, filename)
-		
-		// Check if file is an image
-		if !isImageFile(filename) {
-			logrus.Debugf("Skipping non-image file: %s", filename)
+			// Subdirectories are collections, scan them one level deep
+			if IsValidCollection(file.Name()) {
+				paths = append(paths, listCollectionFiles(filepath.Join(tilesDir, file.Name()))...)
+			}
 			continue
 		}
 		
-		// Process the image file
-		if err := processImageFile(filePath, db); err != nil {
-			logrus.WithError(err).WithField("file", filePath).Error("Failed to process image file")
+		if isImageFile(file.Name()) {
+			paths = append(paths, filepath.Join(tilesDir, file.Name()))
+		} else {
+			logrus.Debugf("Skipping non-image file: %s", file.Name())
 		}
 	}
+	return paths, nil
+}
+
+// listCollectionFiles returns the paths of all image files in a collection directory
+func listCollectionFiles(collectionDir string) []string {
+	var paths []string
 	
-	logrus.WithField("tileCount", len(db)).Info("Tiles database population completed")
-	return db
+	files, err := os.ReadDir(collectionDir)
+	if err != nil {
+		logrus.WithError(err).WithField("collection", collectionDir).Error("Failed to read collection directory")
+		return nil
+	}
+	
+	for _, file := range files {
+		if file.IsDir() {
+			continue // Collections are not nested
+		}
+		if isImageFile(file.Name()) {
+			paths = append(paths, filepath.Join(collectionDir, file.Name()))
+		} else {
+			logrus.Debugf("Skipping non-image file: %s", file.Name())
+		}
+	}
+	return paths
+}
+
+// Descriptor holds the values computed for a tile when it is ingested
+// SHA256 is the hex digest of the file content and identifies the tile independently
+// of its file name. Size and ModTime identify the file version the descriptor was computed from
+// and HashVersion the DHash version of Hash
+type Descriptor struct {
+	Color       [3]float64
+	Hash        uint64
+	HashVersion int
+	SHA256      string
+	Size        int64
+	ModTime     time.Time
+	Stats       Stats
+}
+
+// Fingerprint returns what near-duplicate detection compares of the tile
+func (d Descriptor) Fingerprint() Fingerprint {
+	return Fingerprint{Hash: d.Hash, Color: d.Color}
+}
+
+// Matches reports whether the descriptor was computed from a file with the given info
+// Descriptors without a content hash, statistics or a current perceptual hash never
+// match so that they get recomputed
+func (d Descriptor) Matches(info os.FileInfo) bool {
+	return d.SHA256 != "" && len(d.Stats.Histogram) > 0 && d.HashVersion == imgpkg.DHashVersion &&
+		d.Size == info.Size() && d.ModTime.Equal(info.ModTime())
+}
+
+// DescribeTile decodes the image at filePath and computes its descriptor
+func DescribeTile(filePath string) (Descriptor, error) {
+	return processImageFile(filePath)
 }
 
 // CloneTilesDB creates a deep copy of the tiles database
@@ -68,6 +144,25 @@ func CloneTilesDB(tilesDB map[string][3]float64) map[string][3]float64 {
 	return db
 }
 
+// IsImageFile reports whether a filename has a supported image extension
+func IsImageFile(filename string) bool {
+	return isImageFile(filename)
+}
+
+// IsValidCollection reports whether name can be used as a collection directory
+// Collection names are a single path segment of letters, digits, '-' and '_'
+func IsValidCollection(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
 // isImageFile checks if a filename has an image extension
 func isImageFile(filename string) bool {
 	ext := strings.ToLower(filepath.Ext(filename))
@@ -81,32 +176,51 @@ func isImageFile(filename string) bool {
 	return false
 }
 
-// processImageFile processes a single image file and adds it to the database
-func processImageFile(filePath string, db map[string][3]float64) error {
+// processImageFile decodes a single image file and computes its descriptor
+func processImageFile(filePath string) (Descriptor, error) {
 	// Open the image file
 	file, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		return Descriptor{}, fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
-	
-	// Decode the image
-	img, format, err := image.Decode(file)
+
+	info, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to decode image: %w", err)
+		return Descriptor{}, fmt.Errorf("failed to stat file: %w", err)
 	}
 	
-	// Calculate average color
-	avgColor := imgpkg.AverageColor(img)
+	if _, _, err := imgpkg.CheckPixels(file, maxPixels.Load()); err != nil {
+		return Descriptor{}, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	// Decode the image, hashing the content as it is read
+	hasher := sha256.New()
+	img, format, err := image.Decode(io.TeeReader(file, hasher))
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("failed to decode image: %w", err)
+	}
+	if _, err := io.Copy(hasher, file); err != nil {
+		return Descriptor{}, fmt.Errorf("failed to read file: %w", err)
+	}
 	
-	// Add to database
-	db[filePath] = avgColor
+	// Calculate average color, perceptual hash and content statistics
+	descriptor := Descriptor{
+		Color:       imgpkg.AverageColor(img),
+		Hash:        imgpkg.DHash(img),
+		HashVersion: imgpkg.DHashVersion,
+		SHA256:      hex.EncodeToString(hasher.Sum(nil)),
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+		Stats:       ComputeStats(img),
+	}
 	
 	logrus.WithFields(logrus.Fields{
 		"file":   filePath,
 		"format": format,
-		"color":  avgColor,
-	}).Debug("Added tile to database")
+		"color":  descriptor.Color,
+		"hash":   fmt.Sprintf("%016x", descriptor.Hash),
+	}).Debug("Described tile")
 	
-	return nil
+	return descriptor, nil
 }
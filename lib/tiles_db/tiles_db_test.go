@@ -1,10 +1,17 @@
 package tiles_db
 
 import (
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
 	"os"
 	"path/filepath"
 	"testing"
+
+	imgpkg "wilbertopachecob/mosaic/lib/img"
 )
 
 // TestCloneTilesDB tests the CloneTilesDB function
@@ -113,4 +120,82 @@ func BenchmarkIsImageFile(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		isImageFile(filename)
 	}
-} 
\ No newline at end of file
+} 
+// TestTilesDBFromDir tests that tiles are loaded from the root directory and collections
+func TestTilesDBFromDir(t *testing.T) {
+	tilesDir := t.TempDir()
+	writeTestImage(t, filepath.Join(tilesDir, "root.png"))
+	writeTestImage(t, filepath.Join(tilesDir, "nature", "leaf.png"))
+	writeTestImage(t, filepath.Join(tilesDir, "nature", "nested", "skipped.png"))
+	if err := os.WriteFile(filepath.Join(tilesDir, "readme.txt"), []byte("text"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	db := TilesDBFromDir(tilesDir)
+
+	if len(db) != 2 {
+		t.Fatalf("Expected 2 tiles, got %d: %v", len(db), db)
+	}
+	for _, path := range []string{filepath.Join(tilesDir, "root.png"), filepath.Join(tilesDir, "nature", "leaf.png")} {
+		if _, exists := db[path]; !exists {
+			t.Errorf("Expected tile '%s' to be loaded", path)
+		}
+	}
+}
+
+// TestDescribeTileMaxPixels tests that tiles over the pixel limit fail before they are decoded
+func TestDescribeTileMaxPixels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tile.png")
+	writeTestImage(t, path)
+
+	SetMaxPixels(15)
+	t.Cleanup(func() { SetMaxPixels(DefaultMaxPixels) })
+	if _, err := DescribeTile(path); !errors.Is(err, imgpkg.ErrTooManyPixels) {
+		t.Errorf("Expected a 4x4 tile to exceed a 15 pixel limit, got %v", err)
+	}
+
+	SetMaxPixels(16)
+	if _, err := DescribeTile(path); err != nil {
+		t.Errorf("Expected a 4x4 tile to fit a 16 pixel limit, got %v", err)
+	}
+}
+
+// TestIsValidCollection tests collection name validation
+func TestIsValidCollection(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{"nature", true},
+		{"stock_photos-2024", true},
+		{"", false},
+		{"..", false},
+		{"a/b", false},
+		{"with space", false},
+	}
+
+	for _, tt := range tests {
+		if result := IsValidCollection(tt.name); result != tt.expected {
+			t.Errorf("IsValidCollection('%s') = %t, want %t", tt.name, result, tt.expected)
+		}
+	}
+}
+
+// writeTestImage writes a small solid gray PNG, creating parent directories
+func writeTestImage(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.Gray{128}}, image.Point{}, draw.Src)
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, img); err != nil {
+		t.Fatalf("Failed to encode image: %v", err)
+	}
+}
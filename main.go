@@ -6,25 +6,113 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"wilbertopachecob/mosaic/config"
+	"wilbertopachecob/mosaic/lib/api_keys"
+	"wilbertopachecob/mosaic/lib/jobs"
+	"wilbertopachecob/mosaic/lib/rate_limit"
+	"wilbertopachecob/mosaic/lib/result_cache"
+	"wilbertopachecob/mosaic/lib/tile_cache"
+	"wilbertopachecob/mosaic/lib/tile_store"
 	"wilbertopachecob/mosaic/lib/tiles_db"
 )
 
-// Global tiles database - initialized at startup
-var tilesDB map[string][3]float64
+// Global tile index - replaced by the configured backend at startup
+var tileStore tile_store.TileStore = tile_store.NewMemoryStore()
+
+// Near-duplicate groups keyed by tile path, each group lists all of its members
+// The map is replaced, never modified, when groups are recomputed
+var tileGroups = make(map[string][]string)
+
+// Tile index and version tileGroups were computed from, guarded by tilesMu
+var (
+	tileGroupsStore   tile_store.TileStore
+	tileGroupsVersion uint64
+)
+
+// tilesMu guards tileGroups and serializes tile management operations that
+// change both the tiles directory and tileStore, which is itself safe for concurrent use
+var tilesMu sync.RWMutex
+
+// Paths of the tiles deleted or moved away through the API while an ingestion runs,
+// nil when none runs. The ingestion must not bring them back. Guarded by tilesMu
+var ingestRemoved map[string]bool
+
+// Progress of the startup tiles ingestion, exposed on the admin API
+var ingestProgress = tiles_db.NewIngestProgress()
+
+// Tiles that failed to ingest - replaced by the persisted quarantine at startup
+var quarantine = tiles_db.NewQuarantine()
+
+// Cache of decoded, pre-scaled tiles shared by all renders
+var tileCache = tile_cache.New(config.Default().TileCacheBytes)
+
+// Cache of rendered mosaics, in memory only until the configured cache replaces it at startup
+var resultCache = result_cache.New(config.Default().ResultCacheBytes, "", 0)
+
+// Slots of the mosaic renders running at the same time - replaced by the configured limit at startup
+var renderSlots = rate_limit.NewSemaphore(config.Default().MaxConcurrentRenders)
+
+// API keys and their usage, nil while the API is open - loaded at startup when configured
+var apiKeys *api_keys.Store
+
+// Queue of asynchronous render jobs, nil until created at startup so that no
+// workers run before the configuration is loaded
+var renderJobs *jobs.Manager
+
+// Global application configuration - replaced by the loaded config at startup
+var appConfig = config.Default()
+
+// Time the server has to write a response, which also bounds synchronous renders
+var writeTimeout = 30 * time.Second
 
 // main is the entry point of the application
+// With arguments it runs a command line subcommand instead of the server
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	// Load configuration
 	cfg := config.Load()
-	
-	// Initialize tiles database
+	appConfig = cfg
+	tiles_db.SetMaxPixels(cfg.MaxImagePixels)
+	tileCache = tile_cache.New(cfg.TileCacheBytes)
+	resultCache = result_cache.New(cfg.ResultCacheBytes, cfg.ResultCacheDir, cfg.ResultCacheDiskBytes)
+	renderSlots = rate_limit.NewSemaphore(cfg.MaxConcurrentRenders)
+
+	store, err := tile_store.Open(cfg.TileStore, cfg.TileStorePath)
+	if err != nil {
+		log.Fatalf("Failed to open tile store: %v", err)
+	}
+	tileStore = store
+	defer func() {
+		if err := tileStore.Close(); err != nil {
+			log.Printf("Failed to close tile store: %v", err)
+		}
+	}()
+
+	if quarantine, err = tiles_db.OpenQuarantine(cfg.QuarantinePath); err != nil {
+		log.Fatalf("Failed to open tile quarantine: %v", err)
+	}
+
+	if cfg.APIKeysPath != "" {
+		if apiKeys, err = api_keys.Load(cfg.APIKeysPath, cfg.APIUsagePath); err != nil {
+			log.Fatalf("Failed to load API keys: %v", err)
+		}
+	} else {
+		log.Println("Warning: API_KEYS_PATH is not set, the API is open to everyone")
+	}
+
+	renderJobs = newRenderJobs(cfg)
+	defer renderJobs.Close()
+
+	// Initialize tiles database in the background so progress can be watched on the admin API
 	log.Println("Initializing tiles database...")
-	tilesDB = tiles_db.TilesDB()
-	log.Printf("Tiles database initialized with %d tiles", len(tilesDB))
+	go loadTilesDB(cfg)
 
 	// Create router
 	router := routes()
@@ -34,7 +122,7 @@ func main() {
 		Addr:         ":" + cfg.ServerPort,
 		Handler:      router,
 		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		WriteTimeout: writeTimeout,
 		IdleTimeout:  60 * time.Second,
 	}
 
@@ -59,8 +147,128 @@ func main() {
 
 	// Attempt graceful shutdown
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		log.Printf("Server forced to shutdown: %v", err)
+		return
 	}
 
 	log.Println("Server exited gracefully")
 }
+
+// newRenderJobs creates the render job pool described by cfg
+func newRenderJobs(cfg *config.Config) *jobs.Manager {
+	return jobs.NewManager(cfg.JobWorkers, cfg.JobQueueSize, time.Duration(cfg.JobResultTTL)*time.Second)
+}
+
+// loadTilesDB ingests the tiles directory and publishes the result to tileStore
+// Tiles whose stored record still matches their file are not decoded again.
+// Progress is logged periodically until the ingestion finishes
+func loadTilesDB(cfg *config.Config) {
+	// Records persisted by a previous run are usable while the ingestion runs
+	known := make(map[string]tiles_db.Descriptor)
+	tileStore.Iterate(func(record tile_store.Record) bool {
+		known[record.Path] = record.Descriptor()
+		return true
+	})
+	tilesMu.Lock()
+	ingestRemoved = make(map[string]bool)
+	tilesMu.Unlock()
+	if len(known) > 0 {
+		refreshDuplicateGroups()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				status := ingestProgress.Snapshot()
+				log.Printf("Ingesting tiles: %d/%d done, %d failed", status.Done, status.Total, status.Failed)
+			}
+		}
+	}()
+
+	result := tiles_db.IngestIncremental(cfg.TilesDir, cfg.TileWorkers, ingestProgress, known)
+	close(done)
+
+	total, groups := mergeIngestResult(result, known)
+
+	if err := syncQuarantine(result); err != nil {
+		log.Printf("Failed to update tile quarantine: %v", err)
+	}
+
+	log.Printf("Tiles database initialized with %d tiles (%d reused, %d failed, %d in duplicate groups)", total, result.Reused, len(result.Errors), groups)
+	if len(result.Errors) > 0 {
+		log.Printf("%d tiles are quarantined, see GET /api/tiles/errors or \"mosaic quarantine\"", len(result.Errors))
+	}
+
+	if len(cfg.TileCacheWarmSizes) > 0 {
+		paths := make([]string, 0, len(result.Descriptors))
+		for path := range result.Descriptors {
+			paths = append(paths, path)
+		}
+		tileCache.Warm(paths, cfg.TileCacheWarmSizes)
+	}
+}
+
+// mergeIngestResult publishes the tiles found by an ingestion to tileStore and
+// drops the stored tiles it found stale. It merges rather than replaces, tiles may
+// have been uploaded while ingesting, and skips the tiles removed meanwhile
+// It returns the number of tiles and of tiles in duplicate groups
+func mergeIngestResult(result *tiles_db.IngestResult, known map[string]tiles_db.Descriptor) (int, int) {
+	tilesMu.Lock()
+
+	removed := ingestRemoved
+	ingestRemoved = nil
+	for path, descriptor := range result.Descriptors {
+		if removed[path] {
+			continue
+		}
+		if err := tileStore.Put(tile_store.NewRecord(path, descriptor, result.Metadata[path])); err != nil {
+			log.Printf("Failed to store tile %s: %v", path, err)
+		}
+	}
+	failed := make(map[string]bool, len(result.Errors))
+	for _, ingestErr := range result.Errors {
+		failed[ingestErr.File] = true
+	}
+	for path := range known {
+		if _, ok := result.Descriptors[path]; !ok && isStaleTile(path, failed) {
+			if err := tileStore.Delete(path); err != nil {
+				log.Printf("Failed to remove stale tile %s: %v", path, err)
+			}
+		}
+	}
+	tilesMu.Unlock()
+
+	refreshDuplicateGroups()
+	tilesMu.RLock()
+	defer tilesMu.RUnlock()
+	return len(tileStore.List()), len(tileGroups)
+}
+
+// markTileRemoved keeps a running ingestion from publishing path again
+// The caller must hold tilesMu
+func markTileRemoved(path string) {
+	if ingestRemoved != nil {
+		ingestRemoved[path] = true
+	}
+}
+
+// isStaleTile reports whether a stored tile that the ingestion did not return
+// should be dropped: it failed to decode, its file is gone or it lies outside
+// the tiles directory. Other tiles were added while the ingestion was running
+func isStaleTile(path string, failed map[string]bool) bool {
+	if failed[path] {
+		return true
+	}
+	if _, err := os.Stat(path); err != nil {
+		return true
+	}
+	info, _ := tileInfo(path, [3]float64{})
+	resolved, ok := tilePathFromID(info.ID)
+	return !ok || resolved != path
+}
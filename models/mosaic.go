@@ -1,22 +1,45 @@
 package models
 
-// MosaicRequest represents the request structure for mosaic generation
+import "wilbertopachecob/mosaic/lib/encoder"
+
+// MosaicRequest is the JSON body of a render request
 type MosaicRequest struct {
-	TileSize int `json:"tileSize"`
+	RenderOptions
+	Image string `json:"image"` // Base64 or a data URL
 }
 
-// MosaicResponse represents the response structure for mosaic generation
+// MosaicResponse is the result of a mosaic render
+// Format is the format of the uploaded image, Output describes the encoded mosaic
+// and Cached reports whether it came from the result cache
 type MosaicResponse struct {
-	MosaicImg string  `json:"mosaicImg"`
-	Duration  float64 `json:"duration"`
-	Error     string  `json:"error,omitempty"`
+	MosaicImg string         `json:"mosaicImg"`
+	Duration  float64        `json:"duration"`
+	Format    string         `json:"format"`
+	Output    encoder.Result `json:"output"`
+	Cached    bool           `json:"cached,omitempty"`
+	Credits   []Credit       `json:"credits"`
+}
+
+// Credit attributes a tile used in a mosaic
+// SHA256 identifies the tile content and stays stable when files are renamed or moved
+type Credit struct {
+	ID        string `json:"id"`
+	SHA256    string `json:"sha256,omitempty"`
+	Count     int    `json:"count"`
+	Author    string `json:"author,omitempty"`
+	SourceURL string `json:"sourceUrl,omitempty"`
+	License   string `json:"license,omitempty"`
+	Caption   string `json:"caption,omitempty"`
 }
 
 // ErrorResponse represents an error response
+// ErrorCode and Fields are set for requests whose options failed validation
 type ErrorResponse struct {
-	Error   string `json:"error"`
-	Message string `json:"message"`
-	Code    int    `json:"code"`
+	Error     string       `json:"error"`
+	Message   string       `json:"message"`
+	Code      int          `json:"code"`
+	ErrorCode string       `json:"errorCode,omitempty"`
+	Fields    []FieldError `json:"fields,omitempty"`
 }
 
 // Color represents RGB color values
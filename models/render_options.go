@@ -0,0 +1,153 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"wilbertopachecob/mosaic/lib/encoder"
+)
+
+// Machine-readable error codes of rejected render requests
+// They are part of the API and must not change
+const (
+	// ErrorCodeInvalidOptions is the ErrorResponse code of a request with invalid options
+	ErrorCodeInvalidOptions = "invalid_options"
+	// ErrorCodeUploadTooLarge is the ErrorResponse code of an upload over the byte limit
+	ErrorCodeUploadTooLarge = "upload_too_large"
+	// ErrorCodeImageTooLarge is the ErrorResponse code of an image declaring too many pixels
+	ErrorCodeImageTooLarge = "image_too_large"
+	// ErrorCodeTooManyCells is the ErrorResponse code of a render with too many cells
+	ErrorCodeTooManyCells = "too_many_cells"
+	// ErrorCodeRenderTimeout is the ErrorResponse code of a render that ran past its timeoutMs
+	ErrorCodeRenderTimeout = "render_timeout"
+	// ErrorCodeRateLimited is the ErrorResponse code of a client over its request rate limit
+	ErrorCodeRateLimited = "rate_limited"
+	// ErrorCodeTooManyRenders is the ErrorResponse code of a render refused because all render slots are taken
+	ErrorCodeTooManyRenders = "too_many_renders"
+	// ErrorCodeUnauthorized is the ErrorResponse code of a request without a valid API key
+	ErrorCodeUnauthorized = "unauthorized"
+	// ErrorCodeForbidden is the ErrorResponse code of a request whose API key lacks the scope of the route
+	ErrorCodeForbidden = "forbidden"
+	// ErrorCodeQuotaExceeded is the ErrorResponse code of a render over a daily quota of its API key
+	ErrorCodeQuotaExceeded = "quota_exceeded"
+
+	// FieldRequired means a mandatory field is missing
+	FieldRequired = "required"
+	// FieldInvalidType means a value cannot be read as the type of its field
+	FieldInvalidType = "invalid_type"
+	// FieldOutOfRange means a number is outside the range of its field
+	FieldOutOfRange = "out_of_range"
+	// FieldInvalidChoice means a value is not one of the choices of its field
+	FieldInvalidChoice = "invalid_choice"
+	// FieldUnknown means a JSON request has a field that is not an option
+	FieldUnknown = "unknown_field"
+)
+
+// Render option limits
+const (
+	MinTileSize     = 5
+	MaxTileSize     = 200
+	MaxPreviewWidth = 512
+	MaxTimeoutMs    = 10 * 60 * 1000
+)
+
+// FieldError describes why the value of one request field is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// RenderOptions are the options of a mosaic render, read from the fields of a
+// multipart form or from a JSON body
+// An empty OutputFormat lets the Accept header choose, JPEG by default
+type RenderOptions struct {
+	TileSize     int      `json:"tileSize"`
+	Tags         []string `json:"tags,omitempty"`
+	OutputFormat string   `json:"outputFormat,omitempty"`
+	Quality      int      `json:"quality"`
+	Chroma       string   `json:"chroma"`
+	Compression  string   `json:"compression"`
+	Colors       int      `json:"colors"`
+	Palette      string   `json:"palette"`
+	Dither       bool     `json:"dither"`
+	MaxBytes     int      `json:"maxBytes"`
+	PreviewWidth int      `json:"previewWidth"` // Render jobs only
+	TimeoutMs    int      `json:"timeoutMs"`    // Zero for no deadline
+}
+
+// DefaultRenderOptions returns the options of a request that sets none
+func DefaultRenderOptions() RenderOptions {
+	output := encoder.DefaultOptions()
+	return RenderOptions{
+		TileSize:    20,
+		Quality:     output.Quality,
+		Chroma:      output.Chroma,
+		Compression: output.Compression,
+		Colors:      output.Colors,
+		Palette:     output.Palette,
+	}
+}
+
+// Validate checks the ranges and choices of every option
+// It returns one FieldError per invalid field, in field order
+func (o RenderOptions) Validate() []FieldError {
+	var errs []FieldError
+	inRange := func(field string, value, min, max int) {
+		if value < min || value > max {
+			errs = append(errs, FieldError{field, FieldOutOfRange, fmt.Sprintf("%s must be between %d and %d, got %d", field, min, max, value)})
+		}
+	}
+	oneOf := func(field, value string, choices ...string) {
+		for _, choice := range choices {
+			if value == choice {
+				return
+			}
+		}
+		errs = append(errs, FieldError{field, FieldInvalidChoice, fmt.Sprintf("%s must be one of %s, got %q", field, strings.Join(choices, ", "), value)})
+	}
+
+	inRange("tileSize", o.TileSize, MinTileSize, MaxTileSize)
+	if o.OutputFormat != "" {
+		oneOf("outputFormat", o.OutputFormat, encoder.FormatJPEG, encoder.FormatPNG, encoder.FormatGIF, encoder.FormatTIFF)
+	}
+	inRange("quality", o.Quality, 1, 100)
+	oneOf("chroma", o.Chroma, encoder.Chroma420, encoder.ChromaGray)
+	switch o.OutputFormat {
+	case encoder.FormatPNG:
+		oneOf("compression", o.Compression, encoder.CompressionDefault, encoder.CompressionNone, encoder.CompressionSpeed, encoder.CompressionBest)
+	case encoder.FormatTIFF:
+		oneOf("compression", o.Compression, encoder.CompressionDefault, encoder.CompressionNone, encoder.CompressionDeflate)
+	default:
+		// The format may still be negotiated, so accept any compression that applies to one
+		oneOf("compression", o.Compression, encoder.CompressionDefault, encoder.CompressionNone, encoder.CompressionSpeed, encoder.CompressionBest, encoder.CompressionDeflate)
+	}
+	inRange("colors", o.Colors, 2, 256)
+	oneOf("palette", o.Palette, encoder.PaletteAdaptive, encoder.PalettePlan9, encoder.PaletteWebSafe)
+	if o.MaxBytes < 0 {
+		errs = append(errs, FieldError{"maxBytes", FieldOutOfRange, fmt.Sprintf("maxBytes must not be negative, got %d", o.MaxBytes)})
+	}
+	inRange("previewWidth", o.PreviewWidth, 0, MaxPreviewWidth)
+	inRange("timeoutMs", o.TimeoutMs, 0, MaxTimeoutMs)
+	return errs
+}
+
+// EncoderOptions returns the encoder options for format
+func (o RenderOptions) EncoderOptions(format string) encoder.Options {
+	return encoder.Options{
+		Format:      format,
+		Quality:     o.Quality,
+		Chroma:      o.Chroma,
+		Compression: o.Compression,
+		Colors:      o.Colors,
+		Palette:     o.Palette,
+		Dither:      o.Dither,
+		MaxBytes:    o.MaxBytes,
+	}
+}
+
+// Timeout returns the render deadline as a duration, zero for none
+func (o RenderOptions) Timeout() time.Duration {
+	return time.Duration(o.TimeoutMs) * time.Millisecond
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"wilbertopachecob/mosaic/lib/tile_store"
+	"wilbertopachecob/mosaic/lib/tiles_db"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// TileError describes a quarantined tile file
+type TileError struct {
+	ID        string    `json:"id"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// TileErrorsResponse lists the quarantined tiles
+type TileErrorsResponse struct {
+	Errors []TileError `json:"errors"`
+	Total  int         `json:"total"`
+}
+
+// TileRetryResponse reports the outcome of retrying quarantined tiles
+// Recovered tiles are back in the library, duplicates were removed because
+// their content already was, gone files no longer exist
+type TileRetryResponse struct {
+	Recovered  []TileInfo      `json:"recovered"`
+	Duplicates []TileDuplicate `json:"duplicates"`
+	Failed     []TileError     `json:"failed"`
+	Gone       []string        `json:"gone"`
+}
+
+// tileErrorsHandler lists the tiles that failed to ingest
+func tileErrorsHandler(w http.ResponseWriter, r *http.Request) {
+	entries := quarantine.List()
+	response := TileErrorsResponse{Errors: make([]TileError, 0, len(entries)), Total: len(entries)}
+	for _, entry := range entries {
+		response.Errors = append(response.Errors, tileError(entry))
+	}
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// retryTileHandler ingests one quarantined tile again once its file has been fixed
+func retryTileHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	path, ok := tilePathFromID(id)
+	if ok {
+		_, ok = quarantine.Get(path)
+	}
+	if !ok {
+		sendErrorResponse(w, http.StatusNotFound, "Quarantined tile not found", id)
+		return
+	}
+
+	response := retryQuarantined([]string{path})
+	switch {
+	case len(response.Gone) > 0:
+		sendErrorResponse(w, http.StatusNotFound, "Tile not found", "the quarantined file no longer exists")
+	case len(response.Failed) > 0:
+		sendErrorResponse(w, http.StatusUnprocessableEntity, "Tile still fails to ingest", response.Failed[0].Error)
+	default:
+		sendJSONResponse(w, http.StatusOK, response)
+	}
+}
+
+// retryAllTilesHandler ingests every quarantined tile again
+func retryAllTilesHandler(w http.ResponseWriter, r *http.Request) {
+	var paths []string
+	for _, entry := range quarantine.List() {
+		paths = append(paths, entry.File)
+	}
+	sendJSONResponse(w, http.StatusOK, retryQuarantined(paths))
+}
+
+// retryQuarantined describes quarantined files again and publishes the ones that now decode
+func retryQuarantined(paths []string) TileRetryResponse {
+	response := TileRetryResponse{
+		Recovered:  []TileInfo{},
+		Duplicates: []TileDuplicate{},
+		Failed:     []TileError{},
+		Gone:       []string{},
+	}
+
+	recovered := make(map[string]tiles_db.Descriptor)
+	for _, path := range paths {
+		descriptor, err := quarantine.Retry(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			info, _ := tileInfo(path, [3]float64{})
+			response.Gone = append(response.Gone, info.ID)
+		case err != nil:
+			entry, _ := quarantine.Get(path)
+			response.Failed = append(response.Failed, tileError(entry))
+		default:
+			recovered[path] = descriptor
+		}
+	}
+
+	// The sidecar written before the file broke still applies, it is published with
+	// the tile so that nothing can change the tile in between
+	metadata := make(map[string]tiles_db.Metadata)
+	for path := range recovered {
+		if loaded, err := tiles_db.LoadMetadata(path); err == nil && !loaded.IsEmpty() {
+			metadata[path] = loaded
+		}
+	}
+
+	existing := publishTiles(recovered, metadata)
+	for _, path := range paths {
+		descriptor, ok := recovered[path]
+		if !ok {
+			continue
+		}
+		if tile, duplicate := existing[path]; duplicate {
+			response.Duplicates = append(response.Duplicates, TileDuplicate{Name: filepath.Base(path), Tile: tile, SHA256: descriptor.SHA256})
+			continue
+		}
+
+		info, _ := recordInfo(tile_store.NewRecord(path, descriptor, metadata[path]))
+		response.Recovered = append(response.Recovered, info)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"recovered":  len(response.Recovered),
+		"duplicates": len(response.Duplicates),
+		"failed":     len(response.Failed),
+		"gone":       len(response.Gone),
+	}).Info("Quarantined tiles retried")
+	return response
+}
+
+// syncQuarantine quarantines the files that failed in an ingestion of the whole
+// tiles directory and releases the ones that were fixed or removed since
+func syncQuarantine(result *tiles_db.IngestResult) error {
+	failures := make(map[string]string, len(result.Errors))
+	for _, ingestErr := range result.Errors {
+		failures[ingestErr.File] = ingestErr.Error
+	}
+	return quarantine.Sync(failures)
+}
+
+// tileError builds the API description of a quarantine entry
+func tileError(entry tiles_db.QuarantineEntry) TileError {
+	info, _ := tileInfo(entry.File, [3]float64{})
+	return TileError{
+		ID:        info.ID,
+		Error:     entry.Error,
+		Attempts:  entry.Attempts,
+		FirstSeen: entry.FirstSeen,
+		LastSeen:  entry.LastSeen,
+	}
+}
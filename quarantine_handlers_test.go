@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"wilbertopachecob/mosaic/lib/tiles_db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTileErrorsAPI tests that tiles failing to ingest are quarantined, listed and retried
+func TestTileErrorsAPI(t *testing.T) {
+	dir := setupTilesTest(t)
+	writeTestFile(t, filepath.Join(dir, "red.jpg"), imageToBytes(t, createTestImage(10, 10)))
+	writeTestFile(t, filepath.Join(dir, "nature", "broken.jpg"), []byte("not a jpeg"))
+	writeTestFile(t, filepath.Join(dir, "nature", "gone.jpg"), []byte("not a jpeg"))
+
+	loadTilesDB(appConfig)
+	assert.Equal(t, []string{filepath.Join(dir, "red.jpg")}, tileStore.List())
+
+	router := routes()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles/errors", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var list TileErrorsResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+	require.Equal(t, 2, list.Total)
+	assert.Equal(t, "nature/broken.jpg", list.Errors[0].ID)
+	assert.Contains(t, list.Errors[0].Error, "decode")
+	assert.Equal(t, 1, list.Errors[0].Attempts)
+
+	// Still broken
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/api/tiles/errors/nature/broken.jpg/retry", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+
+	// Fixed, keeping the sidecar written before it broke
+	writeTestFile(t, filepath.Join(dir, "nature", "broken.jpg"), imageToBytes(t, createGradientImage(10, 10, false)))
+	require.NoError(t, tiles_db.SaveMetadata(filepath.Join(dir, "nature", "broken.jpg"), tiles_db.Metadata{Author: "Ana"}))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/api/tiles/errors/nature/broken.jpg/retry", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var retried TileRetryResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &retried))
+	require.Len(t, retried.Recovered, 1)
+	assert.Equal(t, "nature/broken.jpg", retried.Recovered[0].ID)
+	record, ok := tileStore.Get(filepath.Join(dir, "nature", "broken.jpg"))
+	assert.True(t, ok)
+	assert.Equal(t, "Ana", record.Metadata.Author)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/api/tiles/errors/nature/broken.jpg/retry", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// A restart releases files that were removed
+	require.NoError(t, os.Remove(filepath.Join(dir, "nature", "gone.jpg")))
+	ingestProgress = tiles_db.NewIngestProgress()
+	loadTilesDB(appConfig)
+	assert.Empty(t, quarantine.List())
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"wilbertopachecob/mosaic/config"
+	"wilbertopachecob/mosaic/lib/rate_limit"
+	"wilbertopachecob/mosaic/models"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// errTooManyRenders is returned when a render cannot start because all render slots are taken
+var errTooManyRenders = errors.New("too many renders in progress")
+
+// renderRetryAfter is the Retry-After of a render refused for lack of a render slot
+const renderRetryAfter = 2 * time.Second
+
+// routeLimiters holds the per-client rate limiters of the API routes
+// Routes with their own limit have their own buckets, the others share the default ones.
+// auth limits the requests with a missing or unknown API key of each IP address
+type routeLimiters struct {
+	fallback *rate_limit.Limiter
+	routes   map[string]*rate_limit.Limiter
+	auth     *rate_limit.Limiter
+}
+
+// newRouteLimiters creates the rate limiters configured in cfg
+func newRouteLimiters(cfg *config.Config) *routeLimiters {
+	limiters := &routeLimiters{
+		fallback: rate_limit.New(cfg.RateLimit.Rate, cfg.RateLimit.Burst),
+		routes:   make(map[string]*rate_limit.Limiter),
+		auth:     rate_limit.New(cfg.AuthRateLimit.Rate, cfg.AuthRateLimit.Burst),
+	}
+	for route, limit := range cfg.RateLimits {
+		limiters.routes[route] = rate_limit.New(limit.Rate, limit.Burst)
+	}
+	return limiters
+}
+
+// forRequest returns the limiter of the route matched by r
+// A "METHOD /path" entry takes precedence over a "/path" entry
+func (l *routeLimiters) forRequest(r *http.Request) *rate_limit.Limiter {
+	template := routeTemplate(r)
+	if limiter, ok := l.routes[r.Method+" "+template]; ok {
+		return limiter
+	}
+	if limiter, ok := l.routes[template]; ok {
+		return limiter
+	}
+	return l.fallback
+}
+
+// rateLimitMiddleware rejects API requests of clients over their rate limit with 429
+func rateLimitMiddleware(limiters *routeLimiters) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "OPTIONS" || !strings.HasPrefix(r.URL.Path, "/api/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			client := clientKey(r)
+			if ok, wait := limiters.forRequest(r).Allow(client); !ok {
+				logrus.WithFields(logrus.Fields{
+					"client": client,
+					"method": r.Method,
+					"path":   r.URL.Path,
+				}).Warn("Request rate limited")
+				sendRateLimited(w, wait)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// sendRateLimited sends the 429 response of a client over its rate limit
+func sendRateLimited(w http.ResponseWriter, wait time.Duration) {
+	setRetryAfter(w, wait)
+	sendErrorCode(w, http.StatusTooManyRequests, models.ErrorCodeRateLimited, "Too many requests",
+		fmt.Sprintf("rate limit exceeded, retry in %s", wait.Round(time.Millisecond)))
+}
+
+// clientKey identifies the client of a request for rate limiting
+// Clients authenticated with an API key are limited by key, the others by IP address
+func clientKey(r *http.Request) string {
+	if key := requestKey(r); key != nil {
+		return "key:" + key.Name
+	}
+	return "ip:" + clientIP(r)
+}
+
+// clientIP returns the IP address of the client of a request
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// setRetryAfter sets the Retry-After header to wait rounded up to whole seconds
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+// sendTooManyRenders sends the 429 response of a render refused for lack of a render slot
+func sendTooManyRenders(w http.ResponseWriter) {
+	setRetryAfter(w, renderRetryAfter)
+	sendErrorCode(w, http.StatusTooManyRequests, models.ErrorCodeTooManyRenders, "Too many renders",
+		fmt.Sprintf("at most %d mosaics are rendered at the same time", appConfig.MaxConcurrentRenders))
+}
+
+// acquireRenderSlot takes one of slots. Jobs wait until one is free or ctx is
+// done, requests that answer synchronously fail with errTooManyRenders instead
+func acquireRenderSlot(ctx context.Context, slots *rate_limit.Semaphore, wait bool) error {
+	if wait {
+		return slots.Acquire(ctx)
+	}
+	if !slots.TryAcquire() {
+		return errTooManyRenders
+	}
+	return nil
+}
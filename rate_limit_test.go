@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"wilbertopachecob/mosaic/config"
+	"wilbertopachecob/mosaic/lib/api_keys"
+	"wilbertopachecob/mosaic/lib/rate_limit"
+	"wilbertopachecob/mosaic/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRateLimitMiddleware tests per-client buckets, route overrides and the 429 response
+func TestRateLimitMiddleware(t *testing.T) {
+	setupTilesTest(t)
+	setupAPIKeys(t, api_keys.Key{Name: "a", Key: "key-a", Scopes: []api_keys.Scope{api_keys.ScopeAdmin}})
+	appConfig.RateLimit = config.RateLimit{Rate: 0.01, Burst: 2}
+	appConfig.RateLimits = map[string]config.RateLimit{
+		"/api/admin/cache":      {Rate: 0},
+		"GET /api/admin/ingest": {Rate: 0.01, Burst: 1},
+	}
+	router := routes()
+
+	get := func(url, remoteAddr, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		req.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusOK, get("/api/health", "10.0.0.1:1000", "").Code)
+	assert.Equal(t, http.StatusOK, get("/api/health", "10.0.0.1:2000", "").Code)
+	limited := get("/api/health", "10.0.0.1:3000", "")
+	require.Equal(t, http.StatusTooManyRequests, limited.Code)
+	assert.NotEmpty(t, limited.Header().Get("Retry-After"))
+	var response models.ErrorResponse
+	require.NoError(t, json.Unmarshal(limited.Body.Bytes(), &response))
+	assert.Equal(t, models.ErrorCodeRateLimited, response.ErrorCode)
+
+	// Other addresses and API keys have their own bucket, shared by every address of a key
+	assert.Equal(t, http.StatusOK, get("/api/health", "10.0.0.2:1000", "").Code)
+	assert.Equal(t, http.StatusOK, get("/api/tiles", "10.0.0.1:1000", "key-a").Code)
+	assert.Equal(t, http.StatusOK, get("/api/tiles", "10.0.0.3:1000", "key-a").Code)
+	assert.Equal(t, http.StatusTooManyRequests, get("/api/tiles", "10.0.0.4:1000", "key-a").Code)
+
+	// Routes with their own limit do not use the default bucket
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, get("/api/admin/cache", "10.0.0.1:1000", "key-a").Code)
+	}
+	assert.Equal(t, http.StatusOK, get("/api/admin/ingest", "10.0.0.1:1000", "key-a").Code)
+	assert.Equal(t, http.StatusTooManyRequests, get("/api/admin/ingest", "10.0.0.1:1000", "key-a").Code)
+}
+
+// TestTooManyRenders tests that a render without a free render slot is refused with 429
+func TestTooManyRenders(t *testing.T) {
+	dir := setupTilesTest(t)
+	writeTestFile(t, filepath.Join(dir, "red.jpg"), imageToBytes(t, createTestImage(10, 10)))
+	loadTilesDB(appConfig)
+	prev := renderSlots
+	renderSlots = rate_limit.NewSemaphore(1)
+	t.Cleanup(func() { renderSlots = prev })
+	router := routes()
+
+	require.True(t, renderSlots.TryAcquire())
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, renderRequest(t, "/api/file/upload", createTestImage(40, 30), map[string]string{"tileSize": "10"}))
+	require.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "2", rr.Header().Get("Retry-After"))
+	var response models.ErrorResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, models.ErrorCodeTooManyRenders, response.ErrorCode)
+
+	renderSlots.Release()
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, renderRequest(t, "/api/file/upload", createTestImage(40, 30), map[string]string{"tileSize": "10"}))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, 0, renderSlots.InUse())
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"strings"
+
+	"wilbertopachecob/mosaic/lib/encoder"
+	"wilbertopachecob/mosaic/lib/rate_limit"
+	"wilbertopachecob/mosaic/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+// cachedRender is an encoded mosaic and what its responses report about it
+type cachedRender struct {
+	Data         []byte
+	Output       encoder.Result
+	SourceFormat string
+	Columns      int
+	Rows         int
+	Tiles        int
+	Credits      []models.Credit
+}
+
+// renderCacheKey returns the key of a render in the result cache
+// It hashes the source image bytes, the options that change the mosaic and the
+// version of the tile set, so it also serves as the ETag of the result
+func renderCacheKey(req *mosaicRequest, output encoder.Options, version uint64) string {
+	data, _ := json.Marshal(struct {
+		Source   string          `json:"source"`
+		TileSize int             `json:"tileSize"`
+		Tags     []string        `json:"tags"`
+		Output   encoder.Options `json:"output"`
+		Version  uint64          `json:"version"`
+	}{req.sourceSum, req.options.TileSize, req.options.Tags, output, version})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// renderETag returns the entity tag of a render for the negotiated content type
+// The JSON and binary responses of the same render are different representations.
+// The tag is weak: renders of a key are equivalent, not byte for byte identical,
+// since JSON responses report their duration and whether they came from the cache
+func renderETag(key, contentType string) string {
+	if contentType == "application/json" {
+		return `W/"` + key + `-json"`
+	}
+	return `W/"` + key + `"`
+}
+
+// etagMatches reports whether an If-None-Match header value lists etag
+// Comparison is weak, as If-None-Match requires
+func etagMatches(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// renderOrLoad returns the cached render for key at the tile set version, or renders,
+// encodes and caches it. It reports whether the render came from the cache
+// A render holds one of slots for as long as it runs, see acquireRenderSlot, and
+// is only cached if the tile set did not change meanwhile
+func renderOrLoad(ctx context.Context, req *mosaicRequest, output encoder.Options, version uint64, key string, slots *rate_limit.Semaphore, wait bool, report func(done, total int, mosaic *image.NRGBA)) (*cachedRender, bool, error) {
+	if data, ok := resultCache.Get(version, key); ok {
+		var render cachedRender
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&render); err == nil {
+			return &render, true, nil
+		} else {
+			logrus.WithError(err).WithField("key", key).Warn("Failed to decode cached render")
+		}
+	}
+
+	if err := acquireRenderSlot(ctx, slots, wait); err != nil {
+		return nil, false, err
+	}
+	defer slots.Release()
+
+	mosaic, usage, err := renderMosaic(ctx, tileStore, req.original, req.options.TileSize, req.options.Tags, report)
+	if err != nil {
+		return nil, false, err
+	}
+	data, result, err := encoder.Encode(mosaic, output)
+	if err != nil {
+		return nil, false, err
+	}
+
+	bounds, tileSize := req.original.Bounds(), req.options.TileSize
+	render := &cachedRender{
+		Data:         data,
+		Output:       result,
+		SourceFormat: req.format,
+		Columns:      (bounds.Dx() + tileSize - 1) / tileSize,
+		Rows:         (bounds.Dy() + tileSize - 1) / tileSize,
+		Tiles:        len(usage),
+		Credits:      buildCredits(tileStore, usage),
+	}
+	if tileStore.Version() == version {
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(render); err != nil {
+			logrus.WithError(err).WithField("key", key).Warn("Failed to encode render for the cache")
+		} else {
+			resultCache.Put(version, key, buf.Bytes())
+		}
+	}
+	return render, false, nil
+}
+
+// response returns the JSON response of the render
+func (render *cachedRender) response(duration float64, cached bool) models.MosaicResponse {
+	return models.MosaicResponse{
+		MosaicImg: base64.StdEncoding.EncodeToString(render.Data),
+		Duration:  duration,
+		Format:    render.SourceFormat,
+		Output:    render.Output,
+		Cached:    cached,
+		Credits:   render.Credits,
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"wilbertopachecob/mosaic/lib/result_cache"
+	"wilbertopachecob/mosaic/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRenderCache tests cache hits, conditional requests and invalidation by tile changes
+func TestRenderCache(t *testing.T) {
+	dir := setupTilesTest(t)
+	writeTestFile(t, filepath.Join(dir, "red.jpg"), imageToBytes(t, createTestImage(10, 10)))
+	loadTilesDB(appConfig)
+	router := routes()
+	source := createTestImage(40, 30)
+	fields := map[string]string{"tileSize": "10"}
+
+	render := func(accept, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := renderRequest(t, "/api/file/upload", source, fields)
+		req.Header.Set("Accept", accept)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := render("image/jpeg", "")
+	require.Equal(t, http.StatusCreated, first.Code)
+	assert.Equal(t, "MISS", first.Header().Get("X-Mosaic-Cache"))
+	etag := first.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+	assert.True(t, strings.HasPrefix(etag, "W/"), "renders are only equivalent, so their tag is weak")
+
+	second := render("image/jpeg", "")
+	require.Equal(t, http.StatusCreated, second.Code)
+	assert.Equal(t, "HIT", second.Header().Get("X-Mosaic-Cache"))
+	assert.Equal(t, etag, second.Header().Get("ETag"))
+	assert.Equal(t, first.Body.Bytes(), second.Body.Bytes())
+	assert.Equal(t, "4x3", second.Header().Get("X-Mosaic-Grid"))
+
+	// The JSON representation has its own tag but shares the cached render
+	asJSON := render("application/json", "")
+	require.Equal(t, http.StatusCreated, asJSON.Code)
+	assert.NotEqual(t, etag, asJSON.Header().Get("ETag"))
+	var response models.MosaicResponse
+	require.NoError(t, json.Unmarshal(asJSON.Body.Bytes(), &response))
+	assert.True(t, response.Cached)
+	assert.Len(t, response.Credits, 1)
+
+	notModified := render("image/jpeg", `"other", `+strings.TrimPrefix(etag, "W/"))
+	assert.Equal(t, http.StatusNotModified, notModified.Code)
+	assert.Equal(t, etag, notModified.Header().Get("ETag"))
+	assert.Empty(t, notModified.Body.Bytes())
+
+	// Responses that are not the render carry no tag
+	fields["maxBytes"] = "10"
+	failed := render("image/jpeg", "")
+	require.Equal(t, http.StatusUnprocessableEntity, failed.Code)
+	assert.Empty(t, failed.Header().Get("ETag"))
+	delete(fields, "maxBytes")
+
+	// A different option is a different render
+	fields["quality"] = "50"
+	other := render("image/jpeg", etag)
+	require.Equal(t, http.StatusCreated, other.Code)
+	assert.NotEqual(t, etag, other.Header().Get("ETag"))
+	delete(fields, "quality")
+
+	// Changing the tile index invalidates every render
+	writeTestFile(t, filepath.Join(dir, "blue.jpg"), imageToBytes(t, createTestImage(10, 10)))
+	loadTilesDB(appConfig)
+	changed := render("image/jpeg", etag)
+	require.Equal(t, http.StatusCreated, changed.Code)
+	assert.Equal(t, "MISS", changed.Header().Get("X-Mosaic-Cache"))
+	assert.NotEqual(t, etag, changed.Header().Get("ETag"))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/admin/result-cache", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var stats result_cache.Stats
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &stats))
+	assert.Equal(t, 1, stats.Entries)
+}
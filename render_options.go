@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"wilbertopachecob/mosaic/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+// isJSONRequest reports whether the body of r is JSON
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// decodeRenderBody decodes a JSON render request into body
+// Type mismatches and unknown fields are reported as field errors, a body that
+// is not a JSON object as an error
+func decodeRenderBody(r io.Reader, body *models.MosaicRequest) ([]models.FieldError, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(body)
+
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return nil, nil
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return []models.FieldError{{
+			Field:   typeErr.Field,
+			Code:    models.FieldInvalidType,
+			Message: fmt.Sprintf("%s must be a %s, got a %s", typeErr.Field, typeErr.Type, typeErr.Value),
+		}}, nil
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return []models.FieldError{{Field: field, Code: models.FieldUnknown, Message: fmt.Sprintf("%s is not a render option", field)}}, nil
+	}
+	return nil, err
+}
+
+// decodeImageData decodes a base64 image, optionally written as a data URL
+func decodeImageData(value string) ([]byte, error) {
+	if strings.HasPrefix(value, "data:") {
+		_, encoded, ok := strings.Cut(value, ",")
+		if !ok {
+			return nil, errors.New("image is a data URL without data")
+		}
+		value = encoded
+	}
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("image must be base64-encoded: %w", err)
+	}
+	return data, nil
+}
+
+// parseRenderForm reads the render options from the fields of a multipart form
+// Fields that are not set keep their defaults
+func parseRenderForm(r *http.Request) (models.RenderOptions, []models.FieldError) {
+	options := models.DefaultRenderOptions()
+	var errs []models.FieldError
+
+	if value := r.FormValue("tags"); value != "" {
+		options.Tags = strings.Split(value, ",")
+	}
+	if value := r.FormValue("outputFormat"); value != "" {
+		options.OutputFormat = strings.ToLower(value)
+	}
+	for field, target := range map[string]*string{
+		"chroma":      &options.Chroma,
+		"compression": &options.Compression,
+		"palette":     &options.Palette,
+	} {
+		if value := r.FormValue(field); value != "" {
+			*target = value
+		}
+	}
+	for _, field := range []struct {
+		name   string
+		target *int
+	}{
+		{"tileSize", &options.TileSize},
+		{"quality", &options.Quality},
+		{"colors", &options.Colors},
+		{"maxBytes", &options.MaxBytes},
+		{"previewWidth", &options.PreviewWidth},
+		{"timeoutMs", &options.TimeoutMs},
+	} {
+		value := r.FormValue(field.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, models.FieldError{Field: field.name, Code: models.FieldInvalidType, Message: fmt.Sprintf("%s must be an integer, got %q", field.name, value)})
+			continue
+		}
+		*field.target = n
+	}
+	if value := r.FormValue("dither"); value != "" {
+		dither, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, models.FieldError{Field: "dither", Code: models.FieldInvalidType, Message: fmt.Sprintf("dither must be a boolean, got %q", value)})
+		}
+		options.Dither = dither
+	}
+	return options, errs
+}
+
+// fieldLabels name the render options in error titles
+var fieldLabels = map[string]string{
+	"tileSize":     "tile size",
+	"outputFormat": "output format",
+	"maxBytes":     "maximum size",
+	"previewWidth": "preview width",
+	"timeoutMs":    "timeout",
+}
+
+// sendValidationError sends a 400 response listing the invalid fields of a request
+// The title names the field when there is only one
+func sendValidationError(w http.ResponseWriter, errs []models.FieldError) {
+	title := "Invalid render options"
+	if len(errs) == 1 && errs[0].Field != "" {
+		label, ok := fieldLabels[errs[0].Field]
+		if !ok {
+			label = errs[0].Field
+		}
+		title = "Invalid " + label
+	}
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Message
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"code":    http.StatusBadRequest,
+		"details": messages,
+	}).Error(title)
+
+	sendJSONResponse(w, http.StatusBadRequest, models.ErrorResponse{
+		Error:     title,
+		Message:   strings.Join(messages, "; "),
+		Code:      http.StatusBadRequest,
+		ErrorCode: models.ErrorCodeInvalidOptions,
+		Fields:    errs,
+	})
+}
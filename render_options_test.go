@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"wilbertopachecob/mosaic/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jsonRenderRequest builds a JSON render request for url
+func jsonRenderRequest(t *testing.T, url string, body map[string]interface{}) *http.Request {
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+	req := httptest.NewRequest("POST", url, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// TestRenderOptionsJSON tests rendering from a JSON body
+func TestRenderOptionsJSON(t *testing.T) {
+	dir := setupTilesTest(t)
+	writeTestFile(t, filepath.Join(dir, "red.jpg"), imageToBytes(t, createTestImage(10, 10)))
+	loadTilesDB(appConfig)
+	router := routes()
+
+	encoded := base64.StdEncoding.EncodeToString(imageToBytes(t, createTestImage(40, 30)))
+	for _, image := range []string{encoded, "data:image/jpeg;base64," + encoded} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, jsonRenderRequest(t, "/api/file/upload", map[string]interface{}{
+			"image":        image,
+			"tileSize":     10,
+			"tags":         []string{},
+			"outputFormat": "png",
+		}))
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+		var response models.MosaicResponse
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+		assert.Equal(t, "png", response.Output.Format)
+		require.Len(t, response.Credits, 1)
+		assert.Equal(t, 12, response.Credits[0].Count)
+	}
+
+	// Render jobs take the same body
+	rr := httptest.NewRecorder()
+	setupJobsTest(t)
+	router.ServeHTTP(rr, jsonRenderRequest(t, "/api/jobs", map[string]interface{}{"image": encoded, "previewWidth": 16}))
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+}
+
+// TestRenderOptionsErrors tests the field errors and codes of invalid options
+func TestRenderOptionsErrors(t *testing.T) {
+	setupTilesTest(t)
+	router := routes()
+	encoded := base64.StdEncoding.EncodeToString(imageToBytes(t, createTestImage(20, 20)))
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		title  string
+		fields map[string]string
+	}{
+		{
+			name:   "form type",
+			req:    renderRequest(t, "/api/file/upload", createTestImage(20, 20), map[string]string{"tileSize": "big"}),
+			title:  "Invalid tile size",
+			fields: map[string]string{"tileSize": models.FieldInvalidType},
+		},
+		{
+			name:   "form ranges",
+			req:    renderRequest(t, "/api/file/upload", createTestImage(20, 20), map[string]string{"tileSize": "1", "quality": "101", "palette": "grays"}),
+			title:  "Invalid render options",
+			fields: map[string]string{"tileSize": models.FieldOutOfRange, "quality": models.FieldOutOfRange, "palette": models.FieldInvalidChoice},
+		},
+		{
+			name:   "json type",
+			req:    jsonRenderRequest(t, "/api/file/upload", map[string]interface{}{"image": encoded, "tileSize": "20"}),
+			title:  "Invalid tile size",
+			fields: map[string]string{"tileSize": models.FieldInvalidType},
+		},
+		{
+			name:   "json unknown field",
+			req:    jsonRenderRequest(t, "/api/file/upload", map[string]interface{}{"image": encoded, "size": 20}),
+			title:  "Invalid size",
+			fields: map[string]string{"size": models.FieldUnknown},
+		},
+		{
+			name:   "json missing image",
+			req:    jsonRenderRequest(t, "/api/file/upload", map[string]interface{}{"tileSize": 20}),
+			title:  "Invalid image",
+			fields: map[string]string{"image": models.FieldRequired},
+		},
+		{
+			name:   "json enums",
+			req:    jsonRenderRequest(t, "/api/file/upload", map[string]interface{}{"image": encoded, "outputFormat": "webp", "chroma": "444"}),
+			title:  "Invalid render options",
+			fields: map[string]string{"outputFormat": models.FieldInvalidChoice, "chroma": models.FieldInvalidChoice},
+		},
+		{
+			name:   "negative timeout",
+			req:    renderRequest(t, "/api/file/upload", createTestImage(20, 20), map[string]string{"timeoutMs": "-1"}),
+			title:  "Invalid timeout",
+			fields: map[string]string{"timeoutMs": models.FieldOutOfRange},
+		},
+		{
+			name:   "job preview width",
+			req:    renderRequest(t, "/api/jobs", createTestImage(20, 20), map[string]string{"previewWidth": "9999"}),
+			title:  "Invalid preview width",
+			fields: map[string]string{"previewWidth": models.FieldOutOfRange},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, tt.req)
+			require.Equal(t, http.StatusBadRequest, rr.Code)
+
+			var response models.ErrorResponse
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+			assert.Equal(t, tt.title, response.Error)
+			assert.Equal(t, models.ErrorCodeInvalidOptions, response.ErrorCode)
+			assert.Equal(t, http.StatusBadRequest, response.Code)
+			fields := make(map[string]string)
+			for _, field := range response.Fields {
+				fields[field.Field] = field.Code
+				assert.NotEmpty(t, field.Message)
+			}
+			assert.Equal(t, tt.fields, fields)
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/file/upload", bytes.NewReader([]byte("[1, 2")))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Invalid request body")
+}
@@ -15,11 +15,49 @@ func routes() *mux.Router {
 	// Add middleware
 	router.Use(loggingMiddleware)
 	router.Use(corsMiddleware)
+	limiters := newRouteLimiters(appConfig)
+	router.Use(authMiddleware(limiters))
+	router.Use(rateLimitMiddleware(limiters))
 
 	// API routes
 	api := router.PathPrefix("/api").Subrouter()
 	api.HandleFunc("/file/upload", mosaicHandler).Methods("POST")
-	
+
+	// Asynchronous render jobs
+	api.HandleFunc("/jobs", createJobHandler).Methods("POST")
+	api.HandleFunc("/jobs/{id}", getJobHandler).Methods("GET")
+	api.HandleFunc("/jobs/{id}", cancelJobHandler).Methods("DELETE")
+	api.HandleFunc("/jobs/{id}/result", jobResultHandler).Methods("GET")
+	api.HandleFunc("/jobs/{id}/events", jobEventsHandler).Methods("GET")
+
+	// Tile management routes - tile IDs may contain a collection prefix ("nature/leaf.jpg")
+	api.HandleFunc("/tiles", listTilesHandler).Methods("GET")
+	api.HandleFunc("/tiles", uploadTilesHandler).Methods("POST")
+	api.HandleFunc("/tiles/duplicates", duplicateTilesHandler).Methods("GET")
+	api.HandleFunc("/tiles/coverage", libraryCoverageHandler).Methods("GET")
+	api.HandleFunc("/tiles/coverage", sourceCoverageHandler).Methods("POST")
+	api.HandleFunc("/tiles/slice", sliceTilesHandler).Methods("POST")
+	api.HandleFunc("/tiles/import", importTilesHandler).Methods("POST")
+	api.HandleFunc("/tiles/synth", synthTilesHandler).Methods("POST")
+	api.HandleFunc("/tiles/errors", tileErrorsHandler).Methods("GET")
+	api.HandleFunc("/tiles/sheet", contactSheetHandler).Methods("GET")
+	api.HandleFunc("/tiles/search", searchTilesByColorHandler).Methods("GET")
+	api.HandleFunc("/tiles/search", searchTilesByImageHandler).Methods("POST")
+	api.HandleFunc("/tiles/errors/retry", retryAllTilesHandler).Methods("POST")
+	api.HandleFunc("/tiles/errors/{id:.+}/retry", retryTileHandler).Methods("POST")
+	api.HandleFunc("/tiles/{id:.+}/thumbnail", tileThumbnailHandler).Methods("GET")
+	api.HandleFunc("/tiles/{id:.+}/move", moveTileHandler).Methods("POST")
+	api.HandleFunc("/tiles/{id:.+}/metadata", getTileMetadataHandler).Methods("GET")
+	api.HandleFunc("/tiles/{id:.+}/metadata", putTileMetadataHandler).Methods("PUT")
+	api.HandleFunc("/tiles/{id:.+}", getTileHandler).Methods("GET")
+	api.HandleFunc("/tiles/{id:.+}", deleteTileHandler).Methods("DELETE")
+
+	// Admin routes
+	api.HandleFunc("/admin/ingest", ingestStatusHandler).Methods("GET")
+	api.HandleFunc("/admin/cache", tileCacheStatsHandler).Methods("GET")
+	api.HandleFunc("/admin/result-cache", resultCacheStatsHandler).Methods("GET")
+	api.HandleFunc("/admin/usage", apiUsageHandler).Methods("GET")
+
 	// Health check endpoint
 	api.HandleFunc("/health", healthHandler).Methods("GET")
 
@@ -52,7 +90,8 @@ func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Retry-After, X-Mosaic-Duration, X-Mosaic-Source-Format, X-Mosaic-Grid, X-Mosaic-Tile-Size, X-Mosaic-Tiles, X-Mosaic-Quality, X-Mosaic-Colors, X-Mosaic-Cache")
 		
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
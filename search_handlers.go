@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	imgpkg "wilbertopachecob/mosaic/lib/img"
+	"wilbertopachecob/mosaic/lib/synth"
+	"wilbertopachecob/mosaic/lib/tiles_db"
+)
+
+const (
+	defaultSearchResults = 10
+	maxSearchResults     = 100
+)
+
+// TileMatch is a search result: a tile and its distance to the query color
+// Distance is the RGB distance used by renders, scaled to 8-bit (0 to about 441)
+type TileMatch struct {
+	TileInfo
+	Distance float64 `json:"distance"`
+}
+
+// TileSearchResponse lists the tiles nearest to the query color, nearest first
+type TileSearchResponse struct {
+	Color   string      `json:"color"`
+	Results []TileMatch `json:"results"`
+}
+
+// searchTilesByColorHandler finds the tiles nearest to a #rrggbb color
+func searchTilesByColorHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("color")
+	colors, err := synth.ParsePalette(query)
+	if err != nil || len(colors) != 1 {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid color", fmt.Sprintf("color %q is not a single #rrggbb color", query))
+		return
+	}
+	k, ok := searchCount(w, r)
+	if !ok {
+		return
+	}
+	c := colors[0]
+	searchTiles(w, [3]float64{float64(c.R) * 257, float64(c.G) * 257, float64(c.B) * 257}, r.URL.Query().Get("tag"), k)
+}
+
+// searchTilesByImageHandler finds the tiles nearest to the average color of an example image
+func searchTilesByImageHandler(w http.ResponseWriter, r *http.Request) {
+	limitUpload(w, r)
+	if err := r.ParseMultipartForm(appConfig.MaxFileSize); isUploadTooLarge(err) {
+		sendUploadTooLarge(w)
+		return
+	} else if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid form data", err.Error())
+		return
+	}
+
+	k, ok := searchCount(w, r)
+	if !ok {
+		return
+	}
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, "Failed to get uploaded file", err.Error())
+		return
+	}
+	defer file.Close()
+
+	example, _, err := decodeUpload(file)
+	if err != nil {
+		sendDecodeError(w, err)
+		return
+	}
+
+	// Decoding the example costs about as much as decoding a render source
+	if _, ok := chargeRender(w, r, megapixels(example.Bounds())); !ok {
+		return
+	}
+
+	// The example is described the same way tiles are when they are ingested
+	searchTiles(w, imgpkg.AverageColor(example), r.FormValue("tag"), k)
+}
+
+// searchCount reads the number of results k of a search
+// It writes a 400 response and returns false when k is out of range
+func searchCount(w http.ResponseWriter, r *http.Request) (int, bool) {
+	k := queryInt(r, "k", defaultSearchResults)
+	if k < 1 || k > maxSearchResults {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid k", fmt.Sprintf("k must be between 1 and %d", maxSearchResults))
+		return 0, false
+	}
+	return k, true
+}
+
+// searchTiles responds with the k tiles nearest to target among the tiles renders would use
+func searchTiles(w http.ResponseWriter, target [3]float64, tag string, k int) {
+	var tags []string
+	if tag != "" {
+		tags = tiles_db.NormalizeTags(strings.Split(tag, ","))
+	}
+
+	db, _ := snapshotTilesDB(tileStore, tags)
+	response := TileSearchResponse{Color: colorHex(target), Results: []TileMatch{}}
+	for _, match := range imgpkg.KNearest(target, db, k) {
+		record, ok := tileStore.Get(match.Key)
+		if !ok {
+			continue
+		}
+		info, ok := recordInfo(record)
+		if !ok {
+			continue
+		}
+		response.Results = append(response.Results, TileMatch{
+			TileInfo: info,
+			Distance: math.Round(match.Distance/257*100) / 100,
+		})
+	}
+	sendJSONResponse(w, http.StatusOK, response)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSearchTiles tests searching tiles by color and by example image
+func TestSearchTiles(t *testing.T) {
+	dir := setupTilesTest(t)
+	for name, c := range map[string]color.RGBA{
+		"red.png":      {255, 0, 0, 255},
+		"darkred.png":  {180, 0, 0, 255},
+		"blue.png":     {0, 0, 255, 255},
+		"sea/teal.png": {0, 128, 128, 255},
+	} {
+		writeTestFile(t, filepath.Join(dir, name), imageToPNG(t, createColorImage(8, 8, c)))
+	}
+	loadTilesDB(appConfig)
+	router := routes()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles/search?k=2&color="+url.QueryEscape("#f00000"), nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var response TileSearchResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, "#f00000", response.Color)
+	require.Len(t, response.Results, 2)
+	assert.Equal(t, "red.png", response.Results[0].ID)
+	assert.Equal(t, "darkred.png", response.Results[1].ID)
+	assert.InDelta(t, 15, response.Results[0].Distance, 0.01)
+	assert.NotNil(t, response.Results[0].Stats)
+
+	// The search uses the same candidates as renders, including tag filters
+	req := multipartRequest(t, "/api/tiles/search?k=1", "image", "example.png", imageToPNG(t, createColorImage(20, 20, color.RGBA{0, 0, 200, 255})), nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	require.Len(t, response.Results, 1)
+	assert.Equal(t, "blue.png", response.Results[0].ID)
+
+	for _, query := range []string{"color=red", "color=" + url.QueryEscape("#ff0000") + "&k=0", "color=" + url.QueryEscape("#ff0000") + "&k=1000"} {
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles/search?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+
+	"wilbertopachecob/mosaic/lib/contact_sheet"
+	"wilbertopachecob/mosaic/lib/tile_cache"
+	"wilbertopachecob/mosaic/lib/tile_store"
+	"wilbertopachecob/mosaic/lib/tiles_db"
+	"wilbertopachecob/mosaic/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ContactSheetResponse reports the statistics of a collection and its tiles in sheet order
+// Tiles is the requested page while Stats covers the whole collection
+type ContactSheetResponse struct {
+	Collection string              `json:"collection"`
+	Sort       string              `json:"sort"`
+	Stats      contact_sheet.Stats `json:"stats"`
+	Tiles      []string            `json:"tiles"`
+}
+
+// contactSheetHandler summarizes a collection, or the whole library when no collection is given
+// Returns JSON by default, or the contact sheet as a PNG when format=png
+func contactSheetHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	collection := query.Get("collection")
+	if collection != "" && !tiles_db.IsValidCollection(collection) {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid collection", fmt.Sprintf("collection %q is not a valid name", collection))
+		return
+	}
+	sortBy := query.Get("sort")
+	if sortBy == "" {
+		sortBy = contact_sheet.SortHue
+	}
+	opts := contact_sheet.DefaultOptions()
+	opts.Columns = queryInt(r, "columns", opts.Columns)
+	opts.CellSize = queryInt(r, "cell", opts.CellSize)
+	opts.Padding = queryInt(r, "padding", opts.Padding)
+	if err := opts.Validate(); err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid contact sheet layout", err.Error())
+		return
+	}
+	offset, limit := queryInt(r, "offset", 0), queryInt(r, "limit", 0)
+	if offset < 0 || limit < 0 {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid contact sheet page", "offset and limit must not be negative")
+		return
+	}
+
+	tiles := collectionTiles(tileStore.Snapshot(), collection)
+	if collection != "" && len(tiles) == 0 {
+		sendErrorResponse(w, http.StatusNotFound, "Collection not found", collection)
+		return
+	}
+	if err := contact_sheet.SortTiles(tiles, sortBy); err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid sort", err.Error())
+		return
+	}
+
+	page := sheetPage(tiles, offset, limit)
+
+	if query.Get("format") == "png" {
+		if err := checkSheetSize(len(page), opts); err != nil {
+			sendErrorCode(w, http.StatusUnprocessableEntity, models.ErrorCodeImageTooLarge, "Contact sheet too large", err.Error())
+			return
+		}
+		if _, ok := chargeRender(w, r, megapixels(opts.Bounds(len(page)))); !ok {
+			return
+		}
+		sheet, errs := renderContactSheet(page, opts)
+		for _, err := range errs {
+			logrus.WithError(err).Warn("Failed to load tile for contact sheet")
+		}
+		sendPNGResponse(w, sheet)
+		return
+	}
+
+	response := ContactSheetResponse{
+		Collection: collection,
+		Sort:       sortBy,
+		Stats:      contact_sheet.Summarize(tiles, appConfig.DuplicateDistance),
+		Tiles:      make([]string, 0, len(page)),
+	}
+	for _, tile := range page {
+		response.Tiles = append(response.Tiles, tile.ID)
+	}
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// collectionTiles returns the tiles of records that belong to collection, all of them when it is empty
+func collectionTiles(records map[string]tile_store.Record, collection string) []contact_sheet.Tile {
+	var tiles []contact_sheet.Tile
+	for _, record := range records {
+		info, ok := tileInfo(record.Path, record.Color)
+		if !ok || (collection != "" && info.Collection != collection) {
+			continue
+		}
+		tiles = append(tiles, contact_sheet.Tile{
+			ID:     info.ID,
+			Path:   record.Path,
+			Color:  record.Color,
+			Size:   record.Size,
+			SHA256: record.SHA256,
+			Hash:   record.Hash,
+		})
+	}
+	return tiles
+}
+
+// sheetPage returns the tiles from offset on, at most limit of them unless limit is zero
+func sheetPage(tiles []contact_sheet.Tile, offset, limit int) []contact_sheet.Tile {
+	tiles = tiles[min(offset, len(tiles)):]
+	if limit > 0 && limit < len(tiles) {
+		tiles = tiles[:limit]
+	}
+	return tiles
+}
+
+// checkSheetSize rejects contact sheets of more than MaxImagePixels pixels
+func checkSheetSize(count int, opts contact_sheet.Options) error {
+	bounds := opts.Bounds(count)
+	if pixels := int64(bounds.Dx()) * int64(bounds.Dy()); pixels > appConfig.MaxImagePixels {
+		return fmt.Errorf("a sheet of %d tiles is %dx%d pixels, more than the limit of %d; use limit and offset to page through the tiles",
+			count, bounds.Dx(), bounds.Dy(), appConfig.MaxImagePixels)
+	}
+	return nil
+}
+
+// renderContactSheet draws the tiles through the shared tile cache
+func renderContactSheet(tiles []contact_sheet.Tile, opts contact_sheet.Options) (*image.NRGBA, []error) {
+	return contact_sheet.Render(tiles, opts, func(tile contact_sheet.Tile) (image.Image, error) {
+		return tileCache.Get(tile_cache.Key{Path: tile.Path, Size: opts.CellSize})
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"wilbertopachecob/mosaic/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestContactSheetHandler tests collection statistics and the PNG contact sheet
+func TestContactSheetHandler(t *testing.T) {
+	dir := setupTilesTest(t)
+	red := imageToBytes(t, createTestImage(10, 10))
+	writeTestFile(t, filepath.Join(dir, "nature", "red.jpg"), red)
+	writeTestFile(t, filepath.Join(dir, "nature", "red-copy.jpg"), red)
+	writeTestFile(t, filepath.Join(dir, "nature", "checker.jpg"), imageToBytes(t, createCheckerImage(10, 10, 2)))
+	writeTestFile(t, filepath.Join(dir, "other.jpg"), red)
+	loadTilesDB(appConfig)
+
+	router := routes()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles/sheet?collection=nature&sort=name", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var response ContactSheetResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, []string{"nature/checker.jpg", "nature/red-copy.jpg", "nature/red.jpg"}, response.Tiles)
+	assert.Equal(t, 3, response.Stats.Count)
+	assert.Equal(t, 1, response.Stats.Duplicates.ExactGroups)
+	assert.Equal(t, 2, response.Stats.Duplicates.ExactFiles)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles/sheet?format=png&columns=2&cell=10&padding=0", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "image/png", rr.Header().Get("Content-Type"))
+	sheet, err := png.Decode(bytes.NewReader(rr.Body.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, 20, sheet.Bounds().Dx())
+	assert.Equal(t, 20, sheet.Bounds().Dy())
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles/sheet?sort=name&offset=1&limit=2", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	response = ContactSheetResponse{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, []string{"nature/red-copy.jpg", "nature/red.jpg"}, response.Tiles)
+	assert.Equal(t, 4, response.Stats.Count)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles/sheet?format=png&limit=1&cell=10&padding=0", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	sheet, err = png.Decode(bytes.NewReader(rr.Body.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, 10, sheet.Bounds().Dx())
+
+	appConfig.MaxImagePixels = 399
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles/sheet?format=png&columns=2&cell=10&padding=0", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Contains(t, rr.Body.String(), models.ErrorCodeImageTooLarge)
+
+	for _, query := range []string{"sort=size", "collection=../x", "columns=0", "offset=-1"} {
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles/sheet?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles/sheet?collection=missing", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
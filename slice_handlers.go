@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"wilbertopachecob/mosaic/lib/slicer"
+)
+
+// SliceResponse reports the outcome of generating a collection from source images
+type SliceResponse struct {
+	*slicer.Result
+	Added      []TileInfo      `json:"added"`
+	Duplicates []TileDuplicate `json:"duplicates"`
+}
+
+// sliceTilesHandler cuts uploaded source images into square crops and stores them as a new collection
+func sliceTilesHandler(w http.ResponseWriter, r *http.Request) {
+	limitUploads(w, r)
+	if err := r.ParseMultipartForm(appConfig.MaxFileSize); isUploadTooLarge(err) {
+		sendUploadsTooLarge(w)
+		return
+	} else if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid form data", err.Error())
+		return
+	}
+
+	opts, err := sliceOptionsFromForm(r)
+	if err == nil {
+		err = opts.Validate()
+	}
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid slice options", err.Error())
+		return
+	}
+
+	dir, err := newCollectionDir(r.FormValue("collection"))
+	if err != nil {
+		sendCollectionError(w, err)
+		return
+	}
+
+	files := r.MultipartForm.File["sources"]
+	if len(files) == 0 {
+		sendErrorResponse(w, http.StatusBadRequest, "No sources uploaded", "expected one or more files in the 'sources' field")
+		return
+	}
+	if !checkUploadedImages(w, files) {
+		return
+	}
+
+	// The slicer works on files, so stage the uploads in a temporary directory
+	staging, err := os.MkdirTemp("", "mosaic-slice")
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, "Failed to stage sources", err.Error())
+		return
+	}
+	defer os.RemoveAll(staging)
+
+	var sources []string
+	for _, header := range files {
+		path := filepath.Join(staging, strconv.Itoa(len(sources))+"_"+filepath.Base(header.Filename))
+		if err := copyUploadedFile(header, path); err != nil {
+			sendErrorResponse(w, http.StatusInternalServerError, "Failed to stage sources", err.Error())
+			return
+		}
+		sources = append(sources, path)
+	}
+
+	result, err := slicer.SliceFiles(sources, dir, opts)
+	if errors.Is(err, slicer.ErrTooManyCrops) {
+		sendErrorResponse(w, http.StatusUnprocessableEntity, "Too many crops", err.Error())
+		return
+	} else if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, "Failed to slice sources", err.Error())
+		return
+	}
+
+	response := SliceResponse{Result: result}
+	var errs []string
+	response.Added, response.Duplicates, errs = publishFiles(result.Written)
+	result.Errors = append(result.Errors, errs...)
+
+	sendJSONResponse(w, http.StatusCreated, response)
+}
+
+// sliceOptionsFromForm reads slicer options from form fields, keeping defaults for missing ones
+func sliceOptionsFromForm(r *http.Request) (slicer.Options, error) {
+	opts := slicer.DefaultOptions()
+	opts.MaxPixels = appConfig.MaxImagePixels
+	opts.MaxCrops = appConfig.SliceMaxCrops
+	if mode := r.FormValue("mode"); mode != "" {
+		opts.Mode = mode
+	}
+
+	ints := map[string]*int{"size": &opts.Size, "overlap": &opts.Overlap, "count": &opts.Count}
+	for key, target := range ints {
+		if value := r.FormValue(key); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return opts, err
+			}
+			*target = parsed
+		}
+	}
+
+	floats := map[string]*float64{"minStdDev": &opts.MinStdDev, "minSharpness": &opts.MinSharpness}
+	for key, target := range floats {
+		if value := r.FormValue(key); value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return opts, err
+			}
+			*target = parsed
+		}
+	}
+
+	if value := r.FormValue("seed"); value != "" {
+		seed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return opts, err
+		}
+		opts.Seed = seed
+	}
+	return opts, nil
+}
+
+// copyUploadedFile writes an uploaded file to path
+func copyUploadedFile(header *multipart.FileHeader, path string) error {
+	src, err := header.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createCheckerImage creates a sharp checkerboard suitable as a slicing source
+func createCheckerImage(width, height, square int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if (x/square+y/square)%2 == 0 {
+				img.Set(x, y, color.White)
+			} else {
+				img.Set(x, y, color.RGBA{20, 60, 200, 255})
+			}
+		}
+	}
+	return img
+}
+
+// TestSliceTilesHandler tests generating a collection from an uploaded source
+func TestSliceTilesHandler(t *testing.T) {
+	dir := setupTilesTest(t)
+	router := routes()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, multipartRequest(t, "/api/tiles/slice", "sources", "panorama.jpg", imageToBytes(t, createCheckerImage(96, 64, 12)), map[string]string{"collection": "panorama", "size": "32"}))
+	require.Equal(t, http.StatusCreated, rr.Code)
+
+	var response SliceResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, 1, response.Sources)
+	assert.Len(t, response.Added, 6)
+	assert.Len(t, tileStore.List(), 6)
+
+	entries, err := os.ReadDir(filepath.Join(dir, "panorama"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 6)
+
+	// The collection now exists and can't be generated again
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, multipartRequest(t, "/api/tiles/slice", "sources", "panorama.jpg", imageToBytes(t, createCheckerImage(96, 64, 8)), map[string]string{"collection": "panorama", "size": "32"}))
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	// Names that can't be a collection are bad requests
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, multipartRequest(t, "/api/tiles/slice", "sources", "panorama.jpg", imageToBytes(t, createCheckerImage(96, 64, 8)), map[string]string{"collection": "../escape", "size": "32"}))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Every crop of a source repeating with the crop size is the same tile
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, multipartRequest(t, "/api/tiles/slice", "sources", "panorama.jpg", imageToBytes(t, createCheckerImage(96, 64, 8)), map[string]string{"collection": "repeated", "size": "32"}))
+	require.Equal(t, http.StatusCreated, rr.Code)
+	response = SliceResponse{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Len(t, response.Added, 1)
+	assert.Len(t, response.Duplicates, 5)
+	entries, err = os.ReadDir(filepath.Join(dir, "repeated"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// Overlaps leaving less than half a crop between steps are bad requests
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, multipartRequest(t, "/api/tiles/slice", "sources", "panorama.jpg", imageToBytes(t, createCheckerImage(96, 64, 12)), map[string]string{"collection": "dense", "size": "32", "overlap": "31"}))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Sources yielding more crops than allowed are refused before anything is written
+	appConfig.SliceMaxCrops = 5
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, multipartRequest(t, "/api/tiles/slice", "sources", "panorama.jpg", imageToBytes(t, createCheckerImage(96, 64, 12)), map[string]string{"collection": "crowded", "size": "32"}))
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	_, err = os.Stat(filepath.Join(dir, "crowded"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"wilbertopachecob/mosaic/lib/synth"
+)
+
+// SynthRequest configures a synthetic tile collection, missing fields keep their defaults
+type SynthRequest struct {
+	Collection string   `json:"collection"`
+	Size       *int     `json:"size"`
+	Count      *int     `json:"count"`
+	Style      string   `json:"style"`
+	Sampling   string   `json:"sampling"`
+	Palette    []string `json:"palette"`
+	Seed       *int64   `json:"seed"`
+}
+
+// SynthResponse reports the outcome of generating a synthetic collection
+type SynthResponse struct {
+	*synth.Result
+	Added      []TileInfo      `json:"added"`
+	Duplicates []TileDuplicate `json:"duplicates"`
+	Errors     []string        `json:"errors"`
+}
+
+// synthTilesHandler generates a synthetic tile collection covering a color space
+// Expects a JSON body such as {"collection": "flat", "count": 64, "style": "solid", "sampling": "lab"}
+func synthTilesHandler(w http.ResponseWriter, r *http.Request) {
+	var body SynthRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid request body", err.Error())
+		return
+	}
+
+	opts, err := body.options()
+	if err == nil {
+		err = opts.Validate()
+	}
+	if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid synth options", err.Error())
+		return
+	}
+
+	dir, err := newCollectionDir(body.Collection)
+	if err != nil {
+		sendCollectionError(w, err)
+		return
+	}
+
+	result, err := synth.Generate(dir, opts)
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, "Failed to generate tiles", err.Error())
+		return
+	}
+
+	response := SynthResponse{Result: result}
+	response.Added, response.Duplicates, response.Errors = publishFiles(result.Written)
+	if response.Errors == nil {
+		response.Errors = []string{}
+	}
+	sendJSONResponse(w, http.StatusCreated, response)
+}
+
+// options converts the request into generator options
+func (body SynthRequest) options() (synth.Options, error) {
+	opts := synth.DefaultOptions()
+	if body.Size != nil {
+		opts.Size = *body.Size
+	}
+	if body.Count != nil {
+		opts.Count = *body.Count
+	}
+	if body.Style != "" {
+		opts.Style = body.Style
+	}
+	if body.Sampling != "" {
+		opts.Sampling = body.Sampling
+	}
+	if body.Seed != nil {
+		opts.Seed = *body.Seed
+	}
+	if len(body.Palette) > 0 {
+		palette, err := synth.ParsePalette(strings.Join(body.Palette, ","))
+		if err != nil {
+			return opts, err
+		}
+		opts.Palette = palette
+		// A palette without an explicit count yields one tile per palette color
+		if body.Sampling == "" {
+			opts.Sampling = synth.SamplingPalette
+		}
+		if body.Count == nil {
+			opts.Count = 0
+		}
+	}
+	return opts, nil
+}
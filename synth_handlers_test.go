@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"wilbertopachecob/mosaic/lib/synth"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSynthTilesHandler tests generating a synthetic collection through the API
+func TestSynthTilesHandler(t *testing.T) {
+	setupTilesTest(t)
+	router := routes()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/api/tiles/synth",
+		strings.NewReader(`{"collection": "flat", "size": 8, "count": 27, "sampling": "lab"}`)))
+	require.Equal(t, http.StatusCreated, rr.Code)
+
+	var response SynthResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Len(t, response.Written, 27)
+	assert.Len(t, response.Added, 27)
+	assert.Equal(t, "flat", response.Added[0].Collection)
+	assert.Len(t, tileStore.List(), 27)
+
+	// A palette defaults to one tile per color
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/api/tiles/synth",
+		strings.NewReader(`{"collection": "brand", "style": "pattern", "palette": ["#ff0000", "#0000ff"]}`)))
+	require.Equal(t, http.StatusCreated, rr.Code)
+	response = SynthResponse{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Len(t, response.Added, 2)
+
+	for _, body := range []string{
+		`{"collection": "bad", "style": "plaid"}`,
+		`{"collection": "bad", "palette": ["red"]}`,
+	} {
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", "/api/tiles/synth", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+	}
+
+	// Existing collections conflict, invalid names are bad requests
+	for body, status := range map[string]int{
+		`{"collection": "flat"}`:      http.StatusConflict,
+		`{"collection": "../escape"}`: http.StatusBadRequest,
+	} {
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", "/api/tiles/synth", strings.NewReader(body)))
+		assert.Equal(t, status, rr.Code, body)
+	}
+}
+
+// TestGenerateMosaicWithSyntheticTiles renders against a deterministic synthetic library
+func TestGenerateMosaicWithSyntheticTiles(t *testing.T) {
+	dir := setupTilesTest(t)
+	opts := synth.DefaultOptions()
+	opts.Size, opts.Count = 10, 27
+	result, err := synth.Generate(filepath.Join(dir, "flat"), opts)
+	require.NoError(t, err)
+	added, _, errs := publishFiles(result.Written)
+	require.Empty(t, errs)
+	require.Len(t, added, 27)
+
+	source := createGradientImage(60, 30, false)
+	first, usage, err := generateMosaic(tileStore, source, 10, nil)
+	require.NoError(t, err)
+	second, _, err := generateMosaic(tileStore, source, 10, nil)
+	require.NoError(t, err)
+	assert.Equal(t, first, second, "renders of the same library must be identical")
+
+	cells := 0
+	for _, count := range usage {
+		cells += count
+	}
+	assert.Equal(t, 18, cells)
+
+	// The black start of the gradient gets the black tile, its white end the white tile
+	data, err := base64.StdEncoding.DecodeString(first)
+	require.NoError(t, err)
+	mosaic, err := jpeg.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	r, _, _, _ := mosaic.At(5, 5).RGBA()
+	assert.Less(t, r>>8, uint32(16))
+	r, _, _, _ = mosaic.At(55, 5).RGBA()
+	assert.Greater(t, r>>8, uint32(240))
+}
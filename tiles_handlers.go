@@ -0,0 +1,735 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	imgpkg "wilbertopachecob/mosaic/lib/img"
+	"wilbertopachecob/mosaic/lib/tile_store"
+	"wilbertopachecob/mosaic/lib/tiles_db"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTilesPageSize = 50
+	maxTilesPageSize     = 500
+	defaultThumbnailSize = 100
+	maxThumbnailSize     = 512
+)
+
+// TileInfo describes a tile in API responses
+// The ID is the tile path relative to the tiles directory, using forward slashes.
+// SHA256 identifies the content; Aliases lists the other IDs with the same content
+type TileInfo struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Collection string     `json:"collection"`
+	Color      [3]float64 `json:"color"`
+	Hex        string     `json:"hex"`
+	SHA256     string     `json:"sha256,omitempty"`
+	Aliases    []string   `json:"aliases,omitempty"`
+
+	Metadata *tiles_db.Metadata `json:"metadata,omitempty"`
+	Stats    *tiles_db.Stats    `json:"stats,omitempty"`
+}
+
+// sha256IDPrefix marks tile IDs that refer to a tile by content hash
+const sha256IDPrefix = "sha256:"
+
+// TileListResponse is the paginated response of the tile list endpoint
+type TileListResponse struct {
+	Tiles    []TileInfo `json:"tiles"`
+	Page     int        `json:"page"`
+	PageSize int        `json:"pageSize"`
+	Total    int        `json:"total"`
+}
+
+// TileUploadFailure reports a file that could not be added to the tiles database
+type TileUploadFailure struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// TileDuplicate reports an uploaded file whose content is already in the library
+type TileDuplicate struct {
+	Name   string `json:"name"`
+	Tile   string `json:"tile"` // ID of the existing tile
+	SHA256 string `json:"sha256"`
+}
+
+// TileUploadResponse reports the outcome of a tile upload
+type TileUploadResponse struct {
+	Added      []TileInfo          `json:"added"`
+	Duplicates []TileDuplicate     `json:"duplicates"`
+	Failed     []TileUploadFailure `json:"failed"`
+}
+
+// listTilesHandler lists tiles with their average colors and metadata
+// Tiles can be filtered by collection and by tags (comma separated, any tag matches)
+func listTilesHandler(w http.ResponseWriter, r *http.Request) {
+	page := queryInt(r, "page", 1)
+	if page < 1 {
+		page = 1
+	}
+	pageSize := queryInt(r, "pageSize", defaultTilesPageSize)
+	if pageSize < 1 || pageSize > maxTilesPageSize {
+		pageSize = defaultTilesPageSize
+	}
+	collection := r.URL.Query().Get("collection")
+	var tags []string
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		tags = tiles_db.NormalizeTags(strings.Split(tag, ","))
+	}
+	sortKey := r.URL.Query().Get("sort")
+	statValue, descending, ok := tileStatSort(sortKey)
+	if !ok {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid sort", fmt.Sprintf("sort %q is not one of id, variance, brightness, edgeDensity, optionally prefixed with '-'", sortKey))
+		return
+	}
+
+	// Records are filtered, sorted and paged before they are described, so alias
+	// lookups are only paid for the tiles of the requested page
+	type listedTile struct {
+		id     string
+		record tile_store.Record
+	}
+	listed := []listedTile{}
+	for _, record := range tileStore.Snapshot() {
+		info, ok := tileInfo(record.Path, record.Color)
+		if !ok || (collection != "" && info.Collection != collection) {
+			continue
+		}
+		if len(tags) > 0 && !record.Metadata.HasAnyTag(tags) {
+			continue
+		}
+		listed = append(listed, listedTile{id: info.ID, record: record})
+	}
+
+	// Sort by ID so pages are stable between requests, then by the requested statistic
+	sort.Slice(listed, func(i, j int) bool { return listed[i].id < listed[j].id })
+	if statValue != nil {
+		sort.SliceStable(listed, func(i, j int) bool {
+			if descending {
+				return statValue(listed[i].record) > statValue(listed[j].record)
+			}
+			return statValue(listed[i].record) < statValue(listed[j].record)
+		})
+	}
+
+	start := (page - 1) * pageSize
+	if start > len(listed) {
+		start = len(listed)
+	}
+	end := start + pageSize
+	if end > len(listed) {
+		end = len(listed)
+	}
+
+	tiles := make([]TileInfo, 0, end-start)
+	for _, entry := range listed[start:end] {
+		info, _ := recordInfo(entry.record)
+		tiles = append(tiles, info)
+	}
+
+	sendJSONResponse(w, http.StatusOK, TileListResponse{
+		Tiles:    tiles,
+		Page:     page,
+		PageSize: pageSize,
+		Total:    len(listed),
+	})
+}
+
+// tileStatSort resolves the sort query parameter of the tile list
+// A nil value function means sorting by ID. Tiles without statistics sort as zero
+func tileStatSort(key string) (value func(tile_store.Record) float64, descending bool, ok bool) {
+	descending = strings.HasPrefix(key, "-")
+	stat := func(get func(tiles_db.Stats) float64) func(tile_store.Record) float64 {
+		return func(record tile_store.Record) float64 {
+			if len(record.Stats.Histogram) == 0 {
+				return 0
+			}
+			return get(record.Stats)
+		}
+	}
+
+	switch strings.TrimPrefix(key, "-") {
+	case "", "id":
+		return nil, false, !descending
+	case "variance":
+		return stat(func(s tiles_db.Stats) float64 { return s.Variance }), descending, true
+	case "brightness":
+		return stat(func(s tiles_db.Stats) float64 { return s.Brightness }), descending, true
+	case "edgeDensity":
+		return stat(func(s tiles_db.Stats) float64 { return s.EdgeDensity }), descending, true
+	default:
+		return nil, false, false
+	}
+}
+
+// uploadTilesHandler adds one or more uploaded images to a tile collection
+func uploadTilesHandler(w http.ResponseWriter, r *http.Request) {
+	limitUploads(w, r)
+	if err := r.ParseMultipartForm(appConfig.MaxFileSize); isUploadTooLarge(err) {
+		sendUploadsTooLarge(w)
+		return
+	} else if err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid form data", err.Error())
+		return
+	}
+
+	collection := r.FormValue("collection")
+	if collection != "" && !tiles_db.IsValidCollection(collection) {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid collection", fmt.Sprintf("collection %q is not a valid name", collection))
+		return
+	}
+
+	files := r.MultipartForm.File["tiles"]
+	if len(files) == 0 {
+		sendErrorResponse(w, http.StatusBadRequest, "No tiles uploaded", "expected one or more files in the 'tiles' field")
+		return
+	}
+	if !checkUploadedImages(w, files) {
+		return
+	}
+
+	dir := filepath.Join(appConfig.TilesDir, collection)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, "Failed to create collection", err.Error())
+		return
+	}
+
+	response := TileUploadResponse{Added: []TileInfo{}, Duplicates: []TileDuplicate{}, Failed: []TileUploadFailure{}}
+	added := make(map[string]tiles_db.Descriptor)
+	var order []string
+	for _, header := range files {
+		name := filepath.Base(header.Filename)
+		path, err := saveUploadedTile(header, dir, name)
+		var descriptor tiles_db.Descriptor
+		if err == nil {
+			descriptor, err = tiles_db.DescribeTile(path)
+			if err != nil {
+				os.Remove(path)
+			}
+		}
+		if err != nil {
+			response.Failed = append(response.Failed, TileUploadFailure{Name: name, Error: err.Error()})
+			continue
+		}
+
+		added[path] = descriptor
+		order = append(order, path)
+	}
+
+	duplicates := publishTiles(added, nil)
+	for _, path := range order {
+		if existing, ok := duplicates[path]; ok {
+			response.Duplicates = append(response.Duplicates, TileDuplicate{Name: filepath.Base(path), Tile: existing, SHA256: added[path].SHA256})
+			continue
+		}
+		info, _ := recordInfo(tile_store.NewRecord(path, added[path], tiles_db.Metadata{}))
+		response.Added = append(response.Added, info)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"collection": collection,
+		"added":      len(response.Added),
+		"duplicates": len(response.Duplicates),
+		"failed":     len(response.Failed),
+	}).Info("Tiles uploaded")
+
+	status := http.StatusCreated
+	switch {
+	case len(response.Added) == 0 && len(response.Duplicates) > 0:
+		status = http.StatusOK
+	case len(response.Added) == 0:
+		status = http.StatusBadRequest
+	}
+	sendJSONResponse(w, status, response)
+}
+
+// saveUploadedTile copies an uploaded file into dir without overwriting existing tiles
+func saveUploadedTile(header *multipart.FileHeader, dir, name string) (string, error) {
+	if !tiles_db.IsImageFile(name) {
+		return "", fmt.Errorf("unsupported file type")
+	}
+
+	src, err := header.Open()
+	if err != nil {
+		return "", fmt.Errorf("failed to read upload: %w", err)
+	}
+	defer src.Close()
+
+	path := filepath.Join(dir, name)
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return "", fmt.Errorf("tile already exists")
+		}
+		return "", fmt.Errorf("failed to create tile file: %w", err)
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(path)
+		return "", fmt.Errorf("failed to write tile file: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("failed to write tile file: %w", err)
+	}
+	return path, nil
+}
+
+// getTileHandler serves the original tile image
+func getTileHandler(w http.ResponseWriter, r *http.Request) {
+	path, ok := lookupTile(w, r)
+	if !ok {
+		return
+	}
+	http.ServeFile(w, r, path)
+}
+
+// tileThumbnailHandler serves a JPEG thumbnail of a tile
+func tileThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	path, ok := lookupTile(w, r)
+	if !ok {
+		return
+	}
+
+	size := queryInt(r, "size", defaultThumbnailSize)
+	if size < 1 || size > maxThumbnailSize {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid thumbnail size", fmt.Sprintf("size must be between 1 and %d", maxThumbnailSize))
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, "Failed to open tile", err.Error())
+		return
+	}
+	defer file.Close()
+
+	tileImg, _, err := image.Decode(file)
+	if err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, "Failed to decode tile", err.Error())
+		return
+	}
+
+	thumbnail := imgpkg.Resize(tileImg, size)
+	w.Header().Set("Content-Type", "image/jpeg")
+	if err := jpeg.Encode(w, &thumbnail, nil); err != nil {
+		logrus.WithError(err).WithField("tile", path).Warn("Failed to encode thumbnail")
+	}
+}
+
+// deleteTileHandler removes a tile from disk and from the tiles database
+func deleteTileHandler(w http.ResponseWriter, r *http.Request) {
+	path, ok := lookupTile(w, r)
+	if !ok {
+		return
+	}
+
+	tilesMu.Lock()
+	defer refreshDuplicateGroups()
+	defer tilesMu.Unlock()
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		sendErrorResponse(w, http.StatusInternalServerError, "Failed to delete tile", err.Error())
+		return
+	}
+	if err := os.Remove(tiles_db.SidecarPath(path)); err != nil && !os.IsNotExist(err) {
+		logrus.WithError(err).WithField("tile", path).Warn("Failed to delete tile metadata")
+	}
+	markTileRemoved(path)
+	if err := tileStore.Delete(path); err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, "Failed to update tile index", err.Error())
+		return
+	}
+	tileCache.Invalidate(path)
+
+	logrus.WithField("tile", path).Info("Tile deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// moveTileHandler moves a tile into another collection
+// Expects a JSON body of the form {"collection": "name"}, an empty name is the default collection
+func moveTileHandler(w http.ResponseWriter, r *http.Request) {
+	path, ok := lookupTile(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Collection string `json:"collection"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid request body", err.Error())
+		return
+	}
+	if body.Collection != "" && !tiles_db.IsValidCollection(body.Collection) {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid collection", fmt.Sprintf("collection %q is not a valid name", body.Collection))
+		return
+	}
+
+	dir := filepath.Join(appConfig.TilesDir, body.Collection)
+	newPath := filepath.Join(dir, filepath.Base(path))
+
+	tilesMu.Lock()
+	defer refreshDuplicateGroups()
+	defer tilesMu.Unlock()
+
+	record, exists := tileStore.Get(path)
+	if !exists {
+		sendErrorResponse(w, http.StatusNotFound, "Tile not found", mux.Vars(r)["id"])
+		return
+	}
+	if newPath != path {
+		if _, err := os.Stat(newPath); err == nil {
+			sendErrorResponse(w, http.StatusConflict, "Tile already exists", "the target collection already has a tile with this name")
+			return
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			sendErrorResponse(w, http.StatusInternalServerError, "Failed to create collection", err.Error())
+			return
+		}
+		if err := os.Rename(path, newPath); err != nil {
+			sendErrorResponse(w, http.StatusInternalServerError, "Failed to move tile", err.Error())
+			return
+		}
+		if !record.Metadata.IsEmpty() {
+			if err := os.Rename(tiles_db.SidecarPath(path), tiles_db.SidecarPath(newPath)); err != nil {
+				logrus.WithError(err).WithField("tile", path).Warn("Failed to move tile metadata")
+			}
+		}
+		markTileRemoved(path)
+		record.Path = newPath
+		if err := tileStore.Put(record); err != nil {
+			sendErrorResponse(w, http.StatusInternalServerError, "Failed to update tile index", err.Error())
+			return
+		}
+		if err := tileStore.Delete(path); err != nil {
+			logrus.WithError(err).WithField("tile", path).Warn("Failed to remove moved tile from the index")
+		}
+		tileCache.Invalidate(path)
+	}
+
+	info, _ := recordInfo(record)
+	sendJSONResponse(w, http.StatusOK, info)
+}
+
+// getTileMetadataHandler returns the tags and attribution of a tile
+func getTileMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	path, ok := lookupTile(w, r)
+	if !ok {
+		return
+	}
+
+	record, _ := tileStore.Get(path)
+	sendJSONResponse(w, http.StatusOK, record.Metadata)
+}
+
+// putTileMetadataHandler replaces the tags and attribution of a tile
+// The metadata is stored in the tile's sidecar file so it survives restarts
+func putTileMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	path, ok := lookupTile(w, r)
+	if !ok {
+		return
+	}
+
+	var metadata tiles_db.Metadata
+	if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid request body", err.Error())
+		return
+	}
+	metadata = metadata.Normalize()
+
+	tilesMu.Lock()
+	defer tilesMu.Unlock()
+
+	if err := tiles_db.SaveMetadata(path, metadata); err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, "Failed to save metadata", err.Error())
+		return
+	}
+	record, exists := tileStore.Get(path)
+	if !exists {
+		sendErrorResponse(w, http.StatusNotFound, "Tile not found", mux.Vars(r)["id"])
+		return
+	}
+	record.Metadata = metadata
+	if err := tileStore.Put(record); err != nil {
+		sendErrorResponse(w, http.StatusInternalServerError, "Failed to update tile index", err.Error())
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, metadata)
+}
+
+// DuplicateCluster is a group of near-duplicate tiles
+type DuplicateCluster struct {
+	Tiles []TileInfo `json:"tiles"`
+}
+
+// DuplicatesResponse lists the near-duplicate clusters of the tile library
+type DuplicatesResponse struct {
+	Distance int                `json:"distance"`
+	Clusters []DuplicateCluster `json:"clusters"`
+}
+
+// duplicateTilesHandler lists clusters of near-duplicate tiles
+// The optional distance query parameter overrides the configured Hamming distance
+func duplicateTilesHandler(w http.ResponseWriter, r *http.Request) {
+	distance := queryInt(r, "distance", appConfig.DuplicateDistance)
+	if distance < 0 || distance > 64 {
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid distance", "distance must be between 0 and 64")
+		return
+	}
+
+	response := DuplicatesResponse{Distance: distance, Clusters: []DuplicateCluster{}}
+
+	records := tileStore.Snapshot()
+	fingerprints := make(map[string]tiles_db.Fingerprint, len(records))
+	for path, record := range records {
+		fingerprints[path] = record.Descriptor().Fingerprint()
+	}
+	for _, group := range tiles_db.GroupDuplicates(fingerprints, distance) {
+		cluster := DuplicateCluster{Tiles: make([]TileInfo, 0, len(group))}
+		for _, path := range group {
+			info, _ := recordInfo(records[path])
+			cluster.Tiles = append(cluster.Tiles, info)
+		}
+		response.Clusters = append(response.Clusters, cluster)
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// publishTiles adds described tiles to the tile store so the next render can use them,
+// with their entry of metadata if any, which may be nil
+// Tiles whose content is already in the library, or earlier in added, are deduplicated:
+// their file is removed and they are returned mapped to the ID of the existing tile
+func publishTiles(added map[string]tiles_db.Descriptor, metadata map[string]tiles_db.Metadata) map[string]string {
+	tilesMu.Lock()
+	defer refreshDuplicateGroups()
+	defer tilesMu.Unlock()
+
+	paths := make([]string, 0, len(added))
+	for path := range added {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	duplicates := make(map[string]string)
+	for _, path := range paths {
+		descriptor := added[path]
+		if existing := tileStore.FindByHash(descriptor.SHA256); len(existing) > 0 && existing[0].Path != path {
+			info, _ := tileInfo(existing[0].Path, existing[0].Color)
+			duplicates[path] = info.ID
+			if err := os.Remove(path); err != nil {
+				logrus.WithError(err).WithField("tile", path).Warn("Failed to remove duplicate tile")
+			}
+			continue
+		}
+		if err := tileStore.Put(tile_store.NewRecord(path, descriptor, metadata[path])); err != nil {
+			logrus.WithError(err).WithField("tile", path).Error("Failed to add tile to the index")
+		}
+	}
+	return duplicates
+}
+
+// publishFiles describes and publishes tiles that were written to the tiles directory
+// It returns the added tiles and the duplicates in the order of paths, and the
+// errors of the files that could not be described
+func publishFiles(paths []string) ([]TileInfo, []TileDuplicate, []string) {
+	added := make(map[string]tiles_db.Descriptor, len(paths))
+	var errs []string
+	for _, path := range paths {
+		descriptor, err := tiles_db.DescribeTile(path)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", filepath.Base(path), err))
+			continue
+		}
+		added[path] = descriptor
+	}
+
+	infos, duplicates := []TileInfo{}, []TileDuplicate{}
+	existing := publishTiles(added, nil)
+	for _, path := range paths {
+		descriptor, ok := added[path]
+		if !ok {
+			continue
+		}
+		if tile, duplicate := existing[path]; duplicate {
+			duplicates = append(duplicates, TileDuplicate{Name: filepath.Base(path), Tile: tile, SHA256: descriptor.SHA256})
+			continue
+		}
+		info, _ := recordInfo(tile_store.NewRecord(path, descriptor, tiles_db.Metadata{}))
+		infos = append(infos, info)
+	}
+	return infos, duplicates, errs
+}
+
+// errInvalidCollection is returned by newCollectionDir for a name that cannot be a collection
+var errInvalidCollection = errors.New("invalid collection name")
+
+// errCollectionExists is returned by newCollectionDir for a collection that already holds files
+var errCollectionExists = errors.New("collection already exists")
+
+// newCollectionDir returns the directory of a collection that does not hold any tiles yet
+func newCollectionDir(collection string) (string, error) {
+	if !tiles_db.IsValidCollection(collection) {
+		return "", fmt.Errorf("%w: collection %q is not a valid name", errInvalidCollection, collection)
+	}
+
+	dir := filepath.Join(appConfig.TilesDir, collection)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if len(entries) > 0 {
+		return "", fmt.Errorf("%w: collection %q already exists", errCollectionExists, collection)
+	}
+	return dir, nil
+}
+
+// sendCollectionError sends the response of a newCollectionDir error
+// Invalid names are 400, existing collections 409 and I/O failures 500
+func sendCollectionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidCollection):
+		sendErrorResponse(w, http.StatusBadRequest, "Invalid collection", err.Error())
+	case errors.Is(err, errCollectionExists):
+		sendErrorResponse(w, http.StatusConflict, "Collection already exists", err.Error())
+	default:
+		sendErrorResponse(w, http.StatusInternalServerError, "Failed to read collection", err.Error())
+	}
+}
+
+// refreshDuplicateGroups recomputes tileGroups from the hashes in the tile store
+// Grouping compares many tiles, so it works on a snapshot without holding tilesMu,
+// which the caller must not hold either; changes deferring it do so before their
+// deferred unlock. The groups only replace ones computed from the same or an
+// older version of the tile store, never newer ones of a concurrent refresh
+func refreshDuplicateGroups() {
+	store := tileStore
+	version := store.Version()
+	groups := make(map[string][]string)
+	for _, group := range tiles_db.GroupDuplicates(tile_store.Fingerprints(store), appConfig.DuplicateDistance) {
+		for _, path := range group {
+			groups[path] = group
+		}
+	}
+
+	tilesMu.Lock()
+	defer tilesMu.Unlock()
+	if store != tileStore || (store == tileGroupsStore && version < tileGroupsVersion) {
+		return
+	}
+	tileGroups, tileGroupsStore, tileGroupsVersion = groups, store, version
+}
+
+// lookupTile resolves the {id} route variable to a tile path in the tile store
+// Besides paths, IDs of the form "sha256:<hex>" select the first alias of a content hash.
+// It writes a 404 response and returns false if the tile does not exist
+func lookupTile(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id := mux.Vars(r)["id"]
+	var path string
+	var ok bool
+	if sum, isHash := strings.CutPrefix(id, sha256IDPrefix); isHash {
+		if records := tileStore.FindByHash(strings.ToLower(sum)); len(records) > 0 {
+			path, ok = records[0].Path, true
+		}
+	} else if path, ok = tilePathFromID(id); ok {
+		_, ok = tileStore.Get(path)
+	}
+	if !ok {
+		sendErrorResponse(w, http.StatusNotFound, "Tile not found", id)
+		return "", false
+	}
+	return path, true
+}
+
+// tilePathFromID converts a tile ID into its path on disk
+// IDs are either "name" for the default collection or "collection/name"
+func tilePathFromID(id string) (string, bool) {
+	parts := strings.Split(id, "/")
+	switch {
+	case len(parts) == 1 && tiles_db.IsImageFile(parts[0]) && parts[0] == filepath.Base(parts[0]):
+		return filepath.Join(appConfig.TilesDir, parts[0]), true
+	case len(parts) == 2 && tiles_db.IsValidCollection(parts[0]) && tiles_db.IsImageFile(parts[1]) && parts[1] == filepath.Base(parts[1]):
+		return filepath.Join(appConfig.TilesDir, parts[0], parts[1]), true
+	}
+	return "", false
+}
+
+// tileInfo builds the API description of the tile stored at path
+func tileInfo(path string, color [3]float64) (TileInfo, bool) {
+	rel, err := filepath.Rel(appConfig.TilesDir, path)
+	if err != nil {
+		return TileInfo{}, false
+	}
+	id := filepath.ToSlash(rel)
+
+	collection := ""
+	if dir := filepath.Dir(rel); dir != "." {
+		collection = filepath.ToSlash(dir)
+	}
+
+	return TileInfo{
+		ID:         id,
+		Name:       filepath.Base(path),
+		Collection: collection,
+		Color:      color,
+		Hex:        colorHex(color),
+	}, true
+}
+
+// recordInfo describes a stored tile with its content hash, aliases and metadata
+func recordInfo(record tile_store.Record) (TileInfo, bool) {
+	info, ok := tileInfo(record.Path, record.Color)
+	if !ok {
+		return info, false
+	}
+	info.SHA256 = record.SHA256
+	for _, alias := range tileStore.FindByHash(record.SHA256) {
+		if alias.Path != record.Path {
+			aliasInfo, _ := tileInfo(alias.Path, alias.Color)
+			info.Aliases = append(info.Aliases, aliasInfo.ID)
+		}
+	}
+	if !record.Metadata.IsEmpty() {
+		metadata := record.Metadata
+		info.Metadata = &metadata
+	}
+	if len(record.Stats.Histogram) > 0 {
+		stats := record.Stats
+		info.Stats = &stats
+	}
+	return info, true
+}
+
+// colorHex formats a 16-bit per channel color as a #rrggbb string
+func colorHex(color [3]float64) string {
+	return fmt.Sprintf("#%02x%02x%02x", uint8(int(color[0])>>8), uint8(int(color[1])>>8), uint8(int(color[2])>>8))
+}
+
+// queryInt reads an integer query parameter, returning defaultValue when it is missing or invalid
+func queryInt(r *http.Request, key string, defaultValue int) int {
+	value, err := strconv.Atoi(r.URL.Query().Get(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"wilbertopachecob/mosaic/config"
+	"wilbertopachecob/mosaic/lib/result_cache"
+	"wilbertopachecob/mosaic/lib/tile_store"
+	"wilbertopachecob/mosaic/lib/tiles_db"
+	"wilbertopachecob/mosaic/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupTilesTest points the application at an empty temporary tiles directory
+func setupTilesTest(t *testing.T) string {
+	dir := t.TempDir()
+
+	prevConfig, prevStore, prevGroups := appConfig, tileStore, tileGroups
+	prevQuarantine, prevProgress, prevResults := quarantine, ingestProgress, resultCache
+	appConfig = config.Default()
+	appConfig.TilesDir = dir
+	appConfig.QuarantinePath = filepath.Join(t.TempDir(), "quarantine.json")
+	tileStore = tile_store.NewMemoryStore()
+	tileGroups = make(map[string][]string)
+	quarantine = tiles_db.NewQuarantine()
+	ingestProgress = tiles_db.NewIngestProgress()
+	resultCache = result_cache.New(appConfig.ResultCacheBytes, "", 0)
+
+	t.Cleanup(func() {
+		appConfig, tileStore, tileGroups = prevConfig, prevStore, prevGroups
+		quarantine, ingestProgress, resultCache = prevQuarantine, prevProgress, prevResults
+	})
+	return dir
+}
+
+// TestTilesAPILifecycle uploads, lists, moves and deletes tiles through the router
+func TestTilesAPILifecycle(t *testing.T) {
+	dir := setupTilesTest(t)
+	router := routes()
+
+	// Upload two valid tiles and one invalid file
+	req := multipartFilesRequest(t, "/api/tiles", "tiles", map[string][]byte{
+		"red1.jpg":  imageToBytes(t, createTestImage(20, 20)),
+		"red2.jpg":  imageToBytes(t, createTestImage(30, 30)),
+		"notes.txt": []byte("not an image"),
+	}, map[string]string{"collection": "reds"})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusCreated, rr.Code)
+
+	var upload TileUploadResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &upload))
+	assert.Len(t, upload.Added, 2)
+	assert.Len(t, upload.Failed, 1)
+	assert.Len(t, tileStore.List(), 2)
+	assert.FileExists(t, filepath.Join(dir, "reds", "red1.jpg"))
+
+	// List with pagination
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles?pageSize=1&page=2&collection=reds", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var list TileListResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+	assert.Equal(t, 2, list.Total)
+	require.Len(t, list.Tiles, 1)
+	assert.Equal(t, "reds/red2.jpg", list.Tiles[0].ID)
+	assert.Equal(t, "reds", list.Tiles[0].Collection)
+	assert.True(t, strings.HasPrefix(list.Tiles[0].Hex, "#"))
+
+	// Thumbnail is a decodable JPEG of the requested width
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles/reds/red1.jpg/thumbnail?size=10", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	thumb, err := jpeg.Decode(rr.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 10, thumb.Bounds().Dx())
+
+	// Move to the default collection
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/api/tiles/reds/red1.jpg/move", strings.NewReader(`{"collection": ""}`)))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.FileExists(t, filepath.Join(dir, "red1.jpg"))
+	assert.Contains(t, tileStore.List(), filepath.Join(dir, "red1.jpg"))
+	assert.NotContains(t, tileStore.List(), filepath.Join(dir, "reds", "red1.jpg"))
+
+	// Original file is served from its new location
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles/red1.jpg", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Delete removes the file and the index entry
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("DELETE", "/api/tiles/red1.jpg", nil))
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.NotContains(t, tileStore.List(), filepath.Join(dir, "red1.jpg"))
+	_, err = os.Stat(filepath.Join(dir, "red1.jpg"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// TestTileMetadataAPI tests setting metadata, filtering by tag and moving sidecars with tiles
+func TestTileMetadataAPI(t *testing.T) {
+	dir := setupTilesTest(t)
+	router := routes()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, multipartFilesRequest(t, "/api/tiles", "tiles", map[string][]byte{
+		"beach.jpg":  imageToBytes(t, createTestImage(10, 10)),
+		"forest.jpg": imageToBytes(t, createTestImage(10, 10)),
+	}, nil))
+	require.Equal(t, http.StatusCreated, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/tiles/beach.jpg/metadata",
+		strings.NewReader(`{"tags": ["Sea", " sand", "sea"], "author": "Ana", "license": "CC-BY-4.0"}`)))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.FileExists(t, filepath.Join(dir, "beach.jpg.json"))
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles/beach.jpg/metadata", nil))
+	var metadata tiles_db.Metadata
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &metadata))
+	assert.Equal(t, []string{"sand", "sea"}, metadata.Tags)
+	assert.Equal(t, "Ana", metadata.Author)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles?tag=SEA", nil))
+	var list TileListResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+	require.Len(t, list.Tiles, 1)
+	assert.Equal(t, "beach.jpg", list.Tiles[0].ID)
+	require.NotNil(t, list.Tiles[0].Metadata)
+	assert.Equal(t, "CC-BY-4.0", list.Tiles[0].Metadata.License)
+
+	// The sidecar follows the tile into another collection
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/api/tiles/beach.jpg/move", strings.NewReader(`{"collection": "coast"}`)))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.FileExists(t, filepath.Join(dir, "coast", "beach.jpg.json"))
+	moved, ok := tileStore.Get(filepath.Join(dir, "coast", "beach.jpg"))
+	require.True(t, ok)
+	assert.Equal(t, "Ana", moved.Metadata.Author)
+
+	// Renders restricted to a tag only use matching tiles and credit them
+	db, _ := snapshotTilesDB(tileStore, []string{"sea"})
+	assert.Len(t, db, 1)
+	credits := buildCredits(tileStore, map[string]int{filepath.Join(dir, "coast", "beach.jpg"): 3})
+	require.Len(t, credits, 1)
+	assert.Equal(t, models.Credit{ID: "coast/beach.jpg", SHA256: moved.SHA256, Count: 3, Author: "Ana", License: "CC-BY-4.0"}, credits[0])
+}
+
+// TestTilesAPIRejectsUnknownTiles tests that missing and malformed tile IDs return 404
+func TestTilesAPIRejectsUnknownTiles(t *testing.T) {
+	setupTilesTest(t)
+	router := routes()
+
+	for _, path := range []string{
+		"/api/tiles/missing.jpg",
+		"/api/tiles/../secret.jpg",
+		"/api/tiles/a/b/c.jpg",
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		assert.NotEqual(t, http.StatusOK, rr.Code, path)
+	}
+}
+
+// TestDuplicateTilesHandler tests that re-saved copies of a tile are clustered
+func TestDuplicateTilesHandler(t *testing.T) {
+	setupTilesTest(t)
+	router := routes()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, multipartFilesRequest(t, "/api/tiles", "tiles", map[string][]byte{
+		"original.jpg": imageToBytes(t, createGradientImage(64, 64, false)),
+		"copy.jpg":     imageToBytes(t, createGradientImage(32, 32, false)),
+		"other.jpg":    imageToBytes(t, createGradientImage(64, 64, true)),
+	}, nil))
+	require.Equal(t, http.StatusCreated, rr.Code)
+
+	// Duplicates are grouped for rendering
+	assert.Len(t, tileGroups, 2)
+
+	// Groups computed from an older version never replace newer ones
+	computed := tileGroups
+	tilesMu.Lock()
+	tileGroups, tileGroupsVersion = map[string][]string{}, tileStore.Version()+1
+	tilesMu.Unlock()
+	refreshDuplicateGroups()
+	assert.Empty(t, tileGroups)
+	tileGroupsVersion = tileStore.Version() - 1
+	refreshDuplicateGroups()
+	assert.Equal(t, computed, tileGroups)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles/duplicates", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var response DuplicatesResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	require.Len(t, response.Clusters, 1)
+	require.Len(t, response.Clusters[0].Tiles, 2)
+	assert.Equal(t, "copy.jpg", response.Clusters[0].Tiles[0].ID)
+	assert.Equal(t, "original.jpg", response.Clusters[0].Tiles[1].ID)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles/duplicates?distance=65", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+// createGradientImage creates a horizontal grayscale gradient, reversed when descending is set
+func createGradientImage(width, height int, descending bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8(x * 255 / width)
+			if descending {
+				v = 255 - v
+			}
+			img.Set(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	return img
+}
+
+// TestTilePathFromID tests tile ID validation
+func TestTilePathFromID(t *testing.T) {
+	setupTilesTest(t)
+
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{"leaf.jpg", true},
+		{"nature/leaf.jpg", true},
+		{"nature/leaf.txt", false},
+		{"../leaf.jpg", false},
+		{"a/b/leaf.jpg", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		_, ok := tilePathFromID(tt.id)
+		assert.Equal(t, tt.valid, ok, tt.id)
+	}
+}
+
+// TestLoadTilesDBReconcilesStore tests that startup ingestion keeps a persistent store in sync with the tiles directory
+func TestLoadTilesDBReconcilesStore(t *testing.T) {
+	dir := setupTilesTest(t)
+	storePath := filepath.Join(t.TempDir(), "tiles.db")
+	store, err := tile_store.OpenFileStore(storePath)
+	require.NoError(t, err)
+	tileStore = store
+
+	writeTestFile(t, filepath.Join(dir, "red.jpg"), imageToBytes(t, createTestImage(10, 10)))
+	writeTestFile(t, filepath.Join(dir, "nature", "leaf.jpg"), imageToBytes(t, createGradientImage(10, 10, false)))
+	require.NoError(t, tileStore.Put(tile_store.Record{Path: filepath.Join(dir, "gone.jpg")}))
+
+	loadTilesDB(appConfig)
+	assert.Equal(t, []string{filepath.Join(dir, "nature", "leaf.jpg"), filepath.Join(dir, "red.jpg")}, tileStore.List())
+	require.NoError(t, tileStore.Close())
+
+	// Records survive a restart
+	store, err = tile_store.OpenFileStore(storePath)
+	require.NoError(t, err)
+	defer store.Close()
+	record, ok := store.Get(filepath.Join(dir, "red.jpg"))
+	require.True(t, ok)
+	assert.Greater(t, record.Color[0], record.Color[2])
+}
+
+// TestIngestKeepsDeletedTilesDeleted tests that a tile deleted while an ingestion runs stays deleted
+func TestIngestKeepsDeletedTilesDeleted(t *testing.T) {
+	dir := setupTilesTest(t)
+	path := filepath.Join(dir, "red.jpg")
+	writeTestFile(t, path, imageToBytes(t, createTestImage(10, 10)))
+	loadTilesDB(appConfig)
+	require.Contains(t, tileStore.List(), path)
+
+	// An ingestion starts and finds the tile before it is deleted through the API
+	tilesMu.Lock()
+	ingestRemoved = make(map[string]bool)
+	tilesMu.Unlock()
+	result := tiles_db.IngestIncremental(dir, 1, tiles_db.NewIngestProgress(), nil)
+	require.Contains(t, result.Descriptors, path)
+
+	rr := httptest.NewRecorder()
+	routes().ServeHTTP(rr, httptest.NewRequest("DELETE", "/api/tiles/red.jpg", nil))
+	require.Equal(t, http.StatusNoContent, rr.Code)
+
+	mergeIngestResult(result, map[string]tiles_db.Descriptor{})
+	assert.NotContains(t, tileStore.List(), path)
+	assert.Nil(t, ingestRemoved)
+}
+
+// TestContentAddressedTiles tests upload deduplication, hash IDs and aliases
+func TestContentAddressedTiles(t *testing.T) {
+	dir := setupTilesTest(t)
+	router := routes()
+	red := imageToBytes(t, createTestImage(10, 10))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, multipartRequest(t, "/api/tiles", "tiles", "red.jpg", red, nil))
+	require.Equal(t, http.StatusCreated, rr.Code)
+	var upload TileUploadResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &upload))
+	require.Len(t, upload.Added, 1)
+	sum := upload.Added[0].SHA256
+	assert.Len(t, sum, 64)
+
+	// The same content under another name is not stored twice
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, multipartRequest(t, "/api/tiles", "tiles", "copy.jpg", red, map[string]string{"collection": "reds"}))
+	require.Equal(t, http.StatusOK, rr.Code)
+	upload = TileUploadResponse{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &upload))
+	assert.Empty(t, upload.Added)
+	assert.Equal(t, []TileDuplicate{{Name: "copy.jpg", Tile: "red.jpg", SHA256: sum}}, upload.Duplicates)
+	assert.NoFileExists(t, filepath.Join(dir, "reds", "copy.jpg"))
+
+	// Tiles can be addressed by content hash
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles/sha256:"+sum, nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, red, rr.Body.Bytes())
+
+	// Identical files already in the tiles directory are aliases of one tile
+	alias := filepath.Join(dir, "alias.jpg")
+	writeTestFile(t, alias, red)
+	descriptor, err := tiles_db.DescribeTile(alias)
+	require.NoError(t, err)
+	require.NoError(t, tileStore.Put(tile_store.NewRecord(alias, descriptor, tiles_db.Metadata{})))
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles", nil))
+	var list TileListResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+	require.Len(t, list.Tiles, 2)
+	assert.Equal(t, []string{"red.jpg"}, list.Tiles[0].Aliases)
+
+	db, _ := snapshotTilesDB(tileStore, nil)
+	assert.Equal(t, []string{alias}, keys(db))
+}
+
+// keys returns the sorted keys of a tiles database
+func keys(db map[string][3]float64) []string {
+	paths := make([]string, 0, len(db))
+	for path := range db {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// TestTileStats tests that tile statistics are listed, sortable and used to match flat regions
+func TestTileStats(t *testing.T) {
+	dir := setupTilesTest(t)
+	writeTestFile(t, filepath.Join(dir, "busy.jpg"), imageToBytes(t, createCheckerImage(12, 12, 3)))
+	flat := image.NewRGBA(image.Rect(0, 0, 12, 12))
+	draw.Draw(flat, flat.Bounds(), &image.Uniform{color.RGBA{150, 170, 235, 255}}, image.Point{}, draw.Src)
+	writeTestFile(t, filepath.Join(dir, "flat.jpg"), imageToBytes(t, flat))
+	_, _, errs := publishFiles([]string{filepath.Join(dir, "busy.jpg"), filepath.Join(dir, "flat.jpg")})
+	require.Empty(t, errs)
+
+	router := routes()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles?sort=-variance", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var list TileListResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+	require.Len(t, list.Tiles, 2)
+	assert.Equal(t, "busy.jpg", list.Tiles[0].ID)
+	require.NotNil(t, list.Tiles[0].Stats)
+	require.NotNil(t, list.Tiles[1].Stats)
+	assert.Greater(t, list.Tiles[0].Stats.EdgeDensity, list.Tiles[1].Stats.EdgeDensity)
+	assert.NotEmpty(t, list.Tiles[0].Stats.Dominant)
+	assert.LessOrEqual(t, len(list.Tiles[0].Stats.Dominant), 3)
+	assert.Len(t, list.Tiles[0].Stats.Histogram, 16)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tiles?sort=size", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// The busy tile averages to the flat source color, but the flat tile is preferred
+	source := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	busy, _ := tileStore.Get(filepath.Join(dir, "busy.jpg"))
+	r, g, b := uint8(int(busy.Color[0])>>8), uint8(int(busy.Color[1])>>8), uint8(int(busy.Color[2])>>8)
+	draw.Draw(source, source.Bounds(), &image.Uniform{color.RGBA{r, g, b, 255}}, image.Point{}, draw.Src)
+	_, usage, err := generateMosaic(tileStore, source, 10, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{filepath.Join(dir, "flat.jpg"): 1}, usage)
+}
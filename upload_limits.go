@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+
+	imgpkg "wilbertopachecob/mosaic/lib/img"
+	"wilbertopachecob/mosaic/models"
+)
+
+// uploadOverhead is the room an upload body has beyond MaxFileSize for the
+// other form fields and the multipart framing
+const uploadOverhead = 1 << 20
+
+// limitUpload caps the body of a single-image upload at MaxFileSize, plus the
+// base64 inflation when the image comes in a JSON body
+func limitUpload(w http.ResponseWriter, r *http.Request) {
+	limit := appConfig.MaxFileSize + uploadOverhead
+	if isJSONRequest(r) {
+		limit = appConfig.MaxFileSize/3*4 + uploadOverhead
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+}
+
+// limitUploads caps the body of an upload of several images at MaxUploadBytes
+func limitUploads(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, appConfig.MaxUploadBytes+uploadOverhead)
+}
+
+// isUploadTooLarge reports whether err comes from reading past the limit of limitUpload or limitUploads
+func isUploadTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// sendUploadTooLarge sends the 413 response of an upload over MaxFileSize
+func sendUploadTooLarge(w http.ResponseWriter) {
+	sendErrorCode(w, http.StatusRequestEntityTooLarge, models.ErrorCodeUploadTooLarge, "Upload too large",
+		fmt.Sprintf("images must be at most %d bytes", appConfig.MaxFileSize))
+}
+
+// sendUploadsTooLarge sends the 413 response of an upload of several images over MaxUploadBytes
+func sendUploadsTooLarge(w http.ResponseWriter) {
+	sendErrorCode(w, http.StatusRequestEntityTooLarge, models.ErrorCodeUploadTooLarge, "Upload too large",
+		fmt.Sprintf("uploads must be at most %d bytes in total", appConfig.MaxUploadBytes))
+}
+
+// checkUploadedImages checks the size and the declared dimensions of every
+// uploaded image before any of them is stored. It sends 413 or 422 and returns
+// false when one is over the limits; other errors are left to the decoding
+func checkUploadedImages(w http.ResponseWriter, files []*multipart.FileHeader) bool {
+	for _, header := range files {
+		name := filepath.Base(header.Filename)
+		if header.Size > appConfig.MaxFileSize {
+			sendErrorCode(w, http.StatusRequestEntityTooLarge, models.ErrorCodeUploadTooLarge, "Upload too large",
+				fmt.Sprintf("%s is %d bytes, images must be at most %d bytes", name, header.Size, appConfig.MaxFileSize))
+			return false
+		}
+
+		file, err := header.Open()
+		if err != nil {
+			continue
+		}
+		_, _, err = decodeUploadConfig(file)
+		file.Close()
+		if errors.Is(err, errImageTooLarge) {
+			sendErrorCode(w, http.StatusUnprocessableEntity, models.ErrorCodeImageTooLarge, "Image too large", fmt.Sprintf("%s: %v", name, err))
+			return false
+		}
+	}
+	return true
+}
+
+// errImageTooLarge is returned for an image that declares more than MaxImagePixels pixels
+var errImageTooLarge = imgpkg.ErrTooManyPixels
+
+// decodeUploadConfig reads the dimensions an uploaded image declares in its header,
+// without decoding the pixels, and rewinds source for decoding
+// It returns errImageTooLarge when the image has more pixels than MaxImagePixels
+func decodeUploadConfig(source io.ReadSeeker) (image.Config, string, error) {
+	return imgpkg.CheckPixels(source, appConfig.MaxImagePixels)
+}
+
+// decodeUpload decodes an uploaded image once its dimensions pass decodeUploadConfig
+func decodeUpload(source io.ReadSeeker) (image.Image, string, error) {
+	if _, _, err := decodeUploadConfig(source); err != nil {
+		return nil, "", err
+	}
+	return image.Decode(source)
+}
+
+// sendDecodeError sends the response of an uploaded image that failed to decode,
+// 422 when it is too large and 400 otherwise
+func sendDecodeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errImageTooLarge) {
+		sendErrorCode(w, http.StatusUnprocessableEntity, models.ErrorCodeImageTooLarge, "Image too large", err.Error())
+		return
+	}
+	sendErrorResponse(w, http.StatusBadRequest, "Failed to decode image", err.Error())
+}
+
+// mosaicCells returns the number of cells of a mosaic of a width x height image
+func mosaicCells(width, height, tileSize int) int {
+	return ((width + tileSize - 1) / tileSize) * ((height + tileSize - 1) / tileSize)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"wilbertopachecob/mosaic/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pngHeader returns the start of a PNG that declares width x height pixels
+// It is enough for image.DecodeConfig, decoding the pixels fails
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12], ihdr[13] = 8, 2 // 8-bit RGB
+
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = binary.BigEndian.AppendUint32(data, 13)
+	data = append(data, ihdr...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(ihdr))
+}
+
+// TestUploadLimits tests rejecting uploads over the byte, pixel and cell limits
+func TestUploadLimits(t *testing.T) {
+	dir := setupTilesTest(t)
+	writeTestFile(t, filepath.Join(dir, "red.jpg"), imageToBytes(t, createTestImage(10, 10)))
+	loadTilesDB(appConfig)
+	appConfig.MaxFileSize = 4096
+	appConfig.MaxImagePixels = 100 * 100
+	appConfig.MaxMosaicCells = 10
+	appConfig.MaxUploadBytes = 64 << 10
+	router := routes()
+
+	// Files within MaxFileSize that together exceed MaxUploadBytes and the form overhead
+	tiles := make(map[string][]byte)
+	for i := 0; len(tiles)*4096 <= int(appConfig.MaxUploadBytes)+uploadOverhead; i++ {
+		tiles[fmt.Sprintf("%d.png", i)] = make([]byte, 4096)
+	}
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+		code   string
+	}{
+		{"within limits", renderRequest(t, "/api/file/upload", createTestImage(30, 30), map[string]string{"tileSize": "10"}), http.StatusCreated, ""},
+		{"file over limit", multipartRequest(t, "/api/file/upload", "imgUpload", "upload.png", make([]byte, 8192), nil), http.StatusRequestEntityTooLarge, models.ErrorCodeUploadTooLarge},
+		{"body over limit", multipartRequest(t, "/api/file/upload", "imgUpload", "upload.png", make([]byte, 2<<20), nil), http.StatusRequestEntityTooLarge, models.ErrorCodeUploadTooLarge},
+		{"json over limit", jsonRenderRequest(t, "/api/file/upload", map[string]interface{}{"image": base64.StdEncoding.EncodeToString(make([]byte, 8192))}), http.StatusRequestEntityTooLarge, models.ErrorCodeUploadTooLarge},
+		{"decompression bomb", multipartRequest(t, "/api/file/upload", "imgUpload", "upload.png", pngHeader(50000, 50000), nil), http.StatusUnprocessableEntity, models.ErrorCodeImageTooLarge},
+		{"json bomb", jsonRenderRequest(t, "/api/file/upload", map[string]interface{}{"image": base64.StdEncoding.EncodeToString(pngHeader(50000, 50000))}), http.StatusUnprocessableEntity, models.ErrorCodeImageTooLarge},
+		{"job bomb", multipartRequest(t, "/api/jobs", "imgUpload", "upload.png", pngHeader(50000, 50000), nil), http.StatusUnprocessableEntity, models.ErrorCodeImageTooLarge},
+		{"too many cells", renderRequest(t, "/api/file/upload", createTestImage(40, 30), map[string]string{"tileSize": "5"}), http.StatusUnprocessableEntity, models.ErrorCodeTooManyCells},
+		{"coverage bomb", multipartRequest(t, "/api/tiles/coverage", "imgUpload", "upload.png", pngHeader(50000, 50000), nil), http.StatusUnprocessableEntity, models.ErrorCodeImageTooLarge},
+		{"tile over limit", multipartRequest(t, "/api/tiles", "tiles", "big.png", make([]byte, 8192), nil), http.StatusRequestEntityTooLarge, models.ErrorCodeUploadTooLarge},
+		{"tiles over limit", multipartFilesRequest(t, "/api/tiles", "tiles", tiles, nil), http.StatusRequestEntityTooLarge, models.ErrorCodeUploadTooLarge},
+		{"tile bomb", multipartRequest(t, "/api/tiles", "tiles", "bomb.png", pngHeader(50000, 50000), nil), http.StatusUnprocessableEntity, models.ErrorCodeImageTooLarge},
+		{"slice source over limit", multipartRequest(t, "/api/tiles/slice", "sources", "big.png", make([]byte, 8192), map[string]string{"collection": "big"}), http.StatusRequestEntityTooLarge, models.ErrorCodeUploadTooLarge},
+		{"slice bomb", multipartRequest(t, "/api/tiles/slice", "sources", "bomb.png", pngHeader(50000, 50000), map[string]string{"collection": "bomb"}), http.StatusUnprocessableEntity, models.ErrorCodeImageTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, tt.req)
+			require.Equal(t, tt.status, rr.Code, rr.Body.String())
+			if tt.code == "" {
+				return
+			}
+			var response models.ErrorResponse
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+			assert.Equal(t, tt.code, response.ErrorCode)
+			assert.Equal(t, tt.status, response.Code)
+		})
+	}
+}